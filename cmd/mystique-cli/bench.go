@@ -0,0 +1,69 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/TheThingsIndustries/mystique/pkg/bench"
+	"github.com/TheThingsIndustries/mystique/pkg/client"
+	"github.com/TheThingsIndustries/mystique/pkg/server"
+	"github.com/spf13/pflag"
+)
+
+var benchCommand = command{
+	description: "Simulate devices and applications, and measure the latency, throughput and drops of messages",
+	flags: func(flags *pflag.FlagSet) {
+		config := bench.DefaultConfig
+		flags.String("prefix", config.Prefix, "Prefix of client and application identifiers")
+		flags.Int("applications", config.Applications, "Number of applications")
+		flags.Int("publishers", config.Publishers, "Number of publishers, divided over the applications")
+		flags.Int("subscribers", config.Subscribers, "Number of subscribers, divided over the applications")
+		flags.Float64("rate", config.Rate, "Messages per second per publisher")
+		flags.Int("size", config.Size, "Size of the messages in bytes")
+		flags.IntP("qos", "q", int(config.QoS), "QoS of the messages and subscriptions")
+		flags.Duration("duration", config.Duration, "Time to publish")
+		flags.Duration("drain", config.Drain, "Maximum time to wait for messages after publishing")
+		flags.Bool("in-process", false, "Run against an in-process server instead of the URL")
+	},
+	run: func(ctx context.Context, flags *pflag.FlagSet) error {
+		var config bench.Config
+		config.Prefix, _ = flags.GetString("prefix")
+		config.Applications, _ = flags.GetInt("applications")
+		config.Publishers, _ = flags.GetInt("publishers")
+		config.Subscribers, _ = flags.GetInt("subscribers")
+		config.Rate, _ = flags.GetFloat64("rate")
+		config.Size, _ = flags.GetInt("size")
+		qos, _ := flags.GetInt("qos")
+		config.QoS = byte(qos)
+		config.Duration, _ = flags.GetDuration("duration")
+		config.Drain, _ = flags.GetDuration("drain")
+
+		var (
+			dial client.Dialer
+			err  error
+		)
+		if inProcess, _ := flags.GetBool("in-process"); inProcess {
+			dial, err = bench.Local(ctx, server.New(ctx))
+		} else {
+			dial, err = dialer(flags)
+		}
+		if err != nil {
+			return err
+		}
+
+		result, err := bench.Run(ctx, dial, config, connectOptions(flags)...)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("duration:   %s\n", result.Duration)
+		fmt.Printf("published:  %d (%.1f/s)\n", result.Published, result.PublishThroughput())
+		fmt.Printf("errors:     %d\n", result.Errors)
+		fmt.Printf("received:   %d (%.1f/s)\n", result.Received, result.ReceiveThroughput())
+		fmt.Printf("dropped:    %d of %d\n", result.Dropped, result.Expected)
+		fmt.Printf("latency:    p50=%s p90=%s p99=%s max=%s\n",
+			result.Latency.P50, result.Latency.P90, result.Latency.P99, result.Latency.Max)
+		return nil
+	},
+}
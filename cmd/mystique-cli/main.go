@@ -0,0 +1,308 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+// The Mystique CLI publishes and subscribes to MQTT servers.
+//
+// Usage: mystique-cli <command> [options]
+//
+// Commands:
+//   bench  Simulate devices and applications, and measure the latency, throughput and drops of messages
+//   ping   Connect to the server and measure the round-trip time of pings
+//   pub    Publish a message, or the lines of stdin
+//   sub    Subscribe to topics, and print the messages as JSON lines
+//
+// Run mystique-cli <command> --help for the options of a command
+//
+// Usage: mystique-cli pub [options]
+//
+// Publish a message, or the lines of stdin
+//
+// Options:
+//         --client-id string       Client identifier (assigned by the server if empty)
+//     -d, --debug                  Print debug logs
+//         --keepalive duration     Interval of keepalive pings (default 1m0s)
+//     -m, --message string         Message to publish
+//     -P, --password string        Password
+//         --protocol-version int   Protocol version (4 is MQTT 3.1.1, 5 is MQTT 5.0) (default 4)
+//     -q, --qos int                QoS of the messages
+//     -r, --retain                 Retain the messages
+//     -l, --stdin                  Publish each line of stdin as a message
+//         --timeout duration       Time to wait for the connection and responses of the server (default 10s)
+//         --tls.ca string          Location of the CA certificates to verify the server (system CAs if empty)
+//         --tls.cert string        Location of the client certificate
+//         --tls.insecure           Do not verify the certificate of the server
+//         --tls.key string         Location of the client key
+//     -t, --topic string           Topic to publish to
+//         --url string             URL of the server (tcp, tls, ws, wss or unix) (default "tcp://localhost:1883")
+//     -u, --username string        Username
+//         --will.message string    Message of the will
+//         --will.qos int           QoS of the will
+//         --will.retain            Retain the will
+//         --will.topic string      Topic of the will (no will if empty)
+//
+// Usage: mystique-cli sub [options]
+//
+// Subscribe to topics, and print the messages as JSON lines
+//
+// Options:
+//         --client-id string       Client identifier (assigned by the server if empty)
+//     -c, --count int              Number of messages to receive before exiting (0 is unlimited)
+//     -d, --debug                  Print debug logs
+//         --keepalive duration     Interval of keepalive pings (default 1m0s)
+//     -P, --password string        Password
+//         --protocol-version int   Protocol version (4 is MQTT 3.1.1, 5 is MQTT 5.0) (default 4)
+//     -q, --qos int                QoS of the subscriptions
+//         --timeout duration       Time to wait for the connection and responses of the server (default 10s)
+//         --tls.ca string          Location of the CA certificates to verify the server (system CAs if empty)
+//         --tls.cert string        Location of the client certificate
+//         --tls.insecure           Do not verify the certificate of the server
+//         --tls.key string         Location of the client key
+//     -t, --topic strings          Topic filters to subscribe to
+//         --url string             URL of the server (tcp, tls, ws, wss or unix) (default "tcp://localhost:1883")
+//     -u, --username string        Username
+//         --will.message string    Message of the will
+//         --will.qos int           QoS of the will
+//         --will.retain            Retain the will
+//         --will.topic string      Topic of the will (no will if empty)
+//
+// Usage: mystique-cli ping [options]
+//
+// Connect to the server and measure the round-trip time of pings
+//
+// Options:
+//         --client-id string       Client identifier (assigned by the server if empty)
+//     -c, --count int              Number of pings (0 is unlimited) (default 1)
+//     -d, --debug                  Print debug logs
+//     -i, --interval duration      Time between pings (default 1s)
+//         --keepalive duration     Interval of keepalive pings (default 1m0s)
+//     -P, --password string        Password
+//         --protocol-version int   Protocol version (4 is MQTT 3.1.1, 5 is MQTT 5.0) (default 4)
+//         --timeout duration       Time to wait for the connection and responses of the server (default 10s)
+//         --tls.ca string          Location of the CA certificates to verify the server (system CAs if empty)
+//         --tls.cert string        Location of the client certificate
+//         --tls.insecure           Do not verify the certificate of the server
+//         --tls.key string         Location of the client key
+//         --url string             URL of the server (tcp, tls, ws, wss or unix) (default "tcp://localhost:1883")
+//     -u, --username string        Username
+//         --will.message string    Message of the will
+//         --will.qos int           QoS of the will
+//         --will.retain            Retain the will
+//         --will.topic string      Topic of the will (no will if empty)
+//
+// Usage: mystique-cli bench [options]
+//
+// Simulate devices and applications, and measure the latency, throughput and drops of messages
+//
+// Options:
+//         --applications int       Number of applications (default 1)
+//         --client-id string       Client identifier (assigned by the server if empty)
+//     -d, --debug                  Print debug logs
+//         --drain duration         Maximum time to wait for messages after publishing (default 5s)
+//         --duration duration      Time to publish (default 10s)
+//         --in-process             Run against an in-process server instead of the URL
+//         --keepalive duration     Interval of keepalive pings (default 1m0s)
+//     -P, --password string        Password
+//         --prefix string          Prefix of client and application identifiers (default "bench")
+//         --protocol-version int   Protocol version (4 is MQTT 3.1.1, 5 is MQTT 5.0) (default 4)
+//         --publishers int         Number of publishers, divided over the applications (default 10)
+//     -q, --qos int                QoS of the messages and subscriptions
+//         --rate float             Messages per second per publisher (default 1)
+//         --size int               Size of the messages in bytes (default 64)
+//         --subscribers int        Number of subscribers, divided over the applications (default 1)
+//         --timeout duration       Time to wait for the connection and responses of the server (default 10s)
+//         --tls.ca string          Location of the CA certificates to verify the server (system CAs if empty)
+//         --tls.cert string        Location of the client certificate
+//         --tls.insecure           Do not verify the certificate of the server
+//         --tls.key string         Location of the client key
+//         --url string             URL of the server (tcp, tls, ws, wss or unix) (default "tcp://localhost:1883")
+//     -u, --username string        Username
+//         --will.message string    Message of the will
+//         --will.qos int           QoS of the will
+//         --will.retain            Retain the will
+//         --will.topic string      Topic of the will (no will if empty)
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/TheThingsIndustries/mystique/pkg/apex"
+	"github.com/TheThingsIndustries/mystique/pkg/client"
+	"github.com/TheThingsIndustries/mystique/pkg/log"
+	"github.com/TheThingsIndustries/mystique/pkg/packet"
+	"github.com/spf13/pflag"
+)
+
+type command struct {
+	description string
+	flags       func(flags *pflag.FlagSet)
+	run         func(ctx context.Context, flags *pflag.FlagSet) error
+}
+
+var commands = map[string]command{
+	"bench": benchCommand,
+	"pub":   pubCommand,
+	"sub":   subCommand,
+	"ping":  pingCommand,
+}
+
+var logger = apex.Log
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: mystique-cli <command> [options]")
+	fmt.Fprintln(os.Stderr, "Commands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-6s %s\n", name, commands[name].description)
+	}
+	fmt.Fprintln(os.Stderr, "Run mystique-cli <command> --help for the options of a command")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	name := os.Args[1]
+	cmd, ok := commands[name]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	flags := pflag.NewFlagSet(name, pflag.ExitOnError)
+	connectFlags(flags)
+	cmd.flags(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: mystique-cli %s [options]\n", name)
+		fmt.Fprintln(os.Stderr, cmd.description)
+		fmt.Fprintln(os.Stderr, "Options:")
+		flags.PrintDefaults()
+	}
+	flags.SortFlags = true
+	flags.Parse(os.Args[2:])
+
+	if debug, _ := flags.GetBool("debug"); debug {
+		apex.SetLevelFromString("debug")
+	}
+
+	ctx, cancel := context.WithCancel(log.NewContext(context.Background(), logger))
+	defer cancel()
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		cancel()
+	}()
+
+	if err := cmd.run(ctx, flags); err != nil && err != context.Canceled {
+		logger.WithError(err).Fatalf("Could not %s", name)
+	}
+}
+
+// connectFlags adds the flags for connecting to the server
+func connectFlags(flags *pflag.FlagSet) {
+	flags.BoolP("debug", "d", false, "Print debug logs")
+	flags.String("url", "tcp://localhost:1883", "URL of the server (tcp, tls, ws, wss or unix)")
+	flags.Int("protocol-version", int(packet.Version311), "Protocol version (4 is MQTT 3.1.1, 5 is MQTT 5.0)")
+	flags.String("client-id", "", "Client identifier (assigned by the server if empty)")
+	flags.StringP("username", "u", "", "Username")
+	flags.StringP("password", "P", "", "Password")
+	flags.Duration("keepalive", client.DefaultKeepAlive, "Interval of keepalive pings")
+	flags.Duration("timeout", 10*time.Second, "Time to wait for the connection and responses of the server")
+	flags.String("tls.ca", "", "Location of the CA certificates to verify the server (system CAs if empty)")
+	flags.String("tls.cert", "", "Location of the client certificate")
+	flags.String("tls.key", "", "Location of the client key")
+	flags.Bool("tls.insecure", false, "Do not verify the certificate of the server")
+	flags.String("will.topic", "", "Topic of the will (no will if empty)")
+	flags.String("will.message", "", "Message of the will")
+	flags.Int("will.qos", 0, "QoS of the will")
+	flags.Bool("will.retain", false, "Retain the will")
+}
+
+func tlsConfig(flags *pflag.FlagSet) (*tls.Config, error) {
+	config := &tls.Config{}
+	config.InsecureSkipVerify, _ = flags.GetBool("tls.insecure")
+	if ca, _ := flags.GetString("tls.ca"); ca != "" {
+		pem, err := os.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("Could not read CA certificates")
+		}
+	}
+	cert, _ := flags.GetString("tls.cert")
+	key, _ := flags.GetString("tls.key")
+	if cert != "" || key != "" {
+		keyPair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("Could not load X509 keypair: %s", err)
+		}
+		config.Certificates = []tls.Certificate{keyPair}
+	}
+	return config, nil
+}
+
+// dialer returns the dialer for the URL in the flags
+func dialer(flags *pflag.FlagSet) (client.Dialer, error) {
+	url, _ := flags.GetString("url")
+	config, err := tlsConfig(flags)
+	if err != nil {
+		return nil, err
+	}
+	return client.URL(url, config)
+}
+
+// connectOptions returns the client options for the flags
+func connectOptions(flags *pflag.FlagSet) []client.Option {
+	version, _ := flags.GetInt("protocol-version")
+	clientID, _ := flags.GetString("client-id")
+	username, _ := flags.GetString("username")
+	password, _ := flags.GetString("password")
+	keepAlive, _ := flags.GetDuration("keepalive")
+	options := []client.Option{
+		client.WithProtocolVersion(byte(version)),
+		client.WithClientID(clientID),
+		client.WithCredentials(username, []byte(password)),
+		client.WithKeepAlive(keepAlive),
+	}
+	if topic, _ := flags.GetString("will.topic"); topic != "" {
+		message, _ := flags.GetString("will.message")
+		qos, _ := flags.GetInt("will.qos")
+		retain, _ := flags.GetBool("will.retain")
+		options = append(options, client.WithWill(&packet.PublishPacket{
+			TopicName: topic,
+			Message:   []byte(message),
+			QoS:       byte(qos),
+			Retain:    retain,
+		}))
+	}
+	return options
+}
+
+// connect to the server with the flags and the options
+func connect(ctx context.Context, flags *pflag.FlagSet, option ...client.Option) (client.Client, error) {
+	dial, err := dialer(flags)
+	if err != nil {
+		return nil, err
+	}
+	url, _ := flags.GetString("url")
+	timeout, _ := flags.GetDuration("timeout")
+	connectCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	logger.WithField("url", url).Debug("Connect")
+	return client.Connect(connectCtx, dial, append(connectOptions(flags), option...)...)
+}
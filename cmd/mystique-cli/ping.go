@@ -0,0 +1,52 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/TheThingsIndustries/mystique/pkg/client"
+	"github.com/spf13/pflag"
+)
+
+var pingCommand = command{
+	description: "Connect to the server and measure the round-trip time of pings",
+	flags: func(flags *pflag.FlagSet) {
+		flags.IntP("count", "c", 1, "Number of pings (0 is unlimited)")
+		flags.DurationP("interval", "i", time.Second, "Time between pings")
+	},
+	run: func(ctx context.Context, flags *pflag.FlagSet) error {
+		count, _ := flags.GetInt("count")
+		interval, _ := flags.GetDuration("interval")
+		timeout, _ := flags.GetDuration("timeout")
+		url, _ := flags.GetString("url")
+
+		start := time.Now()
+		c, err := connect(ctx, flags, client.WithoutReconnect())
+		if err != nil {
+			return err
+		}
+		defer c.Disconnect()
+		fmt.Printf("connected to %s: time=%s\n", url, time.Since(start))
+
+		for i := 1; count == 0 || i <= count; i++ {
+			if i > 1 {
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-time.After(interval):
+				}
+			}
+			pingCtx, cancel := context.WithTimeout(ctx, timeout)
+			rtt, err := c.Ping(pingCtx)
+			cancel()
+			if err != nil {
+				return err
+			}
+			fmt.Printf("pong from %s: seq=%d time=%s\n", url, i, rtt)
+		}
+		return nil
+	},
+}
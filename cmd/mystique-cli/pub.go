@@ -0,0 +1,76 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/TheThingsIndustries/mystique/pkg/client"
+	"github.com/TheThingsIndustries/mystique/pkg/packet"
+	"github.com/spf13/pflag"
+)
+
+var pubCommand = command{
+	description: "Publish a message, or the lines of stdin",
+	flags: func(flags *pflag.FlagSet) {
+		flags.StringP("topic", "t", "", "Topic to publish to")
+		flags.StringP("message", "m", "", "Message to publish")
+		flags.BoolP("stdin", "l", false, "Publish each line of stdin as a message")
+		flags.IntP("qos", "q", 0, "QoS of the messages")
+		flags.BoolP("retain", "r", false, "Retain the messages")
+	},
+	run: func(ctx context.Context, flags *pflag.FlagSet) error {
+		topic, _ := flags.GetString("topic")
+		if topic == "" {
+			return errors.New("No topic")
+		}
+		qos, _ := flags.GetInt("qos")
+		retain, _ := flags.GetBool("retain")
+		timeout, _ := flags.GetDuration("timeout")
+
+		c, err := connect(ctx, flags, client.WithoutReconnect())
+		if err != nil {
+			return err
+		}
+		defer c.Disconnect()
+
+		publish := func(message []byte) error {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			logger.WithField("topic", topic).Debug("Publish")
+			return c.Publish(ctx, &packet.PublishPacket{
+				TopicName: topic,
+				QoS:       byte(qos),
+				Retain:    retain,
+				Message:   message,
+			})
+		}
+
+		if stdin, _ := flags.GetBool("stdin"); !stdin {
+			message, _ := flags.GetString("message")
+			return publish([]byte(message))
+		}
+		lines := bufio.NewReader(os.Stdin)
+		for {
+			line, err := lines.ReadBytes('\n')
+			if len(line) > 0 && line[len(line)-1] == '\n' {
+				line = line[:len(line)-1]
+			}
+			if len(line) > 0 {
+				if err := publish(line); err != nil {
+					return err
+				}
+			}
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	},
+}
@@ -0,0 +1,65 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+
+	"github.com/TheThingsIndustries/mystique/pkg/packet"
+	"github.com/spf13/pflag"
+)
+
+var subCommand = command{
+	description: "Subscribe to topics, and print the messages as JSON lines",
+	flags: func(flags *pflag.FlagSet) {
+		flags.StringSliceP("topic", "t", nil, "Topic filters to subscribe to")
+		flags.IntP("qos", "q", 0, "QoS of the subscriptions")
+		flags.IntP("count", "c", 0, "Number of messages to receive before exiting (0 is unlimited)")
+	},
+	run: func(ctx context.Context, flags *pflag.FlagSet) error {
+		filters, _ := flags.GetStringSlice("topic")
+		if len(filters) == 0 {
+			return errors.New("No topic")
+		}
+		qos, _ := flags.GetInt("qos")
+		count, _ := flags.GetInt("count")
+		timeout, _ := flags.GetDuration("timeout")
+
+		c, err := connect(ctx, flags)
+		if err != nil {
+			return err
+		}
+		defer c.Disconnect()
+
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		output := json.NewEncoder(os.Stdout)
+		var received int
+		handler := func(pkt *packet.PublishPacket) {
+			if count > 0 && received >= count {
+				return
+			}
+			output.Encode(pkt)
+			if received++; count > 0 && received == count {
+				cancel()
+			}
+		}
+
+		for _, filter := range filters {
+			subscribeCtx, subscribeCancel := context.WithTimeout(ctx, timeout)
+			qos, err := c.Subscribe(subscribeCtx, filter, byte(qos), handler)
+			subscribeCancel()
+			if err != nil {
+				return err
+			}
+			logger.WithField("topic", filter).WithField("qos", qos).Debug("Subscribed")
+		}
+
+		<-ctx.Done()
+		return nil
+	},
+}
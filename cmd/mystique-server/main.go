@@ -5,26 +5,77 @@
 //     Usage: mystique-server [options]
 //
 //     Options:
-//     -d, --debug                      Print debug logs
-//         --listen.http string         TCP address for HTTP+websocket server to listen on (default ":1880")
-//         --listen.https string        TLS address for HTTP+websocket server to listen on (default ":1443")
-//         --listen.status string       Address for status server to listen on (default ":9383")
-//         --listen.tcp string          TCP address for MQTT server to listen on (default ":1883")
-//         --listen.tls string          TLS address for MQTT server to listen on (default ":8883")
-//         --tls.cert string            Location of the TLS certificate
-//         --tls.key string             Location of the TLS key
-//         --websocket.pattern string   URL pattern for websocket server to be registered on (default "/mqtt")
+//         --check-config                        Check the configuration and exit
+//     -c, --config string                       Location of the configuration file (YAML, TOML or JSON); flags take precedence over the file
+//     -d, --debug                               Print debug logs
+//         --limit.ip int                        Connection limit per IP address (0 is unlimited)
+//         --limit.packet-size int               Maximum size of packets that are received from clients (0 is unlimited)
+//         --limit.user int                      Connection limit per Username (0 is unlimited)
+//         --listen.http string                  TCP address for HTTP+websocket server to listen on (default ":1880")
+//         --listen.https string                 TLS address for HTTP+websocket server to listen on (default ":1443")
+//         --listen.pprof                        Serve pprof handlers on the status server, which does not authenticate requests
+//         --listen.proxy.trusted strings        CIDRs of proxies that send PROXY protocol (v1 or v2) headers on the MQTT and HTTP listeners
+//         --listen.status string                Address for status server to listen on (default ":9383")
+//         --listen.tcp string                   TCP address for MQTT server to listen on (default ":1883")
+//         --listen.tls string                   TLS address for MQTT server to listen on (default ":8883")
+//         --listen.unix string                  Unix socket path for MQTT server to listen on
+//         --session.expiry duration             Time after which a disconnected persistent session expires (0 disables persistent sessions) (default 1h0m0s)
+//         --session.queue.max-bytes int         Maximum size of queued messages per client for the queue action (0 is unlimited) (default 1048576)
+//         --session.queue.max-messages int      Maximum number of queued messages per client for the queue action (0 is unlimited) (default 1000)
+//         --session.shared-strategy string      Strategy for selecting the member of a shared subscription group (round-robin, random, sticky) (default "round-robin")
+//         --session.slow-consumer string        Action for messages to clients that can not keep up (drop-newest, drop-oldest, disconnect, queue) (default "drop-newest")
+//         --shutdown.grace-period duration      Time to drain sessions when shutting down (default 30s)
+//         --tls.cert string                     Location of the default TLS certificate
+//         --tls.certificate-dir string          Directory with more TLS certificates and keys (<name>.crt and <name>.key, or <name>.pem and <name>-key.pem) that are selected by server name
+//         --tls.certificates strings            Locations of more TLS certificates and keys (<cert>:<key>) that are selected by server name
+//         --tls.cipher-suites strings           Cipher suites for TLS 1.0-1.2, such as TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256
+//         --tls.client-auth string              Authentication of clients with TLS certificates (none, request, require) (default "none")
+//         --tls.client-ca string                Location of the CA certificates to verify client certificates
+//         --tls.crl string                      Location of the certificate revocation lists (PEM or DER) to check client certificates
+//         --tls.curves strings                  Curves in order of preference (X25519, P256, P384, P521)
+//         --tls.key string                      Location of the default TLS key
+//         --tls.max-version string              Maximum TLS version (1.0, 1.1, 1.2, 1.3)
+//         --tls.min-version string              Minimum TLS version (1.0, 1.1, 1.2, 1.3)
+//         --tls.ocsp string                     Location of the OCSP response (DER) to staple to the default TLS certificate
+//         --websocket.allow-no-origin           Allow websocket clients without Origin header, such as clients that are not browsers
+//         --websocket.origins strings           Allowed origins of websocket clients, such as https://*.example.com or example.com (default all)
+//         --websocket.pattern string            URL pattern for websocket server to be registered on (default "/mqtt")
+//         --websocket.ping-interval duration    Interval of websocket pings; clients that do not answer a ping within the interval are disconnected (0 disables pings)
+//         --websocket.trusted-proxies strings   CIDRs of proxies that set the X-Forwarded-For or X-Real-IP header of websocket clients
+//
+// Sockets that are passed by systemd socket activation are used instead of the listen addresses.
+// The FileDescriptorName of a socket is the name of its listener: tcp, tls, unix, http, https or status.
+//
+// On SIGUSR2, the server passes its listeners to a new process of the same binary, and drains its sessions.
+//
+// The configuration file has the options above as nested keys, and can declare more listeners:
+//
+//     listen:
+//       tcp: ":1883"
+//     limit:
+//       ip: 100
+//     listeners:
+//       - name: internal
+//         transport: tcp
+//         address: "127.0.0.1:1884"
+//         auth: anonymous
+//         read-only: true
+//         mount-point: internal
+//
+// On SIGHUP, or when the configuration file changes, the connection limits, the shutdown grace period and debug logging are reloaded.
+// The other options are applied on the next restart.
 package main
 
 import (
-	_ "net/http/pprof" // Add pprof handlers to the default http mux
-
 	"github.com/TheThingsIndustries/mystique"
-	"github.com/TheThingsIndustries/mystique/pkg/server"
+	"github.com/TheThingsIndustries/mystique/pkg/log"
 )
 
 func main() {
 	mystique.Configure("mystique-server")
-	s := server.New(mystique.Context())
-	mystique.RunServer(s)
+	s, err := mystique.NewServer(mystique.Context(), mystique.FlagConfig())
+	if err != nil {
+		log.FromContext(mystique.Context()).WithError(err).Fatal("Could not set up server")
+	}
+	mystique.Run(s)
 }
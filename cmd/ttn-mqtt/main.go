@@ -6,6 +6,7 @@
 //
 // Options:
 //         --auth.applications                     Authenticate Applications (default true)
+//         --auth.certificate.identity string      Identity of verified TLS client certificates that is used as Gateway ID (cn, dns, email, uri; leave empty to disable)
 //         --auth.gateways                         Authenticate Gateways (default true)
 //         --auth.handler.password string          Handler password (leave empty to disable user)
 //         --auth.handler.username string          Handler username (default "$handler")
@@ -15,26 +16,78 @@
 //         --auth.router.password string           Router password (leave empty to disable user)
 //         --auth.router.username string           Router username (default "$router")
 //         --auth.ttn.account-server stringSlice   TTN Account Servers (default [ttn-account-v2=https://account.thethingsnetwork.org])
+//         --check-config                          Check the configuration and exit
+//     -c, --config string                         Location of the configuration file (YAML, TOML or JSON); flags take precedence over the file
 //     -d, --debug                                 Print debug logs
+//         --limit.ip int                          Connection limit per IP address (0 is unlimited)
+//         --limit.packet-size int                 Maximum size of packets that are received from clients (0 is unlimited)
+//         --limit.rate float                      Rate limit per connection (default 10)
+//         --limit.user int                        Connection limit per Username (0 is unlimited)
 //         --listen.http string                    TCP address for HTTP+websocket server to listen on (default ":1880")
 //         --listen.https string                   TLS address for HTTP+websocket server to listen on (default ":1443")
+//         --listen.pprof                          Serve pprof handlers on the status server, which does not authenticate requests
+//         --listen.proxy.trusted strings          CIDRs of proxies that send PROXY protocol (v1 or v2) headers on the MQTT and HTTP listeners
 //         --listen.status string                  Address for status server to listen on (default ":9383")
 //         --listen.tcp string                     TCP address for MQTT server to listen on (default ":1883")
 //         --listen.tls string                     TLS address for MQTT server to listen on (default ":8883")
-//         --tls.cert string                       Location of the TLS certificate
-//         --tls.key string                        Location of the TLS key
+//         --listen.unix string                    Unix socket path for MQTT server to listen on
+//         --session.expiry duration               Time after which a disconnected persistent session expires (0 disables persistent sessions) (default 1h0m0s)
+//         --session.queue.max-bytes int           Maximum size of queued messages per client for the queue action (0 is unlimited) (default 1048576)
+//         --session.queue.max-messages int        Maximum number of queued messages per client for the queue action (0 is unlimited) (default 1000)
+//         --session.shared-strategy string        Strategy for selecting the member of a shared subscription group (round-robin, random, sticky) (default "round-robin")
+//         --session.slow-consumer string          Action for messages to clients that can not keep up (drop-newest, drop-oldest, disconnect, queue) (default "drop-newest")
+//         --shutdown.grace-period duration        Time to drain sessions when shutting down (default 30s)
+//         --tls.cert string                       Location of the default TLS certificate
+//         --tls.certificate-dir string            Directory with more TLS certificates and keys (<name>.crt and <name>.key, or <name>.pem and <name>-key.pem) that are selected by server name
+//         --tls.certificates strings              Locations of more TLS certificates and keys (<cert>:<key>) that are selected by server name
+//         --tls.cipher-suites strings             Cipher suites for TLS 1.0-1.2, such as TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256
+//         --tls.client-auth string                Authentication of clients with TLS certificates (none, request, require) (default "none")
+//         --tls.client-ca string                  Location of the CA certificates to verify client certificates
+//         --tls.crl string                        Location of the certificate revocation lists (PEM or DER) to check client certificates
+//         --tls.curves strings                    Curves in order of preference (X25519, P256, P384, P521)
+//         --tls.key string                        Location of the default TLS key
+//         --tls.max-version string                Maximum TLS version (1.0, 1.1, 1.2, 1.3)
+//         --tls.min-version string                Minimum TLS version (1.0, 1.1, 1.2, 1.3)
+//         --tls.ocsp string                       Location of the OCSP response (DER) to staple to the default TLS certificate
+//         --websocket.allow-no-origin             Allow websocket clients without Origin header, such as clients that are not browsers
+//         --websocket.origins strings             Allowed origins of websocket clients, such as https://*.example.com or example.com (default all)
 //         --websocket.pattern string              URL pattern for websocket server to be registered on (default "/mqtt")
+//         --websocket.ping-interval duration      Interval of websocket pings; clients that do not answer a ping within the interval are disconnected (0 disables pings)
+//         --websocket.trusted-proxies strings     CIDRs of proxies that set the X-Forwarded-For or X-Real-IP header of websocket clients
+//
+// Sockets that are passed by systemd socket activation are used instead of the listen addresses.
+// The FileDescriptorName of a socket is the name of its listener: tcp, tls, unix, http, https or status.
+//
+// On SIGUSR2, the server passes its listeners to a new process of the same binary, and drains its sessions.
+//
+// The configuration file has the options above as nested keys, and can declare more listeners (see mystique.ListenerConfig)
+// and the access of TLS client certificates by identity:
+//
+//     auth:
+//       certificate:
+//         identity: cn
+//         users:
+//           - identity: router
+//             read: ["+/up", "+/status"]
+//             write: ["+/down"]
+//
+// On SIGHUP, or when the configuration file changes, the connection limits, the shutdown grace period, debug logging,
+// the super-users, the penalty, the rate limit and the access of certificates are reloaded.
+// The other options are applied on the next restart.
 package main
 
 import (
-	_ "net/http/pprof" // Add pprof handlers to the default http mux
+	"errors"
+	"fmt"
 	"regexp"
 	"strings"
 
 	"github.com/TheThingsIndustries/mystique"
+	"github.com/TheThingsIndustries/mystique/pkg/auth/certauth"
 	"github.com/TheThingsIndustries/mystique/pkg/auth/ttnauth"
 	"github.com/TheThingsIndustries/mystique/pkg/log"
 	"github.com/TheThingsIndustries/mystique/pkg/server"
+	"github.com/TheThingsIndustries/mystique/pkg/topic"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 	"golang.org/x/time/rate"
@@ -56,12 +109,12 @@ func main() {
 
 	pflag.Duration("auth.penalty", 0, "Time penalty for a failed login")
 
+	pflag.String("auth.certificate.identity", "", "Identity of verified TLS client certificates that is used as Gateway ID (cn, dns, email, uri; leave empty to disable)")
+
 	pflag.StringSlice("auth.ttn.account-server", []string{
 		"ttn-account-v2=https://account.thethingsnetwork.org",
 	}, "TTN Account Servers")
 
-	pflag.Int("limit.ip", 0, "Connection limit per IP address")
-	pflag.Int("limit.user", 0, "Connection limit per Username")
 	pflag.Float64("limit.rate", 10, "Rate limit per connection")
 
 	mystique.Configure("ttn-mqtt")
@@ -84,61 +137,125 @@ func main() {
 
 	ttnIDRegexp := regexp.MustCompile("^" + ttnauth.IDRegexp + "$")
 
-	rootUsername, rootPassword := viper.GetString("auth.root.username"), viper.GetString("auth.root.password")
-	if rootUsername != "" && rootPassword != "" {
-		if ttnIDRegexp.MatchString(rootUsername) {
-			logger.Warnf(`The root username "%s" may clash with TTN usernames, consider prefixing it with $`, rootUsername)
+	// superUsers are the usernames of the super-users that were added
+	superUsers := make(map[string]bool)
+	configureSuperUsers := func() {
+		added := make(map[string]bool)
+		for _, role := range []struct {
+			name   string
+			access ttnauth.Access
+		}{
+			{"root", ttnauth.Access{Root: true}},
+			{"router", ttnauth.RouterAccess},
+			{"handler", ttnauth.HandlerAccess},
+		} {
+			username, password := viper.GetString("auth."+role.name+".username"), viper.GetString("auth."+role.name+".password")
+			if username == "" || password == "" {
+				continue
+			}
+			if ttnIDRegexp.MatchString(username) {
+				logger.Warnf(`The %s username "%s" may clash with TTN usernames, consider prefixing it with $`, role.name, username)
+			}
+			if username == password {
+				logger.Warnf("The %s password equals the username, which is not very secure, use the --auth.%s.password flag to change it", role.name, role.name)
+			}
+			auth.AddSuperUser(username, []byte(password), role.access)
+			added[username] = true
 		}
-		if rootUsername == rootPassword {
-			logger.Warn("The root password equals the username, which is not very secure, use the --auth.root.password flag to change it")
+		for username := range superUsers {
+			if !added[username] {
+				auth.RemoveSuperUser(username)
+			}
 		}
-		auth.AddSuperUser(rootUsername, []byte(rootPassword), ttnauth.Access{Root: true})
-	}
+		superUsers = added
 
-	routerUsername, routerPassword := viper.GetString("auth.router.username"), viper.GetString("auth.router.password")
-	if routerUsername != "" && routerPassword != "" {
-		if ttnIDRegexp.MatchString(routerUsername) {
-			logger.Warnf(`The router username "%s" may clash with TTN usernames, consider prefixing it with $`, routerUsername)
-		}
-		if routerUsername == routerPassword {
-			logger.Warn("The router password equals the username, which is not very secure, use the --auth.router.password flag to change it")
-		}
-		auth.AddSuperUser(routerUsername, []byte(routerPassword), ttnauth.RouterAccess)
+		auth.SetPenalty(viper.GetDuration("auth.penalty"))
+		auth.SetRateLimit(rate.Limit(viper.GetFloat64("limit.rate")))
 	}
+	configureSuperUsers()
 
 	if viper.GetBool("auth.gateways") {
 		auth.AuthenticateGateways()
 	}
 
-	handlerUsername, handlerPassword := viper.GetString("auth.handler.username"), viper.GetString("auth.handler.password")
-	if handlerUsername != "" && handlerPassword != "" {
-		if ttnIDRegexp.MatchString(handlerUsername) {
-			logger.Warnf(`The handler username "%s" may clash with TTN usernames, consider prefixing it with $`, handlerUsername)
-		}
-		if handlerUsername == handlerPassword {
-			logger.Warn("The handler password equals the username, which is not very secure, use the --auth.handler.password flag to change it")
-		}
-		auth.AddSuperUser(handlerUsername, []byte(handlerPassword), ttnauth.HandlerAccess)
-	}
-
 	if viper.GetBool("auth.applications") {
 		auth.AuthenticateApplications()
 	}
 
-	auth.SetPenalty(viper.GetDuration("auth.penalty"))
-	auth.SetRateLimit(rate.Limit(viper.GetFloat64("limit.rate")))
+	authOption := server.WithAuth(auth)
+	if identity := viper.GetString("auth.certificate.identity"); identity != "" {
+		certs, err := certauth.New(identity)
+		if err != nil {
+			logger.WithError(err).Fatal("Could not set up certificate authentication")
+		}
+		// Gateways with a certificate have the same access as gateways with a key
+		certs.SetDefaultAccess(certauth.Access{
+			Read: [][]string{
+				{certauth.Username, "down"},
+			},
+			Write: [][]string{
+				{certauth.Username, "up"},
+				{certauth.Username, "status"},
+				{"connect"},
+				{"disconnect"},
+			},
+		})
+		certs.SetFallback(auth)
+		if err := configureCertificateUsers(certs); err != nil {
+			logger.WithError(err).Fatal("Could not set up certificate authentication")
+		}
+		authOption = server.WithAuth(certs)
+		mystique.OnReload(func() error { return configureCertificateUsers(certs) })
+	}
 
-	serverOptions := []server.Option{server.WithAuth(auth)}
+	mystique.OnReload(func() error {
+		configureSuperUsers()
+		return nil
+	})
 
-	if ipLimit := viper.GetInt("limit.ip"); ipLimit > 0 {
-		serverOptions = append(serverOptions, server.WithIPLimits(ipLimit))
+	serverOptions := []server.Option{
+		authOption,
 	}
 
-	if userLimit := viper.GetInt("limit.user"); userLimit > 0 {
-		serverOptions = append(serverOptions, server.WithUserLimits(userLimit))
+	s, err := mystique.NewServer(mystique.Context(), mystique.FlagConfig(), serverOptions...)
+	if err != nil {
+		logger.WithError(err).Fatal("Could not set up server")
 	}
 
-	s := server.New(mystique.Context(), serverOptions...)
+	mystique.Run(s)
+}
+
+// certificateUser is the access of a certificate in the auth.certificate.users list of the configuration file
+type certificateUser struct {
+	Identity string   `mapstructure:"identity"`
+	Root     bool     `mapstructure:"root"`
+	Read     []string `mapstructure:"read"`  // topic filters
+	Write    []string `mapstructure:"write"` // topic filters
+}
 
-	mystique.RunServer(s)
+// configureCertificateUsers replaces the users of the certificate authentication with the users of the configuration
+func configureCertificateUsers(certs *certauth.CertAuth) error {
+	var users []certificateUser
+	if err := viper.UnmarshalKey("auth.certificate.users", &users); err != nil {
+		return err
+	}
+	access := make(map[string]certauth.Access, len(users))
+	for _, user := range users {
+		if user.Identity == "" {
+			return errors.New("Certificate user without identity")
+		}
+		if _, ok := access[user.Identity]; ok {
+			return fmt.Errorf("Duplicate certificate user %s", user.Identity)
+		}
+		userAccess := certauth.Access{Root: user.Root}
+		for _, filter := range user.Read {
+			userAccess.Read = append(userAccess.Read, topic.Split(filter))
+		}
+		for _, filter := range user.Write {
+			userAccess.Write = append(userAccess.Write, topic.Split(filter))
+		}
+		access[user.Identity] = userAccess
+	}
+	certs.SetUsers(access)
+	return nil
 }
@@ -0,0 +1,174 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+package mystique
+
+import (
+	"time"
+
+	"github.com/TheThingsIndustries/mystique/pkg/auth"
+	"github.com/TheThingsIndustries/mystique/pkg/session"
+)
+
+// Config for the Server
+// The mapstructure tags match the flags of Configure.
+type Config struct {
+	Listen    ListenConfig    `mapstructure:"listen"`
+	TLS       TLSSettings     `mapstructure:"tls"`
+	Websocket WebsocketConfig `mapstructure:"websocket"`
+	Session   SessionConfig   `mapstructure:"session"`
+	Limit     LimitConfig     `mapstructure:"limit"`
+	Shutdown  ShutdownConfig  `mapstructure:"shutdown"`
+
+	Listeners []ListenerConfig `mapstructure:"listeners"`
+}
+
+// ListenConfig contains the addresses to listen on; empty addresses are disabled
+// Sockets that are passed by systemd socket activation are used instead of the addresses, and enable the listener with their name.
+type ListenConfig struct {
+	TCP    string `mapstructure:"tcp"`    // MQTT
+	TLS    string `mapstructure:"tls"`    // MQTT+TLS
+	Unix   string `mapstructure:"unix"`   // MQTT on a Unix socket
+	HTTP   string `mapstructure:"http"`   // HTTP+websocket
+	HTTPS  string `mapstructure:"https"`  // HTTPS+websocket
+	Status string `mapstructure:"status"` // status+debug+metrics
+	Pprof  bool   `mapstructure:"pprof"`  // pprof handlers on the status server; the status server does not authenticate requests
+
+	Proxy ProxyConfig `mapstructure:"proxy"`
+}
+
+// ProxyConfig contains the proxies that are trusted to send PROXY protocol headers on the MQTT and HTTP listeners
+type ProxyConfig struct {
+	Trusted []string `mapstructure:"trusted"` // CIDRs or IP addresses
+}
+
+// ListenerConfig declares a listener with its own auth, limits and mount point, in addition to the listeners of ListenConfig
+// The listener uses the configuration of the server for the options that are not set.
+type ListenerConfig struct {
+	Name       string `mapstructure:"name"`        // name in Addrs, and of the activated socket
+	Transport  string `mapstructure:"transport"`   // tcp, tls, unix, ws or wss
+	Address    string `mapstructure:"address"`     // address, or path of the Unix socket
+	Pattern    string `mapstructure:"pattern"`     // URL pattern of the websocket server
+	Auth       string `mapstructure:"auth"`        // default (the auth interface of the server) or anonymous
+	ReadOnly   bool   `mapstructure:"read-only"`   // clients can not publish
+	IPLimit    int    `mapstructure:"ip-limit"`    // maximum number of connections per IP address
+	UserLimit  int    `mapstructure:"user-limit"`  // maximum number of connections per username
+	PacketSize int    `mapstructure:"packet-size"` // maximum size of packets that are received from clients
+	MountPoint string `mapstructure:"mount-point"` // topic prefix of the clients
+
+	// AuthInterface is the auth interface of the listener; it overrides Auth
+	AuthInterface auth.Interface `mapstructure:"-"`
+}
+
+// TLSSettings contains the TLS certificates; TLS listeners are disabled without certificates
+// The certificate is selected by the server name that the client indicates (SNI).
+// Cert and Key are the default certificate; otherwise the first of the other certificates is the default.
+type TLSSettings struct {
+	Cert           string   `mapstructure:"cert"`
+	Key            string   `mapstructure:"key"`
+	Certificates   []string `mapstructure:"certificates"`    // <cert>:<key> pairs
+	CertificateDir string   `mapstructure:"certificate-dir"` // <name>.crt and <name>.key, or <name>.pem and <name>-key.pem pairs
+	ClientAuth     string   `mapstructure:"client-auth"`     // none, request or require
+	ClientCA       string   `mapstructure:"client-ca"`       // CA bundle to verify client certificates
+	CRL            string   `mapstructure:"crl"`             // revocation lists to check client certificates
+	OCSP           string   `mapstructure:"ocsp"`            // DER encoded OCSP response to staple to the default certificate
+	MinVersion     string   `mapstructure:"min-version"`     // 1.0, 1.1, 1.2 or 1.3
+	MaxVersion     string   `mapstructure:"max-version"`     // 1.0, 1.1, 1.2 or 1.3
+	CipherSuites   []string `mapstructure:"cipher-suites"`   // names of the cipher suites for TLS 1.0-1.2
+	Curves         []string `mapstructure:"curves"`          // X25519, P256, P384 or P521, in order of preference
+}
+
+// Enabled returns true if certificates are configured
+func (c TLSSettings) Enabled() bool {
+	return (c.Cert != "" && c.Key != "") || len(c.Certificates) > 0 || c.CertificateDir != ""
+}
+
+// WebsocketConfig contains the websocket configuration
+type WebsocketConfig struct {
+	Pattern        string        `mapstructure:"pattern"`
+	Origins        []string      `mapstructure:"origins"`         // allowed origins of browsers, with * wildcards; empty allows all origins
+	AllowNoOrigin  bool          `mapstructure:"allow-no-origin"` // allow clients without Origin header
+	PingInterval   time.Duration `mapstructure:"ping-interval"`   // 0 disables pings
+	TrustedProxies []string      `mapstructure:"trusted-proxies"` // CIDRs or IP addresses of proxies that set X-Forwarded-For or X-Real-IP
+}
+
+// SessionConfig contains the session configuration
+type SessionConfig struct {
+	Expiry         time.Duration `mapstructure:"expiry"`
+	SharedStrategy string        `mapstructure:"shared-strategy"`
+	SlowConsumer   string        `mapstructure:"slow-consumer"`
+	Queue          QueueConfig   `mapstructure:"queue"`
+}
+
+// QueueConfig contains the budget of the queue slow consumer action
+type QueueConfig struct {
+	MaxMessages int `mapstructure:"max-messages"`
+	MaxBytes    int `mapstructure:"max-bytes"`
+}
+
+// LimitConfig contains the limits of connections
+type LimitConfig struct {
+	PacketSize int `mapstructure:"packet-size"`
+	IP         int `mapstructure:"ip"`   // connections per IP address
+	User       int `mapstructure:"user"` // connections per username
+}
+
+// ShutdownConfig contains the shutdown configuration
+type ShutdownConfig struct {
+	GracePeriod time.Duration `mapstructure:"grace-period"`
+}
+
+// DefaultConfig returns the default configuration
+func DefaultConfig() Config {
+	return Config{
+		Listen: ListenConfig{
+			TCP:    ":1883",
+			TLS:    ":8883",
+			HTTP:   ":1880",
+			HTTPS:  ":1443",
+			Status: ":9383",
+		},
+		TLS: TLSSettings{
+			ClientAuth: "none",
+		},
+		Websocket: WebsocketConfig{
+			Pattern: "/mqtt",
+		},
+		Session: SessionConfig{
+			Expiry:         session.DefaultExpiry,
+			SharedStrategy: "round-robin",
+			SlowConsumer:   session.DefaultSlowConsumerPolicy.Action.String(),
+			Queue: QueueConfig{
+				MaxMessages: 1000,
+				MaxBytes:    1 << 20,
+			},
+		},
+		Shutdown: ShutdownConfig{
+			GracePeriod: 30 * time.Second,
+		},
+	}
+}
+
+// Store returns a session store with the configuration
+func (c SessionConfig) Store() (session.Store, error) {
+	sharedStrategy, err := session.NewSharedStrategy(c.SharedStrategy)
+	if err != nil {
+		return nil, err
+	}
+	return session.SimpleStore(
+		session.WithExpiry(c.Expiry),
+		session.WithSharedStrategy(sharedStrategy),
+	), nil
+}
+
+// SlowConsumerPolicy returns the slow consumer policy of the configuration
+func (c SessionConfig) SlowConsumerPolicy() (session.SlowConsumerPolicy, error) {
+	action, err := session.ParseSlowConsumerAction(c.SlowConsumer)
+	if err != nil {
+		return session.SlowConsumerPolicy{}, err
+	}
+	return session.SlowConsumerPolicy{
+		Action:            action,
+		MaxQueuedMessages: c.Queue.MaxMessages,
+		MaxQueuedBytes:    c.Queue.MaxBytes,
+	}, nil
+}
@@ -0,0 +1,137 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+package mystique
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/TheThingsIndustries/mystique/pkg/server"
+	"github.com/TheThingsIndustries/mystique/pkg/topic"
+)
+
+// listenFDsStart is the first file descriptor of socket activation
+var listenFDsStart = 3
+
+// activatedListeners returns the listeners that were passed by systemd socket activation (LISTEN_FDS) or by Restart, by name
+// The names are set with FileDescriptorName in the socket units, and match the names of the listeners (tcp, tls, http, https, status, unix).
+// The environment variables are unset, so that child processes do not inherit the sockets.
+func activatedListeners() (map[string]net.Listener, error) {
+	pid, fds, names := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES")
+	restartPID := os.Getenv(restartPIDEnv)
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	os.Unsetenv(restartPIDEnv)
+	if pid != strconv.Itoa(os.Getpid()) && (restartPID == "" || restartPID != strconv.Itoa(os.Getppid())) {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(fds)
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("Invalid LISTEN_FDS %q", fds)
+	}
+	nameList := strings.Split(names, ":")
+	listeners := make(map[string]net.Listener, count)
+	for i := 0; i < count; i++ {
+		name := "unknown"
+		if i < len(nameList) && nameList[i] != "" {
+			name = nameList[i]
+		}
+		file := os.NewFile(uintptr(listenFDsStart+i), name)
+		lis, err := net.FileListener(file)
+		file.Close()
+		if err == nil {
+			if _, ok := listeners[name]; ok {
+				lis.Close()
+				err = fmt.Errorf("Duplicate name")
+			}
+		}
+		if err != nil {
+			for _, lis := range listeners {
+				lis.Close()
+			}
+			return nil, fmt.Errorf("Could not use activated socket %s: %s", name, err)
+		}
+		listeners[name] = lis
+	}
+	return listeners, nil
+}
+
+// removeStaleSocket removes the Unix socket file if no server listens on it
+func removeStaleSocket(path string) {
+	info, err := os.Stat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return
+	}
+	os.Remove(path)
+}
+
+// listenerNames are the names of the listeners of ListenConfig
+var listenerNames = []string{"tcp", "tls", "unix", "http", "https", "status"}
+
+var listenerTransports = map[string]bool{"tcp": true, "tls": true, "unix": true, "ws": true, "wss": true}
+
+// validateListeners validates the declared listeners
+func (c Config) validateListeners() error {
+	names := make(map[string]bool)
+	for _, name := range listenerNames {
+		names[name] = true
+	}
+	for _, listener := range c.Listeners {
+		if listener.Name == "" {
+			return fmt.Errorf("No name for listener on %s", listener.Address)
+		}
+		if names[listener.Name] {
+			return fmt.Errorf("Duplicate listener name %s", listener.Name)
+		}
+		names[listener.Name] = true
+		if !listenerTransports[listener.Transport] {
+			return fmt.Errorf("Invalid transport %q of listener %s", listener.Transport, listener.Name)
+		}
+		if (listener.Transport == "tls" || listener.Transport == "wss") && !c.TLS.Enabled() {
+			return fmt.Errorf("No TLS certificates for listener %s", listener.Name)
+		}
+		if _, err := listener.options(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// options returns the options of the MQTT server for the listener
+func (c ListenerConfig) options() ([]server.ListenerOption, error) {
+	var options []server.ListenerOption
+	switch {
+	case c.AuthInterface != nil:
+		options = append(options, server.WithListenerAuth(c.AuthInterface))
+	case c.Auth == "", c.Auth == "default":
+	case c.Auth == "anonymous":
+		options = append(options, server.WithListenerAuth(nil))
+	default:
+		return nil, fmt.Errorf("Invalid auth %q of listener %s", c.Auth, c.Name)
+	}
+	if c.ReadOnly {
+		options = append(options, server.WithListenerReadOnly())
+	}
+	if c.IPLimit > 0 {
+		options = append(options, server.WithListenerIPLimits(c.IPLimit))
+	}
+	if c.UserLimit > 0 {
+		options = append(options, server.WithListenerUserLimits(c.UserLimit))
+	}
+	if c.MountPoint != "" {
+		if err := topic.ValidateTopic(c.MountPoint); err != nil ||
+			strings.HasPrefix(c.MountPoint, topic.InternalPrefix) || strings.HasSuffix(c.MountPoint, topic.Separator) {
+			return nil, fmt.Errorf("Invalid mount point %q of listener %s", c.MountPoint, c.Name)
+		}
+		options = append(options, server.WithMountPoint(c.MountPoint))
+	}
+	return options, nil
+}
@@ -0,0 +1,62 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+//go:build unix
+
+package mystique
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/TheThingsIndustries/mystique/pkg/client"
+	"github.com/smartystreets/assertions"
+	"github.com/smartystreets/assertions/should"
+)
+
+func TestServerActivated(t *testing.T) {
+	a := assertions.New(t)
+	ctx := context.Background()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := lis.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := syscall.Dup(int(file.Fd())) // the activated socket is closed by the server
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	lis.Close()
+
+	defer func(start int) { listenFDsStart = start }(listenFDsStart)
+	listenFDsStart = fd
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "1")
+	os.Setenv("LISTEN_FDNAMES", "tcp")
+
+	config := testConfig()
+	config.Listen.TCP = ""
+	s, err := NewServer(ctx, config)
+	a.So(err, should.BeNil)
+	if !a.So(s.Start(ctx), should.BeNil) {
+		return
+	}
+	defer s.Shutdown(ctx)
+
+	// the environment is not inherited by child processes
+	a.So(os.Getenv("LISTEN_FDS"), should.BeEmpty)
+
+	a.So(s.Addrs()["tcp"].String(), should.Equal, lis.Addr().String())
+	c, err := client.Connect(ctx, client.TCP(lis.Addr().String()), client.WithoutReconnect())
+	if a.So(err, should.BeNil) {
+		a.So(c.Disconnect(), should.BeNil)
+	}
+}
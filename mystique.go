@@ -2,32 +2,24 @@
 
 // Package mystique implements an MQTT server.
 // See the cmd package for the main executables.
+//
+// The Server can be embedded in other programs with a programmatic Config.
+// Config.Listeners declares more listeners, each with its own transport, auth, limits and mount point.
+// Configure, FlagConfig and Run map command-line flags and the configuration file onto a Server for the main executables.
 package mystique
 
 import (
 	"context"
-	"crypto/sha1"
 	"crypto/tls"
-	"crypto/x509"
-	"encoding/hex"
 	"fmt"
-	"net"
-	"net/http"
 	"os"
 	"os/signal"
 	"strings"
-	"sync"
 	"syscall"
-	"time"
 
 	"github.com/TheThingsIndustries/mystique/pkg/apex"
-	"github.com/TheThingsIndustries/mystique/pkg/inspect"
 	"github.com/TheThingsIndustries/mystique/pkg/log"
-	mqttnet "github.com/TheThingsIndustries/mystique/pkg/net"
 	"github.com/TheThingsIndustries/mystique/pkg/server"
-	"github.com/fsnotify/fsnotify"
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
@@ -36,8 +28,6 @@ var (
 	ctx        = context.Background()
 	logger     = apex.Log
 	configured = false
-
-	s server.Server
 )
 
 // Context returns the global context
@@ -50,15 +40,44 @@ func Context() context.Context {
 
 // Configure the binary
 func Configure(binaryName string) {
+	defaults := DefaultConfig()
 	pflag.BoolP("debug", "d", false, "Print debug logs")
-	pflag.String("listen.tcp", ":1883", "TCP address for MQTT server to listen on")
-	pflag.String("listen.tls", ":8883", "TLS address for MQTT server to listen on")
-	pflag.String("listen.http", ":1880", "TCP address for HTTP+websocket server to listen on")
-	pflag.String("listen.https", ":1443", "TLS address for HTTP+websocket server to listen on")
-	pflag.String("websocket.pattern", "/mqtt", "URL pattern for websocket server to be registered on")
-	pflag.String("listen.status", ":9383", "Address for status server to listen on")
-	pflag.String("tls.cert", "", "Location of the TLS certificate")
-	pflag.String("tls.key", "", "Location of the TLS key")
+	pflag.StringP("config", "c", "", "Location of the configuration file (YAML, TOML or JSON); flags take precedence over the file")
+	pflag.Bool("check-config", false, "Check the configuration and exit")
+	pflag.String("listen.tcp", defaults.Listen.TCP, "TCP address for MQTT server to listen on")
+	pflag.String("listen.tls", defaults.Listen.TLS, "TLS address for MQTT server to listen on")
+	pflag.String("listen.unix", defaults.Listen.Unix, "Unix socket path for MQTT server to listen on")
+	pflag.String("listen.http", defaults.Listen.HTTP, "TCP address for HTTP+websocket server to listen on")
+	pflag.String("listen.https", defaults.Listen.HTTPS, "TLS address for HTTP+websocket server to listen on")
+	pflag.String("websocket.pattern", defaults.Websocket.Pattern, "URL pattern for websocket server to be registered on")
+	pflag.StringSlice("websocket.origins", defaults.Websocket.Origins, "Allowed origins of websocket clients, such as https://*.example.com or example.com (default all)")
+	pflag.Bool("websocket.allow-no-origin", defaults.Websocket.AllowNoOrigin, "Allow websocket clients without Origin header, such as clients that are not browsers")
+	pflag.Duration("websocket.ping-interval", defaults.Websocket.PingInterval, "Interval of websocket pings; clients that do not answer a ping within the interval are disconnected (0 disables pings)")
+	pflag.StringSlice("websocket.trusted-proxies", defaults.Websocket.TrustedProxies, "CIDRs of proxies that set the X-Forwarded-For or X-Real-IP header of websocket clients")
+	pflag.String("listen.status", defaults.Listen.Status, "Address for status server to listen on")
+	pflag.Bool("listen.pprof", defaults.Listen.Pprof, "Serve pprof handlers on the status server, which does not authenticate requests")
+	pflag.StringSlice("listen.proxy.trusted", defaults.Listen.Proxy.Trusted, "CIDRs of proxies that send PROXY protocol (v1 or v2) headers on the MQTT and HTTP listeners")
+	pflag.Duration("shutdown.grace-period", defaults.Shutdown.GracePeriod, "Time to drain sessions when shutting down")
+	pflag.Int("limit.packet-size", defaults.Limit.PacketSize, "Maximum size of packets that are received from clients (0 is unlimited)")
+	pflag.Int("limit.ip", defaults.Limit.IP, "Connection limit per IP address (0 is unlimited)")
+	pflag.Int("limit.user", defaults.Limit.User, "Connection limit per Username (0 is unlimited)")
+	pflag.String("tls.cert", defaults.TLS.Cert, "Location of the default TLS certificate")
+	pflag.String("tls.key", defaults.TLS.Key, "Location of the default TLS key")
+	pflag.StringSlice("tls.certificates", defaults.TLS.Certificates, "Locations of more TLS certificates and keys (<cert>:<key>) that are selected by server name")
+	pflag.String("tls.certificate-dir", defaults.TLS.CertificateDir, "Directory with more TLS certificates and keys (<name>.crt and <name>.key, or <name>.pem and <name>-key.pem) that are selected by server name")
+	pflag.String("tls.client-auth", defaults.TLS.ClientAuth, "Authentication of clients with TLS certificates (none, request, require)")
+	pflag.String("tls.client-ca", defaults.TLS.ClientCA, "Location of the CA certificates to verify client certificates")
+	pflag.String("tls.crl", defaults.TLS.CRL, "Location of the certificate revocation lists (PEM or DER) to check client certificates")
+	pflag.String("tls.ocsp", defaults.TLS.OCSP, "Location of the OCSP response (DER) to staple to the default TLS certificate")
+	pflag.String("tls.min-version", defaults.TLS.MinVersion, "Minimum TLS version (1.0, 1.1, 1.2, 1.3)")
+	pflag.String("tls.max-version", defaults.TLS.MaxVersion, "Maximum TLS version (1.0, 1.1, 1.2, 1.3)")
+	pflag.StringSlice("tls.cipher-suites", defaults.TLS.CipherSuites, "Cipher suites for TLS 1.0-1.2, such as TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256")
+	pflag.StringSlice("tls.curves", defaults.TLS.Curves, "Curves in order of preference (X25519, P256, P384, P521)")
+	pflag.Duration("session.expiry", defaults.Session.Expiry, "Time after which a disconnected persistent session expires (0 disables persistent sessions)")
+	pflag.String("session.shared-strategy", defaults.Session.SharedStrategy, "Strategy for selecting the member of a shared subscription group (round-robin, random, sticky)")
+	pflag.String("session.slow-consumer", defaults.Session.SlowConsumer, "Action for messages to clients that can not keep up (drop-newest, drop-oldest, disconnect, queue)")
+	pflag.Int("session.queue.max-messages", defaults.Session.Queue.MaxMessages, "Maximum number of queued messages per client for the queue action (0 is unlimited)")
+	pflag.Int("session.queue.max-bytes", defaults.Session.Queue.MaxBytes, "Maximum size of queued messages per client for the queue action (0 is unlimited)")
 
 	pflag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s [options]\n", binaryName)
@@ -72,211 +91,182 @@ func Configure(binaryName string) {
 	viper.AutomaticEnv()
 	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_", "-", "_"))
 
-	if viper.GetBool("debug") {
-		apex.SetLevelFromString("debug")
+	if file := viper.GetString("config"); file != "" {
+		viper.SetConfigFile(file)
+		if err := viper.ReadInConfig(); err != nil {
+			logger.WithError(err).Fatal("Could not read configuration file")
+		}
 	}
+
+	setLogLevel()
 	ctx = log.NewContext(ctx, logger)
 
 	configured = true
 }
 
-var certificateExpiry = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-	Namespace: "tls",
-	Name:      "certificate_expiry_seconds",
-	Help:      "Expiry date of the TLS certificate.",
-}, []string{"fingerprint"})
-
-func init() {
-	prometheus.MustRegister(certificateExpiry)
+func setLogLevel() {
+	if viper.GetBool("debug") {
+		apex.SetLevelFromString("debug")
+	} else {
+		apex.SetLevelFromString("info")
+	}
 }
 
-func TLSConfig(certFile, keyFile string) (tlsConfig *tls.Config) {
-	var (
-		cert   *tls.Certificate
-		certMu sync.RWMutex
-	)
+// FlagConfig returns the configuration from the flags (and environment and configuration file) of Configure
+func FlagConfig() Config {
+	if !configured {
+		panic("mystique.Configure() was not called")
+	}
+	config, err := flagConfig()
+	if err != nil {
+		logger.WithError(err).Fatal("Invalid configuration")
+	}
+	return config
+}
 
-	readCert := func() error {
-		newCert, err := tls.LoadX509KeyPair(certFile, keyFile)
-		if err != nil {
-			return fmt.Errorf("Could not load X509 keypair: %s", err)
-		}
-		newCert.Leaf, err = x509.ParseCertificate(newCert.Certificate[0])
-		if err != nil {
-			logger.WithError(err).Warn("Could not parse leaf certificate")
-		}
+func flagConfig() (Config, error) {
+	config := DefaultConfig()
+	err := viper.Unmarshal(&config)
+	return config, err
+}
 
-		sum := sha1.Sum(newCert.Leaf.Raw)
+var reloaders []func() error
 
-		certMu.Lock()
-		cert = &newCert
-		certificateExpiry.Reset()
-		certificateExpiry.WithLabelValues(hex.EncodeToString(sum[:])).Set(float64(newCert.Leaf.NotAfter.Unix()))
-		certMu.Unlock()
+// OnReload registers a function that is called when Run reloads the configuration
+// The function applies the settings of the main executable that are safe to change while the server runs.
+func OnReload(f func() error) {
+	reloaders = append(reloaders, f)
+}
 
-		return nil
+// reload the configuration file, and apply the configuration to the server and the functions of OnReload
+func reload(s *Server) {
+	if viper.ConfigFileUsed() != "" {
+		if err := viper.ReadInConfig(); err != nil {
+			logger.WithError(err).Error("Could not read configuration file")
+			return
+		}
 	}
-
-	if err := readCert(); err != nil {
-		logger.WithError(err).Fatal("Could not set up TLS")
+	config, err := flagConfig()
+	if err == nil {
+		err = s.Reload(config)
 	}
-
-	if watcher, err := fsnotify.NewWatcher(); err == nil {
-		if watcher.Add(certFile) == nil && watcher.Add(keyFile) == nil {
-			update := make(chan bool, 1)
-			go func() {
-				for {
-					select {
-					case event := <-watcher.Events:
-						if event.Op&fsnotify.Write == fsnotify.Write {
-							select {
-							case update <- true:
-								logger.Info("Detected certificate change. Scheduling update...")
-								time.AfterFunc(5*time.Second, func() {
-									logger.Info("Updating TLS certificate...")
-									if err := readCert(); err != nil {
-										logger.WithError(err).Error("Could not update TLS certificate")
-									} else {
-										logger.Info("Updated TLS certificate")
-									}
-									<-update
-								})
-							default:
-								// Debounce
-							}
-						}
-					case err := <-watcher.Errors:
-						logger.WithError(err).Warn("Error watching file")
-					}
-				}
-			}()
-		}
+	if err != nil {
+		logger.WithError(err).Error("Invalid configuration")
+		return
 	}
-
-	return &tls.Config{
-		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
-			certMu.RLock()
-			currentCert := cert
-			certMu.RUnlock()
-			return currentCert, nil
-		},
+	setLogLevel()
+	for _, f := range reloaders {
+		if err := f(); err != nil {
+			logger.WithError(err).Error("Could not reload configuration")
+		}
 	}
+	logger.Info("Reloaded configuration")
 }
 
-// RunServer the server
-func RunServer(s server.Server) {
-	wss := mqttnet.Websocket(s.Handle)
-
-	var tlsConfig *tls.Config
-	certFile, keyFile := viper.GetString("tls.cert"), viper.GetString("tls.key")
-	if certFile != "" && keyFile != "" {
-		tlsConfig = TLSConfig(certFile, keyFile)
+// Run the server until a signal is received, and then shut it down within the grace period of the configuration
+// On SIGUSR2, a new process takes over the listeners (see Server.Restart) before the server is shut down.
+// On SIGHUP, or when the configuration file changes, the configuration is reloaded (see Server.Reload and OnReload).
+// With the check-config flag, Run returns without starting the server; the configuration was checked by NewServer.
+func Run(s *Server) {
+	if viper.GetBool("check-config") {
+		logger.Info("Configuration is valid")
+		return
 	}
 
-	if listen := viper.GetString("listen.status"); listen != "" {
-		http.Handle("/mqtt", wss)
-		http.Handle("/metrics", promhttp.Handler())
-		if s.Sessions() != nil {
-			http.Handle("/debug/sessions", inspect.Sessions(s.Sessions()))
-		}
-		logger.WithField("address", listen).Info("Starting status+debug+metrics server")
-		go func() {
-			err := http.ListenAndServe(listen, nil)
-			if err != nil {
-				logger.WithError(err).Fatal("Could not start status+debug+metrics server")
-			}
-		}()
+	if err := s.Start(ctx); err != nil {
+		logger.WithError(err).Fatal("Could not start server")
 	}
 
-	if listen := viper.GetString("listen.tcp"); listen != "" {
-		logger.WithField("address", listen).Info("Starting MQTT server")
-		lis, err := mqttnet.Listen("tcp", listen)
+	fileChanged := make(chan struct{}, 1)
+	if file := viper.ConfigFileUsed(); file != "" {
+		watcher, err := watchFiles(logger, func() []string { return []string{file} }, configReloadDelay, func() {
+			select {
+			case fileChanged <- struct{}{}:
+			default:
+			}
+		})
 		if err != nil {
-			logger.WithError(err).Fatal("Could not start MQTT server")
+			logger.WithError(err).Warn("Could not watch configuration file")
+		} else {
+			defer watcher.Close()
 		}
-		defer lis.Close()
+	}
 
-		go func() {
-			for {
-				conn, err := lis.Accept()
+	sigChan := make(chan os.Signal, 1)
+	signals := []os.Signal{os.Interrupt, syscall.SIGTERM}
+	signals = append(signals, restartSignals...)
+	signals = append(signals, reloadSignals...)
+	signal.Notify(sigChan, signals...)
+	for running := true; running; {
+		select {
+		case <-fileChanged:
+			reload(s)
+		case sig := <-sigChan:
+			logger.WithField("signal", sig.String()).Info("Signal received")
+			switch {
+			case isSignal(sig, reloadSignals):
+				reload(s)
+			case isSignal(sig, restartSignals):
+				logger.Info("Restarting")
+				process, err := s.Restart()
 				if err != nil {
-					logger.WithError(err).Error("Could not accept connection")
-					return
+					logger.WithError(err).Error("Could not restart")
+					continue
 				}
-				go s.Handle(conn)
+				logger.WithField("pid", process.Pid).Info("Restarted, listeners were passed to the new process")
+				running = false
+			default:
+				running = false
 			}
-		}()
-	}
-
-	if listen := viper.GetString("listen.tls"); listen != "" {
-		if tlsConfig != nil {
-			logger.WithField("address", listen).Info("Starting MQTT+TLS server")
-			tlsLis, err := tls.Listen("tcp", listen, tlsConfig)
-			if err != nil {
-				logger.WithError(err).Fatal("Could not start MQTT+TLS server")
-			}
-			defer tlsLis.Close()
-
-			lis := mqttnet.NewListener(tlsLis, "tls")
-
-			go func() {
-				for {
-					conn, err := lis.Accept()
-					if err != nil {
-						logger.WithError(err).Error("Could not accept connection")
-						return
-					}
-					go s.Handle(conn)
-				}
-			}()
 		}
 	}
 
-	mux := http.NewServeMux()
-	mux.Handle(viper.GetString("websocket.pattern"), wss)
-
-	if _, err := os.Stat("example/websocket_client.html"); err == nil {
-		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-			http.ServeFile(w, r, "example/websocket_client.html")
-		})
+	s.mu.Lock()
+	gracePeriod := s.config.Shutdown.GracePeriod
+	s.mu.Unlock()
+	logger.WithField("grace_period", gracePeriod).Info("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+	stats, err := s.Shutdown(shutdownCtx)
+	logger := logger.WithFields(log.F{
+		"sessions": stats.Sessions,
+		"drained":  stats.Drained,
+		"aborted":  stats.Aborted,
+	})
+	if err != nil {
+		logger.WithError(err).Warn("Shut down before all sessions were drained")
+	} else {
+		logger.Info("Shut down")
 	}
+}
 
-	if listen := viper.GetString("listen.http"); listen != "" {
-		logger.WithField("address", listen).Info("Starting HTTP+ws server")
-		lis, err := net.Listen("tcp", listen)
-		if err != nil {
-			logger.WithError(err).Fatal("Could not start HTTP+ws server")
-		}
-		defer lis.Close()
-
-		go func() {
-			err := http.Serve(lis, mux)
-			if err != nil {
-				logger.WithError(err).Error("Could not serve HTTP+ws")
-			}
-		}()
+// RunServer runs the MQTT server with the listeners of the flags until a signal is received
+//
+// Deprecated: use NewServer with FlagConfig and Run, which also apply the session and limit settings.
+func RunServer(s server.Server) {
+	server, err := newServer(Context(), FlagConfig(), s)
+	if err != nil {
+		logger.WithError(err).Fatal("Could not set up server")
 	}
+	Run(server)
+}
 
-	if listen := viper.GetString("listen.https"); listen != "" {
-		if tlsConfig != nil {
-			logger.WithField("address", listen).Info("Starting HTTPS+wss server")
-			tlsLis, err := tls.Listen("tcp", listen, tlsConfig)
-			if err != nil {
-				logger.WithError(err).Fatal("Could not start HTTPS+wss server")
-			}
-			defer tlsLis.Close()
+// TLSConfig returns a TLS configuration with the certificate, which is reloaded when the files change
+//
+// Deprecated: use TLSSettings in the Config of NewServer.
+func TLSConfig(certFile, keyFile string) *tls.Config {
+	certs, err := loadCertificates(logger, TLSSettings{Cert: certFile, Key: keyFile})
+	if err != nil {
+		logger.WithError(err).Fatal("Could not set up TLS")
+	}
+	return &tls.Config{GetCertificate: certs.GetCertificate}
+}
 
-			go func() {
-				err := http.Serve(tlsLis, mux)
-				if err != nil {
-					logger.WithError(err).Error("Could not serve HTTPS+wss")
-				}
-			}()
+func isSignal(sig os.Signal, signals []os.Signal) bool {
+	for _, signal := range signals {
+		if sig == signal {
+			return true
 		}
 	}
-
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
-	signal := (<-sigChan).String()
-	logger.WithField("signal", signal).Info("Signal received")
+	return false
 }
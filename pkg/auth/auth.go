@@ -5,6 +5,8 @@ package auth
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 
 	"github.com/TheThingsIndustries/mystique/pkg/topic"
@@ -32,19 +34,62 @@ type Info struct {
 	RemoteAddr string
 	Transport  string
 	ServerName string
+	TLS        *TLSInfo
 	ClientID   string
 	Username   string
 	Password   []byte
 	Metadata   interface{}
 }
 
+// TLSInfo of the connection of an MQTT user
+type TLSInfo struct {
+	Proxy          bool   // TLS was terminated by a proxy
+	Version        string // TLS version, such as "TLSv1.2"
+	CipherSuite    string
+	PeerCommonName string // common name of the certificate of the client
+	PeerVerified   bool   // the certificate of the client was verified
+
+	// PeerCertificates is the certificate chain of the client, starting with the leaf certificate.
+	// If PeerVerified is true, this is the chain that was verified.
+	PeerCertificates []*x509.Certificate
+}
+
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "TLSv1.0",
+	tls.VersionTLS11: "TLSv1.1",
+	tls.VersionTLS12: "TLSv1.2",
+	tls.VersionTLS13: "TLSv1.3",
+}
+
+// NewTLSInfo returns the TLSInfo of a TLS connection that was terminated by the server
+func NewTLSInfo(state tls.ConnectionState) *TLSInfo {
+	info := &TLSInfo{
+		Version:          tlsVersions[state.Version],
+		CipherSuite:      tls.CipherSuiteName(state.CipherSuite),
+		PeerCertificates: state.PeerCertificates,
+	}
+	if len(state.VerifiedChains) > 0 {
+		info.PeerCertificates = state.VerifiedChains[0]
+		info.PeerVerified = true
+	}
+	if len(info.PeerCertificates) > 0 {
+		info.PeerCommonName = info.PeerCertificates[0].Subject.CommonName
+	}
+	return info
+}
+
 // Subscribe to the requested topic and QoS, which can be adapted by the auth plugin
 func (i *Info) Subscribe(requestedTopic string, requestedQoS byte) (acceptedTopic string, acceptedQoS byte, err error) {
 	if i == nil {
 		return requestedTopic, requestedQoS, errors.New("no auth info present")
 	}
 	if iface := i.Interface; iface != nil {
-		return i.Interface.Subscribe(i, requestedTopic, requestedQoS)
+		if group, filter, ok := topic.SplitShare(requestedTopic); ok {
+			// the interface authorizes the filter of the shared subscription
+			acceptedTopic, acceptedQoS, err = iface.Subscribe(i, filter, requestedQoS)
+			return topic.JoinShare(group, acceptedTopic), acceptedQoS, err
+		}
+		return iface.Subscribe(i, requestedTopic, requestedQoS)
 	}
 	return requestedTopic, requestedQoS, nil
 }
@@ -65,3 +65,24 @@ func TestAuth(t *testing.T) {
 	a.So(i.CanRead("topic"), should.BeTrue)
 	a.So(i.CanWrite("topic"), should.BeTrue)
 }
+
+func TestReadOnly(t *testing.T) {
+	a := assertions.New(t)
+	ctx := context.Background()
+
+	anonymous := ReadOnly(nil)
+	info := &Info{}
+	_, err := anonymous.Connect(ctx, info)
+	a.So(err, should.BeNil)
+	a.So(info.CanRead("foo"), should.BeTrue)
+	a.So(info.CanWrite("foo"), should.BeFalse)
+
+	_, err = ReadOnly(alwaysAuth{ok: false}).Connect(ctx, &Info{})
+	a.So(err, should.NotBeNil)
+
+	info = &Info{}
+	_, err = ReadOnly(alwaysAuth{ok: true}).Connect(ctx, info)
+	a.So(err, should.BeNil)
+	a.So(info.CanRead("foo"), should.BeTrue)
+	a.So(info.CanWrite("foo"), should.BeFalse)
+}
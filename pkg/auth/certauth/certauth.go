@@ -0,0 +1,238 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+// Package certauth implements MQTT authentication with TLS client certificates
+package certauth
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/TheThingsIndustries/mystique/pkg/auth"
+	"github.com/TheThingsIndustries/mystique/pkg/packet"
+	"github.com/TheThingsIndustries/mystique/pkg/topic"
+)
+
+// Identities of certificates that can be used as username
+const (
+	CommonName   = "cn"    // common name of the subject
+	DNSName      = "dns"   // first DNS name of the subject alternative names
+	EmailAddress = "email" // first email address of the subject alternative names
+	URI          = "uri"   // first URI of the subject alternative names
+)
+
+// Username is the placeholder in the topics of Access that is replaced by the username
+const Username = "{username}"
+
+// New returns a new auth interface that authenticates clients with verified TLS client certificates.
+// The username of a client is the identity of its certificate.
+func New(identity string) (*CertAuth, error) {
+	switch identity {
+	case CommonName, DNSName, EmailAddress, URI:
+	default:
+		return nil, fmt.Errorf("Invalid certificate identity %q", identity)
+	}
+	return &CertAuth{
+		identity: identity,
+		users:    make(map[string]Access),
+	}, nil
+}
+
+// CertAuth implements authentication with TLS client certificates
+type CertAuth struct {
+	identity string
+
+	// the users, default access and fallback can be changed while clients connect
+	mu            sync.RWMutex
+	users         map[string]Access
+	defaultAccess *Access
+	fallback      auth.Interface
+}
+
+// AddUser adds the access of the certificate with the identity
+func (a *CertAuth) AddUser(username string, access Access) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.users[username] = access
+}
+
+// SetUsers replaces the users with the access of the certificates by identity
+// The access of clients that are connected does not change.
+func (a *CertAuth) SetUsers(users map[string]Access) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.users = make(map[string]Access, len(users))
+	for username, access := range users {
+		a.users[username] = access
+	}
+}
+
+// SetDefaultAccess sets the access of certificates that were not added as user.
+// By default, these certificates are not authorized.
+func (a *CertAuth) SetDefaultAccess(access Access) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.defaultAccess = &access
+}
+
+// SetFallback sets the auth interface for clients without a verified certificate.
+// By default, these clients are not authorized.
+func (a *CertAuth) SetFallback(fallback auth.Interface) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.fallback = fallback
+}
+
+// Access information
+// The Username placeholder in the topics is replaced by the username of the client.
+type Access struct {
+	Root  bool
+	Read  [][]string
+	Write [][]string
+}
+
+// forUser returns the access with the Username placeholders replaced
+func (a Access) forUser(username string) *Access {
+	replace := func(topics [][]string) [][]string {
+		replaced := make([][]string, len(topics))
+		for i, parts := range topics {
+			replaced[i] = make([]string, len(parts))
+			for j, part := range parts {
+				replaced[i][j] = strings.Replace(part, Username, username, -1)
+			}
+		}
+		return replaced
+	}
+	return &Access{Root: a.Root, Read: replace(a.Read), Write: replace(a.Write)}
+}
+
+// Identity returns the identity of the verified client certificate of the connection, or an empty string
+func (a *CertAuth) Identity(info *auth.Info) string {
+	if info.TLS == nil || !info.TLS.PeerVerified {
+		return ""
+	}
+	if len(info.TLS.PeerCertificates) == 0 {
+		// proxies only forward the common name
+		if a.identity == CommonName {
+			return info.TLS.PeerCommonName
+		}
+		return ""
+	}
+	return identity(info.TLS.PeerCertificates[0], a.identity)
+}
+
+func identity(cert *x509.Certificate, identity string) string {
+	switch identity {
+	case CommonName:
+		return cert.Subject.CommonName
+	case DNSName:
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+	case EmailAddress:
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+	case URI:
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String()
+		}
+	}
+	return ""
+}
+
+// validUsername returns true iff the username can be used in topics
+func validUsername(username string) bool {
+	return username != "" &&
+		!strings.HasPrefix(username, topic.InternalPrefix) &&
+		!strings.ContainsAny(username, topic.Separator+topic.Wildcard+topic.PartWildcard)
+}
+
+// Connect or return error code
+// Clients with a verified certificate may leave the username empty, or set it to the identity of the certificate.
+func (a *CertAuth) Connect(ctx context.Context, info *auth.Info) (context.Context, error) {
+	username := a.Identity(info)
+	if username == "" {
+		a.mu.RLock()
+		fallback := a.fallback
+		a.mu.RUnlock()
+		if fallback != nil {
+			return fallback.Connect(ctx, info)
+		}
+		return nil, packet.ConnectNotAuthorized
+	}
+	if !validUsername(username) {
+		return nil, packet.ConnectNotAuthorized
+	}
+	if info.Username != "" && info.Username != username {
+		return nil, packet.ConnectMalformedUsernameOrPassword
+	}
+	a.mu.RLock()
+	access, ok := a.users[username]
+	defaultAccess := a.defaultAccess
+	a.mu.RUnlock()
+	if !ok {
+		if defaultAccess == nil {
+			return nil, packet.ConnectNotAuthorized
+		}
+		access = *defaultAccess
+	}
+	info.Username = username
+	info.Metadata = access.forUser(username)
+	info.Interface = a
+	return ctx, nil
+}
+
+// Subscribe accepts all subscriptions; messages are delivered to the client if it can read the topic
+func (a *CertAuth) Subscribe(info *auth.Info, requestedTopic string, requestedQoS byte) (acceptedTopic string, acceptedQoS byte, err error) {
+	return requestedTopic, requestedQoS, nil
+}
+
+// CanRead returns true iff the session can read from the topic
+func (a *CertAuth) CanRead(info *auth.Info, t ...string) bool {
+	switch len(t) {
+	case 0:
+		return false
+	case 1:
+		t = topic.Split(t[0])
+	}
+	access, ok := info.Metadata.(*Access)
+	if !ok {
+		return false
+	}
+	if access.Root {
+		return true
+	}
+	for _, allowed := range access.Read {
+		if topic.MatchPath(t, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// CanWrite returns true iff the session can write to the topic
+func (a *CertAuth) CanWrite(info *auth.Info, t ...string) bool {
+	switch len(t) {
+	case 0:
+		return false
+	case 1:
+		t = topic.Split(t[0])
+	}
+	access, ok := info.Metadata.(*Access)
+	if !ok {
+		return false
+	}
+	if access.Root {
+		// Only the server can write to internal topics
+		return !strings.HasPrefix(t[0], topic.InternalPrefix)
+	}
+	for _, allowed := range access.Write {
+		if topic.MatchPath(t, allowed) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,156 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+package certauth
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/url"
+	"testing"
+
+	"github.com/TheThingsIndustries/mystique/pkg/auth"
+	"github.com/TheThingsIndustries/mystique/pkg/packet"
+	"github.com/smartystreets/assertions"
+	"github.com/smartystreets/assertions/should"
+)
+
+type passwordAuth struct{}
+
+func (passwordAuth) Connect(ctx context.Context, info *auth.Info) (context.Context, error) {
+	if string(info.Password) != "pass" {
+		return nil, packet.ConnectNotAuthorized
+	}
+	info.Interface = passwordAuth{}
+	return ctx, nil
+}
+
+func (passwordAuth) Subscribe(info *auth.Info, topic string, qos byte) (string, byte, error) {
+	return topic, qos, nil
+}
+
+func (passwordAuth) CanRead(info *auth.Info, topic ...string) bool  { return true }
+func (passwordAuth) CanWrite(info *auth.Info, topic ...string) bool { return true }
+
+func certInfo(cert *x509.Certificate, verified bool) *auth.Info {
+	return &auth.Info{TLS: &auth.TLSInfo{
+		PeerCertificates: []*x509.Certificate{cert},
+		PeerCommonName:   cert.Subject.CommonName,
+		PeerVerified:     verified,
+	}}
+}
+
+func TestCertAuth(t *testing.T) {
+	a := assertions.New(t)
+	ctx := context.Background()
+
+	_, err := New("serial")
+	a.So(err, should.NotBeNil)
+
+	s, err := New(CommonName)
+	a.So(err, should.BeNil)
+	s.AddUser("router", Access{Root: true})
+
+	gateway := &x509.Certificate{Subject: pkix.Name{CommonName: "gateway"}}
+
+	// without default access, only users are authorized
+	_, err = s.Connect(ctx, certInfo(gateway, true))
+	a.So(err, should.Equal, packet.ConnectNotAuthorized)
+
+	s.SetDefaultAccess(Access{
+		Read:  [][]string{{Username, "down"}},
+		Write: [][]string{{Username, "up"}},
+	})
+
+	// unverified certificates and connections without certificates are not authorized
+	_, err = s.Connect(ctx, certInfo(gateway, false))
+	a.So(err, should.Equal, packet.ConnectNotAuthorized)
+	_, err = s.Connect(ctx, &auth.Info{Password: []byte("pass")})
+	a.So(err, should.Equal, packet.ConnectNotAuthorized)
+
+	info := certInfo(gateway, true)
+	_, err = s.Connect(ctx, info)
+	a.So(err, should.BeNil)
+	a.So(info.Username, should.Equal, "gateway")
+	a.So(info.CanRead("gateway/down"), should.BeTrue)
+	a.So(info.CanRead("other/down"), should.BeFalse)
+	a.So(info.CanWrite("gateway/up"), should.BeTrue)
+	a.So(info.CanWrite("gateway/down"), should.BeFalse)
+	topic, _, err := info.Subscribe("#", 1)
+	a.So(err, should.BeNil)
+	a.So(topic, should.Equal, "#")
+
+	// the username must match the certificate
+	info = certInfo(gateway, true)
+	info.Username = "gateway"
+	_, err = s.Connect(ctx, info)
+	a.So(err, should.BeNil)
+	info = certInfo(gateway, true)
+	info.Username = "other"
+	_, err = s.Connect(ctx, info)
+	a.So(err, should.NotBeNil)
+
+	// identities that can not be used in topics are not authorized
+	for _, cn := range []string{"foo/bar", "+", "#", "$sys", ""} {
+		_, err = s.Connect(ctx, certInfo(&x509.Certificate{Subject: pkix.Name{CommonName: cn}}, true))
+		a.So(err, should.NotBeNil)
+	}
+
+	info = certInfo(&x509.Certificate{Subject: pkix.Name{CommonName: "router"}}, true)
+	_, err = s.Connect(ctx, info)
+	a.So(err, should.BeNil)
+	a.So(info.CanRead("gateway/up"), should.BeTrue)
+	a.So(info.CanWrite("gateway/down"), should.BeTrue)
+	a.So(info.CanWrite("$SYS/foo"), should.BeFalse)
+
+	// the users can be replaced
+	s.SetUsers(map[string]Access{"gateway": {Root: true}})
+	info = certInfo(&x509.Certificate{Subject: pkix.Name{CommonName: "router"}}, true)
+	_, err = s.Connect(ctx, info)
+	a.So(err, should.BeNil)
+	a.So(info.CanWrite("gateway/down"), should.BeFalse)
+	info = certInfo(gateway, true)
+	_, err = s.Connect(ctx, info)
+	a.So(err, should.BeNil)
+	a.So(info.CanWrite("gateway/down"), should.BeTrue)
+
+	// proxies only forward the common name
+	info = &auth.Info{TLS: &auth.TLSInfo{Proxy: true, PeerCommonName: "gateway", PeerVerified: true}}
+	_, err = s.Connect(ctx, info)
+	a.So(err, should.BeNil)
+	a.So(info.Username, should.Equal, "gateway")
+
+	// clients without certificates use the fallback
+	s.SetFallback(passwordAuth{})
+	info = &auth.Info{Username: "user", Password: []byte("pass")}
+	_, err = s.Connect(ctx, info)
+	a.So(err, should.BeNil)
+	a.So(info.Interface, should.Resemble, passwordAuth{})
+	_, err = s.Connect(ctx, &auth.Info{Username: "user", Password: []byte("wrong")})
+	a.So(err, should.NotBeNil)
+}
+
+func TestIdentity(t *testing.T) {
+	a := assertions.New(t)
+
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "cn"},
+		DNSNames:       []string{"gateway.example.com", "other.example.com"},
+		EmailAddresses: []string{"gateway@example.com"},
+		URIs:           []*url.URL{{Scheme: "urn", Opaque: "gateway"}},
+	}
+	for identity, expected := range map[string]string{
+		CommonName:   "cn",
+		DNSName:      "gateway.example.com",
+		EmailAddress: "gateway@example.com",
+		URI:          "urn:gateway",
+	} {
+		s, _ := New(identity)
+		a.So(s.Identity(certInfo(cert, true)), should.Equal, expected)
+		a.So(s.Identity(certInfo(&x509.Certificate{}, true)), should.BeEmpty)
+		a.So(s.Identity(certInfo(cert, false)), should.BeEmpty)
+	}
+
+	s, _ := New(DNSName)
+	a.So(s.Identity(&auth.Info{TLS: &auth.TLSInfo{Proxy: true, PeerCommonName: "cn", PeerVerified: true}}), should.BeEmpty)
+}
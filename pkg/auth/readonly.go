@@ -0,0 +1,44 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+package auth
+
+import "context"
+
+// ReadOnly returns an auth interface that does not allow clients to write.
+// The clients are authenticated and authorized to read by the interface; if the interface is nil, all clients can connect and read.
+func ReadOnly(iface Interface) Interface {
+	return readOnly{iface}
+}
+
+type readOnly struct {
+	Interface
+}
+
+func (r readOnly) Connect(ctx context.Context, info *Info) (context.Context, error) {
+	if r.Interface != nil {
+		var err error
+		if ctx, err = r.Interface.Connect(ctx, info); err != nil {
+			return nil, err
+		}
+	}
+	info.Interface = readOnly{info.Interface}
+	return ctx, nil
+}
+
+func (r readOnly) Subscribe(info *Info, requestedTopic string, requestedQoS byte) (acceptedTopic string, acceptedQoS byte, err error) {
+	if r.Interface != nil {
+		return r.Interface.Subscribe(info, requestedTopic, requestedQoS)
+	}
+	return requestedTopic, requestedQoS, nil
+}
+
+func (r readOnly) CanRead(info *Info, topic ...string) bool {
+	if r.Interface != nil {
+		return r.Interface.CanRead(info, topic...)
+	}
+	return true
+}
+
+func (r readOnly) CanWrite(info *Info, topic ...string) bool {
+	return false
+}
@@ -14,6 +14,7 @@ import (
 	"net/http"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/TheThingsIndustries/mystique/pkg/auth"
@@ -44,14 +45,17 @@ func New(servers map[string]string) *TTNAuth {
 // TTNAuth implements authentication for TTN
 type TTNAuth struct {
 	logger       log.Interface
-	penalty      time.Duration
-	rateLimit    rate.Limit
 	gateways     bool
 	applications bool
 	client       *http.Client
 	cache        *cache
 	servers      map[string]string
-	superUsers   map[string]superUser
+
+	// the super-users, penalty and rate limit can be changed while clients connect
+	mu         sync.RWMutex
+	penalty    time.Duration
+	rateLimit  rate.Limit
+	superUsers map[string]superUser
 }
 
 // SetLogger sets the logger interface.
@@ -66,21 +70,35 @@ func (a *TTNAuth) SetCacheExpire(expires time.Duration) {
 	a.cache.expires = expires
 }
 
-// AddSuperUser adds a super-user to the auth plugin
+// AddSuperUser adds a super-user to the auth plugin, or replaces the super-user with the same username
 func (a *TTNAuth) AddSuperUser(username string, password []byte, access Access) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
 	a.superUsers[username] = superUser{
 		password: password,
 		Access:   access,
 	}
 }
 
+// RemoveSuperUser removes a super-user from the auth plugin
+// Clients that are connected as the super-user stay connected.
+func (a *TTNAuth) RemoveSuperUser(username string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.superUsers, username)
+}
+
 // SetPenalty sets the time penalty for a failed login
 func (a *TTNAuth) SetPenalty(d time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
 	a.penalty = d
 }
 
 // SetRateLimit sets the rate limit for non-super-users.
 func (a *TTNAuth) SetRateLimit(l rate.Limit) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
 	a.rateLimit = l
 }
 
@@ -199,11 +217,16 @@ func (a *TTNAuth) FetchAccess(username string, password []byte) (*Access, error)
 
 // Connect or return error code
 func (a *TTNAuth) Connect(ctx context.Context, info *auth.Info) (context.Context, error) {
+	a.mu.RLock()
+	penalty, rateLimit := a.penalty, a.rateLimit
+	superUser, isSuperUser := a.superUsers[info.Username]
+	a.mu.RUnlock()
+
 	var err error
-	if a.penalty > 0 {
+	if penalty > 0 {
 		defer func() {
 			if err != nil {
-				time.Sleep(a.penalty)
+				time.Sleep(penalty)
 			}
 		}()
 	}
@@ -212,7 +235,7 @@ func (a *TTNAuth) Connect(ctx context.Context, info *auth.Info) (context.Context
 	info.Metadata = &access
 	info.Interface = a
 
-	if superUser, ok := a.superUsers[info.Username]; ok {
+	if isSuperUser {
 		if subtle.ConstantTimeCompare(info.Password, superUser.password) != 1 {
 			return nil, packet.ConnectNotAuthorized
 		}
@@ -230,7 +253,7 @@ func (a *TTNAuth) Connect(ctx context.Context, info *auth.Info) (context.Context
 		return nil, packet.ConnectNotAuthorized
 	}
 
-	ctx = ratelimit.New(ctx, a.rateLimit)
+	ctx = ratelimit.New(ctx, rateLimit)
 
 	return ctx, nil
 }
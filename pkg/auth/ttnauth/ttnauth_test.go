@@ -77,6 +77,13 @@ func TestTTNAuth(t *testing.T) {
 	a.So(root.CanRead("$SYS/#"), should.BeTrue)
 	a.So(root.CanWrite("$SYS/#"), should.BeFalse)
 
+	s.RemoveSuperUser("root")
+	_, err = s.Connect(context.Background(), &auth.Info{
+		Username: "root",
+		Password: []byte("rootpass"),
+	})
+	a.So(err, should.NotBeNil)
+
 	incorrect := &auth.Info{
 		Username: "test",
 		Password: []byte("test.incorrect"),
@@ -0,0 +1,279 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+// Package bench generates MQTT load and measures the end-to-end latency of messages.
+//
+// The clients follow the topic layout of TTN: publishers act like devices of which gateways forward uplink messages,
+// and subscribers act like applications that receive the uplink messages of their devices.
+package bench
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/TheThingsIndustries/mystique/pkg/client"
+	"github.com/TheThingsIndustries/mystique/pkg/log"
+	mqttnet "github.com/TheThingsIndustries/mystique/pkg/net"
+	"github.com/TheThingsIndustries/mystique/pkg/packet"
+	"github.com/TheThingsIndustries/mystique/pkg/server"
+)
+
+// Config of a benchmark
+type Config struct {
+	Prefix       string        // prefix of client identifiers and application identifiers
+	Applications int           // number of applications
+	Publishers   int           // number of publishers, divided over the applications
+	Subscribers  int           // number of subscribers, divided over the applications
+	Rate         float64       // messages per second per publisher
+	Size         int           // size of the messages (at least 8 bytes for the timestamp)
+	QoS          byte          // QoS of messages and subscriptions
+	Duration     time.Duration // time to publish
+	Drain        time.Duration // maximum time to wait for messages after publishing
+}
+
+// DefaultConfig is the default configuration of a benchmark
+var DefaultConfig = Config{
+	Prefix:       "bench",
+	Applications: 1,
+	Publishers:   10,
+	Subscribers:  1,
+	Rate:         1,
+	Size:         64,
+	Duration:     10 * time.Second,
+	Drain:        5 * time.Second,
+}
+
+const timestampSize = 8
+
+// Latency percentiles of the messages
+type Latency struct {
+	P50, P90, P99, Max time.Duration
+}
+
+// Result of a benchmark
+type Result struct {
+	Duration  time.Duration // time that was spent publishing
+	Published uint64        // messages that were published
+	Errors    uint64        // messages that could not be published
+	Expected  uint64        // messages that should have been received by the subscribers
+	Received  uint64        // messages that were received by the subscribers
+	Dropped   uint64        // expected messages that were not received
+	Latency   Latency
+}
+
+// PublishThroughput returns the published messages per second
+func (r Result) PublishThroughput() float64 {
+	return float64(r.Published) / r.Duration.Seconds()
+}
+
+// ReceiveThroughput returns the received messages per second
+func (r Result) ReceiveThroughput() float64 {
+	return float64(r.Received) / r.Duration.Seconds()
+}
+
+// Local serves the server on a local TCP port until the context is done, and returns a Dialer that connects to it
+// Unlike pipes, TCP connections are buffered, so that the load on the server is similar to that of a deployment.
+func Local(ctx context.Context, s server.Server) (client.Dialer, error) {
+	lis, err := mqttnet.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		<-ctx.Done()
+		lis.Close()
+	}()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go s.Handle(conn)
+		}
+	}()
+	return client.TCP(lis.Addr().String()), nil
+}
+
+type benchmark struct {
+	config    Config
+	published []uint64 // per application
+	errors    uint64
+	received  uint64
+
+	subscribers []uint64 // per application
+
+	latencies   []time.Duration
+	latenciesMu sync.Mutex
+}
+
+func (b *benchmark) application(i int) string {
+	return fmt.Sprintf("%s-app-%d", b.config.Prefix, i%b.config.Applications)
+}
+
+func (b *benchmark) handle(pkt *packet.PublishPacket) {
+	if len(pkt.Message) < timestampSize {
+		return
+	}
+	sent := time.Unix(0, int64(binary.BigEndian.Uint64(pkt.Message)))
+	latency := time.Since(sent)
+	atomic.AddUint64(&b.received, 1)
+	b.latenciesMu.Lock()
+	b.latencies = append(b.latencies, latency)
+	b.latenciesMu.Unlock()
+}
+
+func (b *benchmark) expected() (expected uint64) {
+	for i := range b.published {
+		expected += atomic.LoadUint64(&b.published[i]) * b.subscribers[i]
+	}
+	return
+}
+
+// publish messages at the rate of the config until stop is done
+func (b *benchmark) publish(ctx, stop context.Context, c client.Client, i int) {
+	app := i % b.config.Applications
+	topic := fmt.Sprintf("%s/devices/%s-device-%d/up", b.application(i), b.config.Prefix, i)
+	interval := time.Duration(float64(time.Second) / b.config.Rate)
+	// spread the publishers over the interval
+	select {
+	case <-stop.Done():
+		return
+	case <-time.After(interval * time.Duration(i) / time.Duration(b.config.Publishers)):
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		message := make([]byte, b.config.Size)
+		binary.BigEndian.PutUint64(message, uint64(time.Now().UnixNano()))
+		err := c.Publish(ctx, &packet.PublishPacket{TopicName: topic, QoS: b.config.QoS, Message: message})
+		if err == nil {
+			atomic.AddUint64(&b.published[app], 1)
+		} else if ctx.Err() == nil {
+			atomic.AddUint64(&b.errors, 1)
+		}
+		select {
+		case <-stop.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Run the benchmark against the server of the dialer
+// The options are applied to all clients.
+func Run(ctx context.Context, dial client.Dialer, config Config, option ...client.Option) (*Result, error) {
+	if config.Applications < 1 || config.Publishers < 1 || config.Rate <= 0 {
+		return nil, errors.New("The benchmark needs at least one application, one publisher and a rate")
+	}
+	if config.Size < timestampSize {
+		config.Size = timestampSize
+	}
+	logger := log.FromContext(ctx)
+	b := &benchmark{
+		config:      config,
+		published:   make([]uint64, config.Applications),
+		subscribers: make([]uint64, config.Applications),
+	}
+
+	var clients []client.Client
+	defer func() {
+		for _, c := range clients {
+			c.Disconnect()
+		}
+	}()
+	connect := func(clientID string) (client.Client, error) {
+		c, err := client.Connect(ctx, dial, append(option, client.WithClientID(clientID))...)
+		if err != nil {
+			return nil, fmt.Errorf("Could not connect %s: %s", clientID, err)
+		}
+		clients = append(clients, c)
+		return c, nil
+	}
+
+	for i := 0; i < config.Subscribers; i++ {
+		c, err := connect(fmt.Sprintf("%s-sub-%d", config.Prefix, i))
+		if err != nil {
+			return nil, err
+		}
+		if _, err = c.Subscribe(ctx, b.application(i)+"/devices/+/up", config.QoS, b.handle); err != nil {
+			return nil, fmt.Errorf("Could not subscribe: %s", err)
+		}
+		b.subscribers[i%config.Applications]++
+	}
+	logger.WithField("count", config.Subscribers).Debug("Connected subscribers")
+
+	publishers := make([]client.Client, config.Publishers)
+	for i := range publishers {
+		c, err := connect(fmt.Sprintf("%s-pub-%d", config.Prefix, i))
+		if err != nil {
+			return nil, err
+		}
+		publishers[i] = c
+	}
+	logger.WithField("count", config.Publishers).Debug("Connected publishers")
+
+	start := time.Now()
+	stop, cancel := context.WithTimeout(ctx, config.Duration)
+	var wg sync.WaitGroup
+	for i, c := range publishers {
+		wg.Add(1)
+		go func(i int, c client.Client) {
+			defer wg.Done()
+			b.publish(ctx, stop, c, i)
+		}(i, c)
+	}
+	wg.Wait()
+	cancel()
+	duration := time.Since(start)
+
+	expected := b.expected()
+	drain := time.NewTimer(config.Drain)
+	defer drain.Stop()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for atomic.LoadUint64(&b.received) < expected {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-drain.C:
+			expected = 0 // stop waiting
+		case <-ticker.C:
+		}
+	}
+
+	result := &Result{
+		Duration: duration,
+		Errors:   atomic.LoadUint64(&b.errors),
+		Expected: b.expected(),
+		Received: atomic.LoadUint64(&b.received),
+	}
+	for i := range b.published {
+		result.Published += atomic.LoadUint64(&b.published[i])
+	}
+	if result.Received < result.Expected {
+		result.Dropped = result.Expected - result.Received
+	}
+
+	b.latenciesMu.Lock()
+	latencies := b.latencies
+	b.latenciesMu.Unlock()
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		percentile := func(p float64) time.Duration {
+			return latencies[int(p*float64(len(latencies)-1))]
+		}
+		result.Latency = Latency{
+			P50: percentile(0.5),
+			P90: percentile(0.9),
+			P99: percentile(0.99),
+			Max: latencies[len(latencies)-1],
+		}
+	}
+
+	return result, nil
+}
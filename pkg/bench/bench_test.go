@@ -0,0 +1,54 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+package bench
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/TheThingsIndustries/mystique/pkg/client"
+	"github.com/TheThingsIndustries/mystique/pkg/server"
+	"github.com/smartystreets/assertions"
+	"github.com/smartystreets/assertions/should"
+)
+
+func TestRun(t *testing.T) {
+	a := assertions.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, qos := range []byte{0, 1, 2} {
+		dial, err := Local(ctx, server.New(ctx))
+		if !a.So(err, should.BeNil) {
+			continue
+		}
+		result, err := Run(ctx, dial, Config{
+			Prefix:       "test",
+			Applications: 2,
+			Publishers:   4,
+			Subscribers:  3,
+			Rate:         50,
+			Size:         32,
+			QoS:          qos,
+			Duration:     200 * time.Millisecond,
+			Drain:        time.Second,
+		})
+		if !a.So(err, should.BeNil) {
+			continue
+		}
+		a.So(result.Published, should.BeGreaterThan, 0)
+		a.So(result.Errors, should.Equal, 0)
+		// two subscribers of the first application, one of the second
+		a.So(result.Expected, should.BeBetweenOrEqual, result.Published, 2*result.Published)
+		a.So(result.Received, should.Equal, result.Expected)
+		a.So(result.Dropped, should.Equal, 0)
+		a.So(result.Latency.P50, should.BeGreaterThan, 0)
+		a.So(result.Latency.P50, should.BeLessThanOrEqualTo, result.Latency.P99)
+		a.So(result.Latency.P99, should.BeLessThanOrEqualTo, result.Latency.Max)
+	}
+
+	_, err := Run(ctx, client.TCP("127.0.0.1:0"), Config{})
+	a.So(err, should.NotBeNil)
+}
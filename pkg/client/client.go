@@ -0,0 +1,682 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+// Package client implements an MQTT client on top of the packet and net packages.
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/TheThingsIndustries/mystique/pkg/log"
+	mqttnet "github.com/TheThingsIndustries/mystique/pkg/net"
+	"github.com/TheThingsIndustries/mystique/pkg/packet"
+	"github.com/TheThingsIndustries/mystique/pkg/pending"
+	"github.com/TheThingsIndustries/mystique/pkg/topic"
+)
+
+// DefaultKeepAlive is the default interval of keepalive pings
+var DefaultKeepAlive = time.Minute
+
+// ConnectTimeout sets the maximum time to wait for the Connack when reconnecting
+var ConnectTimeout = 10 * time.Second
+
+// ReconnectMinBackoff and ReconnectMaxBackoff set the time to wait between attempts to reconnect
+// the time doubles after each failed attempt, from the minimum up to the maximum
+var (
+	ReconnectMinBackoff = 100 * time.Millisecond
+	ReconnectMaxBackoff = 30 * time.Second
+)
+
+// ErrClosed is returned when a client is used after Disconnect
+var ErrClosed = errors.New("Client is closed")
+
+// ErrConnectionLost is returned when the connection is lost while waiting for a response
+var ErrConnectionLost = errors.New("Connection lost")
+
+// Handler handles the messages for a subscription
+// The handlers are called from the goroutine that reads from the connection,
+// so a handler must not wait for responses of the server, such as the acknowledgements of Subscribe and Publish.
+type Handler func(pkt *packet.PublishPacket)
+
+// Option for the client
+type Option func(c *client)
+
+// WithClientID returns an option that sets the client identifier
+// the server assigns a client identifier if it is empty
+func WithClientID(clientID string) Option {
+	return func(c *client) { c.connect.ClientID = clientID }
+}
+
+// WithCredentials returns an option that sets the username and password
+func WithCredentials(username string, password []byte) Option {
+	return func(c *client) {
+		c.connect.Username = username
+		c.connect.Password = password
+	}
+}
+
+// WithProtocolVersion returns an option that sets the protocol version (packet.Version311 or packet.Version5)
+func WithProtocolVersion(version byte) Option {
+	return func(c *client) { c.connect.ProtocolLevel = version }
+}
+
+// WithKeepAlive returns an option that sets the interval of keepalive pings (0 disables pings)
+func WithKeepAlive(d time.Duration) Option {
+	return func(c *client) { c.keepAlive = d }
+}
+
+// WithWill returns an option that sets the will, which the server publishes when the connection is lost
+func WithWill(will *packet.PublishPacket) Option {
+	return func(c *client) {
+		c.connect.Will = true
+		c.connect.WillTopic = will.TopicName
+		c.connect.WillMessage = will.Message
+		c.connect.WillQoS = will.QoS
+		c.connect.WillRetain = will.Retain
+		c.connect.WillProperties = will.Properties
+	}
+}
+
+// WithoutReconnect returns an option that disables reconnecting when the connection is lost
+func WithoutReconnect() Option {
+	return func(c *client) { c.reconnect = false }
+}
+
+// Client is an MQTT client
+// The client reconnects when the connection is lost, subscribes to its subscriptions again,
+// and retransmits the Publish messages that were not acknowledged.
+type Client interface {
+	// Subscribe to the topic filter, and call the handler for the messages on topics that match the filter
+	// returns the QoS that was granted by the server
+	// returns the reason code if the server rejected the subscription
+	Subscribe(ctx context.Context, filter string, qos byte, handler Handler) (byte, error)
+
+	// Unsubscribe from the topic filter
+	Unsubscribe(ctx context.Context, filter string) error
+
+	// Publish a message
+	// if QoS 0: returns when the message is sent
+	// if QoS 1: returns when the message is acknowledged with a Puback
+	// if QoS 2: returns when the message is acknowledged with a Pubcomp
+	// returns the reason code if the server acknowledged the message with an error
+	// if the context is done before the message is acknowledged, the message is still retransmitted until it is acknowledged
+	Publish(ctx context.Context, pkt *packet.PublishPacket) error
+
+	// Ping the server and return the round-trip time
+	Ping(ctx context.Context) (time.Duration, error)
+
+	// Disconnect from the server
+	// the will is not published
+	Disconnect() error
+}
+
+// Connect to the server with the dialer
+// The context is used for the first connection; the client keeps the logger of the context.
+// returns the reason code if the server rejects the connection
+func Connect(ctx context.Context, dial Dialer, option ...Option) (Client, error) {
+	c := &client{
+		ctx:  log.NewContext(context.Background(), log.FromContext(ctx)),
+		dial: dial,
+		connect: packet.ConnectPacket{
+			ProtocolName:  "MQTT",
+			ProtocolLevel: packet.Version311,
+			CleanStart:    true,
+		},
+		keepAlive:     DefaultKeepAlive,
+		reconnect:     true,
+		subscriptions: make(map[string]subscription),
+		waiting:       make(map[uint16]chan packet.ControlPacket),
+		pendingIn:     make(map[uint16]struct{}),
+		closing:       make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	for _, opt := range option {
+		opt(c)
+	}
+	c.connect.KeepAlive = uint16(c.keepAlive / time.Second)
+	conn, err := c.dialConnect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.conn = conn
+	go c.run(conn)
+	return c, nil
+}
+
+type subscription struct {
+	qos     byte
+	handler Handler
+}
+
+type client struct {
+	ctx       context.Context
+	dial      Dialer
+	connect   packet.ConnectPacket
+	keepAlive time.Duration
+	reconnect bool
+
+	// conn is nil while the client is reconnecting
+	conn   mqttnet.Conn
+	sendMu sync.Mutex
+
+	// subscriptions are subscribed to again when the client reconnects
+	subscriptions map[string]subscription
+
+	// pendingOut contains
+	// - Publish packets that have not been acknowledged with a Puback or Pubrec
+	// - Pubrel packets that have not been acknowledged with a Pubcomp
+	// - Subscribe and Unsubscribe packets that have not been acknowledged
+	pendingOut pending.List
+
+	// waiting contains the channels that receive the acknowledgements of pendingOut
+	waiting map[uint16]chan packet.ControlPacket
+
+	// pings contains the channels that receive the Pingresps
+	pings []chan bool
+
+	mu sync.Mutex
+
+	// pendingIn contains the packet identifiers of QoS 2 messages that have not been released with a Pubrel
+	// it is only used by the goroutine that reads from the connection, and reset when a connection without session is made
+	pendingIn map[uint16]struct{}
+
+	closeOnce sync.Once
+	closing   chan struct{}
+	done      chan struct{}
+	err       error
+}
+
+// dialConnect dials a connection and sends the Connect packet
+func (c *client) dialConnect(ctx context.Context) (mqttnet.Conn, error) {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	conn.SetProtocolVersion(c.connect.ProtocolLevel)
+	connect := c.connect
+	if err = conn.Send(&connect); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	pkt, err := conn.Receive()
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	connack, ok := pkt.(*packet.ConnackPacket)
+	if !ok {
+		conn.Close()
+		return nil, errors.New("First packet was not a CONNACK")
+	}
+	if connack.ReasonCode.IsError() {
+		conn.Close()
+		return nil, connack.ReasonCode
+	}
+	if !connack.SessionPresent {
+		// the server does not retransmit the QoS 2 messages of a previous session, and reuses their packet identifiers
+		c.pendingIn = make(map[uint16]struct{})
+	}
+	if c.keepAlive > 0 {
+		conn.SetReadTimeout(c.keepAlive * 3 / 2)
+	}
+	return conn, nil
+}
+
+func (c *client) send(conn mqttnet.Conn, pkt packet.ControlPacket) error {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	return conn.Send(pkt)
+}
+
+// request sends the packet that is returned by build with an unused packet identifier
+// the returned channel receives the acknowledgement, or nil if the connection is lost
+func (c *client) request(build func(id uint16) packet.ControlPacket) (id uint16, ack chan packet.ControlPacket, err error) {
+	ack = make(chan packet.ControlPacket, 1)
+	var pkt packet.ControlPacket
+	c.mu.Lock()
+	id, ok := c.pendingOut.Allocate(func(id uint16) packet.ControlPacket {
+		pkt = build(id)
+		if pub, ok := pkt.(*packet.PublishPacket); ok {
+			// once sent, a retransmission of the packet is a duplicate
+			dup := *pub
+			dup.Duplicate = true
+			return &dup
+		}
+		return pkt
+	})
+	if !ok {
+		c.mu.Unlock()
+		return 0, nil, errors.New("No packet identifiers available")
+	}
+	c.waiting[id] = ack
+	conn := c.conn
+	c.mu.Unlock()
+	if conn != nil {
+		c.send(conn, pkt) // if the connection is lost, the packet is handled when reconnecting
+	}
+	return id, ack, nil
+}
+
+// wait for the acknowledgement of the request
+func (c *client) wait(ctx context.Context, id uint16, ack chan packet.ControlPacket) (packet.ControlPacket, error) {
+	select {
+	case pkt := <-ack:
+		if pkt == nil {
+			return nil, ErrConnectionLost
+		}
+		return pkt, nil
+	case <-ctx.Done():
+		c.mu.Lock()
+		delete(c.waiting, id)
+		c.mu.Unlock()
+		return nil, ctx.Err()
+	case <-c.done:
+		return nil, c.err
+	}
+}
+
+// acknowledge a request
+func (c *client) acknowledge(id uint16, pkt packet.ControlPacket) {
+	c.mu.Lock()
+	c.pendingOut.Remove(id)
+	ack, ok := c.waiting[id]
+	delete(c.waiting, id)
+	c.mu.Unlock()
+	if ok {
+		ack <- pkt
+	}
+}
+
+func (c *client) closed() bool {
+	select {
+	case <-c.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *client) Subscribe(ctx context.Context, filter string, qos byte, handler Handler) (byte, error) {
+	if c.closed() {
+		return 0, ErrClosed
+	}
+	if err := topic.ValidateFilter(filter); err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	previous, resubscribe := c.subscriptions[filter]
+	c.subscriptions[filter] = subscription{qos: qos, handler: handler}
+	c.mu.Unlock()
+	id, ack, err := c.request(func(id uint16) packet.ControlPacket {
+		return &packet.SubscribePacket{PacketIdentifier: id, Topics: []string{filter}, QoSs: []byte{qos}}
+	})
+	if err == nil {
+		var pkt packet.ControlPacket
+		if pkt, err = c.wait(ctx, id, ack); err == nil {
+			code := pkt.(*packet.SubackPacket).ReasonCodes[0]
+			if !code.IsError() {
+				return byte(code), nil
+			}
+			err = code
+		}
+	}
+	c.mu.Lock()
+	if resubscribe { // the previous subscription is kept by the server
+		c.subscriptions[filter] = previous
+	} else {
+		delete(c.subscriptions, filter)
+	}
+	c.mu.Unlock()
+	return 0, err
+}
+
+func (c *client) Unsubscribe(ctx context.Context, filter string) error {
+	if c.closed() {
+		return ErrClosed
+	}
+	c.mu.Lock()
+	delete(c.subscriptions, filter)
+	c.mu.Unlock()
+	id, ack, err := c.request(func(id uint16) packet.ControlPacket {
+		return &packet.UnsubscribePacket{PacketIdentifier: id, Topics: []string{filter}}
+	})
+	if err != nil {
+		return err
+	}
+	pkt, err := c.wait(ctx, id, ack)
+	if err != nil {
+		return err
+	}
+	if codes := pkt.(*packet.UnsubackPacket).ReasonCodes; len(codes) > 0 && codes[0].IsError() {
+		return codes[0]
+	}
+	return nil
+}
+
+func (c *client) Publish(ctx context.Context, pkt *packet.PublishPacket) error {
+	if c.closed() {
+		return ErrClosed
+	}
+	if err := topic.ValidateTopic(pkt.TopicName); err != nil {
+		return err
+	}
+	if pkt.QoS == 0 {
+		c.mu.Lock()
+		conn := c.conn
+		c.mu.Unlock()
+		if conn == nil {
+			return ErrConnectionLost
+		}
+		return c.send(conn, pkt)
+	}
+	id, ack, err := c.request(func(id uint16) packet.ControlPacket {
+		pub := *pkt
+		pub.PacketIdentifier = id
+		return &pub
+	})
+	if err != nil {
+		return err
+	}
+	res, err := c.wait(ctx, id, ack)
+	if err != nil {
+		return err
+	}
+	var code packet.ReasonCode
+	switch res := res.(type) {
+	case *packet.PubackPacket:
+		code = res.ReasonCode
+	case *packet.PubrecPacket:
+		code = res.ReasonCode
+	case *packet.PubcompPacket:
+		code = res.ReasonCode
+	}
+	if code.IsError() {
+		return code
+	}
+	return nil
+}
+
+func (c *client) Ping(ctx context.Context) (time.Duration, error) {
+	if c.closed() {
+		return 0, ErrClosed
+	}
+	start := time.Now()
+	pong, err := c.ping()
+	if err != nil {
+		return 0, err
+	}
+	select {
+	case ok := <-pong:
+		if !ok {
+			return 0, ErrConnectionLost
+		}
+		return time.Since(start), nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-c.done:
+		return 0, c.err
+	}
+}
+
+// ping sends a Pingreq; the returned channel receives true on the Pingresp, or false if the connection is lost
+func (c *client) ping() (chan bool, error) {
+	pong := make(chan bool, 1)
+	c.mu.Lock()
+	conn := c.conn
+	if conn != nil {
+		c.pings = append(c.pings, pong)
+	}
+	c.mu.Unlock()
+	if conn == nil {
+		return nil, ErrConnectionLost
+	}
+	return pong, c.send(conn, &packet.PingreqPacket{})
+}
+
+func (c *client) Disconnect() error {
+	c.closeOnce.Do(func() {
+		close(c.closing)
+		c.mu.Lock()
+		conn := c.conn
+		c.mu.Unlock()
+		if conn != nil {
+			c.send(conn, &packet.DisconnectPacket{})
+			conn.Close()
+		}
+	})
+	<-c.done
+	return nil
+}
+
+// run handles the connection, and reconnects when the connection is lost
+func (c *client) run(conn mqttnet.Conn) {
+	logger := log.FromContext(c.ctx)
+	defer close(c.done)
+	for {
+		err := c.serve(conn)
+		c.lost()
+		if c.closed() {
+			c.err = ErrClosed
+			return
+		}
+		if !c.reconnect {
+			logger.WithError(err).Warn("Connection lost")
+			c.err = ErrConnectionLost
+			return
+		}
+		logger.WithError(err).Warn("Connection lost, reconnecting")
+		if conn = c.redial(); conn == nil {
+			c.err = ErrClosed
+			return
+		}
+		logger.Info("Reconnected")
+	}
+}
+
+// redial until the client is connected, or until the client is closed
+func (c *client) redial() mqttnet.Conn {
+	logger := log.FromContext(c.ctx)
+	backoff := ReconnectMinBackoff
+	for {
+		select {
+		case <-c.closing:
+			return nil
+		case <-time.After(backoff):
+		}
+		ctx, cancel := context.WithTimeout(c.ctx, ConnectTimeout)
+		conn, err := c.dialConnect(ctx)
+		cancel()
+		if err == nil {
+			return conn
+		}
+		logger.WithError(err).Debug("Could not reconnect")
+		if backoff *= 2; backoff > ReconnectMaxBackoff {
+			backoff = ReconnectMaxBackoff
+		}
+	}
+}
+
+// serve the connection until it is lost
+// subscribes to the subscriptions and retransmits the pending packets of a previous connection
+func (c *client) serve(conn mqttnet.Conn) error {
+	readErr := make(chan error, 1)
+	go func() { readErr <- c.read(conn) }()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	if c.keepAlive > 0 {
+		go c.keepalive(stop)
+	}
+
+	c.mu.Lock()
+	c.conn = conn
+	resubscribe := &packet.SubscribePacket{}
+	for filter, sub := range c.subscriptions {
+		resubscribe.Topics = append(resubscribe.Topics, filter)
+		resubscribe.QoSs = append(resubscribe.QoSs, sub.qos)
+	}
+	if len(resubscribe.Topics) > 0 {
+		c.pendingOut.Allocate(func(id uint16) packet.ControlPacket {
+			resubscribe.PacketIdentifier = id
+			return resubscribe
+		})
+	}
+	// the pending packets are the packets of a previous connection, and the requests that were made while reconnecting
+	retransmit := c.pendingOut.Get()
+	c.mu.Unlock()
+
+	if c.closed() { // Disconnect was called while reconnecting
+		conn.Close()
+	}
+
+	for _, pkt := range retransmit {
+		if err := c.send(conn, pkt); err != nil {
+			break
+		}
+	}
+
+	return <-readErr
+}
+
+// lost fails the requests that are not retransmitted
+func (c *client) lost() {
+	c.mu.Lock()
+	conn := c.conn
+	c.conn = nil
+	var failed []chan packet.ControlPacket
+	for _, pkt := range c.pendingOut.Get() {
+		var id uint16
+		switch pkt := pkt.(type) {
+		case *packet.SubscribePacket:
+			id = pkt.PacketIdentifier
+		case *packet.UnsubscribePacket:
+			id = pkt.PacketIdentifier
+		default:
+			continue
+		}
+		c.pendingOut.Remove(id)
+		if ack, ok := c.waiting[id]; ok {
+			failed = append(failed, ack)
+			delete(c.waiting, id)
+		}
+	}
+	pings := c.pings
+	c.pings = nil
+	c.mu.Unlock()
+	conn.Close()
+	for _, ack := range failed {
+		ack <- nil
+	}
+	for _, pong := range pings {
+		pong <- false
+	}
+}
+
+// keepalive sends Pingreqs until stop is closed
+func (c *client) keepalive(stop <-chan struct{}) {
+	ticker := time.NewTicker(c.keepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			c.ping()
+		}
+	}
+}
+
+// read and handle packets until the connection is lost
+func (c *client) read(conn mqttnet.Conn) error {
+	for {
+		pkt, err := conn.Receive()
+		if err != nil {
+			return err
+		}
+		var response packet.ControlPacket
+		switch pkt := pkt.(type) {
+		case *packet.PublishPacket:
+			if pkt.TopicName != "" {
+				pkt.TopicParts = topic.Split(pkt.TopicName)
+			}
+			pkt.Received = time.Now().UTC()
+			if pkt.QoS == 2 {
+				if _, ok := c.pendingIn[pkt.PacketIdentifier]; !ok {
+					c.pendingIn[pkt.PacketIdentifier] = struct{}{}
+					c.dispatch(pkt)
+				}
+			} else {
+				c.dispatch(pkt)
+			}
+			response = pkt.Response()
+		case *packet.PubrelPacket:
+			delete(c.pendingIn, pkt.PacketIdentifier)
+			response = pkt.Response()
+		case *packet.PubackPacket:
+			c.acknowledge(pkt.PacketIdentifier, pkt)
+		case *packet.PubrecPacket:
+			if pkt.ReasonCode.IsError() {
+				c.acknowledge(pkt.PacketIdentifier, pkt)
+				break
+			}
+			pubrel := pkt.Response()
+			c.pendingOut.Add(pkt.PacketIdentifier, pubrel)
+			response = pubrel
+		case *packet.PubcompPacket:
+			c.acknowledge(pkt.PacketIdentifier, pkt)
+		case *packet.SubackPacket:
+			c.acknowledge(pkt.PacketIdentifier, pkt)
+		case *packet.UnsubackPacket:
+			c.acknowledge(pkt.PacketIdentifier, pkt)
+		case *packet.PingrespPacket:
+			c.mu.Lock()
+			var pong chan bool
+			if len(c.pings) > 0 {
+				pong, c.pings = c.pings[0], c.pings[1:]
+			}
+			c.mu.Unlock()
+			if pong != nil {
+				pong <- true
+			}
+		case *packet.DisconnectPacket:
+			return pkt.ReasonCode
+		}
+		if response != nil {
+			if err := c.send(conn, response); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// dispatch the message to the handlers of the subscriptions that match its topic
+func (c *client) dispatch(pkt *packet.PublishPacket) {
+	var handlers []Handler
+	c.mu.Lock()
+	for filter, sub := range c.subscriptions {
+		if _, sharedFilter, ok := topic.SplitShare(filter); ok {
+			filter = sharedFilter
+		}
+		if sub.handler != nil && topic.MatchPath(pkt.TopicParts, topic.Split(filter)) {
+			handlers = append(handlers, sub.handler)
+		}
+	}
+	c.mu.Unlock()
+	for _, handler := range handlers {
+		handler(pkt)
+	}
+}
@@ -0,0 +1,316 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TheThingsIndustries/mystique/pkg/auth"
+	mqttnet "github.com/TheThingsIndustries/mystique/pkg/net"
+	"github.com/TheThingsIndustries/mystique/pkg/packet"
+	"github.com/TheThingsIndustries/mystique/pkg/server"
+	"github.com/smartystreets/assertions"
+	"github.com/smartystreets/assertions/should"
+)
+
+// pipe returns a Dialer that connects to the server over a pipe, and keeps the server side of the connections
+type pipe struct {
+	server server.Server
+	mu     sync.Mutex
+	conns  []net.Conn
+}
+
+func (p *pipe) dial(ctx context.Context) (mqttnet.Conn, error) {
+	serverConn, clientConn := net.Pipe()
+	p.mu.Lock()
+	p.conns = append(p.conns, serverConn)
+	p.mu.Unlock()
+	go p.server.Handle(mqttnet.NewConn(serverConn, "pipe"))
+	return mqttnet.NewConn(clientConn, "pipe"), nil
+}
+
+// break the connections on the server side
+func (p *pipe) breakConns() {
+	p.mu.Lock()
+	for _, conn := range p.conns {
+		conn.Close()
+	}
+	p.conns = nil
+	p.mu.Unlock()
+}
+
+func receive(t *testing.T, ch <-chan *packet.PublishPacket) *packet.PublishPacket {
+	t.Helper()
+	select {
+	case pkt := <-ch:
+		return pkt
+	case <-time.After(time.Second):
+		t.Fatal("Did not receive message")
+		return nil
+	}
+}
+
+func TestClient(t *testing.T) {
+	for _, version := range []byte{packet.Version311, packet.Version5} {
+		t.Run(fmt.Sprintf("v%d", version), func(t *testing.T) {
+			a := assertions.New(t)
+			ctx := context.Background()
+			p := &pipe{server: server.New(ctx)}
+
+			sub, err := Connect(ctx, p.dial, WithClientID("sub"), WithProtocolVersion(version))
+			a.So(err, should.BeNil)
+			defer sub.Disconnect()
+
+			pub, err := Connect(ctx, p.dial, WithClientID("pub"), WithProtocolVersion(version))
+			a.So(err, should.BeNil)
+			defer pub.Disconnect()
+
+			rtt, err := sub.Ping(ctx)
+			a.So(err, should.BeNil)
+			a.So(rtt, should.BeGreaterThan, 0)
+
+			messages := make(chan *packet.PublishPacket, 10)
+			handler := func(pkt *packet.PublishPacket) { messages <- pkt }
+			qos, err := sub.Subscribe(ctx, "foo/#", 2, handler)
+			a.So(err, should.BeNil)
+			a.So(qos, should.Equal, 2)
+
+			for qos := byte(0); qos <= 2; qos++ {
+				err = pub.Publish(ctx, &packet.PublishPacket{TopicName: "foo/bar", QoS: qos, Message: []byte{qos}})
+				a.So(err, should.BeNil)
+				msg := receive(t, messages)
+				a.So(msg.TopicName, should.Equal, "foo/bar")
+				a.So(msg.QoS, should.Equal, qos)
+				a.So(msg.Message, should.Resemble, []byte{qos})
+			}
+
+			a.So(sub.Unsubscribe(ctx, "foo/#"), should.BeNil)
+			a.So(pub.Publish(ctx, &packet.PublishPacket{TopicName: "foo/bar", QoS: 1}), should.BeNil)
+			select {
+			case <-messages:
+				t.Error("Received message after unsubscribe")
+			case <-time.After(10 * time.Millisecond):
+			}
+
+			a.So(pub.Publish(ctx, &packet.PublishPacket{TopicName: "foo/+"}), should.NotBeNil)
+
+			a.So(sub.Disconnect(), should.BeNil)
+			_, err = sub.Ping(ctx)
+			a.So(err, should.Equal, ErrClosed)
+		})
+	}
+}
+
+func TestConnectRejected(t *testing.T) {
+	a := assertions.New(t)
+	ctx := context.Background()
+	p := &pipe{server: server.New(ctx)}
+
+	_, err := Connect(ctx, p.dial, WithProtocolVersion(9))
+	a.So(err, should.NotBeNil)
+}
+
+// qosAuth rejects subscriptions with a QoS that is higher than the maximum
+type qosAuth struct{ max byte }
+
+func (a qosAuth) Connect(ctx context.Context, info *auth.Info) (context.Context, error) {
+	info.Interface = a
+	return ctx, nil
+}
+func (a qosAuth) Subscribe(info *auth.Info, requestedTopic string, requestedQoS byte) (string, byte, error) {
+	if requestedQoS > a.max {
+		return "", 0, errors.New("QoS not allowed")
+	}
+	return requestedTopic, requestedQoS, nil
+}
+func (a qosAuth) CanRead(info *auth.Info, topic ...string) bool  { return true }
+func (a qosAuth) CanWrite(info *auth.Info, topic ...string) bool { return true }
+
+func TestResubscribeRejected(t *testing.T) {
+	a := assertions.New(t)
+	ctx := context.Background()
+	p := &pipe{server: server.New(ctx, server.WithAuth(qosAuth{max: 1}))}
+
+	sub, err := Connect(ctx, p.dial, WithClientID("sub"), WithProtocolVersion(packet.Version5))
+	a.So(err, should.BeNil)
+	defer sub.Disconnect()
+
+	messages := make(chan *packet.PublishPacket, 10)
+	_, err = sub.Subscribe(ctx, "foo", 1, func(pkt *packet.PublishPacket) { messages <- pkt })
+	a.So(err, should.BeNil)
+	_, err = sub.Subscribe(ctx, "foo", 2, func(pkt *packet.PublishPacket) { t.Error("Handler of rejected subscription was called") })
+	a.So(err, should.Equal, packet.NotAuthorized)
+
+	// the previous subscription is kept
+	a.So(sub.Publish(ctx, &packet.PublishPacket{TopicName: "foo", QoS: 1, Message: []byte("foo")}), should.BeNil)
+	a.So(receive(t, messages).Message, should.Resemble, []byte("foo"))
+}
+
+func TestReconnect(t *testing.T) {
+	a := assertions.New(t)
+	ctx := context.Background()
+	p := &pipe{server: server.New(ctx)}
+
+	minBackoff := ReconnectMinBackoff
+	ReconnectMinBackoff = time.Millisecond
+	defer func() { ReconnectMinBackoff = minBackoff }()
+
+	sub, err := Connect(ctx, p.dial, WithClientID("sub"))
+	a.So(err, should.BeNil)
+	defer sub.Disconnect()
+
+	messages := make(chan *packet.PublishPacket, 10)
+	_, err = sub.Subscribe(ctx, "foo", 1, func(pkt *packet.PublishPacket) { messages <- pkt })
+	a.So(err, should.BeNil)
+
+	p.breakConns()
+
+	pub, err := Connect(ctx, p.dial, WithClientID("pub"))
+	a.So(err, should.BeNil)
+	defer pub.Disconnect()
+
+	// the client subscribes again after reconnecting
+	deadline := time.Now().Add(time.Second)
+	for {
+		a.So(pub.Publish(ctx, &packet.PublishPacket{TopicName: "foo", QoS: 1, Message: []byte("foo")}), should.BeNil)
+		select {
+		case msg := <-messages:
+			a.So(msg.Message, should.Resemble, []byte("foo"))
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Client did not reconnect")
+		}
+	}
+}
+
+func TestReconnectPendingQoS2(t *testing.T) {
+	a := assertions.New(t)
+	ctx := context.Background()
+
+	minBackoff := ReconnectMinBackoff
+	ReconnectMinBackoff = time.Millisecond
+	defer func() { ReconnectMinBackoff = minBackoff }()
+
+	// the server sends a QoS 2 message with the same packet identifier on each connection,
+	// and the first connection is lost after the Pubrec, before the message is released
+	conns := make(chan mqttnet.Conn, 2)
+	dial := func(ctx context.Context) (mqttnet.Conn, error) {
+		serverConn, clientConn := net.Pipe()
+		conns <- mqttnet.NewConn(serverConn, "pipe")
+		return mqttnet.NewConn(clientConn, "pipe"), nil
+	}
+	serve := func(message string, release bool) {
+		conn := <-conns
+		defer conn.Close()
+		// the pipe is synchronous, so packets are sent while the next packet is received
+		send := make(chan packet.ControlPacket, 4)
+		defer close(send)
+		go func() {
+			for pkt := range send {
+				conn.Send(pkt)
+			}
+		}()
+		published := false
+		for {
+			pkt, err := conn.Receive()
+			if err != nil {
+				return
+			}
+			switch pkt := pkt.(type) {
+			case *packet.ConnectPacket:
+				send <- &packet.ConnackPacket{}
+			case *packet.SubscribePacket:
+				send <- pkt.Response()
+				if !published {
+					send <- &packet.PublishPacket{PacketIdentifier: 1, QoS: 2, TopicName: "foo", Message: []byte(message)}
+					published = true
+				}
+			case *packet.PubrecPacket:
+				if !release {
+					return
+				}
+				send <- &packet.PubrelPacket{PacketIdentifier: 1}
+			case *packet.PubcompPacket:
+				return
+			}
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serve("first", false)
+		serve("second", true)
+	}()
+
+	c, err := Connect(ctx, dial, WithClientID("sub"))
+	a.So(err, should.BeNil)
+	defer c.Disconnect()
+
+	messages := make(chan *packet.PublishPacket, 10)
+	_, err = c.Subscribe(ctx, "foo", 2, func(pkt *packet.PublishPacket) { messages <- pkt })
+	a.So(err, should.BeNil)
+
+	a.So(string(receive(t, messages).Message), should.Equal, "first")
+	// the packet identifier of the message that was not released is used by the new session
+	a.So(string(receive(t, messages).Message), should.Equal, "second")
+	<-done
+}
+
+func TestWithoutReconnect(t *testing.T) {
+	a := assertions.New(t)
+	ctx := context.Background()
+	p := &pipe{server: server.New(ctx)}
+
+	c, err := Connect(ctx, p.dial, WithoutReconnect())
+	a.So(err, should.BeNil)
+
+	p.breakConns()
+
+	select {
+	case <-c.(*client).done:
+	case <-time.After(time.Second):
+		t.Fatal("Client did not close")
+	}
+	_, err = c.Ping(ctx)
+	a.So(err, should.Equal, ErrConnectionLost)
+	a.So(c.Disconnect(), should.BeNil)
+}
+
+func TestURL(t *testing.T) {
+	a := assertions.New(t)
+
+	for _, url := range []string{"tcp://localhost", "mqtt://localhost:1883", "mqtts://localhost", "ws://localhost/mqtt", "wss://localhost:1443/mqtt", "unix:///run/mqtt.sock"} {
+		_, err := URL(url, nil)
+		a.So(err, should.BeNil)
+	}
+	_, err := URL("http://localhost", nil)
+	a.So(err, should.NotBeNil)
+}
+
+func TestWebsocket(t *testing.T) {
+	a := assertions.New(t)
+	ctx := context.Background()
+	s := server.New(ctx)
+	srv := httptest.NewServer(mqttnet.Websocket(s.Handle))
+	defer srv.Close()
+
+	dial, err := URL("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	a.So(err, should.BeNil)
+	c, err := Connect(ctx, dial, WithProtocolVersion(packet.Version5))
+	a.So(err, should.BeNil)
+	defer c.Disconnect()
+
+	_, err = c.Ping(ctx)
+	a.So(err, should.BeNil)
+}
@@ -0,0 +1,133 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+
+	mqttnet "github.com/TheThingsIndustries/mystique/pkg/net"
+	"golang.org/x/net/websocket"
+)
+
+// Dialer dials a connection to the server
+type Dialer func(ctx context.Context) (mqttnet.Conn, error)
+
+// TCP returns a Dialer for MQTT over TCP
+func TCP(address string) Dialer {
+	return func(ctx context.Context) (mqttnet.Conn, error) {
+		return mqttnet.DialContext(ctx, "tcp", address)
+	}
+}
+
+// Unix returns a Dialer for MQTT on a Unix socket
+func Unix(path string) Dialer {
+	return func(ctx context.Context) (mqttnet.Conn, error) {
+		var d net.Dialer
+		inner, err := d.DialContext(ctx, "unix", path)
+		if err != nil {
+			return nil, err
+		}
+		return mqttnet.NewConn(inner, "unix"), nil
+	}
+}
+
+// TLS returns a Dialer for MQTT over TLS
+// the server name of the config defaults to the host of the address
+func TLS(address string, config *tls.Config) Dialer {
+	return func(ctx context.Context) (mqttnet.Conn, error) {
+		d := tls.Dialer{Config: tlsConfig(config, address)}
+		inner, err := d.DialContext(ctx, "tcp", address)
+		if err != nil {
+			return nil, err
+		}
+		return mqttnet.NewConn(inner, "tls"), nil
+	}
+}
+
+// Websocket returns a Dialer for MQTT over websockets
+// the URL has the ws or wss scheme; the TLS config is used for wss
+func Websocket(rawURL string, config *tls.Config) Dialer {
+	return func(ctx context.Context) (mqttnet.Conn, error) {
+		location, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, err
+		}
+		transport, port, origin := "ws", "80", "http://"
+		if location.Scheme == "wss" {
+			transport, port, origin = "wss", "443", "https://"
+		}
+		wsConfig, err := websocket.NewConfig(rawURL, origin+location.Host)
+		if err != nil {
+			return nil, err
+		}
+		wsConfig.Protocol = []string{"mqtt"}
+		address := hostPort(location, port)
+		var inner net.Conn
+		if transport == "wss" {
+			wsConfig.TlsConfig = tlsConfig(config, address)
+			d := tls.Dialer{Config: wsConfig.TlsConfig}
+			inner, err = d.DialContext(ctx, "tcp", address)
+		} else {
+			var d net.Dialer
+			inner, err = d.DialContext(ctx, "tcp", address)
+		}
+		if err != nil {
+			return nil, err
+		}
+		ws, err := websocket.NewClient(wsConfig, inner)
+		if err != nil {
+			inner.Close()
+			return nil, err
+		}
+		ws.PayloadType = websocket.BinaryFrame
+		return mqttnet.NewConn(ws, transport), nil
+	}
+}
+
+// URL returns a Dialer for the URL
+// supported schemes are tcp and mqtt (port 1883), tls, ssl and mqtts (port 8883), ws, wss and unix (unix:///path/to/socket)
+func URL(rawURL string, config *tls.Config) (Dialer, error) {
+	location, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch location.Scheme {
+	case "tcp", "mqtt":
+		return TCP(hostPort(location, "1883")), nil
+	case "tls", "ssl", "mqtts":
+		return TLS(hostPort(location, "8883"), config), nil
+	case "ws", "wss":
+		return Websocket(rawURL, config), nil
+	case "unix":
+		return Unix(location.Path), nil
+	default:
+		return nil, fmt.Errorf("Unsupported scheme %q", location.Scheme)
+	}
+}
+
+// hostPort returns the address of the URL, with the default port if the URL does not have a port
+func hostPort(location *url.URL, port string) string {
+	if p := location.Port(); p != "" {
+		port = p
+	}
+	return net.JoinHostPort(location.Hostname(), port)
+}
+
+// tlsConfig returns a copy of the config with the server name of the address
+func tlsConfig(config *tls.Config, address string) *tls.Config {
+	if config == nil {
+		config = &tls.Config{}
+	} else {
+		config = config.Clone()
+	}
+	if config.ServerName == "" {
+		if host, _, err := net.SplitHostPort(address); err == nil {
+			config.ServerName = host
+		}
+	}
+	return config
+}
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"sort"
 
+	"github.com/TheThingsIndustries/mystique/pkg/auth"
 	"github.com/TheThingsIndustries/mystique/pkg/session"
 )
 
@@ -50,7 +51,9 @@ func (s sortedSessions) Less(i, j int) bool {
 
 type sessionData struct {
 	Transport     string          `json:"transport,omitempty"`
+	Version       byte            `json:"protocol_version"`
 	ServerName    string          `json:"server_name,omitempty"`
+	TLS           *tlsData        `json:"tls,omitempty"`
 	ClientID      string          `json:"client_id"`
 	Username      string          `json:"username,omitempty"`
 	RemoteAddr    string          `json:"remote_addr"`
@@ -59,6 +62,27 @@ type sessionData struct {
 	Subscriptions map[string]byte `json:"subscriptions"`
 }
 
+type tlsData struct {
+	Proxy          bool   `json:"proxy,omitempty"`
+	Version        string `json:"version,omitempty"`
+	CipherSuite    string `json:"cipher_suite,omitempty"`
+	PeerCommonName string `json:"peer_common_name,omitempty"`
+	PeerVerified   bool   `json:"peer_verified,omitempty"`
+}
+
+func newTLSData(info *auth.TLSInfo) *tlsData {
+	if info == nil {
+		return nil
+	}
+	return &tlsData{
+		Proxy:          info.Proxy,
+		Version:        info.Version,
+		CipherSuite:    info.CipherSuite,
+		PeerCommonName: info.PeerCommonName,
+		PeerVerified:   info.PeerVerified,
+	}
+}
+
 // Sessions inspector
 func Sessions(s session.Store) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -67,7 +91,9 @@ func Sessions(s session.Store) http.Handler {
 			stats := sess.Stats()
 			data.Sessions = append(data.Sessions, sessionData{
 				Transport:     sess.AuthInfo().Transport,
+				Version:       sess.ProtocolVersion(),
 				ServerName:    sess.AuthInfo().ServerName,
+				TLS:           newTLSData(sess.AuthInfo().TLS),
 				ClientID:      sess.AuthInfo().ClientID,
 				Username:      sess.AuthInfo().Username,
 				RemoteAddr:    sess.AuthInfo().RemoteAddr,
@@ -45,11 +45,22 @@ var sentMessages = prometheus.NewCounterVec(
 	[]string{"message_type"},
 )
 
+var rejectedMessages = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "mystique",
+		Subsystem: "server",
+		Name:      "messages_too_large_total",
+		Help:      "Total number of messages that were rejected because they exceed the maximum packet size.",
+	},
+	[]string{"direction"},
+)
+
 func init() {
 	prometheus.MustRegister(receivedBytes)
 	prometheus.MustRegister(sentBytes)
 	prometheus.MustRegister(receivedMessages)
 	prometheus.MustRegister(sentMessages)
+	prometheus.MustRegister(rejectedMessages)
 }
 
 func registerSend(pkt packet.ControlPacket) {
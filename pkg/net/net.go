@@ -21,11 +21,28 @@ type Conn interface {
 	Send(pkt packet.ControlPacket) error
 	Receive() (packet.ControlPacket, error)
 	SetReadTimeout(d time.Duration)
+	SetProtocolVersion(version byte)
+	ProtocolVersion() byte
+	// SetMaxPacketSize sets the maximum size of packets that are received and sent (0 means no limit)
+	SetMaxPacketSize(receive, send int)
+	// MaxPacketSize returns the maximum size of packets that are received and sent
+	MaxPacketSize() (receive, send int)
+}
+
+// Option for connections
+type Option func(*conn)
+
+// WithMaxPacketSize returns an option that sets the maximum size of packets that are received (0 means no limit)
+func WithMaxPacketSize(size int) Option {
+	return func(c *conn) { c.maxReceive = size }
 }
 
 type conn struct {
-	transport string
-	timeout   time.Duration
+	transport  string
+	timeout    time.Duration
+	version    byte
+	maxReceive int
+	maxSend    int
 	net.Conn
 }
 
@@ -33,6 +50,10 @@ func (c *conn) NetConn() net.Conn {
 	return c.Conn
 }
 
+func (c *conn) ProxyHeader() *ProxyHeader {
+	return proxyHeaderOf(c.Conn)
+}
+
 func (c *conn) Transport() string {
 	return c.transport
 }
@@ -44,8 +65,14 @@ func (c *conn) Write(b []byte) (n int, err error) {
 }
 
 func (c *conn) Send(pkt packet.ControlPacket) error {
+	if err := packet.WriteVersionLimit(c, pkt, c.version, c.maxSend); err != nil {
+		if err == packet.PacketTooLarge {
+			rejectedMessages.WithLabelValues("send").Inc()
+		}
+		return err
+	}
 	registerSend(pkt)
-	return packet.Write(c, pkt)
+	return nil
 }
 
 func (c *conn) Read(b []byte) (n int, err error) {
@@ -55,8 +82,11 @@ func (c *conn) Read(b []byte) (n int, err error) {
 }
 
 func (c *conn) Receive() (packet.ControlPacket, error) {
-	pkt, err := packet.Read(c)
+	pkt, err := packet.ReadVersionLimit(c, c.version, c.maxReceive)
 	if err != nil {
+		if err == packet.PacketTooLarge {
+			rejectedMessages.WithLabelValues("receive").Inc()
+		}
 		return nil, err
 	}
 	registerReceive(pkt)
@@ -69,6 +99,22 @@ func (c *conn) SetReadTimeout(d time.Duration) {
 	c.updateTimeout()
 }
 
+func (c *conn) SetProtocolVersion(version byte) {
+	c.version = version
+}
+
+func (c *conn) ProtocolVersion() byte {
+	return c.version
+}
+
+func (c *conn) SetMaxPacketSize(receive, send int) {
+	c.maxReceive, c.maxSend = receive, send
+}
+
+func (c *conn) MaxPacketSize() (receive, send int) {
+	return c.maxReceive, c.maxSend
+}
+
 func (c *conn) updateTimeout() {
 	var deadline time.Time
 	if c.timeout > 0 {
@@ -83,8 +129,12 @@ func Dial(network, address string) (Conn, error) {
 }
 
 // NewConn creates a Conn that wraps an inner Conn.
-func NewConn(inner net.Conn, transport string) Conn {
-	return &conn{Conn: inner, transport: transport}
+func NewConn(inner net.Conn, transport string, option ...Option) Conn {
+	c := &conn{Conn: inner, transport: transport, version: packet.Version311}
+	for _, opt := range option {
+		opt(c)
+	}
+	return c
 }
 
 // DialContext acts like Dial but takes a context.
@@ -107,6 +157,7 @@ type Listener interface {
 type listener struct {
 	net.Listener
 	transport string
+	options   []Option
 }
 
 func (l *listener) Accept() (Conn, error) {
@@ -114,19 +165,21 @@ func (l *listener) Accept() (Conn, error) {
 	if err != nil {
 		return nil, err
 	}
-	return NewConn(inner, l.transport), nil
+	return NewConn(inner, l.transport, l.options...), nil
 }
 
 // Listen on the local network address.
-func Listen(network, address string) (Listener, error) {
+// The options are applied to accepted connections.
+func Listen(network, address string, option ...Option) (Listener, error) {
 	inner, err := net.Listen(network, address)
 	if err != nil {
 		return nil, err
 	}
-	return NewListener(inner, network), nil
+	return NewListener(inner, network, option...), nil
 }
 
 // NewListener creates a Listener that accepts connections from an inner Listener.
-func NewListener(inner net.Listener, transport string) Listener {
-	return &listener{Listener: inner, transport: transport}
+// The options are applied to accepted connections.
+func NewListener(inner net.Listener, transport string, option ...Option) Listener {
+	return &listener{Listener: inner, transport: transport, options: option}
 }
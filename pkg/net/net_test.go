@@ -52,3 +52,24 @@ func TestMQTTNet(t *testing.T) {
 	a.So(err, should.BeNil)
 	a.So(recv, should.Resemble, pkt)
 }
+
+func TestMaxPacketSize(t *testing.T) {
+	a := assertions.New(t)
+
+	serverConn, clientConn := net.Pipe()
+	sConn := NewConn(serverConn, "pipe", WithMaxPacketSize(16))
+	conn := NewConn(clientConn, "pipe")
+	defer sConn.Close()
+	defer conn.Close()
+
+	receive, send := sConn.MaxPacketSize()
+	a.So(receive, should.Equal, 16)
+	a.So(send, should.Equal, 0)
+
+	go conn.Send(&packet.PublishPacket{TopicName: "foo", Message: make([]byte, 16)})
+	_, err := sConn.Receive()
+	a.So(err, should.Equal, packet.PacketTooLarge)
+
+	sConn.SetMaxPacketSize(16, 4)
+	a.So(sConn.Send(&packet.PublishPacket{TopicName: "foo"}), should.Equal, packet.PacketTooLarge)
+}
@@ -0,0 +1,372 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+package net
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// ProxyHeaderTimeout is the time to wait for the PROXY protocol header of a connection
+var ProxyHeaderTimeout = 5 * time.Second
+
+// ProxyHeader is the PROXY protocol header that a proxy sent at the start of a connection
+type ProxyHeader struct {
+	Version     int
+	Source      net.Addr  // address of the client; nil for connections of the proxy itself
+	Destination net.Addr  // address that the client connected to
+	Authority   string    // host name that the client connected to (v2 only)
+	TLS         *ProxyTLS // TLS information if the proxy terminated TLS (v2 only)
+}
+
+// ProxyTLS is the TLS information of a connection that was terminated by the proxy
+type ProxyTLS struct {
+	Version           string
+	CipherSuite       string
+	ClientCertificate bool   // the client presented a certificate
+	ClientVerified    bool   // the proxy verified the certificate of the client
+	CommonName        string // common name of the certificate of the client
+}
+
+// Proxied is implemented by connections that can be accepted through a proxy
+type Proxied interface {
+	// ProxyHeader returns the PROXY protocol header, or nil if the connection was not proxied
+	ProxyHeader() *ProxyHeader
+}
+
+// ParseCIDRs parses CIDRs and IP addresses into networks
+func ParseCIDRs(cidrs ...string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid IP address %q", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// ProxyListener wraps a listener to read the PROXY protocol (v1 or v2) header of connections from trusted sources.
+// Connections from trusted sources must start with a header; connections from other sources are accepted as they are.
+// The header is read on the first call to Read or RemoteAddr, so that Accept does not block.
+func ProxyListener(inner net.Listener, trusted []*net.IPNet) net.Listener {
+	return &proxyListener{Listener: inner, trusted: trusted}
+}
+
+type proxyListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	inner, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if addr, ok := inner.RemoteAddr().(*net.TCPAddr); ok {
+		for _, network := range l.trusted {
+			if network.Contains(addr.IP) {
+				return &proxyConn{Conn: inner}, nil
+			}
+		}
+	}
+	return inner, nil
+}
+
+type proxyConn struct {
+	net.Conn
+	once     sync.Once
+	header   *ProxyHeader
+	err      error
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+func (c *proxyConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(ProxyHeaderTimeout))
+		c.header, c.err = ReadProxyHeader(c.Conn)
+		if c.err != nil {
+			c.err = fmt.Errorf("Invalid PROXY protocol header: %s", c.err)
+		}
+		c.mu.Lock()
+		c.Conn.SetReadDeadline(c.deadline)
+		c.mu.Unlock()
+	})
+}
+
+func (c *proxyConn) ProxyHeader() *ProxyHeader {
+	c.readHeader()
+	return c.header
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.readHeader(); c.header != nil && c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	if c.readHeader(); c.header != nil && c.header.Destination != nil {
+		return c.header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *proxyConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *proxyConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+type connContextKey struct{}
+
+// ConnContext stores the connection in the context.
+// It can be used as the ConnContext of an http.Server, so that websocket connections can get the PROXY protocol header.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, c)
+}
+
+// proxyHeaderOf returns the PROXY protocol header of the (wrapped) connection, if any
+func proxyHeaderOf(c net.Conn) *ProxyHeader {
+	for {
+		switch conn := c.(type) {
+		case *proxyConn:
+			return conn.ProxyHeader()
+		case *tls.Conn:
+			c = conn.NetConn()
+		case *websocket.Conn:
+			if c, _ = conn.Request().Context().Value(connContextKey{}).(net.Conn); c == nil {
+				return nil
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+const proxyV1MaxLength = 107
+
+// ReadProxyHeader reads a PROXY protocol (v1 or v2) header from the reader
+func ReadProxyHeader(r io.Reader) (*ProxyHeader, error) {
+	start := make([]byte, len(proxyV1Prefix))
+	if _, err := io.ReadFull(r, start); err != nil {
+		return nil, err
+	}
+	if bytes.Equal(start, proxyV1Prefix) {
+		return readProxyV1(r)
+	}
+	if bytes.Equal(start, proxyV2Signature[:len(start)]) {
+		return readProxyV2(r)
+	}
+	return nil, errors.New("no PROXY protocol signature")
+}
+
+func readProxyV1(r io.Reader) (*ProxyHeader, error) {
+	line := make([]byte, 0, proxyV1MaxLength-len(proxyV1Prefix))
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == cap(line) {
+			return nil, errors.New("v1 header too long")
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+	fields := strings.Fields(string(line))
+	header := &ProxyHeader{Version: 1}
+	if len(fields) > 0 && fields[0] == "UNKNOWN" {
+		return header, nil
+	}
+	if len(fields) != 5 || (fields[0] != "TCP4" && fields[0] != "TCP6") {
+		return nil, fmt.Errorf("invalid v1 header %q", strings.TrimSpace(string(line)))
+	}
+	var err error
+	if header.Source, err = parseProxyV1Addr(fields[1], fields[3]); err != nil {
+		return nil, err
+	}
+	if header.Destination, err = parseProxyV1Addr(fields[2], fields[4]); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+func parseProxyV1Addr(host, port string) (net.Addr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid v1 address %q", host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid v1 port %q", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// PROXY protocol v2 types
+const (
+	proxyV2CommandLocal = 0x0
+	proxyV2CommandProxy = 0x1
+
+	proxyV2FamilyTCP4 = 0x11
+	proxyV2FamilyTCP6 = 0x21
+
+	proxyV2TypeAuthority = 0x02
+	proxyV2TypeSSL       = 0x20
+
+	proxyV2SubtypeSSLVersion = 0x21
+	proxyV2SubtypeSSLCN      = 0x22
+	proxyV2SubtypeSSLCipher  = 0x23
+
+	proxyV2ClientSSL      = 0x01
+	proxyV2ClientCertConn = 0x02
+	proxyV2ClientCertSess = 0x04
+)
+
+func readProxyV2(r io.Reader) (*ProxyHeader, error) {
+	rest := make([]byte, len(proxyV2Signature)-len(proxyV1Prefix)+4)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(rest[:len(rest)-4], proxyV2Signature[len(proxyV1Prefix):]) {
+		return nil, errors.New("no PROXY protocol signature")
+	}
+	verCmd, family, length := rest[len(rest)-4], rest[len(rest)-3], binary.BigEndian.Uint16(rest[len(rest)-2:])
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("invalid v2 version %d", verCmd>>4)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	header := &ProxyHeader{Version: 2}
+	switch verCmd & 0xf {
+	case proxyV2CommandLocal:
+		return header, nil
+	case proxyV2CommandProxy:
+	default:
+		return nil, fmt.Errorf("invalid v2 command %d", verCmd&0xf)
+	}
+
+	var ipLen int
+	switch family {
+	case proxyV2FamilyTCP4:
+		ipLen = net.IPv4len
+	case proxyV2FamilyTCP6:
+		ipLen = net.IPv6len
+	default:
+		return header, nil // unsupported address family; the addresses of the connection are used
+	}
+	if len(payload) < 2*ipLen+4 {
+		return nil, errors.New("v2 addresses too short")
+	}
+	header.Source = &net.TCPAddr{
+		IP:   net.IP(payload[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen:])),
+	}
+	header.Destination = &net.TCPAddr{
+		IP:   net.IP(payload[ipLen : 2*ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen+2:])),
+	}
+
+	err := readProxyV2TLVs(payload[2*ipLen+4:], func(typ byte, value []byte) error {
+		switch typ {
+		case proxyV2TypeAuthority:
+			header.Authority = string(value)
+		case proxyV2TypeSSL:
+			if len(value) < 5 {
+				return errors.New("v2 SSL TLV too short")
+			}
+			client, verify := value[0], binary.BigEndian.Uint32(value[1:5])
+			if client&proxyV2ClientSSL == 0 {
+				return nil
+			}
+			info := &ProxyTLS{
+				ClientCertificate: client&(proxyV2ClientCertConn|proxyV2ClientCertSess) != 0,
+			}
+			info.ClientVerified = info.ClientCertificate && verify == 0
+			header.TLS = info
+			return readProxyV2TLVs(value[5:], func(typ byte, value []byte) error {
+				switch typ {
+				case proxyV2SubtypeSSLVersion:
+					info.Version = string(value)
+				case proxyV2SubtypeSSLCipher:
+					info.CipherSuite = string(value)
+				case proxyV2SubtypeSSLCN:
+					info.CommonName = string(value)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+func readProxyV2TLVs(b []byte, f func(typ byte, value []byte) error) error {
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return errors.New("v2 TLV too short")
+		}
+		typ, length := b[0], int(binary.BigEndian.Uint16(b[1:3]))
+		if len(b) < 3+length {
+			return errors.New("v2 TLV too short")
+		}
+		if err := f(typ, b[3:3+length]); err != nil {
+			return err
+		}
+		b = b[3+length:]
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+package net
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/smartystreets/assertions"
+	"github.com/smartystreets/assertions/should"
+)
+
+func proxyV2Header(command byte, family byte, addrs []byte, tlvs ...[]byte) []byte {
+	var payload bytes.Buffer
+	payload.Write(addrs)
+	for _, tlv := range tlvs {
+		payload.Write(tlv)
+	}
+	var b bytes.Buffer
+	b.Write(proxyV2Signature)
+	b.WriteByte(0x20 | command)
+	b.WriteByte(family)
+	binary.Write(&b, binary.BigEndian, uint16(payload.Len()))
+	b.Write(payload.Bytes())
+	return b.Bytes()
+}
+
+func proxyV2TLV(typ byte, value []byte) []byte {
+	tlv := []byte{typ, 0, 0}
+	binary.BigEndian.PutUint16(tlv[1:], uint16(len(value)))
+	return append(tlv, value...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	a := assertions.New(t)
+
+	header, err := ReadProxyHeader(strings.NewReader("PROXY TCP4 192.0.2.1 198.51.100.1 56324 1883\r\nCONNECT"))
+	a.So(err, should.BeNil)
+	a.So(header.Version, should.Equal, 1)
+	a.So(header.Source.String(), should.Equal, "192.0.2.1:56324")
+	a.So(header.Destination.String(), should.Equal, "198.51.100.1:1883")
+
+	header, err = ReadProxyHeader(strings.NewReader("PROXY TCP6 2001:db8::1 2001:db8::2 56324 1883\r\n"))
+	a.So(err, should.BeNil)
+	a.So(header.Source.String(), should.Equal, "[2001:db8::1]:56324")
+
+	header, err = ReadProxyHeader(strings.NewReader("PROXY UNKNOWN\r\n"))
+	a.So(err, should.BeNil)
+	a.So(header.Source, should.BeNil)
+
+	for _, invalid := range []string{
+		"CONNECT",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 56324 65536\r\n",
+		"PROXY TCP4 foo 198.51.100.1 56324 1883\r\n",
+		"PROXY " + strings.Repeat("x", 200) + "\r\n",
+	} {
+		_, err = ReadProxyHeader(strings.NewReader(invalid))
+		a.So(err, should.NotBeNil)
+	}
+
+	addrs := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x07, 0x5b}
+	ssl := append([]byte{proxyV2ClientSSL | proxyV2ClientCertConn, 0, 0, 0, 0},
+		append(proxyV2TLV(proxyV2SubtypeSSLVersion, []byte("TLSv1.2")),
+			append(proxyV2TLV(proxyV2SubtypeSSLCipher, []byte("ECDHE-RSA-AES128-GCM-SHA256")),
+				proxyV2TLV(proxyV2SubtypeSSLCN, []byte("gateway"))...)...)...)
+	r := bytes.NewReader(append(proxyV2Header(proxyV2CommandProxy, proxyV2FamilyTCP4, addrs,
+		proxyV2TLV(proxyV2TypeAuthority, []byte("mqtt.example.com")),
+		proxyV2TLV(0x04, []byte{0, 0}),
+		proxyV2TLV(proxyV2TypeSSL, ssl),
+	), []byte("CONNECT")...))
+	header, err = ReadProxyHeader(r)
+	a.So(err, should.BeNil)
+	a.So(header.Version, should.Equal, 2)
+	a.So(header.Source.String(), should.Equal, "192.0.2.1:56324")
+	a.So(header.Destination.String(), should.Equal, "198.51.100.1:1883")
+	a.So(header.Authority, should.Equal, "mqtt.example.com")
+	a.So(header.TLS, should.Resemble, &ProxyTLS{
+		Version:           "TLSv1.2",
+		CipherSuite:       "ECDHE-RSA-AES128-GCM-SHA256",
+		ClientCertificate: true,
+		ClientVerified:    true,
+		CommonName:        "gateway",
+	})
+	rest, _ := io.ReadAll(r)
+	a.So(string(rest), should.Equal, "CONNECT")
+
+	header, err = ReadProxyHeader(bytes.NewReader(proxyV2Header(proxyV2CommandLocal, 0, nil)))
+	a.So(err, should.BeNil)
+	a.So(header.Source, should.BeNil)
+
+	_, err = ReadProxyHeader(bytes.NewReader(proxyV2Header(proxyV2CommandProxy, proxyV2FamilyTCP4, addrs[:8])))
+	a.So(err, should.NotBeNil)
+
+	_, err = ReadProxyHeader(bytes.NewReader(proxyV2Header(proxyV2CommandProxy, proxyV2FamilyTCP4, addrs, []byte{proxyV2TypeSSL, 0, 10})))
+	a.So(err, should.NotBeNil)
+}
+
+func TestParseCIDRs(t *testing.T) {
+	a := assertions.New(t)
+
+	networks, err := ParseCIDRs("10.0.0.0/8", "192.0.2.1", "2001:db8::/32")
+	a.So(err, should.BeNil)
+	a.So(networks, should.HaveLength, 3)
+	a.So(networks[1].String(), should.Equal, "192.0.2.1/32")
+	a.So(networks[1].Contains(net.ParseIP("192.0.2.1")), should.BeTrue)
+	a.So(networks[1].Contains(net.ParseIP("192.0.2.2")), should.BeFalse)
+
+	_, err = ParseCIDRs("foo")
+	a.So(err, should.NotBeNil)
+	_, err = ParseCIDRs("10.0.0.0/33")
+	a.So(err, should.NotBeNil)
+}
+
+func TestProxyListener(t *testing.T) {
+	a := assertions.New(t)
+
+	var clients []net.Conn
+	defer func() {
+		for _, client := range clients {
+			client.Close()
+		}
+	}()
+	dial := func(lis net.Listener, data string) Conn {
+		client, err := net.Dial("tcp", lis.Addr().String())
+		if !a.So(err, should.BeNil) {
+			t.FailNow()
+		}
+		clients = append(clients, client)
+		client.Write([]byte(data))
+		conn, err := lis.Accept()
+		if !a.So(err, should.BeNil) {
+			t.FailNow()
+		}
+		return NewConn(conn, "tcp")
+	}
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	a.So(err, should.BeNil)
+	defer inner.Close()
+
+	trusted, _ := ParseCIDRs("127.0.0.1")
+	lis := ProxyListener(inner, trusted)
+
+	conn := dial(lis, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 1883\r\nfoo")
+	a.So(conn.RemoteAddr().String(), should.Equal, "192.0.2.1:56324")
+	a.So(conn.LocalAddr().String(), should.Equal, "198.51.100.1:1883")
+	a.So(conn.(Proxied).ProxyHeader(), should.NotBeNil)
+	b := make([]byte, 3)
+	_, err = io.ReadFull(conn.(io.Reader), b)
+	a.So(err, should.BeNil)
+	a.So(string(b), should.Equal, "foo")
+
+	conn = dial(lis, "CONNECT")
+	_, err = conn.(io.Reader).Read(b)
+	a.So(err, should.NotBeNil)
+
+	// the deadline of the connection applies after the header
+	conn = dial(lis, "PROXY UNKNOWN\r\n")
+	conn.SetReadTimeout(10 * time.Millisecond)
+	a.So(conn.(Proxied).ProxyHeader(), should.NotBeNil)
+	a.So(conn.RemoteAddr().String(), should.StartWith, "127.0.0.1:")
+	_, err = conn.(io.Reader).Read(b)
+	if netErr, ok := err.(net.Error); a.So(ok, should.BeTrue) {
+		a.So(netErr.Timeout(), should.BeTrue)
+	}
+
+	untrusted, _ := ParseCIDRs("192.0.2.0/24")
+	lis = ProxyListener(inner, untrusted)
+	conn = dial(lis, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 1883\r\n")
+	a.So(conn.RemoteAddr().String(), should.StartWith, "127.0.0.1:")
+	a.So(conn.(Proxied).ProxyHeader(), should.BeNil)
+}
@@ -3,65 +3,338 @@
 package net
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/TheThingsIndustries/mystique/pkg/packet"
 	"golang.org/x/net/websocket"
 )
 
+// WebsocketProtocols are the supported subprotocols, in order of preference
+var WebsocketProtocols = []string{"mqtt", "mqttv5", "mqttv3.1"}
+
 type wsConn struct {
 	Conn
+	ws         *websocket.Conn
 	remoteAddr net.Addr
+	mu         sync.Mutex // protects writes, so that pings are not written within a packet
 }
 
 func (c *wsConn) RemoteAddr() net.Addr {
 	return c.remoteAddr
 }
 
-// Websocket returns an http.Handler that exposes MQTT over websockets.
-func Websocket(handle func(Conn)) http.Handler {
-	return websocket.Server{
-		Handshake: func(config *websocket.Config, req *http.Request) (err error) {
-			config.Origin, err = websocket.Origin(config, req)
-			if err != nil {
-				return err
-			}
-			if config.Origin == nil {
-				return fmt.Errorf("empty origin")
+func (c *wsConn) ProxyHeader() *ProxyHeader {
+	if proxied, ok := c.Conn.(Proxied); ok {
+		return proxied.ProxyHeader()
+	}
+	return nil
+}
+
+func (c *wsConn) Send(pkt packet.ControlPacket) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Conn.Send(pkt)
+}
+
+// ping writes a ping frame; the client must read it within the timeout
+func (c *wsConn) ping(timeout time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ws.SetWriteDeadline(time.Now().Add(timeout))
+	defer c.ws.SetWriteDeadline(time.Time{})
+	c.ws.PayloadType = websocket.PingFrame
+	defer func() { c.ws.PayloadType = websocket.BinaryFrame }()
+	_, err := c.ws.Write(nil)
+	return err
+}
+
+// pongConn is the connection of a websocket client that is sent pings
+// Data from the client, such as the pong that answers a ping, extends the read deadline by the timeout.
+// A read deadline that is set on the connection, such as the keep alive of MQTT, applies if it is earlier.
+type pongConn struct {
+	net.Conn
+	timeout time.Duration
+
+	mu           sync.Mutex
+	deadline     time.Time // read deadline that was set on the connection
+	pongDeadline time.Time
+}
+
+// refresh extends the read deadline by the timeout
+func (c *pongConn) refresh() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pongDeadline = time.Now().Add(c.timeout)
+	c.apply()
+}
+
+// apply sets the earliest read deadline on the connection; c.mu must be held
+func (c *pongConn) apply() error {
+	deadline := c.pongDeadline
+	if !c.deadline.IsZero() && c.deadline.Before(deadline) {
+		deadline = c.deadline
+	}
+	return c.Conn.SetReadDeadline(deadline)
+}
+
+func (c *pongConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return c.apply()
+}
+
+func (c *pongConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// pongReader refreshes the read deadline of the connection when data is read
+type pongReader struct {
+	io.Reader
+	conn *pongConn
+}
+
+func (r pongReader) Read(p []byte) (n int, err error) {
+	n, err = r.Reader.Read(p)
+	if n > 0 {
+		r.conn.refresh()
+	}
+	return
+}
+
+// pongWriter hijacks the connection of the websocket client as a pongConn
+type pongWriter struct {
+	http.ResponseWriter
+	timeout time.Duration
+}
+
+func (w pongWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection can not be hijacked")
+	}
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	pong := &pongConn{Conn: conn, timeout: w.timeout}
+	pong.refresh()
+	buf.Reader = bufio.NewReader(pongReader{Reader: buf.Reader, conn: pong})
+	return pong, buf, nil
+}
+
+// WebsocketOption for the websocket handler
+type WebsocketOption func(*websocketHandler)
+
+// WithAllowedOrigins returns an option that only accepts browsers from the origins
+// A pattern with a scheme (https://*.example.com) matches the scheme and host of the origin, and a pattern without scheme (*.example.com) the host.
+// The * wildcard matches any part of the origin; by default, all origins are accepted.
+func WithAllowedOrigins(patterns ...string) WebsocketOption {
+	return func(h *websocketHandler) { h.origins = patterns }
+}
+
+// WithoutOrigin returns an option that accepts clients that do not send an Origin header, such as clients that are not browsers
+func WithoutOrigin() WebsocketOption {
+	return func(h *websocketHandler) { h.allowNoOrigin = true }
+}
+
+// WithPingInterval returns an option that sends pings to the clients, so that proxies do not close idle connections
+// The connection is closed if the client does not read a ping within the interval, or does not answer it with a pong within the interval.
+func WithPingInterval(d time.Duration) WebsocketOption {
+	return func(h *websocketHandler) { h.pingInterval = d }
+}
+
+// WithForwardedFor returns an option that takes the address of the client from the X-Forwarded-For or X-Real-IP header of trusted proxies
+func WithForwardedFor(trusted []*net.IPNet) WebsocketOption {
+	return func(h *websocketHandler) { h.trusted = trusted }
+}
+
+// WithConnOptions returns an option that applies the options to accepted connections
+func WithConnOptions(option ...Option) WebsocketOption {
+	return func(h *websocketHandler) { h.connOptions = append(h.connOptions, option...) }
+}
+
+type websocketHandler struct {
+	origins       []string
+	allowNoOrigin bool
+	pingInterval  time.Duration
+	trusted       []*net.IPNet
+	connOptions   []Option
+}
+
+// ValidateOrigin returns an error if the pattern of WithAllowedOrigins is invalid
+func ValidateOrigin(pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("Invalid origin %q", pattern)
+	}
+	return nil
+}
+
+// allowedOrigin returns true if the origin matches one of the patterns
+func (h *websocketHandler) allowedOrigin(origin *url.URL) bool {
+	if len(h.origins) == 0 {
+		return true
+	}
+	host := strings.ToLower(origin.Host)
+	schemeHost := strings.ToLower(origin.Scheme) + "://" + host
+	for _, pattern := range h.origins {
+		pattern = strings.ToLower(pattern)
+		subject := host
+		if strings.Contains(pattern, "://") {
+			subject = schemeHost
+		}
+		if pattern == "*" || pattern == subject {
+			return true
+		}
+		if ok, _ := path.Match(pattern, subject); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *websocketHandler) trustedIP(ip net.IP) bool {
+	for _, network := range h.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteAddr returns the address of the client of the request
+// If the request comes from a trusted proxy, the address is taken from the X-Forwarded-For or X-Real-IP header.
+// The first address in X-Forwarded-For from the right that is not a trusted proxy is the client.
+// The address of the proxy is returned if the header is invalid.
+func (h *websocketHandler) remoteAddr(req *http.Request) (net.Addr, error) {
+	addr, err := net.ResolveTCPAddr("tcp", req.RemoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	if !h.trustedIP(addr.IP) {
+		return addr, nil
+	}
+	var forwarded []string
+	for _, header := range req.Header.Values("X-Forwarded-For") {
+		for _, ip := range strings.Split(header, ",") {
+			forwarded = append(forwarded, strings.TrimSpace(ip))
+		}
+	}
+	if len(forwarded) == 0 {
+		if realIP := strings.TrimSpace(req.Header.Get("X-Real-IP")); realIP != "" {
+			forwarded = []string{realIP}
+		}
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := net.ParseIP(forwarded[i])
+		if ip == nil {
+			return addr, nil
+		}
+		if i == 0 || !h.trustedIP(ip) {
+			return &net.TCPAddr{IP: ip}, nil
+		}
+	}
+	return addr, nil
+}
+
+func (h *websocketHandler) handshake(config *websocket.Config, req *http.Request) (err error) {
+	config.Origin, err = websocket.Origin(config, req)
+	if err != nil {
+		return err
+	}
+	if config.Origin == nil {
+		if !h.allowNoOrigin {
+			return errors.New("empty origin")
+		}
+	} else if !h.allowedOrigin(config.Origin) {
+		return fmt.Errorf("origin %s is not allowed", config.Origin)
+	}
+	var selectedProtocol string
+selectProtocol:
+	for _, supported := range WebsocketProtocols {
+		for _, protocol := range config.Protocol {
+			if protocol == supported {
+				selectedProtocol = protocol
+				break selectProtocol
 			}
-			var selectedProtocol string
-			for _, protocol := range config.Protocol {
-				switch protocol {
-				case "mqtt", "mqttv3.1":
-					selectedProtocol = protocol
-					break
+		}
+	}
+	if selectedProtocol == "" {
+		return errors.New("no suitable subprotocol")
+	}
+	// the server echoes the selected subprotocol
+	config.Protocol = []string{selectedProtocol}
+	return nil
+}
+
+func (h *websocketHandler) handle(ws *websocket.Conn, handle func(Conn)) {
+	ws.PayloadType = websocket.BinaryFrame
+	addr, err := h.remoteAddr(ws.Request())
+	if err != nil {
+		addr = ws.RemoteAddr()
+	}
+	transport := "ws"
+	if ws.Config().TlsConfig != nil {
+		transport = "wss"
+	}
+	conn := &wsConn{
+		Conn:       NewConn(ws, transport, h.connOptions...),
+		ws:         ws,
+		remoteAddr: addr,
+	}
+	if h.pingInterval > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			ticker := time.NewTicker(h.pingInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					if err := conn.ping(h.pingInterval); err != nil {
+						conn.Close()
+						return
+					}
 				}
 			}
-			if selectedProtocol == "" {
-				return fmt.Errorf("no suitable subprotocol")
-			}
-			return nil
-		},
+		}()
+	}
+	handle(conn)
+}
+
+// Websocket returns an http.Handler that exposes MQTT over websockets.
+// By default, browsers from all origins are accepted, and clients without an Origin header are rejected.
+func Websocket(handle func(Conn), option ...WebsocketOption) http.Handler {
+	h := &websocketHandler{}
+	for _, opt := range option {
+		opt(h)
+	}
+	server := websocket.Server{
+		Handshake: h.handshake,
 		Handler: func(ws *websocket.Conn) {
-			ws.PayloadType = websocket.BinaryFrame
-			var (
-				addr net.Addr
-				err  error
-			)
-			addr, err = net.ResolveTCPAddr("tcp", ws.Request().RemoteAddr)
-			if err != nil {
-				addr = ws.RemoteAddr()
-			}
-			transport := "ws"
-			if ws.Config().TlsConfig != nil {
-				transport = "wss"
-			}
-			conn := &wsConn{
-				Conn:       NewConn(ws, transport),
-				remoteAddr: addr,
-			}
-			handle(conn)
+			h.handle(ws, handle)
 		},
 	}
+	if h.pingInterval == 0 {
+		return server
+	}
+	// the client has one interval to answer a ping before the read deadline expires
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.ServeHTTP(pongWriter{ResponseWriter: w, timeout: 2 * h.pingInterval}, r)
+	})
 }
@@ -0,0 +1,126 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+package net
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/smartystreets/assertions"
+	"github.com/smartystreets/assertions/should"
+)
+
+// upgrade sends a websocket handshake with the headers to the server
+func upgrade(t *testing.T, address string, header map[string]string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, "http://"+address+"/", nil)
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+	if err = req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, r, res
+}
+
+func TestWebsocket(t *testing.T) {
+	a := assertions.New(t)
+
+	trusted, _ := ParseCIDRs("127.0.0.1", "10.0.0.0/8")
+	addrs := make(chan net.Addr, 1)
+	srv := httptest.NewServer(Websocket(func(conn Conn) {
+		addrs <- conn.RemoteAddr()
+		conn.Receive()
+	}, WithAllowedOrigins("https://*.example.com", "example.org"), WithForwardedFor(trusted)))
+	defer srv.Close()
+	address := srv.Listener.Addr().String()
+
+	for _, tt := range []struct {
+		name     string
+		header   map[string]string
+		protocol string // selected protocol, or empty if rejected
+		addr     string
+	}{
+		{"no origin", map[string]string{"Sec-WebSocket-Protocol": "mqtt"}, "", ""},
+		{"allowed origin", map[string]string{"Origin": "https://app.example.com", "Sec-WebSocket-Protocol": "mqtt"}, "mqtt", "127.0.0.1:0"},
+		{"wrong scheme", map[string]string{"Origin": "http://app.example.com", "Sec-WebSocket-Protocol": "mqtt"}, "", ""},
+		{"other origin", map[string]string{"Origin": "https://app.example.net", "Sec-WebSocket-Protocol": "mqtt"}, "", ""},
+		{"allowed host", map[string]string{"Origin": "http://EXAMPLE.org", "Sec-WebSocket-Protocol": "mqtt"}, "mqtt", "127.0.0.1:0"},
+		{"preferred protocol", map[string]string{"Origin": "https://example.org", "Sec-WebSocket-Protocol": "chat, mqttv3.1, mqtt"}, "mqtt", "127.0.0.1:0"},
+		{"mqttv5", map[string]string{"Origin": "https://example.org", "Sec-WebSocket-Protocol": "mqttv5"}, "mqttv5", "127.0.0.1:0"},
+		{"no protocol", map[string]string{"Origin": "https://example.org", "Sec-WebSocket-Protocol": "chat"}, "", ""},
+		{"forwarded", map[string]string{"Origin": "https://example.org", "Sec-WebSocket-Protocol": "mqtt", "X-Forwarded-For": "192.0.2.1, 203.0.113.1, 10.0.0.1"}, "mqtt", "203.0.113.1:0"},
+		{"real ip", map[string]string{"Origin": "https://example.org", "Sec-WebSocket-Protocol": "mqtt", "X-Real-IP": "203.0.113.2"}, "mqtt", "203.0.113.2:0"},
+		{"invalid forwarded", map[string]string{"Origin": "https://example.org", "Sec-WebSocket-Protocol": "mqtt", "X-Forwarded-For": "unknown"}, "mqtt", "127.0.0.1:0"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			a := assertions.New(t)
+			conn, _, res := upgrade(t, address, tt.header)
+			defer conn.Close()
+			if tt.protocol == "" {
+				a.So(res.StatusCode, should.NotEqual, http.StatusSwitchingProtocols)
+				return
+			}
+			a.So(res.StatusCode, should.Equal, http.StatusSwitchingProtocols)
+			a.So(res.Header.Get("Sec-WebSocket-Protocol"), should.Equal, tt.protocol)
+			select {
+			case addr := <-addrs:
+				host, _, _ := net.SplitHostPort(addr.String())
+				expected, _, _ := net.SplitHostPort(tt.addr)
+				a.So(host, should.Equal, expected)
+			case <-time.After(time.Second):
+				t.Error("Connection was not handled")
+			}
+		})
+	}
+
+	// clients without origin can be allowed, and are sent pings
+	srv = httptest.NewServer(Websocket(func(conn Conn) {
+		conn.Receive()
+	}, WithoutOrigin(), WithPingInterval(10*time.Millisecond)))
+	defer srv.Close()
+	conn, r, res := upgrade(t, srv.Listener.Addr().String(), map[string]string{"Sec-WebSocket-Protocol": "mqtt"})
+	defer conn.Close()
+	a.So(res.StatusCode, should.Equal, http.StatusSwitchingProtocols)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	frame := make([]byte, 2)
+	if _, err := io.ReadFull(r, frame); a.So(err, should.BeNil) {
+		a.So(frame, should.Resemble, []byte{0x89, 0x00}) // final ping frame without payload
+	}
+
+	// the connection is kept while the client answers pings with pongs
+	for deadline := time.Now().Add(100 * time.Millisecond); time.Now().Before(deadline); {
+		_, err := conn.Write([]byte{0x8A, 0x80, 0, 0, 0, 0}) // final masked pong frame without payload
+		a.So(err, should.BeNil)
+		_, err = io.ReadFull(r, frame)
+		if !a.So(err, should.BeNil) {
+			return
+		}
+	}
+
+	// the connection is closed when the client does not answer pings
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var err error
+	for err == nil {
+		_, err = io.ReadFull(r, frame)
+	}
+	a.So(err, should.Equal, io.EOF)
+}
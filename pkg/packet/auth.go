@@ -0,0 +1,47 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+package packet
+
+import "bytes"
+
+// AuthPacket is the AUTH packet (MQTT 5.0)
+type AuthPacket struct {
+	ReasonCode ReasonCode
+	Properties Properties
+}
+
+// PacketType returns the MQTT packet type of this packet
+func (AuthPacket) PacketType() byte { return AUTH }
+
+func (p *AuthPacket) setFlags(f flags) error { return validateFlags(p.flags(), f) }
+
+func (p AuthPacket) flags() flags { return flags{} }
+
+// MarshalBinary implements encoding.BinaryMarshaler
+func (p AuthPacket) MarshalBinary() (data []byte, err error) { return p.marshal(Version5) }
+
+func (p AuthPacket) marshal(version byte) (data []byte, err error) {
+	buf := new(bytes.Buffer)
+	err = writeReasonCode(buf, p.ReasonCode, p.Properties)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler
+func (p *AuthPacket) UnmarshalBinary(data []byte) error { return p.unmarshal(data, Version5) }
+
+func (p *AuthPacket) unmarshal(data []byte, version byte) (err error) {
+	p.ReasonCode, p.Properties, err = readReasonCode(bytes.NewBuffer(data))
+	return
+}
+
+// Validate the packet contents
+func (p AuthPacket) Validate() error {
+	switch p.ReasonCode {
+	case Success, ContinueAuthentication, ReAuthenticate:
+		return nil
+	}
+	return ErrProtocolViolation
+}
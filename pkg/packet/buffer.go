@@ -0,0 +1,43 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+package packet
+
+import "sync"
+
+// buffers are pooled in size classes of powers of two, from 2^minBufferBits up to 2^maxBufferBits bytes
+// larger buffers are not pooled, so that a few large packets do not keep a lot of memory in use
+const (
+	minBufferBits = 6
+	maxBufferBits = 16
+)
+
+var bufferPools [maxBufferBits - minBufferBits + 1]sync.Pool
+
+func bufferClass(size int) int {
+	class := 0
+	for size > 1<<(minBufferBits+class) {
+		class++
+	}
+	return class
+}
+
+// getBuffer returns a buffer of the given size
+func getBuffer(size int) []byte {
+	class := bufferClass(size)
+	if class >= len(bufferPools) {
+		return make([]byte, size)
+	}
+	if buf, ok := bufferPools[class].Get().(*[]byte); ok {
+		return (*buf)[:size]
+	}
+	return make([]byte, size, 1<<(minBufferBits+class))
+}
+
+// putBuffer returns a buffer that was obtained with getBuffer to its pool
+func putBuffer(buf []byte) {
+	class := bufferClass(cap(buf))
+	if class >= len(bufferPools) || cap(buf) != 1<<(minBufferBits+class) {
+		return
+	}
+	bufferPools[class].Put(&buf)
+}
@@ -5,9 +5,11 @@ package packet
 import "bytes"
 
 // ConnackPacket is the CONNACK packet
+// In MQTT 3.1.1, the ReasonCode is sent as the corresponding ConnectReturnCode
 type ConnackPacket struct {
-	ReturnCode     ConnectReturnCode
 	SessionPresent bool
+	ReasonCode     ReasonCode
+	Properties     Properties // MQTT 5.0
 }
 
 // PacketType returns the MQTT packet type of this packet
@@ -18,17 +20,29 @@ func (p *ConnackPacket) setFlags(f flags) error { return validateFlags(p.flags()
 func (p ConnackPacket) flags() flags { return flags{} }
 
 // MarshalBinary implements encoding.BinaryMarshaler
-func (p ConnackPacket) MarshalBinary() (data []byte, err error) {
+func (p ConnackPacket) MarshalBinary() (data []byte, err error) { return p.marshal(Version311) }
+
+func (p ConnackPacket) marshal(version byte) (data []byte, err error) {
 	buf := new(bytes.Buffer)
 	var flags byte
 	flags |= bit(p.SessionPresent)
 	WriteByte(buf, flags)
-	WriteByte(buf, byte(p.ReturnCode))
+	if version < Version5 {
+		WriteByte(buf, byte(p.ReasonCode.ConnectReturnCode()))
+		return buf.Bytes(), nil
+	}
+	WriteByte(buf, byte(p.ReasonCode))
+	err = WriteProperties(buf, p.Properties)
+	if err != nil {
+		return nil, err
+	}
 	return buf.Bytes(), nil
 }
 
 // UnmarshalBinary implements encoding.BinaryUnmarshaler
-func (p *ConnackPacket) UnmarshalBinary(data []byte) (err error) {
+func (p *ConnackPacket) UnmarshalBinary(data []byte) error { return p.unmarshal(data, Version311) }
+
+func (p *ConnackPacket) unmarshal(data []byte, version byte) (err error) {
 	buf := bytes.NewBuffer(data)
 	var flags flags
 	flags, err = readFlags(buf)
@@ -39,15 +53,21 @@ func (p *ConnackPacket) UnmarshalBinary(data []byte) (err error) {
 	if flags[1] || flags[2] || flags[3] || flags[4] || flags[5] || flags[6] || flags[7] {
 		return ErrProtocolViolation
 	}
-	var returnCode byte
-	returnCode, err = ReadByte(buf)
+	var code byte
+	code, err = ReadByte(buf)
 	if err != nil {
 		return
 	}
-	p.ReturnCode = ConnectReturnCode(returnCode)
-	if !p.ReturnCode.valid() {
-		return ErrProtocolViolation
+	if version < Version5 {
+		returnCode := ConnectReturnCode(code)
+		if !returnCode.valid() {
+			return ErrProtocolViolation
+		}
+		p.ReasonCode = returnCode.ReasonCode()
+		return
 	}
+	p.ReasonCode = ReasonCode(code)
+	p.Properties, err = ReadProperties(buf)
 	return
 }
 
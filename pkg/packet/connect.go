@@ -18,6 +18,9 @@ type ConnectPacket struct {
 	WillMessage   []byte
 	Username      string
 	Password      []byte
+
+	Properties     Properties // MQTT 5.0
+	WillProperties Properties // MQTT 5.0
 }
 
 // PacketType returns the MQTT packet type of this packet
@@ -28,7 +31,10 @@ func (p *ConnectPacket) setFlags(f flags) error { return validateFlags(p.flags()
 func (p ConnectPacket) flags() flags { return flags{} }
 
 // MarshalBinary implements encoding.BinaryMarshaler
-func (p ConnectPacket) MarshalBinary() (data []byte, err error) {
+func (p ConnectPacket) MarshalBinary() (data []byte, err error) { return p.marshal(p.ProtocolLevel) }
+
+// marshal uses the protocol level of the packet instead of the given version
+func (p ConnectPacket) marshal(_ byte) (data []byte, err error) {
 	buf := new(bytes.Buffer)
 	WriteString(buf, p.ProtocolName)
 	WriteByte(buf, p.ProtocolLevel)
@@ -41,8 +47,20 @@ func (p ConnectPacket) MarshalBinary() (data []byte, err error) {
 	flags |= bit(len(p.Username) > 0) << 7
 	WriteByte(buf, flags)
 	WriteUint16(buf, p.KeepAlive)
+	if p.ProtocolLevel >= Version5 {
+		err = WriteProperties(buf, p.Properties)
+		if err != nil {
+			return nil, err
+		}
+	}
 	WriteString(buf, p.ClientID)
 	if p.Will {
+		if p.ProtocolLevel >= Version5 {
+			err = WriteProperties(buf, p.WillProperties)
+			if err != nil {
+				return nil, err
+			}
+		}
 		WriteString(buf, p.WillTopic)
 		WriteBytes(buf, p.WillMessage)
 	}
@@ -56,7 +74,10 @@ func (p ConnectPacket) MarshalBinary() (data []byte, err error) {
 }
 
 // UnmarshalBinary implements encoding.BinaryUnmarshaler
-func (p *ConnectPacket) UnmarshalBinary(data []byte) (err error) {
+func (p *ConnectPacket) UnmarshalBinary(data []byte) error { return p.unmarshal(data, 0) }
+
+// unmarshal uses the protocol level of the packet instead of the given version
+func (p *ConnectPacket) unmarshal(data []byte, _ byte) (err error) {
 	buf := bytes.NewBuffer(data)
 	p.ProtocolName, err = ReadString(buf)
 	if err != nil {
@@ -88,11 +109,23 @@ func (p *ConnectPacket) UnmarshalBinary(data []byte) (err error) {
 	if err != nil {
 		return
 	}
+	if p.ProtocolLevel >= Version5 {
+		p.Properties, err = ReadProperties(buf)
+		if err != nil {
+			return
+		}
+	}
 	p.ClientID, err = ReadString(buf)
 	if err != nil {
 		return
 	}
 	if p.Will {
+		if p.ProtocolLevel >= Version5 {
+			p.WillProperties, err = ReadProperties(buf)
+			if err != nil {
+				return
+			}
+		}
 		p.WillTopic, err = ReadString(buf)
 		if err != nil {
 			return
@@ -127,12 +160,16 @@ func (p ConnectPacket) Validate() error {
 	switch p.ProtocolName {
 	case "MQIsdp", "MQTT":
 	default:
-		return ConnectUnacceptableProtocolVersion
+		return UnsupportedProtocolVersion
 	}
 	switch p.ProtocolLevel {
-	case 3, 4:
+	case Version31, Version311:
+		if p.ClientID == "" && !p.CleanStart {
+			return ClientIdentifierNotValid
+		}
+	case Version5:
 	default:
-		return ConnectUnacceptableProtocolVersion
+		return UnsupportedProtocolVersion
 	}
 	return nil
 }
@@ -2,7 +2,8 @@
 
 package packet
 
-// ConnectReturnCode is returned in the Connack
+// ConnectReturnCode is returned in the Connack of MQTT 3.1.1
+// In MQTT 5.0, reason codes are used instead
 type ConnectReturnCode byte
 
 // Connect return codes
@@ -46,3 +47,22 @@ func (c ConnectReturnCode) valid() bool {
 	}
 	return true
 }
+
+// ReasonCode returns the MQTT 5.0 reason code that corresponds to the return code
+func (c ConnectReturnCode) ReasonCode() ReasonCode {
+	switch c {
+	case ConnectAccepted:
+		return Success
+	case ConnectUnacceptableProtocolVersion:
+		return UnsupportedProtocolVersion
+	case ConnectIdentifierRejected:
+		return ClientIdentifierNotValid
+	case ConnectServerUnavailable:
+		return ServerUnavailable
+	case ConnectMalformedUsernameOrPassword:
+		return BadUsernameOrPassword
+	case ConnectNotAuthorized:
+		return NotAuthorized
+	}
+	return UnspecifiedError
+}
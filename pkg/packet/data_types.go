@@ -99,7 +99,7 @@ func ReadUint16(r io.Reader) (i uint16, err error) {
 }
 
 func encodeUint32(i uint32) []byte {
-	buf := make([]byte, 2)
+	buf := make([]byte, 4)
 	binary.BigEndian.PutUint32(buf, i)
 	return buf
 }
@@ -116,7 +116,7 @@ func decodeUint32(buf []byte) uint32 {
 
 // ReadUint32 reads an uint32 from the given Reader
 func ReadUint32(r io.Reader) (i uint32, err error) {
-	buf := make([]byte, 2)
+	buf := make([]byte, 4)
 	_, err = io.ReadFull(r, buf)
 	if err != nil {
 		return
@@ -193,11 +193,24 @@ var ErrInvalidRemainingLength = errors.New("Invalid Remaining Length")
 
 // WriteRemainingLength writes a remaining length field to the given Writer
 func WriteRemainingLength(w io.Writer, x int) (err error) {
+	return WriteVariableByteInteger(w, x)
+}
+
+// ErrMalformedRemainingLength is returned when attempting to read a malformed remaining length
+var ErrMalformedRemainingLength = errors.New("Malformed Remaining Length")
+
+// ReadRemainingLength returns the decoded remaining length field
+func ReadRemainingLength(r io.Reader) (value int, err error) {
+	return ReadVariableByteInteger(r)
+}
+
+// WriteVariableByteInteger writes a variable byte integer to the given Writer
+func WriteVariableByteInteger(w io.Writer, x int) (err error) {
 	var (
 		buf         = make([]byte, 0, 4)
 		encodedByte byte
 	)
-	if x > 268435455 {
+	if x < 0 || x > 268435455 {
 		return ErrInvalidRemainingLength
 	}
 	for {
@@ -215,11 +228,8 @@ func WriteRemainingLength(w io.Writer, x int) (err error) {
 	return
 }
 
-// ErrMalformedRemainingLength is returned when attempting to read a malformed remaining length
-var ErrMalformedRemainingLength = errors.New("Malformed Remaining Length")
-
-// ReadRemainingLength returns the decoded remaining length field
-func ReadRemainingLength(r io.Reader) (value int, err error) {
+// ReadVariableByteInteger reads a variable byte integer from the given Reader
+func ReadVariableByteInteger(r io.Reader) (value int, err error) {
 	var (
 		multiplier = 1
 		buf        = make([]byte, 1)
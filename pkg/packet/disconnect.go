@@ -2,8 +2,12 @@
 
 package packet
 
+import "bytes"
+
 // DisconnectPacket is the DISCONNECT packet
 type DisconnectPacket struct {
+	ReasonCode ReasonCode // MQTT 5.0
+	Properties Properties // MQTT 5.0
 }
 
 // PacketType returns the MQTT packet type of this packet
@@ -14,10 +18,30 @@ func (p *DisconnectPacket) setFlags(f flags) error { return validateFlags(p.flag
 func (p DisconnectPacket) flags() flags { return flags{} }
 
 // MarshalBinary implements encoding.BinaryMarshaler
-func (p DisconnectPacket) MarshalBinary() (data []byte, err error) { return nil, nil }
+func (p DisconnectPacket) MarshalBinary() (data []byte, err error) { return p.marshal(Version311) }
+
+func (p DisconnectPacket) marshal(version byte) (data []byte, err error) {
+	if version < Version5 {
+		return nil, nil
+	}
+	buf := new(bytes.Buffer)
+	err = writeReasonCode(buf, p.ReasonCode, p.Properties)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
 
 // UnmarshalBinary implements encoding.BinaryUnmarshaler
-func (p *DisconnectPacket) UnmarshalBinary(data []byte) error { return nil }
+func (p *DisconnectPacket) UnmarshalBinary(data []byte) error { return p.unmarshal(data, Version311) }
+
+func (p *DisconnectPacket) unmarshal(data []byte, version byte) (err error) {
+	if version < Version5 {
+		return nil
+	}
+	p.ReasonCode, p.Properties, err = readReasonCode(bytes.NewBuffer(data))
+	return
+}
 
 // Validate the packet contents (noop)
 func (p DisconnectPacket) Validate() error { return nil }
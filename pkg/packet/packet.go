@@ -53,27 +53,50 @@ var Name = map[byte]string{
 // ErrProtocolViolation is returned when a message violates the protocol specification
 var ErrProtocolViolation = errors.New("Protocol Violation")
 
+// Protocol versions (the protocol level of the CONNECT packet)
+const (
+	Version31  byte = 3 // MQTT 3.1
+	Version311 byte = 4 // MQTT 3.1.1
+	Version5   byte = 5 // MQTT 5.0
+)
+
 // ControlPacket represents an MQTT Control Packet
 type ControlPacket interface {
-	encoding.BinaryMarshaler   // without fixed header
-	encoding.BinaryUnmarshaler // without fixed header
+	encoding.BinaryMarshaler   // without fixed header, MQTT 3.1.1
+	encoding.BinaryUnmarshaler // without fixed header, MQTT 3.1.1
 	PacketType() byte
 	setFlags(f flags) error
 	flags() flags
+	marshal(version byte) ([]byte, error)
+	unmarshal(data []byte, version byte) error
 	Validate() error
 }
 
-// Write a control packet to the writer
+// Write a control packet to the writer using MQTT 3.1.1
 func Write(w io.Writer, p ControlPacket) (err error) {
-	_, err = w.Write([]byte{p.PacketType()<<4 | p.flags().Byte()})
-	if err != nil {
-		return err
-	}
+	return WriteVersion(w, p, Version311)
+}
+
+// WriteVersion writes a control packet to the writer using the given protocol version
+func WriteVersion(w io.Writer, p ControlPacket, version byte) (err error) {
+	return WriteVersionLimit(w, p, version, 0)
+}
+
+// WriteVersionLimit writes a control packet to the writer using the given protocol version
+// returns PacketTooLarge without writing anything if the packet is larger than maxSize (0 means no limit)
+func WriteVersionLimit(w io.Writer, p ControlPacket, version byte, maxSize int) (err error) {
 	var payload []byte
-	payload, err = p.MarshalBinary()
+	payload, err = p.marshal(version)
 	if err != nil {
 		return
 	}
+	if maxSize > 0 && packetSize(len(payload)) > maxSize {
+		return PacketTooLarge
+	}
+	_, err = w.Write([]byte{p.PacketType()<<4 | p.flags().Byte()})
+	if err != nil {
+		return err
+	}
 	err = WriteRemainingLength(w, len(payload))
 	if err != nil {
 		return
@@ -82,11 +105,32 @@ func Write(w io.Writer, p ControlPacket) (err error) {
 	return
 }
 
+// packetSize returns the total size of a packet, including the fixed header, with the given remaining length
+func packetSize(length int) int {
+	size := 1 + 1 + length
+	for x := length; x >= 128; x /= 128 {
+		size++
+	}
+	return size
+}
+
 // ErrInvalidPacketType is returned when the control packet type is invalid
 var ErrInvalidPacketType = errors.New("Invalid packet type")
 
-// Read a control packet from the Reader
+// Read a control packet from the Reader using MQTT 3.1.1
 func Read(r io.Reader) (p ControlPacket, err error) {
+	return ReadVersion(r, Version311)
+}
+
+// ReadVersion reads a control packet from the Reader using the given protocol version
+// The protocol version of a CONNECT packet is determined by the packet itself
+func ReadVersion(r io.Reader, version byte) (p ControlPacket, err error) {
+	return ReadVersionLimit(r, version, 0)
+}
+
+// ReadVersionLimit reads a control packet from the Reader using the given protocol version
+// returns PacketTooLarge before reading the payload if the packet is larger than maxSize (0 means no limit)
+func ReadVersionLimit(r io.Reader, version byte, maxSize int) (p ControlPacket, err error) {
 	b := make([]byte, 1)
 	_, err = io.ReadFull(r, b)
 	if err != nil {
@@ -102,8 +146,12 @@ func Read(r io.Reader) (p ControlPacket, err error) {
 	if err != nil {
 		return
 	}
+	if maxSize > 0 && packetSize(length) > maxSize {
+		return nil, PacketTooLarge
+	}
 	if length > 0 {
-		payload = make([]byte, length)
+		payload = getBuffer(length)
+		defer putBuffer(payload) // unmarshaled packets do not reference the payload
 		_, err = io.ReadFull(r, payload)
 		if err != nil {
 			return
@@ -138,11 +186,16 @@ func Read(r io.Reader) (p ControlPacket, err error) {
 		p = new(PingrespPacket)
 	case DISCONNECT:
 		p = new(DisconnectPacket)
+	case AUTH:
+		if version < Version5 {
+			return nil, ErrInvalidPacketType
+		}
+		p = new(AuthPacket)
 	default:
 		return nil, ErrInvalidPacketType
 	}
 	p.setFlags(flags)
-	err = p.UnmarshalBinary(payload)
+	err = p.unmarshal(payload, version)
 	return
 }
 
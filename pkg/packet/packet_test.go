@@ -5,6 +5,7 @@ package packet
 import (
 	"bytes"
 	"fmt"
+	"runtime"
 	"testing"
 
 	"github.com/smartystreets/assertions"
@@ -20,7 +21,7 @@ var connectTestSubjects = []ControlPacket{
 
 var connackTestSubjects = []ControlPacket{
 	&ConnackPacket{SessionPresent: true},
-	&ConnackPacket{ReturnCode: ConnectNotAuthorized},
+	&ConnackPacket{ReasonCode: NotAuthorized},
 }
 
 var publishTestSubjects = []ControlPacket{
@@ -64,7 +65,7 @@ var subscribeTestSubjects = []ControlPacket{
 var subackTestSubjects = []ControlPacket{
 	&SubackPacket{
 		PacketIdentifier: 1,
-		ReturnCodes:      []byte{0x01},
+		ReasonCodes:      []ReasonCode{GrantedQoS1, UnspecifiedError},
 	},
 }
 
@@ -130,6 +131,138 @@ func TestMarshalUnmarshal(t *testing.T) {
 	}
 }
 
+var v5TestSubjects = []ControlPacket{
+	&ConnectPacket{ProtocolName: "MQTT", ProtocolLevel: Version5, CleanStart: true, Properties: Properties{
+		SessionExpiryInterval: Uint32(3600),
+		ReceiveMaximum:        Uint16(10),
+		UserProperties:        []UserProperty{{Key: "foo", Value: "bar"}, {Key: "foo", Value: "baz"}},
+	}},
+	&ConnectPacket{ProtocolName: "MQTT", ProtocolLevel: Version5, Will: true, WillTopic: "foo", WillMessage: []byte{1, 2, 3, 4}, WillProperties: Properties{
+		WillDelayInterval: Uint32(10),
+		ContentType:       "application/octet-stream",
+	}},
+	&ConnackPacket{SessionPresent: true, Properties: Properties{AssignedClientIdentifier: "foo"}},
+	&ConnackPacket{ReasonCode: BadAuthenticationMethod},
+	&PublishPacket{QoS: 1, PacketIdentifier: 1, TopicName: "foo", Message: []byte{1, 2, 3, 4}, Properties: Properties{
+		PayloadFormatIndicator:  Byte(1),
+		MessageExpiryInterval:   Uint32(60),
+		ResponseTopic:           "bar",
+		CorrelationData:         []byte{1, 2},
+		SubscriptionIdentifiers: []int{1, 268435455},
+	}},
+	&PubackPacket{PacketIdentifier: 1},
+	&PubackPacket{PacketIdentifier: 1, ReasonCode: NoMatchingSubscribers},
+	&PubrecPacket{PacketIdentifier: 1, ReasonCode: QuotaExceeded, Properties: Properties{ReasonString: "quota exceeded"}},
+	&PubrelPacket{PacketIdentifier: 1, ReasonCode: PacketIdentifierNotFound},
+	&PubcompPacket{PacketIdentifier: 1},
+	&SubscribePacket{
+		PacketIdentifier: 1,
+		Topics:           []string{"foo", "bar"},
+		QoSs:             []byte{0x01, 0x02},
+		Options:          []SubscriptionOptions{{NoLocal: true}, {RetainAsPublished: true, RetainHandling: DoNotSendRetained}},
+		Properties:       Properties{SubscriptionIdentifiers: []int{42}},
+	},
+	&SubackPacket{PacketIdentifier: 1, ReasonCodes: []ReasonCode{GrantedQoS1, TopicFilterInvalid}},
+	&UnsubscribePacket{PacketIdentifier: 1, Topics: []string{"foo"}, Properties: Properties{UserProperties: []UserProperty{{Key: "foo", Value: "bar"}}}},
+	&UnsubackPacket{PacketIdentifier: 1, ReasonCodes: []ReasonCode{Success, NoSubscriptionExisted}},
+	&DisconnectPacket{},
+	&DisconnectPacket{ReasonCode: SessionTakenOver},
+	&AuthPacket{ReasonCode: ContinueAuthentication, Properties: Properties{AuthenticationMethod: "foo", AuthenticationData: []byte{1, 2}}},
+}
+
+func TestMarshalUnmarshalV5(t *testing.T) {
+	buf := new(bytes.Buffer)
+	a := assertions.New(t)
+	for _, pkt := range v5TestSubjects {
+		buf.Reset()
+		a.So(WriteVersion(buf, pkt, Version5), should.BeNil)
+		read, err := ReadVersion(buf, Version5)
+		a.So(err, should.BeNil)
+		a.So(read, should.Resemble, pkt)
+	}
+}
+
+func TestVersionDowngrade(t *testing.T) {
+	a := assertions.New(t)
+	buf := new(bytes.Buffer)
+
+	a.So(Write(buf, &ConnackPacket{ReasonCode: BadAuthenticationMethod}), should.BeNil)
+	connack, err := Read(buf)
+	a.So(err, should.BeNil)
+	a.So(connack, should.Resemble, &ConnackPacket{ReasonCode: NotAuthorized})
+
+	a.So(Write(buf, &SubackPacket{PacketIdentifier: 1, ReasonCodes: []ReasonCode{NotAuthorized}}), should.BeNil)
+	suback, err := Read(buf)
+	a.So(err, should.BeNil)
+	a.So(suback, should.Resemble, &SubackPacket{PacketIdentifier: 1, ReasonCodes: []ReasonCode{UnspecifiedError}})
+
+	a.So(Write(buf, &PubackPacket{PacketIdentifier: 1, ReasonCode: NotAuthorized}), should.BeNil)
+	a.So(buf.Bytes(), should.Resemble, []byte{PUBACK << 4, 2, 0, 1})
+
+	buf.Reset()
+	a.So(WriteVersion(buf, &AuthPacket{}, Version5), should.BeNil)
+	_, err = Read(buf)
+	a.So(err, should.Equal, ErrInvalidPacketType)
+}
+
+func TestLimit(t *testing.T) {
+	a := assertions.New(t)
+	buf := new(bytes.Buffer)
+
+	pkt := &PublishPacket{TopicName: "foo", Message: make([]byte, 200)}
+	a.So(packetSize(205), should.Equal, 208) // 1 byte header, 2 bytes remaining length
+
+	a.So(WriteVersionLimit(buf, pkt, Version311, 207), should.Equal, PacketTooLarge)
+	a.So(buf.Len(), should.Equal, 0)
+	a.So(WriteVersionLimit(buf, pkt, Version311, 208), should.BeNil)
+	a.So(buf.Len(), should.Equal, 208)
+
+	data := append([]byte(nil), buf.Bytes()...)
+	buf.Reset()
+	_, err := ReadVersionLimit(bytes.NewBuffer(data), Version311, 207)
+	a.So(err, should.Equal, PacketTooLarge)
+
+	// the limit is checked before the payload is read
+	_, err = ReadVersionLimit(bytes.NewBuffer([]byte{PUBLISH << 4, 0xff, 0xff, 0xff, 0x7f}), Version311, 1024)
+	a.So(err, should.Equal, PacketTooLarge)
+
+	// the property length is checked against the packet before it is allocated
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err = ReadVersionLimit(bytes.NewBuffer([]byte{PUBLISH << 4, 9, 0, 3, 'f', 'o', 'o', 0xff, 0xff, 0xff, 0x7f}), Version5, 1024)
+	runtime.ReadMemStats(&after)
+	a.So(err, should.NotBeNil)
+	a.So(after.TotalAlloc-before.TotalAlloc, should.BeLessThan, 1<<20)
+
+	read, err := ReadVersionLimit(bytes.NewBuffer(data), Version311, 208)
+	a.So(err, should.BeNil)
+	a.So(read, should.Resemble, pkt)
+
+	// the message does not reference the pooled buffer
+	other := &PublishPacket{TopicName: "bar", Message: bytes.Repeat([]byte{1}, 200)}
+	a.So(Write(buf, other), should.BeNil)
+	_, err = Read(buf)
+	a.So(err, should.BeNil)
+	a.So(read, should.Resemble, pkt)
+}
+
+func TestBuffer(t *testing.T) {
+	a := assertions.New(t)
+	a.So(bufferClass(1), should.Equal, 0)
+	a.So(bufferClass(64), should.Equal, 0)
+	a.So(bufferClass(65), should.Equal, 1)
+	a.So(bufferClass(1<<16), should.Equal, len(bufferPools)-1)
+
+	buf := getBuffer(100)
+	a.So(buf, should.HaveLength, 100)
+	a.So(cap(buf), should.Equal, 128)
+	putBuffer(buf)
+
+	buf = getBuffer(1<<16 + 1)
+	a.So(buf, should.HaveLength, 1<<16+1)
+	putBuffer(buf)
+}
+
 func TestResponse(t *testing.T) {
 	a := assertions.New(t)
 	a.So((&ConnectPacket{}).Response(), should.HaveSameTypeAs, &ConnackPacket{})
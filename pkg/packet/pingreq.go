@@ -16,9 +16,13 @@ func (p PingreqPacket) flags() flags { return flags{} }
 // MarshalBinary implements encoding.BinaryMarshaler
 func (p PingreqPacket) MarshalBinary() (data []byte, err error) { return nil, nil }
 
+func (p PingreqPacket) marshal(version byte) (data []byte, err error) { return nil, nil }
+
 // UnmarshalBinary implements encoding.BinaryUnmarshaler
 func (p *PingreqPacket) UnmarshalBinary(data []byte) error { return nil }
 
+func (p *PingreqPacket) unmarshal(data []byte, version byte) error { return nil }
+
 // Response to the packet
 func (p PingreqPacket) Response() *PingrespPacket {
 	return &PingrespPacket{}
@@ -16,8 +16,12 @@ func (p PingrespPacket) flags() flags { return flags{} }
 // MarshalBinary implements encoding.BinaryMarshaler
 func (p PingrespPacket) MarshalBinary() (data []byte, err error) { return nil, nil }
 
+func (p PingrespPacket) marshal(version byte) (data []byte, err error) { return nil, nil }
+
 // UnmarshalBinary implements encoding.BinaryUnmarshaler
 func (p *PingrespPacket) UnmarshalBinary(data []byte) error { return nil }
 
+func (p *PingrespPacket) unmarshal(data []byte, version byte) error { return nil }
+
 // Validate the packet contents (noop)
 func (p PingrespPacket) Validate() error { return nil }
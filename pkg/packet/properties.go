@@ -0,0 +1,336 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+package packet
+
+import (
+	"bytes"
+	"errors"
+	"io"
+)
+
+// Property identifiers
+const (
+	propPayloadFormatIndicator          = 0x01
+	propMessageExpiryInterval           = 0x02
+	propContentType                     = 0x03
+	propResponseTopic                   = 0x08
+	propCorrelationData                 = 0x09
+	propSubscriptionIdentifier          = 0x0B
+	propSessionExpiryInterval           = 0x11
+	propAssignedClientIdentifier        = 0x12
+	propServerKeepAlive                 = 0x13
+	propAuthenticationMethod            = 0x15
+	propAuthenticationData              = 0x16
+	propRequestProblemInformation       = 0x17
+	propWillDelayInterval               = 0x18
+	propRequestResponseInformation      = 0x19
+	propResponseInformation             = 0x1A
+	propServerReference                 = 0x1C
+	propReasonString                    = 0x1F
+	propReceiveMaximum                  = 0x21
+	propTopicAliasMaximum               = 0x22
+	propTopicAlias                      = 0x23
+	propMaximumQoS                      = 0x24
+	propRetainAvailable                 = 0x25
+	propUserProperty                    = 0x26
+	propMaximumPacketSize               = 0x27
+	propWildcardSubscriptionAvailable   = 0x28
+	propSubscriptionIdentifierAvailable = 0x29
+	propSharedSubscriptionAvailable     = 0x2A
+)
+
+// UserProperty is a name-value pair that is sent in MQTT 5.0 packets
+type UserProperty struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Properties of MQTT 5.0 packets
+// Properties that are nil or empty are not present in the packet
+type Properties struct {
+	PayloadFormatIndicator          *byte          `json:"payload_format_indicator,omitempty"`
+	MessageExpiryInterval           *uint32        `json:"message_expiry_interval,omitempty"`
+	ContentType                     string         `json:"content_type,omitempty"`
+	ResponseTopic                   string         `json:"response_topic,omitempty"`
+	CorrelationData                 []byte         `json:"correlation_data,omitempty"`
+	SubscriptionIdentifiers         []int          `json:"subscription_identifiers,omitempty"`
+	SessionExpiryInterval           *uint32        `json:"session_expiry_interval,omitempty"`
+	AssignedClientIdentifier        string         `json:"assigned_client_identifier,omitempty"`
+	ServerKeepAlive                 *uint16        `json:"server_keep_alive,omitempty"`
+	AuthenticationMethod            string         `json:"authentication_method,omitempty"`
+	AuthenticationData              []byte         `json:"authentication_data,omitempty"`
+	RequestProblemInformation       *byte          `json:"request_problem_information,omitempty"`
+	WillDelayInterval               *uint32        `json:"will_delay_interval,omitempty"`
+	RequestResponseInformation      *byte          `json:"request_response_information,omitempty"`
+	ResponseInformation             string         `json:"response_information,omitempty"`
+	ServerReference                 string         `json:"server_reference,omitempty"`
+	ReasonString                    string         `json:"reason_string,omitempty"`
+	ReceiveMaximum                  *uint16        `json:"receive_maximum,omitempty"`
+	TopicAliasMaximum               *uint16        `json:"topic_alias_maximum,omitempty"`
+	TopicAlias                      *uint16        `json:"topic_alias,omitempty"`
+	MaximumQoS                      *byte          `json:"maximum_qos,omitempty"`
+	RetainAvailable                 *byte          `json:"retain_available,omitempty"`
+	UserProperties                  []UserProperty `json:"user_properties,omitempty"`
+	MaximumPacketSize               *uint32        `json:"maximum_packet_size,omitempty"`
+	WildcardSubscriptionAvailable   *byte          `json:"wildcard_subscription_available,omitempty"`
+	SubscriptionIdentifierAvailable *byte          `json:"subscription_identifier_available,omitempty"`
+	SharedSubscriptionAvailable     *byte          `json:"shared_subscription_available,omitempty"`
+}
+
+// Byte returns a pointer to the byte value
+func Byte(v byte) *byte { return &v }
+
+// Uint16 returns a pointer to the uint16 value
+func Uint16(v uint16) *uint16 { return &v }
+
+// Uint32 returns a pointer to the uint32 value
+func Uint32(v uint32) *uint32 { return &v }
+
+// MarshalBinary implements encoding.BinaryMarshaler
+// The result does not contain the property length
+func (p Properties) MarshalBinary() (data []byte, err error) {
+	buf := new(bytes.Buffer)
+	writeByteProperty := func(id byte, v *byte) {
+		if v != nil {
+			WriteByte(buf, id)
+			WriteByte(buf, *v)
+		}
+	}
+	writeUint16Property := func(id byte, v *uint16) {
+		if v != nil {
+			WriteByte(buf, id)
+			WriteUint16(buf, *v)
+		}
+	}
+	writeUint32Property := func(id byte, v *uint32) {
+		if v != nil {
+			WriteByte(buf, id)
+			WriteUint32(buf, *v)
+		}
+	}
+	writeStringProperty := func(id byte, v string) {
+		if v != "" && err == nil {
+			WriteByte(buf, id)
+			err = WriteString(buf, v)
+		}
+	}
+	writeBytesProperty := func(id byte, v []byte) {
+		if len(v) > 0 && err == nil {
+			WriteByte(buf, id)
+			err = WriteBytes(buf, v)
+		}
+	}
+	writeByteProperty(propPayloadFormatIndicator, p.PayloadFormatIndicator)
+	writeUint32Property(propMessageExpiryInterval, p.MessageExpiryInterval)
+	writeStringProperty(propContentType, p.ContentType)
+	writeStringProperty(propResponseTopic, p.ResponseTopic)
+	writeBytesProperty(propCorrelationData, p.CorrelationData)
+	for _, id := range p.SubscriptionIdentifiers {
+		WriteByte(buf, propSubscriptionIdentifier)
+		if err := WriteVariableByteInteger(buf, id); err != nil {
+			return nil, err
+		}
+	}
+	writeUint32Property(propSessionExpiryInterval, p.SessionExpiryInterval)
+	writeStringProperty(propAssignedClientIdentifier, p.AssignedClientIdentifier)
+	writeUint16Property(propServerKeepAlive, p.ServerKeepAlive)
+	writeStringProperty(propAuthenticationMethod, p.AuthenticationMethod)
+	writeBytesProperty(propAuthenticationData, p.AuthenticationData)
+	writeByteProperty(propRequestProblemInformation, p.RequestProblemInformation)
+	writeUint32Property(propWillDelayInterval, p.WillDelayInterval)
+	writeByteProperty(propRequestResponseInformation, p.RequestResponseInformation)
+	writeStringProperty(propResponseInformation, p.ResponseInformation)
+	writeStringProperty(propServerReference, p.ServerReference)
+	writeStringProperty(propReasonString, p.ReasonString)
+	writeUint16Property(propReceiveMaximum, p.ReceiveMaximum)
+	writeUint16Property(propTopicAliasMaximum, p.TopicAliasMaximum)
+	writeUint16Property(propTopicAlias, p.TopicAlias)
+	writeByteProperty(propMaximumQoS, p.MaximumQoS)
+	writeByteProperty(propRetainAvailable, p.RetainAvailable)
+	for _, prop := range p.UserProperties {
+		WriteByte(buf, propUserProperty)
+		if err := WriteStringPair(buf, prop.Key, prop.Value); err != nil {
+			return nil, err
+		}
+	}
+	writeUint32Property(propMaximumPacketSize, p.MaximumPacketSize)
+	writeByteProperty(propWildcardSubscriptionAvailable, p.WildcardSubscriptionAvailable)
+	writeByteProperty(propSubscriptionIdentifierAvailable, p.SubscriptionIdentifierAvailable)
+	writeByteProperty(propSharedSubscriptionAvailable, p.SharedSubscriptionAvailable)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ErrDuplicateProperty is returned when a property that may only be included once is included more than once
+var ErrDuplicateProperty = errors.New("Duplicate property")
+
+// ErrInvalidProperty is returned when a property is unknown or has an invalid value
+var ErrInvalidProperty = errors.New("Invalid property")
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler
+// The data must not contain the property length
+func (p *Properties) UnmarshalBinary(data []byte) (err error) {
+	*p = Properties{}
+	buf := bytes.NewBuffer(data)
+	var seen [256]bool
+	readByteProperty := func() (*byte, error) {
+		v, err := ReadByte(buf)
+		if err != nil {
+			return nil, err
+		}
+		return &v, nil
+	}
+	readBoolProperty := func() (*byte, error) {
+		v, err := readByteProperty()
+		if err == nil && *v > 1 {
+			err = ErrInvalidProperty
+		}
+		return v, err
+	}
+	readUint16Property := func() (*uint16, error) {
+		v, err := ReadUint16(buf)
+		if err != nil {
+			return nil, err
+		}
+		return &v, nil
+	}
+	readUint32Property := func() (*uint32, error) {
+		v, err := ReadUint32(buf)
+		if err != nil {
+			return nil, err
+		}
+		return &v, nil
+	}
+	for buf.Len() > 0 {
+		var id int
+		id, err = ReadVariableByteInteger(buf)
+		if err != nil {
+			return
+		}
+		if id > 0xFF {
+			return ErrInvalidProperty
+		}
+		if seen[id] && id != propUserProperty && id != propSubscriptionIdentifier {
+			return ErrDuplicateProperty
+		}
+		seen[id] = true
+		switch id {
+		case propPayloadFormatIndicator:
+			p.PayloadFormatIndicator, err = readBoolProperty()
+		case propMessageExpiryInterval:
+			p.MessageExpiryInterval, err = readUint32Property()
+		case propContentType:
+			p.ContentType, err = ReadString(buf)
+		case propResponseTopic:
+			p.ResponseTopic, err = ReadString(buf)
+		case propCorrelationData:
+			p.CorrelationData, err = ReadBytes(buf)
+		case propSubscriptionIdentifier:
+			var subscriptionIdentifier int
+			subscriptionIdentifier, err = ReadVariableByteInteger(buf)
+			if err == nil && subscriptionIdentifier == 0 {
+				err = ErrInvalidProperty
+			}
+			p.SubscriptionIdentifiers = append(p.SubscriptionIdentifiers, subscriptionIdentifier)
+		case propSessionExpiryInterval:
+			p.SessionExpiryInterval, err = readUint32Property()
+		case propAssignedClientIdentifier:
+			p.AssignedClientIdentifier, err = ReadString(buf)
+		case propServerKeepAlive:
+			p.ServerKeepAlive, err = readUint16Property()
+		case propAuthenticationMethod:
+			p.AuthenticationMethod, err = ReadString(buf)
+		case propAuthenticationData:
+			p.AuthenticationData, err = ReadBytes(buf)
+		case propRequestProblemInformation:
+			p.RequestProblemInformation, err = readBoolProperty()
+		case propWillDelayInterval:
+			p.WillDelayInterval, err = readUint32Property()
+		case propRequestResponseInformation:
+			p.RequestResponseInformation, err = readBoolProperty()
+		case propResponseInformation:
+			p.ResponseInformation, err = ReadString(buf)
+		case propServerReference:
+			p.ServerReference, err = ReadString(buf)
+		case propReasonString:
+			p.ReasonString, err = ReadString(buf)
+		case propReceiveMaximum:
+			p.ReceiveMaximum, err = readUint16Property()
+			if err == nil && *p.ReceiveMaximum == 0 {
+				err = ErrInvalidProperty
+			}
+		case propTopicAliasMaximum:
+			p.TopicAliasMaximum, err = readUint16Property()
+		case propTopicAlias:
+			p.TopicAlias, err = readUint16Property()
+			if err == nil && *p.TopicAlias == 0 {
+				err = ErrInvalidProperty
+			}
+		case propMaximumQoS:
+			p.MaximumQoS, err = readBoolProperty()
+		case propRetainAvailable:
+			p.RetainAvailable, err = readBoolProperty()
+		case propUserProperty:
+			var prop UserProperty
+			prop.Key, prop.Value, err = ReadStringPair(buf)
+			p.UserProperties = append(p.UserProperties, prop)
+		case propMaximumPacketSize:
+			p.MaximumPacketSize, err = readUint32Property()
+			if err == nil && *p.MaximumPacketSize == 0 {
+				err = ErrInvalidProperty
+			}
+		case propWildcardSubscriptionAvailable:
+			p.WildcardSubscriptionAvailable, err = readBoolProperty()
+		case propSubscriptionIdentifierAvailable:
+			p.SubscriptionIdentifierAvailable, err = readBoolProperty()
+		case propSharedSubscriptionAvailable:
+			p.SharedSubscriptionAvailable, err = readBoolProperty()
+		default:
+			return ErrInvalidProperty
+		}
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return
+		}
+	}
+	return nil
+}
+
+// WriteProperties writes the properties, prefixed with their length, to the given Writer
+func WriteProperties(w io.Writer, p Properties) (err error) {
+	var data []byte
+	data, err = p.MarshalBinary()
+	if err != nil {
+		return
+	}
+	err = WriteVariableByteInteger(w, len(data))
+	if err != nil {
+		return
+	}
+	_, err = w.Write(data)
+	return
+}
+
+// ReadProperties reads the properties, prefixed with their length, from the given Reader
+func ReadProperties(r io.Reader) (p Properties, err error) {
+	var length int
+	length, err = ReadVariableByteInteger(r)
+	if err != nil {
+		return
+	}
+	// the length is not trusted, so the buffer only grows with the data that is actually read
+	var data bytes.Buffer
+	_, err = io.CopyN(&data, r, int64(length))
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return
+	}
+	err = p.UnmarshalBinary(data.Bytes())
+	return
+}
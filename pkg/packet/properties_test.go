@@ -0,0 +1,40 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+package packet
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/smartystreets/assertions"
+	"github.com/smartystreets/assertions/should"
+)
+
+func TestProperties(t *testing.T) {
+	a := assertions.New(t)
+
+	buf := new(bytes.Buffer)
+	a.So(WriteProperties(buf, Properties{}), should.BeNil)
+	a.So(buf.Bytes(), should.Resemble, []byte{0})
+
+	props := Properties{
+		MaximumQoS:                  Byte(1),
+		SharedSubscriptionAvailable: Byte(0),
+		ServerKeepAlive:             Uint16(60),
+		ReasonString:                "foo",
+		UserProperties:              []UserProperty{{Key: "a", Value: "b"}},
+	}
+	buf.Reset()
+	a.So(WriteProperties(buf, props), should.BeNil)
+	read, err := ReadProperties(buf)
+	a.So(err, should.BeNil)
+	a.So(read, should.Resemble, props)
+
+	var p Properties
+	a.So(p.UnmarshalBinary([]byte{propMaximumQoS, 1, propMaximumQoS, 1}), should.Equal, ErrDuplicateProperty)
+	a.So(p.UnmarshalBinary([]byte{propMaximumQoS, 2}), should.Equal, ErrInvalidProperty)
+	a.So(p.UnmarshalBinary([]byte{0x7F, 0}), should.Equal, ErrInvalidProperty)
+	a.So(p.UnmarshalBinary([]byte{propTopicAlias, 0}), should.NotBeNil)
+	a.So(p.UnmarshalBinary([]byte{propSubscriptionIdentifier, 1, propSubscriptionIdentifier, 2}), should.BeNil)
+	a.So(p.SubscriptionIdentifiers, should.Resemble, []int{1, 2})
+}
@@ -2,11 +2,16 @@
 
 package packet
 
-import "io"
+import (
+	"bytes"
+	"io"
+)
 
 // PubcompPacket is the PUBCOMP packet
 type PubcompPacket struct {
 	PacketIdentifier uint16
+	ReasonCode       ReasonCode // MQTT 5.0
+	Properties       Properties // MQTT 5.0
 }
 
 // PacketType returns the MQTT packet type of this packet
@@ -17,17 +22,33 @@ func (p *PubcompPacket) setFlags(f flags) error { return validateFlags(p.flags()
 func (p PubcompPacket) flags() flags { return flags{} }
 
 // MarshalBinary implements encoding.BinaryMarshaler
-func (p PubcompPacket) MarshalBinary() (data []byte, err error) {
-	return encodeUint16(p.PacketIdentifier), nil
+func (p PubcompPacket) MarshalBinary() (data []byte, err error) { return p.marshal(Version311) }
+
+func (p PubcompPacket) marshal(version byte) (data []byte, err error) {
+	if version < Version5 {
+		return encodeUint16(p.PacketIdentifier), nil
+	}
+	buf := bytes.NewBuffer(encodeUint16(p.PacketIdentifier))
+	err = writeReasonCode(buf, p.ReasonCode, p.Properties)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
 // UnmarshalBinary implements encoding.BinaryUnmarshaler
-func (p *PubcompPacket) UnmarshalBinary(data []byte) error {
+func (p *PubcompPacket) UnmarshalBinary(data []byte) error { return p.unmarshal(data, Version311) }
+
+func (p *PubcompPacket) unmarshal(data []byte, version byte) (err error) {
 	if len(data) < 2 {
 		return io.EOF
 	}
 	p.PacketIdentifier = decodeUint16(data)
-	return nil
+	if version < Version5 {
+		return nil
+	}
+	p.ReasonCode, p.Properties, err = readReasonCode(bytes.NewBuffer(data[2:]))
+	return
 }
 
 // Validate the packet contents
@@ -19,14 +19,16 @@ const (
 
 // PublishPacket is the PUBLISH packet
 type PublishPacket struct {
-	Received         time.Time `json:"received"`
-	Retain           bool      `json:"retained"`
-	QoS              byte      `json:"qos"`
-	Duplicate        bool      `json:"-"`
-	PacketIdentifier uint16    `json:"-"`
-	TopicName        string    `json:"topic"`
-	TopicParts       []string  `json:"-"`
-	Message          []byte    `json:"message"`
+	Received         time.Time  `json:"received"`
+	Retain           bool       `json:"retained"`
+	QoS              byte       `json:"qos"`
+	Duplicate        bool       `json:"-"`
+	PacketIdentifier uint16     `json:"-"`
+	TopicName        string     `json:"topic"`
+	TopicParts       []string   `json:"-"`
+	Message          []byte     `json:"message"`
+	Properties       Properties `json:"properties"` // MQTT 5.0
+	ClientID         string     `json:"-"`          // client identifier of the publisher, set by the server
 }
 
 // PacketType returns the MQTT packet type of this packet
@@ -59,18 +61,28 @@ func (p PublishPacket) flags() (f flags) {
 }
 
 // MarshalBinary implements encoding.BinaryMarshaler
-func (p PublishPacket) MarshalBinary() (data []byte, err error) {
+func (p PublishPacket) MarshalBinary() (data []byte, err error) { return p.marshal(Version311) }
+
+func (p PublishPacket) marshal(version byte) (data []byte, err error) {
 	buf := new(bytes.Buffer)
 	WriteString(buf, p.TopicName)
 	if p.QoS > 0 {
 		WriteUint16(buf, p.PacketIdentifier)
 	}
+	if version >= Version5 {
+		err = WriteProperties(buf, p.Properties)
+		if err != nil {
+			return nil, err
+		}
+	}
 	buf.Write(p.Message)
 	return buf.Bytes(), nil
 }
 
 // UnmarshalBinary implements encoding.BinaryUnmarshaler
-func (p *PublishPacket) UnmarshalBinary(data []byte) (err error) {
+func (p *PublishPacket) UnmarshalBinary(data []byte) error { return p.unmarshal(data, Version311) }
+
+func (p *PublishPacket) unmarshal(data []byte, version byte) (err error) {
 	buf := bytes.NewBuffer(data)
 	p.TopicName, err = ReadString(buf)
 	if err != nil {
@@ -82,8 +94,14 @@ func (p *PublishPacket) UnmarshalBinary(data []byte) (err error) {
 			return
 		}
 	}
+	if version >= Version5 {
+		p.Properties, err = ReadProperties(buf)
+		if err != nil {
+			return
+		}
+	}
 	if buf.Len() > 0 {
-		p.Message = buf.Bytes()
+		p.Message = append([]byte(nil), buf.Bytes()...)
 	}
 	return
 }
@@ -104,5 +122,8 @@ func (p PublishPacket) Validate() error {
 	if p.QoS == 0 && p.Duplicate {
 		return errors.New("DUP can not be 1 for QoS 0 messages")
 	}
+	if p.TopicName == "" && p.Properties.TopicAlias != nil {
+		return nil
+	}
 	return topic.ValidateTopic(p.TopicName)
 }
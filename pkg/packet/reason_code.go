@@ -0,0 +1,186 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+package packet
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// ReasonCode indicates the result of an operation in MQTT 5.0
+// Reason codes of 0x80 or greater indicate failure
+type ReasonCode byte
+
+// Reason codes
+const (
+	Success                             ReasonCode = 0x00
+	NormalDisconnection                 ReasonCode = 0x00
+	GrantedQoS0                         ReasonCode = 0x00
+	GrantedQoS1                         ReasonCode = 0x01
+	GrantedQoS2                         ReasonCode = 0x02
+	DisconnectWithWillMessage           ReasonCode = 0x04
+	NoMatchingSubscribers               ReasonCode = 0x10
+	NoSubscriptionExisted               ReasonCode = 0x11
+	ContinueAuthentication              ReasonCode = 0x18
+	ReAuthenticate                      ReasonCode = 0x19
+	UnspecifiedError                    ReasonCode = 0x80
+	MalformedPacket                     ReasonCode = 0x81
+	ProtocolError                       ReasonCode = 0x82
+	ImplementationSpecificError         ReasonCode = 0x83
+	UnsupportedProtocolVersion          ReasonCode = 0x84
+	ClientIdentifierNotValid            ReasonCode = 0x85
+	BadUsernameOrPassword               ReasonCode = 0x86
+	NotAuthorized                       ReasonCode = 0x87
+	ServerUnavailable                   ReasonCode = 0x88
+	ServerBusy                          ReasonCode = 0x89
+	Banned                              ReasonCode = 0x8A
+	ServerShuttingDown                  ReasonCode = 0x8B
+	BadAuthenticationMethod             ReasonCode = 0x8C
+	KeepAliveTimeout                    ReasonCode = 0x8D
+	SessionTakenOver                    ReasonCode = 0x8E
+	TopicFilterInvalid                  ReasonCode = 0x8F
+	TopicNameInvalid                    ReasonCode = 0x90
+	PacketIdentifierInUse               ReasonCode = 0x91
+	PacketIdentifierNotFound            ReasonCode = 0x92
+	ReceiveMaximumExceeded              ReasonCode = 0x93
+	TopicAliasInvalid                   ReasonCode = 0x94
+	PacketTooLarge                      ReasonCode = 0x95
+	MessageRateTooHigh                  ReasonCode = 0x96
+	QuotaExceeded                       ReasonCode = 0x97
+	AdministrativeAction                ReasonCode = 0x98
+	PayloadFormatInvalid                ReasonCode = 0x99
+	RetainNotSupported                  ReasonCode = 0x9A
+	QoSNotSupported                     ReasonCode = 0x9B
+	UseAnotherServer                    ReasonCode = 0x9C
+	ServerMoved                         ReasonCode = 0x9D
+	SharedSubscriptionsNotSupported     ReasonCode = 0x9E
+	ConnectionRateExceeded              ReasonCode = 0x9F
+	MaximumConnectTime                  ReasonCode = 0xA0
+	SubscriptionIdentifiersNotSupported ReasonCode = 0xA1
+	WildcardSubscriptionsNotSupported   ReasonCode = 0xA2
+)
+
+var reasonCodeNames = map[ReasonCode]string{
+	Success:                             "Success",
+	GrantedQoS1:                         "Granted QoS 1",
+	GrantedQoS2:                         "Granted QoS 2",
+	DisconnectWithWillMessage:           "Disconnect with Will Message",
+	NoMatchingSubscribers:               "No matching subscribers",
+	NoSubscriptionExisted:               "No subscription existed",
+	ContinueAuthentication:              "Continue authentication",
+	ReAuthenticate:                      "Re-authenticate",
+	UnspecifiedError:                    "Unspecified error",
+	MalformedPacket:                     "Malformed Packet",
+	ProtocolError:                       "Protocol Error",
+	ImplementationSpecificError:         "Implementation specific error",
+	UnsupportedProtocolVersion:          "Unsupported Protocol Version",
+	ClientIdentifierNotValid:            "Client Identifier not valid",
+	BadUsernameOrPassword:               "Bad User Name or Password",
+	NotAuthorized:                       "Not authorized",
+	ServerUnavailable:                   "Server unavailable",
+	ServerBusy:                          "Server busy",
+	Banned:                              "Banned",
+	ServerShuttingDown:                  "Server shutting down",
+	BadAuthenticationMethod:             "Bad authentication method",
+	KeepAliveTimeout:                    "Keep Alive timeout",
+	SessionTakenOver:                    "Session taken over",
+	TopicFilterInvalid:                  "Topic Filter invalid",
+	TopicNameInvalid:                    "Topic Name invalid",
+	PacketIdentifierInUse:               "Packet Identifier in use",
+	PacketIdentifierNotFound:            "Packet Identifier not found",
+	ReceiveMaximumExceeded:              "Receive Maximum exceeded",
+	TopicAliasInvalid:                   "Topic Alias invalid",
+	PacketTooLarge:                      "Packet too large",
+	MessageRateTooHigh:                  "Message rate too high",
+	QuotaExceeded:                       "Quota exceeded",
+	AdministrativeAction:                "Administrative action",
+	PayloadFormatInvalid:                "Payload format invalid",
+	RetainNotSupported:                  "Retain not supported",
+	QoSNotSupported:                     "QoS not supported",
+	UseAnotherServer:                    "Use another server",
+	ServerMoved:                         "Server moved",
+	SharedSubscriptionsNotSupported:     "Shared Subscriptions not supported",
+	ConnectionRateExceeded:              "Connection rate exceeded",
+	MaximumConnectTime:                  "Maximum connect time",
+	SubscriptionIdentifiersNotSupported: "Subscription Identifiers not supported",
+	WildcardSubscriptionsNotSupported:   "Wildcard Subscriptions not supported",
+}
+
+func (c ReasonCode) Error() string {
+	if name, ok := reasonCodeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("Unknown (0x%02X)", byte(c))
+}
+
+// IsError returns true if the reason code indicates failure
+func (c ReasonCode) IsError() bool {
+	return c >= UnspecifiedError
+}
+
+// ConnectReturnCode returns the MQTT 3.1.1 return code that corresponds to the reason code
+func (c ReasonCode) ConnectReturnCode() ConnectReturnCode {
+	switch c {
+	case Success:
+		return ConnectAccepted
+	case UnsupportedProtocolVersion:
+		return ConnectUnacceptableProtocolVersion
+	case ClientIdentifierNotValid:
+		return ConnectIdentifierRejected
+	case BadUsernameOrPassword:
+		return ConnectMalformedUsernameOrPassword
+	case NotAuthorized, Banned, BadAuthenticationMethod:
+		return ConnectNotAuthorized
+	}
+	return ConnectServerUnavailable
+}
+
+// ReasonCodeOf returns the reason code that corresponds to the error
+// returns UnspecifiedError if the error is not a ReasonCode or ConnectReturnCode
+func ReasonCodeOf(err error) ReasonCode {
+	switch err := err.(type) {
+	case ReasonCode:
+		return err
+	case ConnectReturnCode:
+		return err.ReasonCode()
+	}
+	return UnspecifiedError
+}
+
+// writeReasonCode writes the reason code and properties of MQTT 5.0 acknowledgements,
+// omitting them if they can be omitted
+func writeReasonCode(buf *bytes.Buffer, code ReasonCode, properties Properties) error {
+	props, err := properties.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if code == Success && len(props) == 0 {
+		return nil
+	}
+	WriteByte(buf, byte(code))
+	if len(props) == 0 {
+		return nil
+	}
+	WriteVariableByteInteger(buf, len(props))
+	_, err = buf.Write(props)
+	return err
+}
+
+// readReasonCode reads the reason code and properties of MQTT 5.0 acknowledgements,
+// which are Success and empty if they are omitted
+func readReasonCode(buf *bytes.Buffer) (code ReasonCode, properties Properties, err error) {
+	if buf.Len() == 0 {
+		return
+	}
+	var b byte
+	b, err = ReadByte(buf)
+	if err != nil {
+		return
+	}
+	code = ReasonCode(b)
+	if buf.Len() == 0 {
+		return
+	}
+	properties, err = ReadProperties(buf)
+	return
+}
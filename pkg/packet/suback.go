@@ -5,9 +5,11 @@ package packet
 import "bytes"
 
 // SubackPacket is the SUBACK packet
+// In MQTT 3.1.1, reason codes that indicate failure are sent as 0x80
 type SubackPacket struct {
 	PacketIdentifier uint16
-	ReturnCodes      []byte
+	ReasonCodes      []ReasonCode
+	Properties       Properties // MQTT 5.0
 }
 
 // PacketType returns the MQTT packet type of this packet
@@ -18,23 +20,52 @@ func (p *SubackPacket) setFlags(f flags) error { return validateFlags(p.flags(),
 func (p SubackPacket) flags() flags { return flags{} }
 
 // MarshalBinary implements encoding.BinaryMarshaler
-func (p SubackPacket) MarshalBinary() (data []byte, err error) {
-	return append(encodeUint16(p.PacketIdentifier), p.ReturnCodes...), nil
+func (p SubackPacket) MarshalBinary() (data []byte, err error) { return p.marshal(Version311) }
+
+func (p SubackPacket) marshal(version byte) (data []byte, err error) {
+	buf := new(bytes.Buffer)
+	WriteUint16(buf, p.PacketIdentifier)
+	if version >= Version5 {
+		err = WriteProperties(buf, p.Properties)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, code := range p.ReasonCodes {
+		if version < Version5 && code.IsError() {
+			code = UnspecifiedError
+		}
+		WriteByte(buf, byte(code))
+	}
+	return buf.Bytes(), nil
 }
 
 // UnmarshalBinary implements encoding.BinaryUnmarshaler
-func (p *SubackPacket) UnmarshalBinary(data []byte) (err error) {
+func (p *SubackPacket) UnmarshalBinary(data []byte) error { return p.unmarshal(data, Version311) }
+
+func (p *SubackPacket) unmarshal(data []byte, version byte) (err error) {
 	buf := bytes.NewBuffer(data)
 	p.PacketIdentifier, err = ReadUint16(buf)
+	if err != nil {
+		return
+	}
+	if version >= Version5 {
+		p.Properties, err = ReadProperties(buf)
+		if err != nil {
+			return
+		}
+	}
 	if l := buf.Len(); l > 0 {
-		p.ReturnCodes = make([]byte, buf.Len())
+		p.ReasonCodes = make([]ReasonCode, l)
 		for i, code := range buf.Bytes() {
-			switch code {
-			case 0, 1, 2, 0x80:
-				p.ReturnCodes[i] = code
-			default:
-				return ErrProtocolViolation
+			if version < Version5 {
+				switch code {
+				case 0, 1, 2, 0x80:
+				default:
+					return ErrProtocolViolation
+				}
 			}
+			p.ReasonCodes[i] = ReasonCode(code)
 		}
 	}
 	return nil
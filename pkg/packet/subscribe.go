@@ -14,8 +14,24 @@ type SubscribePacket struct {
 	PacketIdentifier uint16
 	Topics           []string
 	QoSs             []byte
+	Options          []SubscriptionOptions // MQTT 5.0
+	Properties       Properties            // MQTT 5.0
 }
 
+// SubscriptionOptions are the MQTT 5.0 options of a subscription
+type SubscriptionOptions struct {
+	NoLocal           bool
+	RetainAsPublished bool
+	RetainHandling    byte
+}
+
+// Retain handling options
+const (
+	SendRetained      = 0 // Send retained messages at the time of the subscribe
+	SendRetainedIfNew = 1 // Send retained messages at subscribe only if the subscription does not currently exist
+	DoNotSendRetained = 2 // Do not send retained messages at the time of the subscribe
+)
+
 // PacketType returns the MQTT packet type of this packet
 func (SubscribePacket) PacketType() byte { return SUBSCRIBE }
 
@@ -24,23 +40,45 @@ func (p *SubscribePacket) setFlags(f flags) error { return validateFlags(p.flags
 func (p SubscribePacket) flags() flags { return flags{false, true, false, false} }
 
 // MarshalBinary implements encoding.BinaryMarshaler
-func (p SubscribePacket) MarshalBinary() (data []byte, err error) {
+func (p SubscribePacket) MarshalBinary() (data []byte, err error) { return p.marshal(Version311) }
+
+func (p SubscribePacket) marshal(version byte) (data []byte, err error) {
 	buf := new(bytes.Buffer)
 	WriteUint16(buf, p.PacketIdentifier)
+	if version >= Version5 {
+		err = WriteProperties(buf, p.Properties)
+		if err != nil {
+			return nil, err
+		}
+	}
 	for i, topic := range p.Topics {
 		WriteString(buf, topic)
-		WriteByte(buf, p.QoSs[i]&0x3)
+		options := p.QoSs[i] & 0x3
+		if version >= Version5 && i < len(p.Options) {
+			options |= bit(p.Options[i].NoLocal) << 2
+			options |= bit(p.Options[i].RetainAsPublished) << 3
+			options |= (p.Options[i].RetainHandling & 0x3) << 4
+		}
+		WriteByte(buf, options)
 	}
 	return buf.Bytes(), nil
 }
 
 // UnmarshalBinary implements encoding.BinaryUnmarshaler
-func (p *SubscribePacket) UnmarshalBinary(data []byte) (err error) {
+func (p *SubscribePacket) UnmarshalBinary(data []byte) error { return p.unmarshal(data, Version311) }
+
+func (p *SubscribePacket) unmarshal(data []byte, version byte) (err error) {
 	buf := bytes.NewBuffer(data)
 	p.PacketIdentifier, err = ReadUint16(buf)
 	if err != nil {
 		return
 	}
+	if version >= Version5 {
+		p.Properties, err = ReadProperties(buf)
+		if err != nil {
+			return
+		}
+	}
 	for buf.Len() > 0 {
 		topic, err := ReadString(buf)
 		if err == io.EOF {
@@ -49,7 +87,7 @@ func (p *SubscribePacket) UnmarshalBinary(data []byte) (err error) {
 		if err != nil {
 			return err
 		}
-		qos, err := ReadByte(buf)
+		options, err := ReadByte(buf)
 		if err == io.EOF {
 			break
 		}
@@ -57,6 +95,19 @@ func (p *SubscribePacket) UnmarshalBinary(data []byte) (err error) {
 			return err
 		}
 		p.Topics = append(p.Topics, topic)
+		qos := options & 0x3
+		if version >= Version5 {
+			if options>>6 != 0 || options>>4&0x3 == 3 {
+				return ErrProtocolViolation
+			}
+			p.Options = append(p.Options, SubscriptionOptions{
+				NoLocal:           options>>2&1 == 1,
+				RetainAsPublished: options>>3&1 == 1,
+				RetainHandling:    options >> 4 & 0x3,
+			})
+		} else if options>>2 != 0 {
+			return ErrProtocolViolation
+		}
 		switch qos {
 		case 0, 1, 2:
 			p.QoSs = append(p.QoSs, qos)
@@ -69,23 +120,27 @@ func (p *SubscribePacket) UnmarshalBinary(data []byte) (err error) {
 
 // Response to the packet
 func (p SubscribePacket) Response() *SubackPacket {
-	returnCodes := make([]byte, len(p.QoSs))
-	copy(returnCodes, p.QoSs)
-	return &SubackPacket{PacketIdentifier: p.PacketIdentifier, ReturnCodes: returnCodes}
+	reasonCodes := make([]ReasonCode, len(p.QoSs))
+	for i, qos := range p.QoSs {
+		reasonCodes[i] = ReasonCode(qos)
+	}
+	return &SubackPacket{PacketIdentifier: p.PacketIdentifier, ReasonCodes: reasonCodes}
 }
 
-// SubscribeRejected response code
-var SubscribeRejected byte = 0x80
-
 // Validate the packet contents
 func (p SubscribePacket) Validate() (err error) {
 	if err = validatePacketIdentifier(p.PacketIdentifier); err != nil {
 		return err
 	}
-	for _, t := range p.Topics {
+	for i, t := range p.Topics {
 		if err = topic.ValidateFilter(t); err != nil {
 			return err
 		}
+		if i < len(p.Options) && p.Options[i].NoLocal {
+			if _, _, shared := topic.SplitShare(t); shared {
+				return ProtocolError // No Local is not allowed on shared subscriptions
+			}
+		}
 	}
 	return nil
 }
@@ -2,11 +2,16 @@
 
 package packet
 
-import "io"
+import (
+	"bytes"
+	"io"
+)
 
 // UnsubackPacket is the UNSUBACK packet
 type UnsubackPacket struct {
 	PacketIdentifier uint16
+	ReasonCodes      []ReasonCode // MQTT 5.0
+	Properties       Properties   // MQTT 5.0
 }
 
 // PacketType returns the MQTT packet type of this packet
@@ -17,16 +22,45 @@ func (p *UnsubackPacket) setFlags(f flags) error { return validateFlags(p.flags(
 func (p UnsubackPacket) flags() flags { return flags{} }
 
 // MarshalBinary implements encoding.BinaryMarshaler
-func (p UnsubackPacket) MarshalBinary() (data []byte, err error) {
-	return encodeUint16(p.PacketIdentifier), nil
+func (p UnsubackPacket) MarshalBinary() (data []byte, err error) { return p.marshal(Version311) }
+
+func (p UnsubackPacket) marshal(version byte) (data []byte, err error) {
+	if version < Version5 {
+		return encodeUint16(p.PacketIdentifier), nil
+	}
+	buf := bytes.NewBuffer(encodeUint16(p.PacketIdentifier))
+	err = WriteProperties(buf, p.Properties)
+	if err != nil {
+		return nil, err
+	}
+	for _, code := range p.ReasonCodes {
+		WriteByte(buf, byte(code))
+	}
+	return buf.Bytes(), nil
 }
 
 // UnmarshalBinary implements encoding.BinaryUnmarshaler
-func (p *UnsubackPacket) UnmarshalBinary(data []byte) error {
+func (p *UnsubackPacket) UnmarshalBinary(data []byte) error { return p.unmarshal(data, Version311) }
+
+func (p *UnsubackPacket) unmarshal(data []byte, version byte) (err error) {
 	if len(data) < 2 {
 		return io.EOF
 	}
 	p.PacketIdentifier = decodeUint16(data)
+	if version < Version5 {
+		return nil
+	}
+	buf := bytes.NewBuffer(data[2:])
+	p.Properties, err = ReadProperties(buf)
+	if err != nil {
+		return
+	}
+	if l := buf.Len(); l > 0 {
+		p.ReasonCodes = make([]ReasonCode, l)
+		for i, code := range buf.Bytes() {
+			p.ReasonCodes[i] = ReasonCode(code)
+		}
+	}
 	return nil
 }
 
@@ -13,6 +13,7 @@ import (
 type UnsubscribePacket struct {
 	PacketIdentifier uint16
 	Topics           []string
+	Properties       Properties // MQTT 5.0
 }
 
 // PacketType returns the MQTT packet type of this packet
@@ -23,9 +24,17 @@ func (p *UnsubscribePacket) setFlags(f flags) error { return validateFlags(p.fla
 func (p UnsubscribePacket) flags() flags { return flags{false, true, false, false} }
 
 // MarshalBinary implements encoding.BinaryMarshaler
-func (p UnsubscribePacket) MarshalBinary() (data []byte, err error) {
+func (p UnsubscribePacket) MarshalBinary() (data []byte, err error) { return p.marshal(Version311) }
+
+func (p UnsubscribePacket) marshal(version byte) (data []byte, err error) {
 	buf := new(bytes.Buffer)
 	WriteUint16(buf, p.PacketIdentifier)
+	if version >= Version5 {
+		err = WriteProperties(buf, p.Properties)
+		if err != nil {
+			return nil, err
+		}
+	}
 	for _, topic := range p.Topics {
 		WriteString(buf, topic)
 	}
@@ -33,12 +42,20 @@ func (p UnsubscribePacket) MarshalBinary() (data []byte, err error) {
 }
 
 // UnmarshalBinary implements encoding.BinaryUnmarshaler
-func (p *UnsubscribePacket) UnmarshalBinary(data []byte) (err error) {
+func (p *UnsubscribePacket) UnmarshalBinary(data []byte) error { return p.unmarshal(data, Version311) }
+
+func (p *UnsubscribePacket) unmarshal(data []byte, version byte) (err error) {
 	buf := bytes.NewBuffer(data)
 	p.PacketIdentifier, err = ReadUint16(buf)
 	if err != nil {
 		return
 	}
+	if version >= Version5 {
+		p.Properties, err = ReadProperties(buf)
+		if err != nil {
+			return
+		}
+	}
 	for buf.Len() > 0 {
 		topic, err := ReadString(buf)
 		if err == io.EOF {
@@ -54,7 +71,8 @@ func (p *UnsubscribePacket) UnmarshalBinary(data []byte) (err error) {
 
 // Response to the packet
 func (p UnsubscribePacket) Response() *UnsubackPacket {
-	return &UnsubackPacket{PacketIdentifier: p.PacketIdentifier}
+	reasonCodes := make([]ReasonCode, len(p.Topics))
+	return &UnsubackPacket{PacketIdentifier: p.PacketIdentifier, ReasonCodes: reasonCodes}
 }
 
 // Validate the packet contents
@@ -4,6 +4,7 @@
 package pending
 
 import (
+	"math"
 	"sync"
 
 	"github.com/TheThingsIndustries/mystique/pkg/packet"
@@ -18,6 +19,7 @@ type pendingPacket struct {
 type List struct {
 	mu       sync.Mutex
 	messages []pendingPacket
+	last     uint16 // last allocated packet identifier
 }
 
 // Add a pending packet to the end of the list
@@ -37,6 +39,36 @@ func (p *List) Add(id uint16, pkt packet.ControlPacket) (added bool) {
 	return true
 }
 
+// Allocate a packet identifier that is not in use by a pending packet,
+// and add the packet that is returned by build to the end of the list
+// packet identifier 0 is never allocated
+// returns false if all packet identifiers are in use
+func (p *List) Allocate(build func(id uint16) packet.ControlPacket) (id uint16, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.messages) >= math.MaxUint16 {
+		return 0, false
+	}
+	inUse := make(map[uint16]struct{}, len(p.messages))
+	for _, pkt := range p.messages {
+		inUse[pkt.id] = struct{}{}
+	}
+	id = p.last
+	for {
+		id++
+		if id == 0 {
+			continue
+		}
+		if _, ok := inUse[id]; !ok {
+			break
+		}
+	}
+	p.last = id
+	p.messages = append(p.messages, pendingPacket{id: id, pkt: build(id)})
+	pendingMessagesGauge.Inc()
+	return id, true
+}
+
 // Remove a pending packet, guessing it is in the beginning of the list
 func (p *List) Remove(id uint16) (removed bool) {
 	p.mu.Lock()
@@ -52,6 +84,22 @@ func (p *List) Remove(id uint16) (removed bool) {
 	return
 }
 
+// Take removes a pending packet and returns it
+// returns nil if there is no such packet
+func (p *List) Take(id uint16) (pkt packet.ControlPacket) {
+	p.mu.Lock()
+	for i, pending := range p.messages {
+		if pending.id == id {
+			p.messages = append(p.messages[:i], p.messages[i+1:]...)
+			pkt = pending.pkt
+			pendingMessagesGauge.Dec()
+			break
+		}
+	}
+	p.mu.Unlock()
+	return
+}
+
 // Clear the list
 func (p *List) Clear() {
 	p.mu.Lock()
@@ -60,6 +108,18 @@ func (p *List) Clear() {
 	p.mu.Unlock()
 }
 
+// MoveTo moves all pending packets to the end of the other list
+func (p *List) MoveTo(other *List) {
+	p.mu.Lock()
+	messages, last := p.messages, p.last
+	p.messages = nil
+	p.mu.Unlock()
+	other.mu.Lock()
+	other.messages = append(other.messages, messages...)
+	other.last = last
+	other.mu.Unlock()
+}
+
 // Len returns the length of the list.
 func (p *List) Len() (l int) {
 	p.mu.Lock()
@@ -37,6 +37,51 @@ func TestPendingPackets(t *testing.T) {
 	a.So(p.Remove(0), should.BeFalse)
 	a.So(p.Get(), should.HaveLength, 2)
 
+	a.So(p.Take(2), should.NotBeNil)
+	a.So(p.Take(2), should.BeNil)
+	a.So(p.Add(2, new(packet.PublishPacket)), should.BeTrue)
+
+	other := new(List)
+	other.Add(4, new(packet.PublishPacket))
+	p.MoveTo(other)
+	a.So(p.Get(), should.BeEmpty)
+	a.So(other.Get(), should.HaveLength, 3)
+
 	p.Clear()
 	a.So(p.Get(), should.BeEmpty)
 }
+
+func TestAllocate(t *testing.T) {
+	a := assertions.New(t)
+	p := new(List)
+
+	build := func(id uint16) packet.ControlPacket {
+		return &packet.PublishPacket{PacketIdentifier: id}
+	}
+
+	id, ok := p.Allocate(build)
+	a.So(ok, should.BeTrue)
+	a.So(id, should.Equal, 1)
+	a.So(p.Get(), should.Resemble, []packet.ControlPacket{&packet.PublishPacket{PacketIdentifier: 1}})
+
+	// identifiers that are in use are skipped
+	p.Add(2, new(packet.PubrelPacket))
+	id, _ = p.Allocate(build)
+	a.So(id, should.Equal, 3)
+
+	// identifier 0 is skipped when wrapping around
+	p.Clear()
+	p.last = 65534
+	id, _ = p.Allocate(build)
+	a.So(id, should.Equal, 65535)
+	id, _ = p.Allocate(build)
+	a.So(id, should.Equal, 1)
+
+	// the list is full
+	p.Clear()
+	for i := 1; i <= 65535; i++ {
+		p.messages = append(p.messages, pendingPacket{id: uint16(i), pkt: new(packet.PubrelPacket)})
+	}
+	_, ok = p.Allocate(build)
+	a.So(ok, should.BeFalse)
+}
@@ -0,0 +1,24 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+package retained
+
+import "context"
+
+type ctxKeyType struct{}
+
+var ctxKey ctxKeyType
+
+// StoreFromContext returns the retained message store from the context
+func StoreFromContext(ctx context.Context) Store {
+	if v := ctx.Value(ctxKey); v != nil {
+		if store, ok := v.(Store); ok {
+			return store
+		}
+	}
+	return nil
+}
+
+// NewContextWithStore returns a new context that contains the retained message store
+func NewContextWithStore(ctx context.Context, store Store) context.Context {
+	return context.WithValue(ctx, ctxKey, store)
+}
@@ -0,0 +1,84 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+// Package retained implements storage for retained messages.
+package retained
+
+import (
+	"sync"
+
+	"github.com/TheThingsIndustries/mystique/pkg/packet"
+	"github.com/TheThingsIndustries/mystique/pkg/topic"
+)
+
+// Store for retained messages
+type Store interface {
+	// Retain stores the packet as the retained message of its topic
+	// a packet with an empty message clears the retained message of the topic
+	Retain(pkt *packet.PublishPacket)
+
+	// Get the retained messages that match the topic filter
+	Get(filter string) []*packet.PublishPacket
+
+	// Count the retained messages
+	Count() int
+}
+
+// SimpleStore returns a simple in-memory Store implementation
+func SimpleStore() Store {
+	return &simpleStore{
+		messages: make(map[string]*packet.PublishPacket),
+	}
+}
+
+type simpleStore struct {
+	mu       sync.RWMutex
+	messages map[string]*packet.PublishPacket
+}
+
+func (s *simpleStore) Retain(pkt *packet.PublishPacket) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, exists := s.messages[pkt.TopicName]
+	if len(pkt.Message) == 0 {
+		if exists {
+			delete(s.messages, pkt.TopicName)
+			retainedMessagesGauge.Dec()
+		}
+		return
+	}
+	topicParts := pkt.TopicParts
+	if topicParts == nil {
+		topicParts = topic.Split(pkt.TopicName)
+	}
+	s.messages[pkt.TopicName] = &packet.PublishPacket{
+		Received:   pkt.Received,
+		Retain:     true,
+		QoS:        pkt.QoS,
+		TopicName:  pkt.TopicName,
+		TopicParts: topicParts,
+		Message:    pkt.Message,
+		Properties: pkt.Properties,
+	}
+	if !exists {
+		retainedMessagesGauge.Inc()
+	}
+}
+
+func (s *simpleStore) Get(filter string) (matches []*packet.PublishPacket) {
+	filterPath := topic.Split(filter)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, pkt := range s.messages {
+		if topic.MatchPath(pkt.TopicParts, filterPath) {
+			matches = append(matches, pkt)
+		}
+	}
+	return
+}
+
+func (s *simpleStore) Count() (count int) {
+	s.mu.RLock()
+	count = len(s.messages)
+	s.mu.RUnlock()
+	return
+}
@@ -0,0 +1,60 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+package retained
+
+import (
+	"context"
+	"testing"
+
+	"github.com/TheThingsIndustries/mystique/pkg/packet"
+	"github.com/smartystreets/assertions"
+	"github.com/smartystreets/assertions/should"
+)
+
+func TestRetained(t *testing.T) {
+	a := assertions.New(t)
+	s := SimpleStore()
+
+	a.So(s.Get("#"), should.BeEmpty)
+
+	s.Retain(&packet.PublishPacket{TopicName: "foo/bar", Message: []byte("bar"), QoS: 1})
+	s.Retain(&packet.PublishPacket{TopicName: "foo/baz", Message: []byte("baz")})
+	s.Retain(&packet.PublishPacket{TopicName: "$SYS/uptime", Message: []byte("1")})
+
+	a.So(s.Count(), should.Equal, 3)
+	a.So(s.Get("#"), should.HaveLength, 2)
+	a.So(s.Get("foo/+"), should.HaveLength, 2)
+	a.So(s.Get("$SYS/#"), should.HaveLength, 1)
+	a.So(s.Get("other"), should.BeEmpty)
+
+	matches := s.Get("foo/bar")
+	if a.So(matches, should.HaveLength, 1) {
+		a.So(matches[0].Retain, should.BeTrue)
+		a.So(matches[0].QoS, should.Equal, 1)
+		a.So(matches[0].Message, should.Resemble, []byte("bar"))
+	}
+
+	s.Retain(&packet.PublishPacket{TopicName: "foo/bar", Message: []byte("new")})
+	a.So(s.Count(), should.Equal, 3)
+	matches = s.Get("foo/bar")
+	if a.So(matches, should.HaveLength, 1) {
+		a.So(matches[0].Message, should.Resemble, []byte("new"))
+	}
+
+	s.Retain(&packet.PublishPacket{TopicName: "foo/bar"})
+	a.So(s.Count(), should.Equal, 2)
+	a.So(s.Get("foo/bar"), should.BeEmpty)
+
+	s.Retain(&packet.PublishPacket{TopicName: "not/retained"})
+	a.So(s.Count(), should.Equal, 2)
+}
+
+func TestContext(t *testing.T) {
+	a := assertions.New(t)
+
+	a.So(StoreFromContext(context.Background()), should.BeNil)
+
+	s := SimpleStore()
+	ctx := NewContextWithStore(context.Background(), s)
+	a.So(StoreFromContext(ctx), should.Equal, s)
+}
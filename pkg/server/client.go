@@ -0,0 +1,222 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/TheThingsIndustries/mystique/pkg/auth"
+	"github.com/TheThingsIndustries/mystique/pkg/log"
+	"github.com/TheThingsIndustries/mystique/pkg/packet"
+	"github.com/TheThingsIndustries/mystique/pkg/session"
+	"github.com/TheThingsIndustries/mystique/pkg/topic"
+)
+
+// Handler handles the messages for a subscription of an in-process client
+// The handlers of a client are called from a single goroutine; a slow handler makes the client a slow consumer.
+type Handler func(pkt *packet.PublishPacket)
+
+// ChanHandler returns a Handler that sends the messages to the channel
+func ChanHandler(ch chan<- *packet.PublishPacket) Handler {
+	return func(pkt *packet.PublishPacket) { ch <- pkt }
+}
+
+// Client is an in-process client of the server
+// Its subscriptions are added to the same index as the subscriptions of network clients,
+// and the auth interface of the server authorizes its subscriptions and messages.
+type Client interface {
+	AuthInfo() auth.Info
+
+	// Subscribe to the topic filter, and call the handler for the messages on topics that match the filter
+	// returns the QoS that was accepted by the auth interface
+	// returns packet.NotAuthorized if the auth interface does not allow the subscription
+	Subscribe(filter string, qos byte, handler Handler) (byte, error)
+
+	// Unsubscribe from the topic filter
+	// returns packet.NoSubscriptionExisted if the client is not subscribed to the filter
+	Unsubscribe(filter string) error
+
+	// Publish the message
+	// returns nil when the server accepted the message for delivery to the subscribers
+	// returns packet.NotAuthorized if the auth interface does not allow the client to publish on the topic
+	// returns the error of the context if it is done before the server accepted the message
+	Publish(ctx context.Context, pkt *packet.PublishPacket) error
+
+	// Close the client
+	// must not be called from a handler
+	Close()
+}
+
+// ErrClientClosed is returned when a closed client is used
+var ErrClientClosed = errors.New("Client is closed")
+
+func (s *server) Connect(info auth.Info) (Client, error) {
+	select {
+	case <-s.shutdown:
+		return nil, ErrShuttingDown
+	default:
+	}
+	sess, err := session.NewLocal(s.ctx, info, s.Publish)
+	if err != nil {
+		return nil, err
+	}
+	s.sessions.Store(sess)
+	c := &client{
+		server:   s,
+		session:  sess,
+		handlers: make(map[string]Handler),
+		closing:  make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go c.run()
+	return c, nil
+}
+
+type client struct {
+	server  *server
+	session session.Session
+
+	handlers   map[string]Handler
+	handlersMu sync.RWMutex
+
+	closeOnce sync.Once
+	closing   chan struct{}
+	done      chan struct{}
+}
+
+func (c *client) AuthInfo() auth.Info { return c.session.AuthInfo() }
+
+func (c *client) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *client) Subscribe(filter string, qos byte, handler Handler) (byte, error) {
+	if c.closed() {
+		return 0, ErrClientClosed
+	}
+	if err := topic.ValidateFilter(filter); err != nil {
+		return 0, err
+	}
+	if qos > 2 {
+		return 0, packet.QoSNotSupported
+	}
+	c.handlersMu.Lock()
+	c.handlers[filter] = handler
+	c.handlersMu.Unlock()
+	suback, err := c.session.HandleSubscribe(&packet.SubscribePacket{
+		Topics: []string{filter},
+		QoSs:   []byte{qos},
+	})
+	if err == nil && suback.ReasonCodes[0].IsError() {
+		err = suback.ReasonCodes[0]
+	}
+	if err != nil {
+		c.handlersMu.Lock()
+		delete(c.handlers, filter)
+		c.handlersMu.Unlock()
+		return 0, err
+	}
+	return byte(suback.ReasonCodes[0]), nil
+}
+
+func (c *client) Unsubscribe(filter string) error {
+	if c.closed() {
+		return ErrClientClosed
+	}
+	unsuback, err := c.session.HandleUnsubscribe(&packet.UnsubscribePacket{
+		Topics: []string{filter},
+	})
+	if err != nil {
+		return err
+	}
+	c.handlersMu.Lock()
+	delete(c.handlers, filter)
+	c.handlersMu.Unlock()
+	if code := unsuback.ReasonCodes[0]; code != packet.Success {
+		return code
+	}
+	return nil
+}
+
+func (c *client) Publish(ctx context.Context, pkt *packet.PublishPacket) error {
+	if c.closed() {
+		return ErrClientClosed
+	}
+	if err := topic.ValidateTopic(pkt.TopicName); err != nil {
+		return err
+	}
+	if pkt.QoS > 2 {
+		return packet.QoSNotSupported
+	}
+	pub := *pkt
+	pub.Received = time.Now().UTC()
+	pub.TopicParts = topic.Split(pub.TopicName)
+	info := c.session.AuthInfo()
+	if !info.CanWrite(pub.TopicParts...) {
+		return packet.NotAuthorized
+	}
+	return c.server.publish(ctx, &pub)
+}
+
+func (c *client) Close() {
+	c.closeOnce.Do(func() { close(c.closing) })
+	<-c.done
+}
+
+// run dispatches the messages for the client until the client is closed
+func (c *client) run() {
+	logger := log.FromContext(c.session.Context())
+	defer func() {
+		c.server.sessions.Delete(c.session)
+		c.session.Close()
+		close(c.done)
+	}()
+	publish := c.session.PublishChan()
+	terminated := c.session.Terminated()
+	for {
+		select {
+		case <-c.closing:
+			return
+		case err := <-terminated:
+			logger.WithError(err).Info("Terminate in-process client")
+			return
+		case <-c.server.shutdown:
+			return
+		case pkt := <-publish:
+			c.dispatch(pkt)
+			switch pkt.QoS {
+			case 1:
+				c.session.HandlePuback(&packet.PubackPacket{PacketIdentifier: pkt.PacketIdentifier})
+			case 2:
+				c.session.HandlePubrec(&packet.PubrecPacket{PacketIdentifier: pkt.PacketIdentifier})
+				c.session.HandlePubcomp(&packet.PubcompPacket{PacketIdentifier: pkt.PacketIdentifier})
+			}
+		}
+	}
+}
+
+// dispatch the message to the handlers of the filters that match its topic
+func (c *client) dispatch(pkt *packet.PublishPacket) {
+	var handlers []Handler
+	c.handlersMu.RLock()
+	for filter, handler := range c.handlers {
+		if _, sharedFilter, ok := topic.SplitShare(filter); ok {
+			filter = sharedFilter
+		}
+		if topic.MatchPath(pkt.TopicParts, topic.Split(filter)) {
+			handlers = append(handlers, handler)
+		}
+	}
+	c.handlersMu.RUnlock()
+	for _, handler := range handlers {
+		handler(pkt)
+	}
+}
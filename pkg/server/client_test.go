@@ -0,0 +1,164 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/TheThingsIndustries/mystique/pkg/auth"
+	"github.com/TheThingsIndustries/mystique/pkg/packet"
+	"github.com/TheThingsIndustries/mystique/pkg/topic"
+	"github.com/smartystreets/assertions"
+	"github.com/smartystreets/assertions/should"
+)
+
+// prefixAuth allows users to subscribe and publish to topics that start with their username
+type prefixAuth struct{}
+
+func (a prefixAuth) Connect(ctx context.Context, info *auth.Info) (context.Context, error) {
+	if info.Username == "" {
+		return ctx, errors.New("no username")
+	}
+	info.Interface = a
+	return ctx, nil
+}
+func (a prefixAuth) Subscribe(info *auth.Info, requestedTopic string, requestedQoS byte) (string, byte, error) {
+	if !a.CanRead(info, topic.Split(requestedTopic)...) {
+		return requestedTopic, requestedQoS, errors.New("not allowed")
+	}
+	return requestedTopic, requestedQoS, nil
+}
+func (a prefixAuth) CanRead(info *auth.Info, topic ...string) bool {
+	return topic[0] == info.Username
+}
+func (a prefixAuth) CanWrite(info *auth.Info, topic ...string) bool {
+	return topic[0] == info.Username
+}
+
+func receive(t *testing.T, ch <-chan *packet.PublishPacket) *packet.PublishPacket {
+	t.Helper()
+	select {
+	case pkt := <-ch:
+		return pkt
+	case <-time.After(time.Second):
+		t.Fatal("Did not receive message")
+		return nil
+	}
+}
+
+func TestClient(t *testing.T) {
+	a := assertions.New(t)
+	ctx := context.Background()
+	s := New(ctx)
+
+	sub, err := s.Connect(auth.Info{ClientID: "sub"})
+	a.So(err, should.BeNil)
+	defer sub.Close()
+	a.So(sub.AuthInfo().Transport, should.Equal, "local")
+
+	pub, err := s.Connect(auth.Info{})
+	a.So(err, should.BeNil)
+	defer pub.Close()
+	a.So(pub.AuthInfo().ClientID, should.NotBeEmpty)
+
+	messages := make(chan *packet.PublishPacket, 10)
+	qos, err := sub.Subscribe("foo/#", 1, ChanHandler(messages))
+	a.So(err, should.BeNil)
+	a.So(qos, should.Equal, 1)
+
+	_, err = sub.Subscribe("foo/#/bar", 2, nil)
+	a.So(err, should.NotBeNil)
+
+	// from an in-process client
+	a.So(pub.Publish(ctx, &packet.PublishPacket{TopicName: "foo/bar", QoS: 1, Message: []byte("local")}), should.BeNil)
+	msg := receive(t, messages)
+	a.So(msg.TopicName, should.Equal, "foo/bar")
+	a.So(msg.Message, should.Resemble, []byte("local"))
+	a.So(msg.QoS, should.Equal, 1)
+
+	// from a network client
+	conn, _ := connect(t, s, &packet.ConnectPacket{ProtocolName: "MQTT", ProtocolLevel: 4, ClientID: "network"})
+	defer conn.Close()
+	a.So(conn.Send(&packet.SubscribePacket{PacketIdentifier: 1, Topics: []string{"foo/#"}, QoSs: []byte{0}}), should.BeNil)
+	_, err = conn.Receive()
+	a.So(err, should.BeNil)
+	a.So(conn.Send(&packet.PublishPacket{TopicName: "foo/baz", Message: []byte("network")}), should.BeNil)
+	msg = receive(t, messages)
+	a.So(msg.Message, should.Resemble, []byte("network"))
+
+	// to a network client
+	pkt, err := conn.Receive()
+	a.So(err, should.BeNil)
+	a.So(pkt.(*packet.PublishPacket).Message, should.Resemble, []byte("network"))
+	a.So(pub.Publish(ctx, &packet.PublishPacket{TopicName: "foo/qux", Message: []byte("local")}), should.BeNil)
+	pkt, err = conn.Receive()
+	a.So(err, should.BeNil)
+	a.So(pkt.(*packet.PublishPacket).TopicName, should.Equal, "foo/qux")
+	receive(t, messages)
+
+	// retained messages
+	a.So(pub.Publish(ctx, &packet.PublishPacket{TopicName: "retained", Retain: true, Message: []byte("retained")}), should.BeNil)
+	_, err = sub.Subscribe("retained", 0, ChanHandler(messages))
+	a.So(err, should.BeNil)
+	msg = receive(t, messages)
+	a.So(msg.Message, should.Resemble, []byte("retained"))
+
+	a.So(sub.Unsubscribe("foo/#"), should.BeNil)
+	a.So(sub.Unsubscribe("foo/#"), should.Equal, packet.NoSubscriptionExisted)
+	a.So(pub.Publish(ctx, &packet.PublishPacket{TopicName: "foo/bar"}), should.BeNil)
+	a.So(pub.Publish(ctx, &packet.PublishPacket{TopicName: "retained"}), should.BeNil)
+	msg = receive(t, messages)
+	a.So(msg.TopicName, should.Equal, "retained")
+
+	a.So(pub.Publish(ctx, &packet.PublishPacket{TopicName: "foo/#"}), should.NotBeNil)
+
+	sub.Close()
+	a.So(s.Sessions().Get("", "sub"), should.BeNil)
+	_, err = sub.Subscribe("foo", 0, nil)
+	a.So(err, should.Equal, ErrClientClosed)
+	a.So(sub.Publish(ctx, &packet.PublishPacket{TopicName: "foo"}), should.Equal, ErrClientClosed)
+}
+
+func TestClientAuth(t *testing.T) {
+	a := assertions.New(t)
+	ctx := context.Background()
+	s := New(ctx, WithAuth(prefixAuth{}))
+
+	_, err := s.Connect(auth.Info{})
+	a.So(err, should.NotBeNil)
+
+	client, err := s.Connect(auth.Info{Username: "foo"})
+	a.So(err, should.BeNil)
+	defer client.Close()
+
+	messages := make(chan *packet.PublishPacket, 10)
+	_, err = client.Subscribe("bar/#", 1, ChanHandler(messages))
+	a.So(err, should.Equal, packet.NotAuthorized)
+	_, err = client.Subscribe("foo/#", 1, ChanHandler(messages))
+	a.So(err, should.BeNil)
+
+	a.So(client.Publish(ctx, &packet.PublishPacket{TopicName: "bar/baz"}), should.Equal, packet.NotAuthorized)
+	a.So(client.Publish(ctx, &packet.PublishPacket{TopicName: "foo/bar"}), should.BeNil)
+	msg := receive(t, messages)
+	a.So(msg.TopicName, should.Equal, "foo/bar")
+}
+
+func TestClientShutdown(t *testing.T) {
+	a := assertions.New(t)
+	s := New(context.Background())
+
+	client, err := s.Connect(auth.Info{ClientID: "client"})
+	a.So(err, should.BeNil)
+
+	_, err = s.Shutdown(context.Background())
+	a.So(err, should.BeNil)
+
+	client.Close()
+	a.So(s.Sessions().All(), should.BeEmpty)
+
+	_, err = s.Connect(auth.Info{})
+	a.So(err, should.Equal, ErrShuttingDown)
+}
@@ -45,3 +45,10 @@ func (l *limits) disconnect(id string) {
 		delete(l.cnt, id)
 	}
 }
+
+// setMax sets the maximum number of connections per id; connections over the maximum are not closed
+func (l *limits) setMax(max int) {
+	l.Lock()
+	defer l.Unlock()
+	l.max = max
+}
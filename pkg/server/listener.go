@@ -0,0 +1,73 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+package server
+
+import (
+	"context"
+
+	"github.com/TheThingsIndustries/mystique/pkg/auth"
+	mqttnet "github.com/TheThingsIndustries/mystique/pkg/net"
+	"github.com/TheThingsIndustries/mystique/pkg/session"
+)
+
+// listener contains the configuration of the connections of a listener
+type listener struct {
+	ctx        context.Context
+	ipLimits   *limits
+	userLimits *limits
+}
+
+// ListenerOption for the connections of a listener
+type ListenerOption func(l *listener)
+
+// WithListenerAuth returns an option that sets the authentication of the listener
+// If the interface is nil, clients connect without authentication.
+func WithListenerAuth(iface auth.Interface) ListenerOption {
+	return func(l *listener) {
+		l.ctx = auth.NewContextWithInterface(l.ctx, iface)
+	}
+}
+
+// WithListenerReadOnly returns an option that does not allow clients of the listener to write
+// The clients are authenticated by the auth interface of the listener.
+func WithListenerReadOnly() ListenerOption {
+	return func(l *listener) {
+		l.ctx = auth.NewContextWithInterface(l.ctx, auth.ReadOnly(auth.InterfaceFromContext(l.ctx)))
+	}
+}
+
+// WithListenerIPLimits returns an option that sets limits on connections per IP of the listener
+func WithListenerIPLimits(max int) ListenerOption {
+	return func(l *listener) { l.ipLimits = newLimits(max) }
+}
+
+// WithListenerUserLimits returns an option that sets limits on connections per User of the listener
+func WithListenerUserLimits(max int) ListenerOption {
+	return func(l *listener) { l.userLimits = newLimits(max) }
+}
+
+// WithListenerMaxPacketSize returns an option that sets the maximum size of packets that are received from clients of the listener
+func WithListenerMaxPacketSize(size int) ListenerOption {
+	return func(l *listener) {
+		l.ctx = session.NewContextWithMaxPacketSize(l.ctx, size)
+	}
+}
+
+// WithMountPoint returns an option that sets the mount point of the listener
+// The mount point is a topic prefix that is added to the topics of the clients of the listener.
+// The clients and the auth interface use topics without the mount point.
+func WithMountPoint(mountPoint string) ListenerOption {
+	return func(l *listener) {
+		l.ctx = session.NewContextWithMountPoint(l.ctx, mountPoint)
+	}
+}
+
+func (s *server) Handler(option ...ListenerOption) func(conn mqttnet.Conn) {
+	l := *s.listener
+	for _, opt := range option {
+		opt(&l)
+	}
+	return func(conn mqttnet.Conn) {
+		s.handle(&l, conn)
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+package server
+
+import (
+	"context"
+	"testing"
+
+	mqttnet "github.com/TheThingsIndustries/mystique/pkg/net"
+	"github.com/TheThingsIndustries/mystique/pkg/packet"
+	"github.com/smartystreets/assertions"
+	"github.com/smartystreets/assertions/should"
+)
+
+func TestHandler(t *testing.T) {
+	a := assertions.New(t)
+	s := New(context.Background(), WithAuth(prefixAuth{}))
+
+	connect := func(handle func(mqttnet.Conn), clientID, username string) (mqttnet.Conn, *packet.ConnackPacket) {
+		return connectHandler(t, handle, &packet.ConnectPacket{
+			ProtocolName:  "MQTT",
+			ProtocolLevel: packet.Version5,
+			CleanStart:    true,
+			ClientID:      clientID,
+			Username:      username,
+		})
+	}
+	subscribe := func(conn mqttnet.Conn, filter string) {
+		a.So(conn.Send(&packet.SubscribePacket{PacketIdentifier: 1, Topics: []string{filter}, QoSs: []byte{0}}), should.BeNil)
+		suback, err := conn.Receive()
+		if a.So(err, should.BeNil) {
+			a.So(suback.(*packet.SubackPacket).ReasonCodes, should.Resemble, []packet.ReasonCode{0})
+		}
+	}
+
+	// the server does not accept anonymous clients
+	conn, connack := connect(s.Handle, "anonymous", "")
+	a.So(connack.ReasonCode, should.Equal, packet.NotAuthorized)
+	conn.Close()
+
+	public := s.Handler(WithMountPoint("tenant"), WithListenerUserLimits(1))
+
+	conn, connack = connect(public, "public", "user")
+	defer conn.Close()
+	a.So(connack.ReasonCode, should.Equal, packet.Success)
+
+	// the subscriptions and messages of the client are in the mount point
+	subscribe(conn, "user/#")
+	a.So(s.Sessions().Get("user", "public").Subscriptions(), should.ContainKey, "tenant/user/#")
+	a.So(conn.Send(&packet.PublishPacket{TopicName: "user/up", Retain: true, Message: []byte("up")}), should.BeNil)
+	pkt, err := conn.Receive()
+	if a.So(err, should.BeNil) {
+		a.So(pkt.(*packet.PublishPacket).TopicName, should.Equal, "user/up")
+	}
+	a.So(s.Retained().Get("tenant/user/#"), should.HaveLength, 1)
+
+	s.Publish(&packet.PublishPacket{TopicName: "user/down", TopicParts: []string{"user", "down"}})
+	s.Publish(&packet.PublishPacket{TopicName: "tenant/user/down", TopicParts: []string{"tenant", "user", "down"}})
+	pkt, err = conn.Receive()
+	if a.So(err, should.BeNil) {
+		a.So(pkt.(*packet.PublishPacket).TopicName, should.Equal, "user/down")
+	}
+
+	// the user limits of the listener apply
+	second, _ := connect(public, "second", "user")
+	_, err = second.Receive()
+	a.So(err, should.NotBeNil)
+
+	internal := s.Handler(WithListenerAuth(nil), WithListenerReadOnly())
+
+	conn, connack = connect(internal, "internal", "")
+	defer conn.Close()
+	a.So(connack.ReasonCode, should.Equal, packet.Success)
+	subscribe(conn, "internal/#")
+	a.So(conn.Send(&packet.PublishPacket{PacketIdentifier: 1, QoS: 1, TopicName: "tenant/user/down"}), should.BeNil)
+	puback, err := conn.Receive()
+	if a.So(err, should.BeNil) {
+		a.So(puback.(*packet.PubackPacket).ReasonCode, should.Equal, packet.NotAuthorized)
+	}
+}
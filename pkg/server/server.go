@@ -5,14 +5,18 @@ package server
 
 import (
 	"context"
+	"errors"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/TheThingsIndustries/mystique/pkg/auth"
 	"github.com/TheThingsIndustries/mystique/pkg/log"
 	mqttnet "github.com/TheThingsIndustries/mystique/pkg/net"
 	"github.com/TheThingsIndustries/mystique/pkg/packet"
+	"github.com/TheThingsIndustries/mystique/pkg/retained"
 	"github.com/TheThingsIndustries/mystique/pkg/session"
 )
 
@@ -31,6 +35,11 @@ func WithSessionStore(sess session.Store) Option {
 	return func(s *server) { s.sessions = sess }
 }
 
+// WithRetainedStore returns an option that sets the store for retained messages
+func WithRetainedStore(store retained.Store) Option {
+	return func(s *server) { s.retained = store }
+}
+
 // WithIPLimits returns an option that sets limits on connections per IP
 func WithIPLimits(max int) Option {
 	return func(s *server) { s.ipLimits = newLimits(max) }
@@ -41,51 +50,255 @@ func WithUserLimits(max int) Option {
 	return func(s *server) { s.userLimits = newLimits(max) }
 }
 
+// WithSlowConsumerPolicy returns an option that sets the policy for sessions that can not keep up
+// the auth plugin can override the policy for a user by setting it in the context that is returned by Connect
+func WithSlowConsumerPolicy(policy session.SlowConsumerPolicy) Option {
+	return func(s *server) {
+		s.ctx = session.NewContextWithSlowConsumerPolicy(s.ctx, policy)
+	}
+}
+
 // Server interface
 type Server interface {
 	Sessions() session.Store
+	Retained() retained.Store
 	Publish(pkt *packet.PublishPacket)
 	Handle(conn mqttnet.Conn)
+
+	// Handler returns a function that handles the connections of a listener with the options
+	// the options override the auth interface and limits of the server for the connections of the listener
+	Handler(option ...ListenerOption) func(conn mqttnet.Conn)
+
+	// SetLimits changes the limits on connections per IP and per User (0 is unlimited)
+	// connections over the new limits are not closed; listeners with their own limits keep them
+	SetLimits(ip, user int)
+
+	// Connect an in-process client with the auth info
+	// the client is authenticated by the auth interface of the server, like the clients that connect over the network
+	Connect(info auth.Info) (Client, error)
+
+	// Shutdown the server
+	// closes new connections, sends the buffered messages of the sessions,
+	// waits until the messages in flight are acknowledged, and then closes the sessions
+	// the connections that are still open when the context is done are closed
+	Shutdown(ctx context.Context) (ShutdownStats, error)
+}
+
+// ShutdownStats reports what was drained during a shutdown
+type ShutdownStats struct {
+	Sessions int    // number of sessions that were closed
+	Drained  uint64 // number of buffered messages that were sent
+	Aborted  int    // number of connections that were closed when the context was done
 }
 
 // New returns a new MQTT server
 func New(ctx context.Context, option ...Option) Server {
-	s := &server{ctx: ctx}
+	s := &server{
+		ctx:      ctx,
+		conns:    make(map[mqttnet.Conn]struct{}),
+		shutdown: make(chan struct{}),
+	}
 	for _, opt := range option {
 		opt(s)
 	}
 	if s.sessions == nil {
 		s.sessions = session.SimpleStore()
 	}
+	if s.retained == nil {
+		s.retained = retained.SimpleStore()
+	}
+	if s.ipLimits == nil {
+		s.ipLimits = newLimits(0)
+	}
+	if s.userLimits == nil {
+		s.userLimits = newLimits(0)
+	}
+	s.ctx = session.NewContextWithStore(s.ctx, s.sessions)
+	s.ctx = retained.NewContextWithStore(s.ctx, s.retained)
+	s.listener = &listener{ctx: s.ctx, ipLimits: s.ipLimits, userLimits: s.userLimits}
 	return s
 }
 
 type server struct {
+	// BEGIN sync/atomic aligned
+	drainedMessages uint64
+	drainedSessions uint64
+	// END sync/atomic aligned
+
 	ctx        context.Context
 	ipLimits   *limits
 	userLimits *limits
 	sessions   session.Store
+	retained   retained.Store
+
+	// listener contains the configuration of connections that are handled by Handle
+	listener *listener
+
+	// conns that are handled by the server
+	conns    map[mqttnet.Conn]struct{}
+	closing  bool
+	handling sync.WaitGroup
+	connsMu  sync.Mutex
+
+	// shutdown is closed when the server shuts down; the sessions are drained until drainCtx is done
+	shutdown chan struct{}
+	drainCtx context.Context
 }
 
 func (s *server) Sessions() session.Store {
 	return s.sessions
 }
 
+func (s *server) Retained() retained.Store {
+	return s.retained
+}
+
 func (s *server) Publish(pkt *packet.PublishPacket) {
+	if pkt.Retain {
+		s.retained.Retain(pkt)
+	}
 	s.sessions.Publish(pkt)
 }
 
+// publish the message, or return the error of the context if it is done before the message is accepted
+// The message is retained before it is published, like in Publish.
+func (s *server) publish(ctx context.Context, pkt *packet.PublishPacket) error {
+	if pkt.Retain {
+		s.retained.Retain(pkt)
+	}
+	return s.sessions.PublishContext(ctx, pkt)
+}
+
+func (s *server) SetLimits(ip, user int) {
+	s.ipLimits.setMax(ip)
+	s.userLimits.setMax(user)
+}
+
 func (s *server) Handle(conn mqttnet.Conn) {
-	s.handle(conn)
+	s.handle(s.listener, conn)
+}
+
+// ErrShuttingDown is returned when a connection is handled while the server shuts down
+var ErrShuttingDown error = packet.ServerShuttingDown
+
+func (s *server) Shutdown(ctx context.Context) (stats ShutdownStats, err error) {
+	logger := log.FromContext(s.ctx)
+	s.connsMu.Lock()
+	if s.closing {
+		s.connsMu.Unlock()
+		return stats, errors.New("Server is already shutting down")
+	}
+	s.closing = true
+	s.connsMu.Unlock()
+
+	s.drainCtx = ctx
+	close(s.shutdown)
+
+	done := make(chan struct{})
+	go func() {
+		s.handling.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		s.connsMu.Lock()
+		for conn := range s.conns {
+			stats.Aborted++
+			conn.Close()
+		}
+		s.connsMu.Unlock()
+		logger.WithField("count", stats.Aborted).Warn("Close connections that were not drained in time")
+		<-done
+	}
+	stats.Sessions = int(atomic.LoadUint64(&s.drainedSessions))
+	stats.Drained = atomic.LoadUint64(&s.drainedMessages)
+	return stats, err
+}
+
+// track the connection until it is closed
+// returns false if the server shuts down
+func (s *server) track(conn mqttnet.Conn) bool {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	if s.closing {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.handling.Add(1)
+	return true
+}
+
+func (s *server) untrack(conn mqttnet.Conn) {
+	s.connsMu.Lock()
+	delete(s.conns, conn)
+	s.connsMu.Unlock()
+	s.handling.Done()
 }
 
-func (s *server) handle(conn mqttnet.Conn) (err error) {
-	ctx, cancel := context.WithCancel(s.ctx)
+// drain sends the buffered messages of the session, and waits until the messages in flight are acknowledged
+func (s *server) drain(conn mqttnet.Conn, sess session.Session, control <-chan packet.ControlPacket, readErr <-chan error) (err error) {
+	atomic.AddUint64(&s.drainedSessions, 1)
+	publish := sess.PublishChan()
+	send := func(pkt *packet.PublishPacket) error {
+		err := conn.Send(pkt)
+		if err == packet.PacketTooLarge {
+			return discard(sess, pkt)
+		}
+		if err == nil {
+			atomic.AddUint64(&s.drainedMessages, 1)
+		}
+		return err
+	}
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case pkt := <-publish:
+			err = send(pkt)
+		default:
+			if sess.Stats().Pending == 0 {
+				return nil
+			}
+			select {
+			case <-s.drainCtx.Done():
+				return nil
+			case readErr, ok := <-readErr:
+				if ok {
+					return readErr
+				}
+				return nil
+			case pkt, ok := <-control:
+				if !ok {
+					control = nil
+					continue
+				}
+				err = conn.Send(pkt)
+			case pkt := <-publish:
+				err = send(pkt)
+			case <-ticker.C:
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *server) handle(l *listener, conn mqttnet.Conn) (err error) {
+	if !s.track(conn) {
+		conn.Close()
+		return ErrShuttingDown
+	}
+	defer s.untrack(conn)
+
+	ctx, cancel := context.WithCancel(l.ctx)
 	defer cancel()
 
 	remoteAddr := conn.RemoteAddr().String()
 
-	logger := log.FromContext(s.ctx).WithField("remote_addr", remoteAddr)
+	logger := log.FromContext(l.ctx).WithField("remote_addr", remoteAddr)
 	ctx = log.NewContext(ctx, logger)
 
 	logger.Debug("Open connection")
@@ -99,11 +312,12 @@ func (s *server) handle(conn mqttnet.Conn) (err error) {
 		conn.Close()
 	}()
 
-	ip, _, _ := net.SplitHostPort(remoteAddr)
-	if err = s.ipLimits.connect(ip); err != nil {
-		return err
+	if ip, _, _ := net.SplitHostPort(remoteAddr); ip != "" { // connections on Unix sockets do not have an IP address
+		if err = l.ipLimits.connect(ip); err != nil {
+			return err
+		}
+		defer l.ipLimits.disconnect(ip)
 	}
-	defer s.ipLimits.disconnect(ip)
 
 	session := session.New(ctx, conn, s.Publish)
 
@@ -113,20 +327,39 @@ func (s *server) handle(conn mqttnet.Conn) (err error) {
 	defer session.Close()
 
 	if username := session.AuthInfo().Username; username != "" {
-		if err = s.userLimits.connect(username); err != nil {
+		if err = l.userLimits.connect(username); err != nil {
 			return err
 		}
-		defer s.userLimits.disconnect(username)
+		defer l.userLimits.disconnect(username)
 	}
 
+	// the pending packets are taken before the session is stored, so that messages that are published to the stored session
+	// are only sent by the main loop, and not retransmitted as well
+	pending := session.Pending()
+
 	s.sessions.Store(session)
 	defer s.sessions.Delete(session)
 
 	logger = log.FromContext(session.Context()) // update with session fields
 
+	if len(pending) > 0 {
+		logger.WithField("count", len(pending)).Debug("Retransmit pending packets")
+		for _, pkt := range pending {
+			err = conn.Send(pkt)
+			if pub, ok := pkt.(*packet.PublishPacket); ok && err == packet.PacketTooLarge {
+				err = discard(session, pub)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
 	control := make(chan packet.ControlPacket)
 	readErr := make(chan error, 1)
+	stopRead, readDone := make(chan struct{}), make(chan struct{})
 	go func() {
+		defer close(readDone)
 		for {
 			response, err := session.ReadPacket()
 			if err != nil {
@@ -136,19 +369,55 @@ func (s *server) handle(conn mqttnet.Conn) (err error) {
 			}
 			if response != nil {
 				logger.Debugf("Write %s packet", packet.Name[response.PacketType()])
-				control <- response
+				select {
+				case control <- response:
+				case <-ctx.Done():
+					return
+				case <-stopRead:
+					return
+				}
 			}
 		}
 	}()
 
+	// stopReading closes the connection and waits for the reader, so that the session is not handling packets when it is closed
+	var stopOnce sync.Once
+	stopReading := func() {
+		stopOnce.Do(func() {
+			cancel()
+			conn.Close()
+			close(stopRead)
+			<-readDone
+		})
+	}
+	defer stopReading()
+
 	// mainLoop
 	publish := session.PublishChan()
+	terminated := session.Terminated()
 	for {
 		select {
+		case err = <-terminated:
+			logger.WithError(err).Info("Terminate session")
+			disconnect(conn, err)
+			stopReading()
+			return err
+		case <-s.shutdown:
+			logger.Debug("Drain session")
+			if err = s.drain(conn, session, control, readErr); err != nil {
+				stopReading()
+				return err
+			}
+			disconnect(conn, ErrShuttingDown)
+			stopReading()
+			return ErrShuttingDown
 		case readErr, ok := <-readErr:
 			if ok {
 				err = readErr
 			}
+			if _, ok := err.(packet.ReasonCode); ok {
+				disconnect(conn, err)
+			}
 			return err
 		case pkt, ok := <-control:
 			if !ok {
@@ -168,9 +437,30 @@ func (s *server) handle(conn mqttnet.Conn) (err error) {
 			}
 			logger.Debug("Write publish packet")
 			err = conn.Send(pkt)
+			if err == packet.PacketTooLarge {
+				err = discard(session, pkt)
+			}
 		}
 		if err != nil {
 			return err
 		}
 	}
 }
+
+// discard a Publish packet that exceeds the maximum packet size of the client
+// the message is handled as if it was sent and acknowledged
+func discard(sess session.Session, pkt *packet.PublishPacket) error {
+	log.FromContext(sess.Context()).WithFields(log.F{"topic": pkt.TopicName, "size": len(pkt.Message)}).Warn("Discard message that exceeds the maximum packet size of the client")
+	if pkt.QoS > 0 {
+		return sess.HandlePuback(&packet.PubackPacket{PacketIdentifier: pkt.PacketIdentifier})
+	}
+	return nil
+}
+
+// disconnect sends a Disconnect with the reason to MQTT 5.0 clients and closes the connection
+func disconnect(conn mqttnet.Conn, reason error) {
+	if conn.ProtocolVersion() >= packet.Version5 {
+		conn.Send(&packet.DisconnectPacket{ReasonCode: packet.ReasonCodeOf(reason)})
+	}
+	conn.Close()
+}
@@ -0,0 +1,254 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	mqttnet "github.com/TheThingsIndustries/mystique/pkg/net"
+	"github.com/TheThingsIndustries/mystique/pkg/packet"
+	"github.com/smartystreets/assertions"
+	"github.com/smartystreets/assertions/should"
+)
+
+func dial(handle func(mqttnet.Conn)) mqttnet.Conn {
+	serverConn, clientConn := net.Pipe()
+	go handle(mqttnet.NewConn(serverConn, "pipe"))
+	return mqttnet.NewConn(clientConn, "pipe")
+}
+
+func connect(t *testing.T, s Server, pkt *packet.ConnectPacket) (mqttnet.Conn, *packet.ConnackPacket) {
+	t.Helper()
+	return connectHandler(t, s.Handle, pkt)
+}
+
+func connectHandler(t *testing.T, handle func(mqttnet.Conn), pkt *packet.ConnectPacket) (mqttnet.Conn, *packet.ConnackPacket) {
+	t.Helper()
+	conn := dial(handle)
+	conn.SetProtocolVersion(pkt.ProtocolLevel)
+	if err := conn.Send(pkt); err != nil {
+		t.Fatalf("Could not send CONNECT: %s", err)
+	}
+	conn.SetReadTimeout(time.Second)
+	response, err := conn.Receive()
+	if err != nil {
+		t.Fatalf("Could not receive CONNACK: %s", err)
+	}
+	connack, ok := response.(*packet.ConnackPacket)
+	if !ok {
+		t.Fatalf("Expected CONNACK, got %s", packet.Name[response.PacketType()])
+	}
+	return conn, connack
+}
+
+// ping makes sure that the connection is handled by the main loop
+func ping(t *testing.T, conn mqttnet.Conn) {
+	t.Helper()
+	if err := conn.Send(&packet.PingreqPacket{}); err != nil {
+		t.Fatalf("Could not send PINGREQ: %s", err)
+	}
+	if _, err := conn.Receive(); err != nil {
+		t.Fatalf("Could not receive PINGRESP: %s", err)
+	}
+}
+
+func TestTakeover(t *testing.T) {
+	a := assertions.New(t)
+	s := New(context.Background())
+
+	connect := func(cleanStart bool) (mqttnet.Conn, *packet.ConnackPacket) {
+		return connect(t, s, &packet.ConnectPacket{
+			ProtocolName:  "MQTT",
+			ProtocolLevel: 4,
+			ClientID:      "client",
+			CleanStart:    cleanStart,
+		})
+	}
+
+	first, connack := connect(false)
+	defer first.Close()
+	a.So(connack.SessionPresent, should.BeFalse)
+
+	a.So(first.Send(&packet.SubscribePacket{PacketIdentifier: 1, Topics: []string{"foo"}, QoSs: []byte{1}}), should.BeNil)
+	suback, err := first.Receive()
+	a.So(err, should.BeNil)
+	a.So(suback, should.HaveSameTypeAs, &packet.SubackPacket{})
+
+	second, connack := connect(false)
+	defer second.Close()
+	a.So(connack.SessionPresent, should.BeTrue)
+	ping(t, second)
+
+	_, err = first.Receive()
+	a.So(err, should.NotBeNil)
+
+	a.So(s.Sessions().All(), should.HaveLength, 1)
+	a.So(s.Sessions().Get("", "client").Subscriptions(), should.ContainKey, "foo")
+
+	third, connack := connect(true)
+	defer third.Close()
+	a.So(connack.SessionPresent, should.BeFalse)
+	ping(t, third)
+
+	_, err = second.Receive()
+	a.So(err, should.NotBeNil)
+
+	a.So(s.Sessions().All(), should.HaveLength, 1)
+	a.So(s.Sessions().Get("", "client").Subscriptions(), should.BeEmpty)
+}
+
+func TestTakeoverV5(t *testing.T) {
+	a := assertions.New(t)
+	s := New(context.Background())
+
+	connect := func() (mqttnet.Conn, *packet.ConnackPacket) {
+		return connect(t, s, &packet.ConnectPacket{
+			ProtocolName:  "MQTT",
+			ProtocolLevel: 5,
+			ClientID:      "client",
+		})
+	}
+
+	first, _ := connect()
+	defer first.Close()
+	ping(t, first)
+
+	disconnect := make(chan packet.ControlPacket, 1)
+	go func() {
+		pkt, _ := first.Receive()
+		disconnect <- pkt
+	}()
+
+	second, _ := connect()
+	defer second.Close()
+	ping(t, second)
+
+	select {
+	case pkt := <-disconnect:
+		a.So(pkt, should.Resemble, &packet.DisconnectPacket{ReasonCode: packet.SessionTakenOver})
+	case <-time.After(time.Second):
+		t.Fatal("no DISCONNECT received")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	a := assertions.New(t)
+	s := New(context.Background())
+
+	conn, _ := connect(t, s, &packet.ConnectPacket{
+		ProtocolName:  "MQTT",
+		ProtocolLevel: 5,
+		ClientID:      "client",
+	})
+	defer conn.Close()
+	if err := conn.Send(&packet.SubscribePacket{PacketIdentifier: 1, Topics: []string{"foo"}, QoSs: []byte{1}}); err != nil {
+		t.Fatalf("Could not send SUBSCRIBE: %s", err)
+	}
+	if _, err := conn.Receive(); err != nil {
+		t.Fatalf("Could not receive SUBACK: %s", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		s.Publish(&packet.PublishPacket{TopicName: "foo", TopicParts: []string{"foo"}, QoS: 1, Message: []byte{byte(i)}})
+	}
+
+	type result struct {
+		stats ShutdownStats
+		err   error
+	}
+	shutdown := make(chan result, 1)
+	go func() {
+		stats, err := s.Shutdown(context.Background())
+		shutdown <- result{stats, err}
+	}()
+
+	// the buffered messages are sent, and the session is closed when they are acknowledged
+	var messages []byte
+	for i := 0; i < 3; i++ {
+		pkt, err := conn.Receive()
+		a.So(err, should.BeNil)
+		if pub, ok := pkt.(*packet.PublishPacket); a.So(ok, should.BeTrue) {
+			messages = append(messages, pub.Message...)
+			conn.Send(pub.Response())
+		}
+	}
+	a.So(messages, should.HaveLength, 3)
+	for i := 0; i < 3; i++ {
+		a.So(messages, should.Contain, byte(i))
+	}
+	pkt, err := conn.Receive()
+	a.So(err, should.BeNil)
+	a.So(pkt, should.Resemble, &packet.DisconnectPacket{ReasonCode: packet.ServerShuttingDown})
+
+	select {
+	case res := <-shutdown:
+		a.So(res.err, should.BeNil)
+		a.So(res.stats.Sessions, should.Equal, 1)
+		a.So(res.stats.Aborted, should.Equal, 0)
+	case <-time.After(time.Second):
+		t.Fatal("server did not shut down")
+	}
+
+	// new connections are closed
+	conn = dial(s.Handle)
+	conn.Send(&packet.ConnectPacket{ProtocolName: "MQTT", ProtocolLevel: 4, ClientID: "client"})
+	_, err = conn.Receive()
+	a.So(err, should.NotBeNil)
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	a := assertions.New(t)
+	s := New(context.Background())
+
+	conn, _ := connect(t, s, &packet.ConnectPacket{
+		ProtocolName:  "MQTT",
+		ProtocolLevel: 4,
+		ClientID:      "client",
+	})
+	defer conn.Close()
+	ping(t, conn)
+
+	// the client does not read the messages
+	s.Sessions().Get("", "client").HandleSubscribe(&packet.SubscribePacket{PacketIdentifier: 1, Topics: []string{"foo"}, QoSs: []byte{1}})
+	s.Publish(&packet.PublishPacket{TopicName: "foo", TopicParts: []string{"foo"}, QoS: 1, Message: []byte("bar")})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	stats, err := s.Shutdown(ctx)
+	a.So(err == context.DeadlineExceeded, should.BeTrue)
+	a.So(stats.Aborted, should.Equal, 1)
+}
+
+func TestSetLimits(t *testing.T) {
+	a := assertions.New(t)
+	s := New(context.Background(), WithAuth(prefixAuth{}))
+
+	connect := func(clientID string) mqttnet.Conn {
+		conn, connack := connectHandler(t, s.Handle, &packet.ConnectPacket{
+			ProtocolName:  "MQTT",
+			ProtocolLevel: packet.Version5,
+			CleanStart:    true,
+			ClientID:      clientID,
+			Username:      "user",
+		})
+		a.So(connack.ReasonCode, should.Equal, packet.Success)
+		return conn
+	}
+
+	first := connect("first")
+	defer first.Close()
+
+	// the limits apply to new connections
+	s.SetLimits(0, 1)
+	second := connect("second")
+	_, err := second.Receive()
+	a.So(err, should.NotBeNil)
+
+	s.SetLimits(0, 0)
+	third := connect("third")
+	defer third.Close()
+	ping(t, third)
+}
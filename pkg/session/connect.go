@@ -6,12 +6,14 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"math"
 	gnet "net"
 	"strings"
 	"time"
 
 	"github.com/TheThingsIndustries/mystique/pkg/auth"
 	"github.com/TheThingsIndustries/mystique/pkg/log"
+	"github.com/TheThingsIndustries/mystique/pkg/net"
 	"github.com/TheThingsIndustries/mystique/pkg/packet"
 	"github.com/TheThingsIndustries/mystique/pkg/topic"
 	"golang.org/x/net/websocket"
@@ -36,11 +38,14 @@ func (s *session) ReadConnect() error {
 	}
 	connackPacket := connectPacket.Response()
 
+	s.version = connectPacket.ProtocolLevel
+	s.conn.SetProtocolVersion(s.version)
+
 	err = connectPacket.Validate()
 	if err != nil {
 		logger.WithError(err).Warn("Invalid CONNECT")
-		if code, ok := err.(packet.ConnectReturnCode); ok {
-			connackPacket.ReturnCode = code
+		if code, ok := err.(packet.ReasonCode); ok {
+			connackPacket.ReasonCode = code
 			if err := s.conn.Send(connackPacket); err != nil {
 				logger.WithError(err).Warn("Could not send CONNACK")
 				return err
@@ -51,6 +56,9 @@ func (s *session) ReadConnect() error {
 
 	if connectPacket.ClientID == "" {
 		connectPacket.ClientID = fmt.Sprintf("%s-%d", s.conn.RemoteAddr().String(), time.Since(boot))
+		if s.version >= packet.Version5 {
+			connackPacket.Properties.AssignedClientIdentifier = connectPacket.ClientID
+		}
 	} else {
 		connectPacket.ClientID = replaceClientID.Replace(connectPacket.ClientID)
 	}
@@ -71,23 +79,65 @@ func (s *session) ReadConnect() error {
 	switch conn := s.conn.NetConn().(type) {
 	case *gnet.TCPConn:
 	case *tls.Conn:
-		s.auth.ServerName = conn.ConnectionState().ServerName
+		state := conn.ConnectionState()
+		s.auth.ServerName = state.ServerName
+		s.auth.TLS = auth.NewTLSInfo(state)
 	case *websocket.Conn:
 		s.auth.ServerName = conn.Request().Host
+		if state := conn.Request().TLS; state != nil {
+			s.auth.TLS = auth.NewTLSInfo(*state)
+		}
+	}
+
+	if proxied, ok := s.conn.(net.Proxied); ok {
+		if header := proxied.ProxyHeader(); header != nil {
+			if header.Authority != "" {
+				s.auth.ServerName = header.Authority
+			}
+			if proxyTLS := header.TLS; proxyTLS != nil {
+				s.auth.TLS = &auth.TLSInfo{
+					Proxy:          true,
+					Version:        proxyTLS.Version,
+					CipherSuite:    proxyTLS.CipherSuite,
+					PeerCommonName: proxyTLS.CommonName,
+					PeerVerified:   proxyTLS.ClientVerified,
+				}
+			}
+		}
 	}
 
 	if s.auth.ServerName != "" {
 		logger = logger.WithField("server_name", s.auth.ServerName)
 	}
+	if tlsInfo := s.auth.TLS; tlsInfo != nil && tlsInfo.Version != "" {
+		logger = logger.WithFields(log.F{
+			"tls_version":      tlsInfo.Version,
+			"tls_cipher_suite": tlsInfo.CipherSuite,
+		})
+	}
 
 	s.ctx = log.NewContext(s.ctx, logger)
 
+	if s.version >= packet.Version5 {
+		if connectPacket.Properties.AuthenticationMethod != "" {
+			err = packet.BadAuthenticationMethod
+			logger.WithField("authentication_method", connectPacket.Properties.AuthenticationMethod).Debug("Rejected authentication")
+			connackPacket.ReasonCode = packet.BadAuthenticationMethod
+			if err := s.conn.Send(connackPacket); err != nil {
+				return err
+			}
+			return err
+		}
+		connackPacket.Properties.SubscriptionIdentifierAvailable = packet.Byte(0)
+	}
+
 	if authInterface := auth.InterfaceFromContext(s.ctx); authInterface != nil {
 		if ctx, err := authInterface.Connect(s.ctx, s.auth); err != nil {
-			if code, ok := err.(packet.ConnectReturnCode); ok {
-				connackPacket.ReturnCode = code
-			} else {
-				connackPacket.ReturnCode = packet.ConnectNotAuthorized
+			switch err.(type) {
+			case packet.ReasonCode, packet.ConnectReturnCode:
+				connackPacket.ReasonCode = packet.ReasonCodeOf(err)
+			default:
+				connackPacket.ReasonCode = packet.NotAuthorized
 			}
 			logger.WithError(err).Debug("Rejected authentication")
 			if err := s.conn.Send(connackPacket); err != nil {
@@ -98,6 +148,53 @@ func (s *session) ReadConnect() error {
 			s.ctx = ctx
 		}
 	}
+	s.policy = SlowConsumerPolicyFromContext(s.ctx)
+	s.setMountPoint(MountPointFromContext(s.ctx))
+
+	receive, send := s.conn.MaxPacketSize()
+	if size := MaxPacketSizeFromContext(s.ctx); size > 0 && (receive == 0 || size < receive) {
+		receive = size
+		s.conn.SetMaxPacketSize(receive, send)
+	}
+
+	if s.version >= packet.Version5 {
+		if max := connectPacket.Properties.ReceiveMaximum; max != nil && (s.window.size == 0 || int(*max) < s.window.size) {
+			s.window.size = int(*max)
+		}
+		if max := connectPacket.Properties.MaximumPacketSize; max != nil {
+			s.conn.SetMaxPacketSize(receive, int(*max))
+		}
+		if max := maxPendingIn(); max < math.MaxUint16 {
+			connackPacket.Properties.ReceiveMaximum = packet.Uint16(uint16(max))
+		}
+		if receive > 0 {
+			connackPacket.Properties.MaximumPacketSize = packet.Uint32(uint32(receive))
+		}
+		if interval := connectPacket.Properties.SessionExpiryInterval; interval != nil && *interval > 0 {
+			s.persistent = true
+			if *interval != math.MaxUint32 { // MaxUint32 means that the session does not expire
+				s.expiry = time.Duration(*interval) * time.Second
+			}
+		}
+	} else {
+		s.persistent = !connectPacket.CleanStart
+	}
+	if store := StoreFromContext(s.ctx); store != nil {
+		if existing := store.Get(s.auth.Username, s.auth.ClientID); existing != nil {
+			logger.WithField("existing_remote_addr", existing.AuthInfo().RemoteAddr).Info("Take over existing session")
+			sessionTakeovers.Inc()
+			existing.Terminate(ErrTakenOver)
+		}
+		if previous := store.Resume(s.auth.Username, s.auth.ClientID); previous != nil {
+			if previous, ok := previous.(*session); ok && !connectPacket.CleanStart {
+				logger.Debug("Resume session")
+				s.resume(previous)
+				connackPacket.SessionPresent = true
+			} else {
+				previous.Discard()
+			}
+		}
+	}
 
 	if connectPacket.KeepAlive > 0 {
 		s.conn.SetReadTimeout(time.Duration(connectPacket.KeepAlive) * 1500 * time.Millisecond)
@@ -114,7 +211,9 @@ func (s *session) ReadConnect() error {
 				TopicName:  connectPacket.WillTopic,
 				TopicParts: topicParts,
 				Message:    connectPacket.WillMessage,
+				Properties: connectPacket.WillProperties,
 			}
+			s.will.Properties.WillDelayInterval = nil
 		}
 	}
 
@@ -127,6 +226,18 @@ func (s *session) ReadConnect() error {
 	return nil
 }
 
-func (s *session) HandleDisconnect() {
-	s.will = nil
+func (s *session) HandleDisconnect(pkt *packet.DisconnectPacket) {
+	if pkt.ReasonCode != packet.DisconnectWithWillMessage {
+		s.will = nil
+	}
+	if interval := pkt.Properties.SessionExpiryInterval; interval != nil && s.persistent {
+		switch *interval {
+		case 0:
+			s.persistent = false
+		case math.MaxUint32:
+			s.expiry = 0
+		default:
+			s.expiry = time.Duration(*interval) * time.Second
+		}
+	}
 }
@@ -0,0 +1,177 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+package session
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	mqttnet "github.com/TheThingsIndustries/mystique/pkg/net"
+	"github.com/TheThingsIndustries/mystique/pkg/packet"
+	"github.com/smartystreets/assertions"
+	"github.com/smartystreets/assertions/should"
+)
+
+func connect(t *testing.T, ctx context.Context, pkt *packet.ConnectPacket) (*session, *packet.ConnackPacket, error) {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	client := mqttnet.NewConn(clientConn, "pipe")
+	client.SetProtocolVersion(pkt.ProtocolLevel)
+	defer client.Close()
+
+	sess := New(ctx, mqttnet.NewConn(serverConn, "pipe"), func(*packet.PublishPacket) {}).(*session)
+
+	connack := make(chan *packet.ConnackPacket, 1)
+	go func() {
+		defer close(connack)
+		if err := client.Send(pkt); err != nil {
+			return
+		}
+		response, err := client.Receive()
+		if err != nil {
+			return
+		}
+		connack <- response.(*packet.ConnackPacket)
+	}()
+
+	err := sess.ReadConnect()
+	select {
+	case response := <-connack:
+		return sess, response, err
+	case <-time.After(time.Second):
+		t.Fatal("no CONNACK received")
+	}
+	return sess, nil, err
+}
+
+func TestConnectPersistent(t *testing.T) {
+	a := assertions.New(t)
+	store := SimpleStore()
+	ctx := NewContextWithStore(context.Background(), store)
+
+	{
+		_, connack, err := connect(t, ctx, &packet.ConnectPacket{ProtocolName: "MQTT", ProtocolLevel: 4})
+		a.So(err, should.Equal, packet.ClientIdentifierNotValid)
+		if a.So(connack, should.NotBeNil) {
+			a.So(connack.ReasonCode, should.Equal, packet.ClientIdentifierNotValid)
+		}
+	}
+
+	sess, connack, err := connect(t, ctx, &packet.ConnectPacket{ProtocolName: "MQTT", ProtocolLevel: 4, ClientID: "client"})
+	a.So(err, should.BeNil)
+	a.So(connack.SessionPresent, should.BeFalse)
+	a.So(sess.Persistent(), should.BeTrue)
+
+	sess.subscriptions.Add("foo", 1)
+	_, err = sess.HandlePublish(&packet.PublishPacket{TopicName: "bar", TopicParts: []string{"bar"}, QoS: 2, PacketIdentifier: 42})
+	a.So(err, should.BeNil)
+	store.Store(sess)
+	store.Delete(sess)
+	sess.Close()
+
+	resumed, connack, err := connect(t, ctx, &packet.ConnectPacket{ProtocolName: "MQTT", ProtocolLevel: 4, ClientID: "client"})
+	a.So(err, should.BeNil)
+	a.So(connack.SessionPresent, should.BeTrue)
+	a.So(resumed.Subscriptions(), should.ContainKey, "foo")
+	a.So(sess.Subscriptions(), should.BeEmpty)
+
+	{ // Retransmission of QoS 2 message is not delivered again
+		delivered := false
+		resumed.deliver = func(*packet.PublishPacket) { delivered = true }
+		pubrec, err := resumed.HandlePublish(&packet.PublishPacket{TopicName: "bar", TopicParts: []string{"bar"}, QoS: 2, PacketIdentifier: 42, Duplicate: true})
+		a.So(err, should.BeNil)
+		a.So(pubrec, should.HaveSameTypeAs, new(packet.PubrecPacket))
+		a.So(delivered, should.BeFalse)
+	}
+
+	resumed.Close()
+	store.Delete(resumed)
+
+	clean, connack, err := connect(t, ctx, &packet.ConnectPacket{ProtocolName: "MQTT", ProtocolLevel: 4, ClientID: "client", CleanStart: true})
+	a.So(err, should.BeNil)
+	a.So(connack.SessionPresent, should.BeFalse)
+	a.So(clean.Subscriptions(), should.BeEmpty)
+	a.So(resumed.Subscriptions(), should.BeEmpty)
+}
+
+func TestConnectV5(t *testing.T) {
+	a := assertions.New(t)
+	store := SimpleStore()
+	ctx := NewContextWithStore(context.Background(), store)
+
+	{
+		_, connack, err := connect(t, ctx, &packet.ConnectPacket{ProtocolName: "MQTT", ProtocolLevel: 5, Properties: packet.Properties{
+			AuthenticationMethod: "SCRAM-SHA-1",
+		}})
+		a.So(err, should.Equal, packet.BadAuthenticationMethod)
+		if a.So(connack, should.NotBeNil) {
+			a.So(connack.ReasonCode, should.Equal, packet.BadAuthenticationMethod)
+		}
+	}
+
+	{
+		sess, connack, err := connect(t, ctx, &packet.ConnectPacket{ProtocolName: "MQTT", ProtocolLevel: 5})
+		a.So(err, should.BeNil)
+		a.So(sess.ProtocolVersion(), should.Equal, packet.Version5)
+		a.So(sess.Persistent(), should.BeFalse)
+		a.So(connack.Properties.AssignedClientIdentifier, should.NotBeEmpty)
+		a.So(connack.Properties.AssignedClientIdentifier, should.Equal, sess.AuthInfo().ClientID)
+	}
+
+	sess, connack, err := connect(t, ctx, &packet.ConnectPacket{ProtocolName: "MQTT", ProtocolLevel: 5, ClientID: "client", Properties: packet.Properties{
+		SessionExpiryInterval: packet.Uint32(60),
+		ReceiveMaximum:        packet.Uint16(10),
+	}})
+	a.So(err, should.BeNil)
+	a.So(sess.window.size, should.Equal, 10)
+	a.So(connack.SessionPresent, should.BeFalse)
+	a.So(connack.Properties.AssignedClientIdentifier, should.BeEmpty)
+	a.So(connack.Properties.ReceiveMaximum, should.Resemble, packet.Uint16(uint16(maxPendingIn())))
+	a.So(sess.Persistent(), should.BeTrue)
+	a.So(sess.Expiry(), should.Equal, time.Minute)
+
+	sess.subscriptions.AddWithOptions("foo", 1, packet.SubscriptionOptions{NoLocal: true})
+	store.Store(sess)
+	store.Delete(sess)
+	sess.Close()
+
+	resumed, connack, err := connect(t, ctx, &packet.ConnectPacket{ProtocolName: "MQTT", ProtocolLevel: 5, ClientID: "client"})
+	a.So(err, should.BeNil)
+	a.So(connack.SessionPresent, should.BeTrue)
+	a.So(resumed.Subscriptions(), should.ContainKey, "foo")
+	a.So(resumed.Persistent(), should.BeFalse)
+
+	// the options of the subscriptions are resumed
+	resumed.Publish(&packet.PublishPacket{TopicName: "foo", TopicParts: []string{"foo"}, ClientID: "client"})
+	a.So(resumed.PublishChan(), should.HaveLength, 0)
+	resumed.Publish(&packet.PublishPacket{TopicName: "foo", TopicParts: []string{"foo"}, ClientID: "other"})
+	a.So(resumed.PublishChan(), should.HaveLength, 1)
+
+	resumed.HandleDisconnect(&packet.DisconnectPacket{ReasonCode: packet.DisconnectWithWillMessage})
+	resumed.Close()
+	store.Delete(resumed)
+	a.So(store.Resume("", "client"), should.BeNil)
+}
+
+func TestConnectMaxPacketSize(t *testing.T) {
+	a := assertions.New(t)
+	ctx := NewContextWithMaxPacketSize(context.Background(), 1024)
+
+	sess, connack, err := connect(t, ctx, &packet.ConnectPacket{ProtocolName: "MQTT", ProtocolLevel: 5, Properties: packet.Properties{
+		MaximumPacketSize: packet.Uint32(512),
+	}})
+	a.So(err, should.BeNil)
+	a.So(connack.Properties.MaximumPacketSize, should.Resemble, packet.Uint32(1024))
+	receive, send := sess.conn.MaxPacketSize()
+	a.So(receive, should.Equal, 1024)
+	a.So(send, should.Equal, 512)
+
+	sess, connack, err = connect(t, ctx, &packet.ConnectPacket{ProtocolName: "MQTT", ProtocolLevel: 4, ClientID: "client"})
+	a.So(err, should.BeNil)
+	a.So(connack.Properties.MaximumPacketSize, should.BeNil)
+	receive, send = sess.conn.MaxPacketSize()
+	a.So(receive, should.Equal, 1024)
+	a.So(send, should.Equal, 0)
+}
@@ -0,0 +1,88 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+package session
+
+import "context"
+
+type ctxKeyType struct{}
+
+var ctxKey ctxKeyType
+
+// StoreFromContext returns the session store from the context
+func StoreFromContext(ctx context.Context) Store {
+	if v := ctx.Value(ctxKey); v != nil {
+		if store, ok := v.(Store); ok {
+			return store
+		}
+	}
+	return nil
+}
+
+// NewContextWithStore returns a new context that contains the session store
+func NewContextWithStore(ctx context.Context, store Store) context.Context {
+	return context.WithValue(ctx, ctxKey, store)
+}
+
+type policyCtxKeyType struct{}
+
+var policyCtxKey policyCtxKeyType
+
+// SlowConsumerPolicyFromContext returns the slow consumer policy from the context
+// returns the DefaultSlowConsumerPolicy if the context does not contain a policy
+func SlowConsumerPolicyFromContext(ctx context.Context) SlowConsumerPolicy {
+	if v := ctx.Value(policyCtxKey); v != nil {
+		if policy, ok := v.(SlowConsumerPolicy); ok {
+			return policy
+		}
+	}
+	return DefaultSlowConsumerPolicy
+}
+
+// NewContextWithSlowConsumerPolicy returns a new context that contains the slow consumer policy
+// the auth plugin can return such a context from Connect to set the policy for a user
+func NewContextWithSlowConsumerPolicy(ctx context.Context, policy SlowConsumerPolicy) context.Context {
+	return context.WithValue(ctx, policyCtxKey, policy)
+}
+
+type maxPacketSizeCtxKeyType struct{}
+
+var maxPacketSizeCtxKey maxPacketSizeCtxKeyType
+
+// MaxPacketSizeFromContext returns the maximum packet size from the context
+// returns 0 if the context does not contain a maximum packet size
+func MaxPacketSizeFromContext(ctx context.Context) int {
+	if v := ctx.Value(maxPacketSizeCtxKey); v != nil {
+		if size, ok := v.(int); ok {
+			return size
+		}
+	}
+	return 0
+}
+
+// NewContextWithMaxPacketSize returns a new context that contains the maximum size of packets that are received
+// the auth plugin can return such a context from Connect to set a lower maximum than the listener for a user
+func NewContextWithMaxPacketSize(ctx context.Context, size int) context.Context {
+	return context.WithValue(ctx, maxPacketSizeCtxKey, size)
+}
+
+type mountPointCtxKeyType struct{}
+
+var mountPointCtxKey mountPointCtxKeyType
+
+// MountPointFromContext returns the mount point from the context
+// returns an empty string if the context does not contain a mount point
+func MountPointFromContext(ctx context.Context) string {
+	if v := ctx.Value(mountPointCtxKey); v != nil {
+		if mountPoint, ok := v.(string); ok {
+			return mountPoint
+		}
+	}
+	return ""
+}
+
+// NewContextWithMountPoint returns a new context that contains the mount point, which is a topic prefix for the client
+// the client and the auth interface use topics without the mount point
+// the auth plugin can return such a context from Connect to set the mount point for a user
+func NewContextWithMountPoint(ctx context.Context, mountPoint string) context.Context {
+	return context.WithValue(ctx, mountPointCtxKey, mountPoint)
+}
@@ -0,0 +1,57 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+package session
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/TheThingsIndustries/mystique/pkg/auth"
+	"github.com/TheThingsIndustries/mystique/pkg/log"
+	"github.com/TheThingsIndustries/mystique/pkg/packet"
+)
+
+// LocalTransport is the transport of sessions of in-process clients
+const LocalTransport = "local"
+
+// NewLocal returns a new session for an in-process client
+// The client is authenticated by the auth interface of the context, like the clients that connect over the network.
+// The session has no connection: the messages for the client are read from the PublishChan,
+// and are acknowledged with HandlePuback, or HandlePubrec and HandlePubcomp.
+func NewLocal(ctx context.Context, info auth.Info, deliver func(*packet.PublishPacket)) (Session, error) {
+	s := New(ctx, nil, deliver).(*session)
+	s.version = packet.Version5
+
+	if info.ClientID == "" {
+		info.ClientID = fmt.Sprintf("%s-%d", LocalTransport, time.Since(boot))
+	} else {
+		info.ClientID = replaceClientID.Replace(info.ClientID)
+	}
+	if info.Transport == "" {
+		info.Transport = LocalTransport
+	}
+	if info.RemoteAddr == "" {
+		info.RemoteAddr = LocalTransport
+	}
+	s.auth = &info
+
+	logger := log.FromContext(s.ctx).WithFields(log.F{
+		"username":  info.Username,
+		"client_id": info.ClientID,
+	})
+	s.ctx = log.NewContext(s.ctx, logger)
+
+	if authInterface := auth.InterfaceFromContext(s.ctx); authInterface != nil {
+		ctx, err := authInterface.Connect(s.ctx, s.auth)
+		if err != nil {
+			logger.WithError(err).Debug("Rejected authentication")
+			return nil, err
+		}
+		s.ctx = ctx
+	}
+	s.policy = SlowConsumerPolicyFromContext(s.ctx)
+	s.setMountPoint(MountPointFromContext(s.ctx))
+
+	return s, nil
+}
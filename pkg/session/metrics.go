@@ -20,6 +20,49 @@ var sessionsGauge = prometheus.NewGaugeFunc(
 	},
 )
 
+var persistedSessionsGauge = prometheus.NewGaugeFunc(
+	prometheus.GaugeOpts{
+		Namespace: "mystique",
+		Subsystem: "sessions",
+		Name:      "persisted",
+		Help:      "Number of disconnected persistent sessions.",
+	},
+	func() (total float64) {
+		for _, store := range stores {
+			total += float64(store.CountPersisted())
+		}
+		return
+	},
+)
+
+var sessionTakeovers = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "mystique",
+		Subsystem: "sessions",
+		Name:      "takeovers_total",
+		Help:      "Total number of sessions that were taken over by a new connection of the same client.",
+	},
+)
+
+var sharedRedistributed = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "mystique",
+		Subsystem: "sessions",
+		Name:      "shared_redistributed_total",
+		Help:      "Total number of in-flight messages of shared subscriptions that were redistributed to other members of the group.",
+	},
+)
+
+var slowConsumerCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "mystique",
+		Subsystem: "sessions",
+		Name:      "slow_consumer_total",
+		Help:      "Total number of messages for sessions that could not keep up, by the action that was taken.",
+	},
+	[]string{"reason"},
+)
+
 var sessionDuration = prometheus.NewHistogram(
 	prometheus.HistogramOpts{
 		Namespace: "mystique",
@@ -47,6 +90,10 @@ var sessionMessages = prometheus.NewHistogramVec(
 
 func init() {
 	prometheus.MustRegister(sessionsGauge)
+	prometheus.MustRegister(persistedSessionsGauge)
+	prometheus.MustRegister(sessionTakeovers)
+	prometheus.MustRegister(sharedRedistributed)
+	prometheus.MustRegister(slowConsumerCounter)
 	prometheus.MustRegister(sessionDuration)
 	prometheus.MustRegister(sessionMessages)
 }
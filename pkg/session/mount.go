@@ -0,0 +1,65 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+package session
+
+import (
+	"github.com/TheThingsIndustries/mystique/pkg/packet"
+	"github.com/TheThingsIndustries/mystique/pkg/topic"
+)
+
+// The mount point of a session is a topic prefix that is added to the topics of the client.
+// The client and the auth interface only see the topics without the mount point.
+
+// setMountPoint sets the mount point of the session
+func (s *session) setMountPoint(mountPoint string) {
+	s.mountPoint = mountPoint
+	s.mountParts = nil
+	if mountPoint != "" {
+		s.mountParts = topic.Split(mountPoint)
+	}
+}
+
+// mount returns the Publish packet of the client with the mount point of the session
+func (s *session) mount(pkt *packet.PublishPacket) *packet.PublishPacket {
+	if s.mountPoint == "" {
+		return pkt
+	}
+	mounted := *pkt
+	mounted.TopicName = s.mountPoint + topic.Separator + pkt.TopicName
+	mounted.TopicParts = append(append(make([]string, 0, len(s.mountParts)+len(pkt.TopicParts)), s.mountParts...), pkt.TopicParts...)
+	return &mounted
+}
+
+// mountFilter returns the filter of the client with the mount point of the session
+// The group of a shared subscription is kept.
+func (s *session) mountFilter(filter string) string {
+	if s.mountPoint == "" {
+		return filter
+	}
+	if group, filter, ok := topic.SplitShare(filter); ok {
+		return topic.JoinShare(group, s.mountPoint+topic.Separator+filter)
+	}
+	return s.mountPoint + topic.Separator + filter
+}
+
+// unmount returns the topic without the mount point of the session, or false if the topic is outside of the mount point
+func (s *session) unmount(topicParts []string) ([]string, bool) {
+	if len(s.mountParts) == 0 {
+		return topicParts, true
+	}
+	if len(topicParts) <= len(s.mountParts) {
+		return nil, false
+	}
+	for i, part := range s.mountParts {
+		if topicParts[i] != part {
+			return nil, false
+		}
+	}
+	return topicParts[len(s.mountParts):], true
+}
+
+// canRead returns true if the topic is in the mount point of the session, and the client can read it
+func (s *session) canRead(topicParts []string) bool {
+	topicParts, ok := s.unmount(topicParts)
+	return ok && s.auth.CanRead(topicParts...)
+}
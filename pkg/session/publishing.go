@@ -3,71 +3,285 @@
 package session
 
 import (
-	"errors"
 	"sync/atomic"
+	"time"
 
 	"github.com/TheThingsIndustries/mystique/pkg/log"
 	"github.com/TheThingsIndustries/mystique/pkg/packet"
+	"github.com/TheThingsIndustries/mystique/pkg/retained"
+	"github.com/TheThingsIndustries/mystique/pkg/subscription"
+	"github.com/TheThingsIndustries/mystique/pkg/topic"
 )
 
 func (s *session) Publish(pkt *packet.PublishPacket) {
 	if s.subscriptions.Count() == 0 {
 		return
 	}
-	if !s.auth.CanRead(pkt.TopicParts...) {
+	if !s.canRead(pkt.TopicParts) {
 		return
 	}
 	qos, ok := s.subscriptions.Match(pkt.TopicParts...)
 	if !ok {
 		return
 	}
+	if deliver, retain := s.matchOptions(pkt); deliver {
+		s.send(pkt, qos, retain, "")
+	}
+}
+
+// publishMatched sends an outgoing Publish message that was matched to the subscriptions of the session by the index
+func (s *session) publishMatched(pkt *packet.PublishPacket, qos byte) {
+	if !s.canRead(pkt.TopicParts) {
+		return
+	}
+	if deliver, retain := s.matchOptions(pkt); deliver {
+		s.send(pkt, qos, retain, "")
+	}
+}
+
+// matchOptions applies the No Local and Retain As Published options of the subscriptions that match the message
+// The options are only looked up for messages of the client itself and for retained messages.
+func (s *session) matchOptions(pkt *packet.PublishPacket) (deliver, retain bool) {
+	local := pkt.ClientID != "" && pkt.ClientID == s.auth.ClientID
+	if !local && !pkt.Retain {
+		return true, false
+	}
+	noLocal, retainAsPublished := s.subscriptions.MatchOptions(pkt.TopicParts...)
+	return !(local && noLocal), pkt.Retain && retainAsPublished
+}
+
+func (s *session) setIndex(index *subscription.Index) {
+	s.subscriptions.SetIndex(index, s)
+}
+
+func (s *session) MatchShared(topicParts ...string) map[string]byte {
+	return s.subscriptions.MatchShared(topicParts...)
+}
+
+func (s *session) PublishShared(pkt *packet.PublishPacket, share string, qos byte) {
+	if !s.canRead(pkt.TopicParts) {
+		return
+	}
+	var retain bool
+	if pkt.Retain {
+		options, _ := s.subscriptions.Options(share)
+		retain = options.RetainAsPublished
+	}
+	s.send(pkt, qos, retain, share)
+}
+
+func (s *session) TakeShared(share string) (pkts []*packet.PublishPacket) {
+	s.pendingSharedMu.Lock()
+	defer s.pendingSharedMu.Unlock()
+	for id, pendingShare := range s.pendingShared {
+		if pendingShare != share {
+			continue
+		}
+		delete(s.pendingShared, id)
+		s.window.release(id)
+		if pub, ok := s.pendingOut.Take(id).(*packet.PublishPacket); ok {
+			pkts = append(pkts, pub)
+		}
+	}
+	return
+}
+
+// ackShared clears the shared subscription of an acknowledged Publish packet
+func (s *session) ackShared(id uint16) {
+	s.pendingSharedMu.Lock()
+	delete(s.pendingShared, id)
+	s.pendingSharedMu.Unlock()
+}
+
+// publishRetained sends the retained messages that match the filter
+func (s *session) publishRetained(filter string, qos byte) {
+	store := retained.StoreFromContext(s.ctx)
+	if store == nil {
+		return
+	}
+	for _, pkt := range store.Get(filter) {
+		if !s.canRead(pkt.TopicParts) {
+			continue
+		}
+		s.send(pkt, qos, true, "")
+	}
+}
+
+func (s *session) send(pkt *packet.PublishPacket, qos byte, retain bool, share string) {
 	logger := log.FromContext(s.ctx).WithFields(log.F{"topic": pkt.TopicName, "size": len(pkt.Message), "qos": pkt.QoS})
 	pub := &packet.PublishPacket{
 		Received:   pkt.Received,
-		Retain:     pkt.Retain,
+		Retain:     retain,
 		QoS:        qos,
 		TopicName:  pkt.TopicName,
 		TopicParts: pkt.TopicParts,
 		Message:    pkt.Message,
+		Properties: pkt.Properties,
+	}
+	if s.mountPoint != "" {
+		pub.TopicParts, _ = s.unmount(pkt.TopicParts)
+		pub.TopicName = topic.Join(pub.TopicParts)
 	}
 	if pub.QoS > pkt.QoS {
 		pub.QoS = pkt.QoS
 	}
+	pub.Properties.TopicAlias = nil
+	pub.Properties.SubscriptionIdentifiers = nil
+	if expiry := pkt.Properties.MessageExpiryInterval; expiry != nil && !pkt.Received.IsZero() {
+		elapsed := uint32(time.Since(pkt.Received) / time.Second)
+		if elapsed >= *expiry {
+			logger.Debug("Drop expired message")
+			return
+		}
+		pub.Properties.MessageExpiryInterval = packet.Uint32(*expiry - elapsed)
+	}
+	offline := atomic.LoadUint32(&s.offline) == 1
+	if offline && pub.QoS == 0 {
+		return
+	}
+	if pub.QoS > 0 && s.full(pub, offline) {
+		switch {
+		case s.policy.Action == Disconnect && !offline:
+			s.drop(pub, "disconnect", logger)
+			go s.Terminate(ErrSlowConsumer)
+			return
+		case s.policy.Action == DropOldest && s.dropOldest(offline, logger):
+		default:
+			reason := "in_flight_full"
+			if offline {
+				reason = "offline_queue_full"
+			}
+			slowConsumerCounter.WithLabelValues(reason).Inc()
+			logger.WithField("reason", reason).Warn("Drop message for slow consumer")
+			return
+		}
+	}
 	if pub.QoS > 0 {
-		publishIdentifier := atomic.AddUint64(&s.publishIdentifier, 1)
-		pub.PacketIdentifier = uint16(publishIdentifier)
-		s.pendingOut.Add(pub.PacketIdentifier, pub)
-		if s.pendingOut.Len() > PublishBufferSize*2 {
-			s.pendingOut.Clear()
-			logger.WithField("error", "Too many pending messages").Warn("Cleared pendingOut")
+		_, ok := s.pendingOut.Allocate(func(id uint16) packet.ControlPacket {
+			pub.PacketIdentifier = id
+			if offline {
+				return pub
+			}
+			// once sent, a retransmission of the packet is a duplicate
+			dup := *pub
+			dup.Duplicate = true
+			return &dup
+		})
+		if !ok {
+			slowConsumerCounter.WithLabelValues("in_flight_full").Inc()
+			logger.WithField("reason", "in_flight_full").Warn("Drop message for slow consumer")
+			return
+		}
+		s.pendingSharedMu.Lock()
+		if share != "" {
+			if s.pendingShared == nil {
+				s.pendingShared = make(map[uint16]string)
+			}
+			s.pendingShared[pub.PacketIdentifier] = share
+		} else if s.pendingShared != nil {
+			delete(s.pendingShared, pub.PacketIdentifier) // the packet identifier was reused
 		}
+		s.pendingSharedMu.Unlock()
+	}
+	if offline {
+		logger.Debug("Queue message for offline session")
+		return
 	}
+	if pub.QoS > 0 {
+		// the message is sent when it fits in the window of messages in flight
+		s.window.hold(pub)
+		s.sendHeld()
+		return
+	}
+	s.push(pub, logger)
+}
+
+// push a message into the publish buffer
+func (s *session) push(pub *packet.PublishPacket, logger log.Interface) {
 	select {
 	case s.publish <- pub:
 		atomic.AddUint64(&s.published, 1)
 		logger.Debug("Publish message")
 	default:
-		logger.WithError(errors.New("connection too slow")).Warn("Drop message")
+		s.slowConsumer(pub, logger)
 	}
 }
 
+// full returns true if the message does not fit in the budget of messages that were not sent yet
+// Messages for online sessions are held until they fit in the window of messages in flight.
+func (s *session) full(pub *packet.PublishPacket, offline bool) bool {
+	if offline {
+		return s.pendingOut.Len() >= s.policy.maxPending()
+	}
+	count, size := s.window.heldLen()
+	return s.policy.exceeds(count+1, size+len(pub.Message))
+}
+
+// dropOldest drops the oldest message that was not sent yet
+// returns false if there is no such message
+func (s *session) dropOldest(offline bool, logger log.Interface) bool {
+	var oldest *packet.PublishPacket
+	if offline {
+		oldest = s.oldestUnsent()
+	} else {
+		oldest = s.window.oldest()
+	}
+	if oldest == nil {
+		return false
+	}
+	s.drop(oldest, "drop_oldest", logger)
+	return true
+}
+
+// oldestUnsent returns the oldest Publish packet in pendingOut that was not sent
+// Publish packets that were sent are stored as duplicates.
+func (s *session) oldestUnsent() *packet.PublishPacket {
+	for _, pkt := range s.pendingOut.Get() {
+		if pub, ok := pkt.(*packet.PublishPacket); ok && !pub.Duplicate {
+			return pub
+		}
+	}
+	return nil
+}
+
 func (s *session) Deliver(pkt *packet.PublishPacket) {
 	if s.auth.CanWrite(pkt.TopicParts...) {
 		log.FromContext(s.ctx).WithFields(log.F{"topic": pkt.TopicName, "size": len(pkt.Message), "qos": pkt.QoS}).Debug("Deliver message")
 		atomic.AddUint64(&s.delivered, 1)
+		pkt = s.mount(pkt)
+		pkt.ClientID = s.auth.ClientID
 		s.deliver(pkt)
 	}
 }
 
+// maxPendingIn returns the maximum number of incoming QoS 2 messages that were not released
+// MQTT 5.0 clients are sent the maximum as Receive Maximum in the Connack.
+func maxPendingIn() int {
+	return PublishBufferSize * 2
+}
+
 func (s *session) HandlePublish(pkt *packet.PublishPacket) (response packet.ControlPacket, err error) {
+	if pkt.Properties.TopicAlias != nil {
+		return nil, packet.TopicAliasInvalid // the Connack does not allow topic aliases
+	}
 	response = pkt.Response()
+	if !s.auth.CanWrite(pkt.TopicParts...) {
+		switch response := response.(type) {
+		case *packet.PubackPacket:
+			response.ReasonCode = packet.NotAuthorized
+		case *packet.PubrecPacket:
+			response.ReasonCode = packet.NotAuthorized
+		}
+		return
+	}
 	if pkt.QoS == 2 {
 		if !s.pendingIn.Add(pkt.PacketIdentifier, pkt) { // already seen this message
 			return
 		}
-		if s.pendingIn.Len() > PublishBufferSize*2 {
-			s.pendingIn.Clear()
-			log.FromContext(s.ctx).WithField("error", "Too many pending messages").Warn("Cleared pendingIn")
+		if s.pendingIn.Len() > maxPendingIn() {
+			// the message can not be delivered exactly once, so the connection is closed
+			s.pendingIn.Remove(pkt.PacketIdentifier)
+			return nil, packet.ReceiveMaximumExceeded
 		}
 	}
 	s.Deliver(pkt)
@@ -76,10 +290,20 @@ func (s *session) HandlePublish(pkt *packet.PublishPacket) (response packet.Cont
 
 func (s *session) HandlePuback(pkt *packet.PubackPacket) (err error) {
 	s.pendingOut.Remove(pkt.PacketIdentifier)
+	s.ackShared(pkt.PacketIdentifier)
+	s.window.release(pkt.PacketIdentifier)
+	s.sendHeld()
 	return
 }
 
 func (s *session) HandlePubrec(pkt *packet.PubrecPacket) (response *packet.PubrelPacket, err error) {
+	s.ackShared(pkt.PacketIdentifier)
+	if pkt.ReasonCode.IsError() {
+		s.pendingOut.Remove(pkt.PacketIdentifier)
+		s.window.release(pkt.PacketIdentifier)
+		s.sendHeld()
+		return
+	}
 	response = pkt.Response()
 	s.pendingOut.Add(pkt.PacketIdentifier, response)
 	return
@@ -87,15 +311,28 @@ func (s *session) HandlePubrec(pkt *packet.PubrecPacket) (response *packet.Pubre
 
 func (s *session) HandlePubrel(pkt *packet.PubrelPacket) (response *packet.PubcompPacket, err error) {
 	response = pkt.Response()
-	s.pendingIn.Remove(pkt.PacketIdentifier)
+	if !s.pendingIn.Remove(pkt.PacketIdentifier) {
+		response.ReasonCode = packet.PacketIdentifierNotFound
+	}
 	return
 }
 
 func (s *session) HandlePubcomp(pkt *packet.PubcompPacket) (err error) {
 	s.pendingOut.Remove(pkt.PacketIdentifier)
+	s.window.release(pkt.PacketIdentifier)
+	s.sendHeld()
 	return
 }
 
 func (s *session) Pending() []packet.ControlPacket {
-	return s.pendingOut.Get()
+	pending := s.pendingOut.Get()
+	for _, pkt := range pending {
+		if pub, ok := pkt.(*packet.PublishPacket); ok && !pub.Duplicate {
+			// this is the first time the packet is sent, so following retransmissions are duplicates
+			dup := *pub
+			dup.Duplicate = true
+			s.pendingOut.Add(pub.PacketIdentifier, &dup)
+		}
+	}
+	return pending
 }
@@ -4,7 +4,9 @@ package session
 
 import (
 	"context"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/TheThingsIndustries/mystique/pkg/auth"
 	"github.com/TheThingsIndustries/mystique/pkg/packet"
@@ -171,4 +173,241 @@ func TestPublishingQoS2(t *testing.T) {
 
 	a.So(sessionA.pendingOut.Get(), should.HaveLength, 0)
 	a.So(sessionB.pendingIn.Get(), should.HaveLength, 0)
+
+	{ // Messages that exceed the maximum of pending messages are rejected
+		for id := 1; id <= maxPendingIn(); id++ {
+			_, err := sessionB.HandlePublish(&packet.PublishPacket{TopicParts: []string{"foo"}, QoS: 2, PacketIdentifier: uint16(id)})
+			a.So(err, should.BeNil)
+			<-deliveredB
+		}
+		_, err := sessionB.HandlePublish(&packet.PublishPacket{TopicParts: []string{"foo"}, QoS: 2, PacketIdentifier: uint16(maxPendingIn() + 1)})
+		a.So(err, should.Equal, packet.ReceiveMaximumExceeded)
+		a.So(sessionB.pendingIn.Get(), should.HaveLength, maxPendingIn())
+	}
+}
+
+func TestPending(t *testing.T) {
+	a := assertions.New(t)
+	ctx := context.Background()
+	auth := new(auth.Info)
+
+	sess := &session{ctx: ctx, auth: auth, publish: make(chan *packet.PublishPacket, 16), persistent: true}
+	sess.subscriptions.Add("#", 2)
+
+	sess.Publish(&packet.PublishPacket{TopicParts: []string{"foo"}, QoS: 1})
+	sess.Publish(&packet.PublishPacket{TopicParts: []string{"foo"}, QoS: 2})
+	a.So(sess.PublishChan(), should.HaveLength, 2)
+
+	pubrel, err := sess.HandlePubrec(&packet.PubrecPacket{PacketIdentifier: 2})
+	a.So(err, should.BeNil)
+
+	sess.Close()
+
+	sess.Publish(&packet.PublishPacket{TopicParts: []string{"foo"}, QoS: 0})
+	sess.Publish(&packet.PublishPacket{TopicParts: []string{"foo"}, QoS: 1})
+	a.So(sess.PublishChan(), should.HaveLength, 2)
+
+	pending := sess.Pending()
+	if a.So(pending, should.HaveLength, 3) {
+		a.So(pending[0].(*packet.PublishPacket).Duplicate, should.BeTrue)
+		a.So(pending[1], should.Resemble, pubrel)
+		a.So(pending[2].(*packet.PublishPacket).PacketIdentifier, should.Equal, 3)
+		a.So(pending[2].(*packet.PublishPacket).Duplicate, should.BeFalse)
+	}
+
+	pending = sess.Pending()
+	if a.So(pending, should.HaveLength, 3) {
+		a.So(pending[2].(*packet.PublishPacket).Duplicate, should.BeTrue)
+	}
+}
+
+func TestSlowConsumer(t *testing.T) {
+	defer func(size int) { PublishBufferSize = size }(PublishBufferSize)
+	PublishBufferSize = 2
+
+	newSession := func(policy SlowConsumerPolicy) *session {
+		s := &session{
+			ctx:       context.Background(),
+			auth:      new(auth.Info),
+			publish:   make(chan *packet.PublishPacket, PublishBufferSize),
+			terminate: make(chan error, 1),
+			policy:    policy,
+			window:    window{size: 2},
+		}
+		s.subscriptions.Add("#", 1)
+		return s
+	}
+	publish := func(s *session, n int) {
+		for i := 0; i < n; i++ {
+			s.Publish(&packet.PublishPacket{TopicParts: []string{"foo"}, Message: []byte{byte(i)}, QoS: 1})
+		}
+	}
+	received := func(s *session) (messages []byte) {
+		for {
+			select {
+			case pub := <-s.publish:
+				messages = append(messages, pub.Message[0])
+			default:
+				return
+			}
+		}
+	}
+	// acknowledge the received messages, so that held messages are sent
+	ack := func(s *session) (messages []byte) {
+		for {
+			select {
+			case pub := <-s.publish:
+				messages = append(messages, pub.Message[0])
+				s.HandlePuback(&packet.PubackPacket{PacketIdentifier: pub.PacketIdentifier})
+			default:
+				return
+			}
+		}
+	}
+	pending := func(s *session) (messages []byte) {
+		for _, pkt := range s.pendingOut.Get() {
+			messages = append(messages, pkt.(*packet.PublishPacket).Message[0])
+		}
+		return
+	}
+
+	t.Run("DropNewest", func(t *testing.T) {
+		a := assertions.New(t)
+		s := newSession(SlowConsumerPolicy{Action: DropNewest})
+		publish(s, 7)
+		a.So(received(s), should.Resemble, []byte{0, 1})
+		a.So(pending(s), should.Resemble, []byte{0, 1, 2, 3, 4, 5})
+		a.So(ack(s), should.BeEmpty)
+	})
+
+	t.Run("FullBuffer", func(t *testing.T) {
+		a := assertions.New(t)
+		s := newSession(SlowConsumerPolicy{Action: DropNewest})
+		s.closed = make(chan struct{})
+		defer close(s.closed)
+
+		// held messages wait for room in the publish buffer
+		for i := 0; i < 2; i++ {
+			s.Publish(&packet.PublishPacket{TopicParts: []string{"foo"}, Message: []byte{byte(i)}})
+		}
+		publish(s, 2)
+		var messages []byte
+		for i := 0; i < 4; i++ {
+			select {
+			case pub := <-s.publish:
+				messages = append(messages, pub.Message[0])
+			case <-time.After(time.Second):
+				t.Fatal("Did not receive held message")
+			}
+		}
+		a.So(messages, should.Resemble, []byte{0, 1, 0, 1})
+		a.So(pending(s), should.Resemble, []byte{0, 1})
+	})
+
+	t.Run("DropOldest", func(t *testing.T) {
+		a := assertions.New(t)
+		s := newSession(SlowConsumerPolicy{Action: DropOldest})
+		publish(s, 7)
+
+		// the oldest message that was not sent makes room, messages in flight are kept
+		a.So(pending(s), should.Resemble, []byte{0, 1, 3, 4, 5, 6})
+		a.So(ack(s), should.Resemble, []byte{0, 1, 3, 4, 5, 6})
+
+		// messages that were sent before the session went offline are kept
+		publish(s, 2)
+		a.So(received(s), should.Resemble, []byte{0, 1})
+		atomic.StoreUint32(&s.offline, 1)
+		publish(s, 3)
+		a.So(pending(s), should.Resemble, []byte{0, 1, 1, 2})
+	})
+
+	t.Run("Disconnect", func(t *testing.T) {
+		a := assertions.New(t)
+		s := newSession(SlowConsumerPolicy{Action: Disconnect})
+		publish(s, 7)
+		a.So(received(s), should.Resemble, []byte{0, 1})
+		a.So(<-s.Terminated(), should.Equal, ErrSlowConsumer)
+	})
+
+	t.Run("Queue", func(t *testing.T) {
+		a := assertions.New(t)
+		s := newSession(SlowConsumerPolicy{Action: Queue, MaxQueuedMessages: 3})
+		publish(s, 6)
+		a.So(s.pendingOut.Len(), should.Equal, 5)
+		a.So(ack(s), should.Resemble, []byte{0, 1, 2, 3, 4})
+
+		s = newSession(SlowConsumerPolicy{Action: Queue, MaxQueuedBytes: 2})
+		publish(s, 6)
+		a.So(ack(s), should.Resemble, []byte{0, 1, 2, 3})
+	})
+}
+
+func TestInFlightWindow(t *testing.T) {
+	a := assertions.New(t)
+
+	s := &session{
+		ctx:     context.Background(),
+		auth:    new(auth.Info),
+		publish: make(chan *packet.PublishPacket, 16),
+		window:  window{size: 2},
+	}
+	s.subscriptions.Add("#", 2)
+
+	// packet identifiers that are in use are skipped
+	s.pendingOut.Add(2, &packet.PubrelPacket{PacketIdentifier: 2})
+	s.window.reset(2)
+
+	for i := 0; i < 3; i++ {
+		s.Publish(&packet.PublishPacket{TopicParts: []string{"foo"}, Message: []byte{byte(i)}, QoS: 2})
+	}
+	a.So(s.pendingOut.Len(), should.Equal, 4)
+	pub := <-s.publish
+	a.So(pub.PacketIdentifier, should.Equal, 1)
+	a.So(pub.Message, should.Resemble, []byte{0})
+	a.So(s.publish, should.BeEmpty)
+
+	// the Pubcomp for the packet identifier that was in use makes room in the window
+	a.So(s.HandlePubcomp(&packet.PubcompPacket{PacketIdentifier: 2}), should.BeNil)
+	pub = <-s.publish
+	a.So(pub.PacketIdentifier, should.Equal, 3)
+	a.So(s.publish, should.BeEmpty)
+
+	// the message stays in flight until the Pubcomp
+	_, err := s.HandlePubrec(&packet.PubrecPacket{PacketIdentifier: 1})
+	a.So(err, should.BeNil)
+	a.So(s.publish, should.BeEmpty)
+	a.So(s.HandlePubcomp(&packet.PubcompPacket{PacketIdentifier: 1}), should.BeNil)
+	pub = <-s.publish
+	a.So(pub.PacketIdentifier, should.Equal, 4)
+	a.So(pub.Message, should.Resemble, []byte{2})
+}
+
+func TestInFlightOrder(t *testing.T) {
+	a := assertions.New(t)
+
+	s := &session{
+		ctx:     context.Background(),
+		auth:    new(auth.Info),
+		publish: make(chan *packet.PublishPacket, 1),
+		window:  window{size: 4},
+		closed:  make(chan struct{}),
+	}
+	defer close(s.closed)
+	s.subscriptions.Add("#", 1)
+
+	// the first held message waits for room in the publish buffer, and the next messages are not sent before it
+	s.Publish(&packet.PublishPacket{TopicParts: []string{"foo"}, Message: []byte{0}})
+	for i := 1; i < 4; i++ {
+		s.Publish(&packet.PublishPacket{TopicParts: []string{"foo"}, Message: []byte{byte(i)}, QoS: 1})
+	}
+	var messages []byte
+	for len(messages) < 4 {
+		select {
+		case pub := <-s.publish:
+			messages = append(messages, pub.Message[0])
+		case <-time.After(time.Second):
+			t.Fatalf("Received %d of 4 messages", len(messages))
+		}
+	}
+	a.So(messages, should.Resemble, []byte{0, 1, 2, 3})
 }
@@ -7,6 +7,7 @@ import (
 	"context"
 	"errors"
 	"io"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -23,6 +24,12 @@ import (
 // PublishBufferSize sets the size of publish channel buffers
 var PublishBufferSize = 64
 
+// TerminateTimeout sets the maximum time to wait for a terminated session to close
+var TerminateTimeout = 10 * time.Second
+
+// ErrTakenOver is the reason for terminating a session that is taken over by a new connection of the same client
+var ErrTakenOver error = packet.SessionTakenOver
+
 // Session interface
 type Session interface {
 	Context() context.Context
@@ -40,8 +47,9 @@ type Session interface {
 	ReadPacket() (packet.ControlPacket, error)
 
 	// Handle a Disconnect packet
-	// unsets the will
-	HandleDisconnect()
+	// unsets the will, unless the reason code is DisconnectWithWillMessage
+	// updates the session expiry of MQTT 5.0 sessions
+	HandleDisconnect(pkt *packet.DisconnectPacket)
 
 	// Send an outgoing Publish message if the session is subscribed to the topic
 	// if subscription with QoS 0: sends the message
@@ -50,6 +58,17 @@ type Session interface {
 	// if authentication is enabled, the server checks if the client is allowed to receive on the topic
 	Publish(pkt *packet.PublishPacket)
 
+	// MatchShared returns the QoS of the shared subscriptions of the session that match the topic
+	MatchShared(topicParts ...string) map[string]byte
+
+	// Send an outgoing Publish message for a shared subscription that the session was selected for
+	// if authentication is enabled, the server checks if the client is allowed to receive on the topic
+	PublishShared(pkt *packet.PublishPacket, share string, qos byte)
+
+	// TakeShared removes the Publish messages that were sent for the shared subscription,
+	// but were not yet acknowledged, so that they can be sent to another member of the group
+	TakeShared(share string) []*packet.PublishPacket
+
 	// Handle an incoming Publish packet
 	// if QoS 0: delivers the packet and returns nil
 	// if QoS 1: delivers the packet and returns a *PubackPacket
@@ -63,6 +82,7 @@ type Session interface {
 
 	// Handle a Pubrec packet
 	// clears pkt that was waiting for Pubrec, stores Pubrel until Pubcomp, returns *PubrelPacket
+	// if the Pubrec has a reason code that indicates failure, returns nil
 	HandlePubrec(pkt *packet.PubrecPacket) (*packet.PubrelPacket, error)
 
 	// Handle a Pubrel packet
@@ -74,10 +94,13 @@ type Session interface {
 	HandlePubcomp(pkt *packet.PubcompPacket) error
 
 	// Pending messages that should be retransmitted on a reconnect
+	// Publish packets that were sent before have the Duplicate flag set
+	// Pubrel packets that have not been acknowledged with a Pubcomp
 	Pending() []packet.ControlPacket
 
 	// Handle a Subscribe packet
 	// adds subscriptions, returns *SubackPacket
+	// sends the retained messages that match the accepted subscriptions
 	// if authentication is enabled, the server checks if the client is allowed to subscribe to the topic
 	HandleSubscribe(pkt *packet.SubscribePacket) (*packet.SubackPacket, error)
 
@@ -88,30 +111,61 @@ type Session interface {
 	// Subscriptions of the session
 	Subscriptions() map[string]byte
 
+	// ProtocolVersion returns the protocol level of the session
+	ProtocolVersion() byte
+
+	// Persistent returns true if the session state is kept after the connection closes
+	Persistent() bool
+
+	// Expiry returns the time that the state of a persistent session should be kept after the connection closes
+	// returns 0 if the client did not request an expiry
+	Expiry() time.Duration
+
 	// Close the session
 	// closes the connection
 	// delivers the will (if set) and then unsets it
-	// clears the session state
+	// clears the session state, unless the session is persistent
 	Close()
+
+	// Discard the session state
+	Discard()
+
+	// Terminate the session from outside of its handler goroutine
+	// closes the connection and waits until the session is closed
+	Terminate(reason error)
+
+	// Terminated returns a channel that receives the reason when the session is terminated
+	Terminated() <-chan error
 }
 
 func New(ctx context.Context, conn net.Conn, deliver func(*packet.PublishPacket)) Session {
 	return &session{
-		ctx:     log.NewContext(ctx, log.FromContext(ctx)),
-		start:   time.Now(),
-		conn:    conn,
-		publish: make(chan *packet.PublishPacket, PublishBufferSize),
-		deliver: deliver,
+		ctx:       log.NewContext(ctx, log.FromContext(ctx)),
+		start:     time.Now(),
+		conn:      conn,
+		publish:   make(chan *packet.PublishPacket, PublishBufferSize),
+		deliver:   deliver,
+		terminate: make(chan error, 1),
+		closed:    make(chan struct{}),
+		policy:    SlowConsumerPolicyFromContext(ctx),
+		window:    window{size: MaxInFlight},
 	}
 }
 
 type session struct {
 	// BEGIN sync/atomic aligned
-	publishIdentifier uint64
-	published         uint64
-	delivered         uint64
+	published uint64
+	delivered uint64
 	// END sync/atomig aligned
 
+	// offline is set to 1 when the connection of a persistent session closes
+	offline uint32
+
+	// terminated is set to 1 when the session is terminated from outside of its handler goroutine
+	terminated uint32
+	terminate  chan error
+	closed     chan struct{}
+
 	ctx     context.Context
 	start   time.Time
 	conn    net.Conn
@@ -120,6 +174,15 @@ type session struct {
 
 	auth *auth.Info
 
+	// version is the protocol level that the client connected with
+	version byte
+
+	// persistent sessions are kept after the connection closes
+	// is set on (re)connect if the client does not request a clean start (MQTT 3.1.1)
+	// or if the client requests a session expiry interval (MQTT 5.0)
+	persistent bool
+	expiry     time.Duration
+
 	// will of the session
 	// can be set on (re)connect
 	// is delivered when conn breaks
@@ -132,12 +195,26 @@ type session struct {
 	// - Pubrel packets that have not been acknowledged with a Pubcomp
 	pendingOut pending.List
 
+	// window of Publish packets in pendingOut that are in flight
+	window window
+
 	// pendingIn contains
 	// - Pubrec messages that have not been acknowledged with a Pubrel
 	pendingIn pending.List
 
+	// pendingShared contains the shared subscriptions of Publish packets in pendingOut
+	pendingShared   map[uint16]string
+	pendingSharedMu sync.Mutex
+
 	// subcriptions of the session
 	subscriptions subscription.List
+
+	// mountPoint is the topic prefix of the client; see mount.go
+	mountPoint string
+	mountParts []string
+
+	// policy for messages that do not fit in the publish buffer
+	policy SlowConsumerPolicy
 }
 
 func (s *session) Context() context.Context { return s.ctx }
@@ -151,6 +228,7 @@ func (s *session) Stats() Stats {
 	return Stats{
 		Published: atomic.LoadUint64(&s.published),
 		Delivered: atomic.LoadUint64(&s.delivered),
+		Pending:   s.pendingOut.Len(),
 	}
 }
 
@@ -158,25 +236,99 @@ func (s *session) PublishChan() <-chan *packet.PublishPacket {
 	return s.publish
 }
 
+func (s *session) ProtocolVersion() byte { return s.version }
+
+func (s *session) Persistent() bool { return s.persistent }
+
+func (s *session) Expiry() time.Duration { return s.expiry }
+
 func (s *session) Close() {
 	if s.will != nil {
 		s.Deliver(s.will)
 		s.will = nil
 	}
-	s.pendingOut.Clear()
-	s.pendingIn.Clear()
-	s.subscriptions.Clear()
+	if s.persistent {
+		atomic.StoreUint32(&s.offline, 1)
+	} else {
+		s.Discard()
+	}
 	stats := s.Stats()
 	sessionMessages.WithLabelValues("in").Observe(float64(stats.Delivered))
 	sessionMessages.WithLabelValues("out").Observe(float64(stats.Published))
 	sessionDuration.Observe(float64(time.Since(s.start) / time.Second))
+	if s.closed != nil {
+		close(s.closed)
+	}
+}
+
+func (s *session) Terminate(reason error) {
+	if atomic.CompareAndSwapUint32(&s.terminated, 0, 1) {
+		if s.terminate != nil {
+			s.terminate <- reason
+		}
+		// MQTT 5.0 clients are sent a Disconnect with the reason before the connection closes
+		if s.conn != nil && (s.version < packet.Version5 || s.closed == nil) {
+			s.conn.Close()
+		}
+	}
+	if s.closed == nil {
+		return
+	}
+	select {
+	case <-s.closed:
+	case <-time.After(TerminateTimeout):
+		log.FromContext(s.ctx).WithError(reason).Warn("Terminated session did not close in time")
+		if s.conn != nil {
+			s.conn.Close()
+		}
+	}
+}
+
+func (s *session) Terminated() <-chan error {
+	return s.terminate
+}
+
+func (s *session) Discard() {
+	s.pendingSharedMu.Lock()
+	s.pendingShared = nil
+	s.pendingSharedMu.Unlock()
+	s.pendingOut.Clear()
+	s.pendingIn.Clear()
+	s.window.reset()
+	s.subscriptions.Clear()
+}
+
+// resume moves the state of the previous session into this session
+func (s *session) resume(previous *session) {
+	for filter, qos := range previous.subscriptions.Subscriptions() {
+		options, _ := previous.subscriptions.Options(filter)
+		s.subscriptions.AddWithOptions(filter, qos, options)
+	}
+	previous.subscriptions.Clear()
+	previous.pendingOut.MoveTo(&s.pendingOut)
+	previous.pendingIn.MoveTo(&s.pendingIn)
+	previous.window.reset()
+	// all pending packets are retransmitted, so they are in flight
+	var ids []uint16
+	for _, pkt := range s.pendingOut.Get() {
+		switch pkt := pkt.(type) {
+		case *packet.PublishPacket:
+			ids = append(ids, pkt.PacketIdentifier)
+		case *packet.PubrelPacket:
+			ids = append(ids, pkt.PacketIdentifier)
+		}
+	}
+	s.window.reset(ids...)
+	previous.pendingSharedMu.Lock()
+	s.pendingShared, previous.pendingShared = previous.pendingShared, nil
+	previous.pendingSharedMu.Unlock()
 }
 
 func (s *session) ReadPacket() (response packet.ControlPacket, err error) {
 	logger := log.FromContext(s.ctx)
 	pkt, err := s.conn.Receive()
 	if err != nil {
-		if err != io.EOF {
+		if err != io.EOF && atomic.LoadUint32(&s.terminated) == 0 {
 			logger.WithError(err).Warn("Error receiving packet")
 		}
 		return nil, err
@@ -186,6 +338,11 @@ func (s *session) ReadPacket() (response packet.ControlPacket, err error) {
 	}
 	if err := pkt.Validate(); err != nil {
 		logger.WithError(err).Warn("Received invalid packet")
+		if s.version >= packet.Version5 {
+			if _, ok := err.(packet.ReasonCode); !ok {
+				err = packet.ProtocolError
+			}
+		}
 		return nil, err
 	}
 	logger.Debugf("Read %s packet", packet.Name[pkt.PacketType()])
@@ -199,7 +356,10 @@ func (s *session) ReadPacket() (response packet.ControlPacket, err error) {
 	case *packet.PubackPacket:
 		err = s.HandlePuback(pkt)
 	case *packet.PubrecPacket:
-		response, err = s.HandlePubrec(pkt)
+		var pubrel *packet.PubrelPacket
+		if pubrel, err = s.HandlePubrec(pkt); pubrel != nil {
+			response = pubrel
+		}
 	case *packet.PubrelPacket:
 		response, err = s.HandlePubrel(pkt)
 	case *packet.PubcompPacket:
@@ -211,7 +371,9 @@ func (s *session) ReadPacket() (response packet.ControlPacket, err error) {
 	case *packet.PingreqPacket:
 		response = pkt.Response()
 	case *packet.DisconnectPacket:
-		s.HandleDisconnect()
+		s.HandleDisconnect(pkt)
+	case *packet.AuthPacket:
+		err = packet.ProtocolError // enhanced authentication is not supported
 	default:
 		err = errors.New("unknown packet type")
 	}
@@ -0,0 +1,120 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+package session
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"sync"
+
+	"github.com/TheThingsIndustries/mystique/pkg/packet"
+)
+
+// SharedStrategy selects the member of a shared subscription group that receives a message
+type SharedStrategy interface {
+	// Select one of the members (which are sorted by username and client ID)
+	Select(share string, pkt *packet.PublishPacket, members []Session) Session
+}
+
+// SharedStrategyFunc is a function that implements SharedStrategy
+type SharedStrategyFunc func(share string, pkt *packet.PublishPacket, members []Session) Session
+
+// Select implements SharedStrategy
+func (f SharedStrategyFunc) Select(share string, pkt *packet.PublishPacket, members []Session) Session {
+	return f(share, pkt, members)
+}
+
+// RoundRobin returns a SharedStrategy that selects the members of each group in turn
+func RoundRobin() SharedStrategy {
+	var (
+		mu   sync.Mutex
+		next = make(map[string]uint64)
+	)
+	return SharedStrategyFunc(func(share string, _ *packet.PublishPacket, members []Session) Session {
+		mu.Lock()
+		i := next[share]
+		next[share] = i + 1
+		mu.Unlock()
+		return members[i%uint64(len(members))]
+	})
+}
+
+// Random returns a SharedStrategy that selects a random member
+func Random() SharedStrategy {
+	return SharedStrategyFunc(func(_ string, _ *packet.PublishPacket, members []Session) Session {
+		return members[rand.Intn(len(members))]
+	})
+}
+
+// Sticky returns a SharedStrategy that selects the member by the hash of the topic,
+// so that messages on the same topic are delivered to the same member as long as the group does not change
+func Sticky() SharedStrategy {
+	return SharedStrategyFunc(func(_ string, pkt *packet.PublishPacket, members []Session) Session {
+		h := fnv.New32a()
+		h.Write([]byte(pkt.TopicName))
+		return members[h.Sum32()%uint32(len(members))]
+	})
+}
+
+// SharedStrategies by name
+var SharedStrategies = map[string]func() SharedStrategy{
+	"round-robin": RoundRobin,
+	"random":      Random,
+	"sticky":      Sticky,
+}
+
+// NewSharedStrategy returns the SharedStrategy with the given name
+func NewSharedStrategy(name string) (SharedStrategy, error) {
+	strategy, ok := SharedStrategies[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown shared subscription strategy %q", name)
+	}
+	return strategy(), nil
+}
+
+// sharedGroups collects the members of shared subscriptions that match a message
+type sharedGroups map[string]map[Session]byte
+
+func (g *sharedGroups) add(session Session, matches map[string]byte) {
+	for share, qos := range matches {
+		if *g == nil {
+			*g = make(sharedGroups)
+		}
+		if (*g)[share] == nil {
+			(*g)[share] = make(map[Session]byte)
+		}
+		(*g)[share][session] = qos
+	}
+}
+
+// publish the message to one member of each group
+// members of the fallback groups are only selected if the group has no members
+func (g sharedGroups) publish(strategy SharedStrategy, pkt *packet.PublishPacket, fallback sharedGroups) {
+	for share, members := range g {
+		publishShared(strategy, share, pkt, members)
+	}
+	for share, members := range fallback {
+		if _, ok := g[share]; ok {
+			continue
+		}
+		publishShared(strategy, share, pkt, members)
+	}
+}
+
+func publishShared(strategy SharedStrategy, share string, pkt *packet.PublishPacket, members map[Session]byte) {
+	sorted := make([]Session, 0, len(members))
+	for session := range members {
+		sorted = append(sorted, session)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		ki, kj := keyOf(sorted[i]), keyOf(sorted[j])
+		if ki.username != kj.username {
+			return ki.username < kj.username
+		}
+		return ki.clientID < kj.clientID
+	})
+	selected := strategy.Select(share, pkt, sorted)
+	selected.PublishShared(pkt, share, members[selected])
+}
@@ -0,0 +1,115 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+package session
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/TheThingsIndustries/mystique/pkg/log"
+	"github.com/TheThingsIndustries/mystique/pkg/packet"
+)
+
+// SlowConsumerAction is the action that is taken when a session can not keep up with the messages that are sent to it
+type SlowConsumerAction byte
+
+// Slow consumer actions
+const (
+	// DropNewest drops the message that does not fit in the buffer
+	DropNewest SlowConsumerAction = iota
+	// DropOldest drops the oldest message in the buffer to make room for the new message
+	DropOldest
+	// Disconnect disconnects the client
+	Disconnect
+	// Queue queues messages with QoS 1 and 2 that do not fit in the buffer, up to the budget of the policy
+	// messages with QoS 0 and messages that exceed the budget are dropped
+	Queue
+)
+
+var slowConsumerActionNames = map[SlowConsumerAction]string{
+	DropNewest: "drop-newest",
+	DropOldest: "drop-oldest",
+	Disconnect: "disconnect",
+	Queue:      "queue",
+}
+
+func (a SlowConsumerAction) String() string {
+	return slowConsumerActionNames[a]
+}
+
+// ParseSlowConsumerAction parses the name of a slow consumer action
+func ParseSlowConsumerAction(name string) (SlowConsumerAction, error) {
+	for action, actionName := range slowConsumerActionNames {
+		if actionName == name {
+			return action, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown slow consumer action %q", name)
+}
+
+// SlowConsumerPolicy determines what happens with messages for a session that can not keep up
+type SlowConsumerPolicy struct {
+	Action SlowConsumerAction
+
+	// Budget of the Queue action; zero means no limit
+	MaxQueuedMessages int
+	MaxQueuedBytes    int
+}
+
+// DefaultSlowConsumerPolicy is used if there is no policy in the context of the session
+var DefaultSlowConsumerPolicy = SlowConsumerPolicy{Action: DropNewest}
+
+// ErrSlowConsumer is the reason for terminating a session that can not keep up with the messages that are sent to it
+var ErrSlowConsumer error = packet.QuotaExceeded
+
+// exceeds returns true if the messages that are held until they fit in the window of messages in flight exceed the budget
+func (p SlowConsumerPolicy) exceeds(count, size int) bool {
+	if p.Action != Queue {
+		return count > PublishBufferSize*2
+	}
+	return p.MaxQueuedMessages > 0 && count > p.MaxQueuedMessages ||
+		p.MaxQueuedBytes > 0 && size > p.MaxQueuedBytes
+}
+
+// maxPending returns the maximum number of pending messages of an offline session
+func (p SlowConsumerPolicy) maxPending() int {
+	max := PublishBufferSize * 2
+	if p.Action == Queue {
+		max += p.MaxQueuedMessages
+	}
+	return max
+}
+
+// slowConsumer handles a message that does not fit in the publish buffer
+func (s *session) slowConsumer(pub *packet.PublishPacket, logger log.Interface) {
+	switch s.policy.Action {
+	case DropOldest:
+		select {
+		case oldest := <-s.publish:
+			s.drop(oldest, "drop_oldest", logger)
+		default:
+		}
+		select {
+		case s.publish <- pub:
+			atomic.AddUint64(&s.published, 1)
+			return
+		default:
+		}
+	case Disconnect:
+		s.drop(pub, "disconnect", logger)
+		go s.Terminate(ErrSlowConsumer)
+		return
+	}
+	s.drop(pub, "drop_newest", logger)
+}
+
+// drop a message that was not sent
+func (s *session) drop(pub *packet.PublishPacket, reason string, logger log.Interface) {
+	slowConsumerCounter.WithLabelValues(reason).Inc()
+	if pub.QoS > 0 {
+		s.pendingOut.Remove(pub.PacketIdentifier)
+		s.ackShared(pub.PacketIdentifier)
+		s.window.release(pub.PacketIdentifier)
+	}
+	logger.WithField("reason", reason).Warn("Drop message for slow consumer")
+}
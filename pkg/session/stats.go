@@ -6,4 +6,7 @@ package session
 type Stats struct {
 	Published uint64
 	Delivered uint64
+
+	// Pending is the number of outgoing QoS 1 and QoS 2 messages that were not yet acknowledged
+	Pending int
 }
@@ -3,36 +3,118 @@
 package session
 
 import (
+	"context"
 	"runtime"
 	"sync"
+	"time"
 
+	"github.com/TheThingsIndustries/mystique/pkg/log"
 	"github.com/TheThingsIndustries/mystique/pkg/packet"
+	"github.com/TheThingsIndustries/mystique/pkg/subscription"
+	"github.com/TheThingsIndustries/mystique/pkg/topic"
 )
 
 // Store interface
 type Store interface {
 	All() []Session
+
+	// Get the live session of the client
+	// returns nil if there is no such session
+	Get(username, clientID string) Session
+
 	Store(Session)
+
+	// Delete the session from the store
+	// a persistent session is kept until it is resumed or until it expires
+	// the session expires after the expiry of the store or the expiry of the session, whichever is shorter
 	Delete(Session)
+
+	// Resume removes the persisted session of the client from the store and returns it
+	// returns nil if there is no such session
+	Resume(username, clientID string) Session
+
 	Publish(pkt *packet.PublishPacket)
+
+	// PublishContext publishes the message like Publish
+	// returns the error of the context if it is done before the message is accepted by the store
+	PublishContext(ctx context.Context, pkt *packet.PublishPacket) error
+}
+
+// DefaultExpiry is the default time after which a disconnected persistent session expires
+var DefaultExpiry = time.Hour
+
+// StoreOption for the SimpleStore
+type StoreOption func(s *simpleStore)
+
+// WithExpiry returns an option that sets the time after which a disconnected persistent session expires.
+// An expiry of zero disables persistent sessions.
+func WithExpiry(d time.Duration) StoreOption {
+	return func(s *simpleStore) { s.expiry = d }
+}
+
+// WithSharedStrategy returns an option that sets the strategy for selecting the member of a shared subscription group.
+// The default strategy is RoundRobin.
+func WithSharedStrategy(strategy SharedStrategy) StoreOption {
+	return func(s *simpleStore) { s.shared = strategy }
 }
 
 // SimpleStore returns a simple Store implementation and starts a goroutine that keeps the store clean
-func SimpleStore() Store {
+// The store keeps an index of the subscriptions of the sessions that were created with New,
+// only those sessions receive the messages that are published to the store.
+func SimpleStore(option ...StoreOption) Store {
 	s := &simpleStore{
-		packets: make(chan *packet.PublishPacket),
+		index:     new(subscription.Index),
+		expiry:    DefaultExpiry,
+		shared:    RoundRobin(),
+		clients:   make(map[sessionKey]Session),
+		persisted: make(map[sessionKey]*persistedSession),
+		packets:   make(chan *packet.PublishPacket),
+	}
+	for _, opt := range option {
+		opt(s)
 	}
 	n := 2 * runtime.NumCPU()
 	for i := 0; i < n; i++ {
 		go s.work()
 	}
+	if s.expiry > 0 {
+		go s.cleanup()
+	}
 	stores = append(stores, s)
 	return s
 }
 
+type sessionKey struct {
+	username string
+	clientID string
+}
+
+func keyOf(session Session) sessionKey {
+	info := session.AuthInfo()
+	return sessionKey{username: info.Username, clientID: info.ClientID}
+}
+
+// indexedSession is a Session of which the subscriptions are added to the index of the store
+type indexedSession interface {
+	Session
+	setIndex(index *subscription.Index)
+	publishMatched(pkt *packet.PublishPacket, qos byte)
+}
+
+type persistedSession struct {
+	Session
+	expires time.Time
+}
+
 type simpleStore struct {
-	sessions sync.Map
-	packets  chan *packet.PublishPacket
+	expiry    time.Duration
+	shared    SharedStrategy
+	sessions  sync.Map
+	index     *subscription.Index
+	mu        sync.RWMutex
+	clients   map[sessionKey]Session
+	persisted map[sessionKey]*persistedSession
+	packets   chan *packet.PublishPacket
 }
 
 func (s *simpleStore) Count() (count uint64) {
@@ -43,6 +125,13 @@ func (s *simpleStore) Count() (count uint64) {
 	return
 }
 
+func (s *simpleStore) CountPersisted() (count uint64) {
+	s.mu.RLock()
+	count = uint64(len(s.persisted))
+	s.mu.RUnlock()
+	return
+}
+
 func (s *simpleStore) All() (sessions []Session) {
 	s.sessions.Range(func(_ interface{}, value interface{}) bool {
 		sessions = append(sessions, value.(Session))
@@ -51,24 +140,167 @@ func (s *simpleStore) All() (sessions []Session) {
 	return
 }
 
+func (s *simpleStore) Get(username, clientID string) Session {
+	s.mu.RLock()
+	session := s.clients[sessionKey{username: username, clientID: clientID}]
+	s.mu.RUnlock()
+	return session
+}
+
 func (s *simpleStore) Store(session Session) {
+	if session, ok := session.(indexedSession); ok {
+		session.setIndex(s.index)
+	}
 	s.sessions.Store(session, session)
+	s.mu.Lock()
+	s.clients[keyOf(session)] = session
+	s.mu.Unlock()
 }
 
 func (s *simpleStore) Delete(session Session) {
 	s.sessions.Delete(session)
+	s.redistribute(session)
+	key := keyOf(session)
+	s.mu.Lock()
+	if s.clients[key] == session {
+		delete(s.clients, key)
+	}
+	if !session.Persistent() || s.expiry <= 0 {
+		s.mu.Unlock()
+		if session, ok := session.(indexedSession); ok {
+			session.setIndex(nil)
+		}
+		return
+	}
+	expiry := s.expiry
+	if sessionExpiry := session.Expiry(); sessionExpiry > 0 && sessionExpiry < expiry {
+		expiry = sessionExpiry
+	}
+	previous, ok := s.persisted[key]
+	s.persisted[key] = &persistedSession{Session: session, expires: time.Now().Add(expiry)}
+	s.mu.Unlock()
+	if ok {
+		previous.Discard()
+	}
+}
+
+func (s *simpleStore) Resume(username, clientID string) Session {
+	key := sessionKey{username: username, clientID: clientID}
+	s.mu.Lock()
+	persisted, ok := s.persisted[key]
+	delete(s.persisted, key)
+	s.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	if persisted.expires.Before(time.Now()) {
+		persisted.Discard()
+		return nil
+	}
+	return persisted.Session
 }
 
 func (s *simpleStore) Publish(pkt *packet.PublishPacket) {
 	s.packets <- pkt
 }
 
+func (s *simpleStore) PublishContext(ctx context.Context, pkt *packet.PublishPacket) error {
+	select {
+	case s.packets <- pkt:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (s *simpleStore) work() {
 	for pkt := range s.packets {
+		subscribers, shared := s.index.Match(pkt.TopicParts...)
+		for subscriber, qos := range subscribers {
+			session := subscriber.(indexedSession)
+			if _, ok := s.state(session); ok {
+				session.publishMatched(pkt, qos)
+			}
+		}
+		if len(shared) == 0 {
+			continue
+		}
+		var live, offline sharedGroups
+		for share, members := range shared {
+			for member, qos := range members {
+				session := member.(indexedSession)
+				online, ok := s.state(session)
+				switch {
+				case !ok:
+				case online:
+					live.add(session, map[string]byte{share: qos})
+				default:
+					offline.add(session, map[string]byte{share: qos})
+				}
+			}
+		}
+		live.publish(s.shared, pkt, offline)
+	}
+}
+
+// state returns whether the session is online, and whether it is in the store at all
+func (s *simpleStore) state(session Session) (online bool, ok bool) {
+	if _, ok := s.sessions.Load(session); ok {
+		return true, true
+	}
+	s.mu.RLock()
+	persisted, ok := s.persisted[keyOf(session)]
+	s.mu.RUnlock()
+	return false, ok && persisted.Session == session
+}
+
+// redistribute the unacknowledged messages of the shared subscriptions of the session to the other members of the groups
+func (s *simpleStore) redistribute(session Session) {
+	for share := range session.Subscriptions() {
+		if _, _, ok := topic.SplitShare(share); !ok {
+			continue
+		}
+		members := make(map[Session]byte)
 		s.sessions.Range(func(_ interface{}, value interface{}) bool {
-			session := value.(Session)
-			session.Publish(pkt)
+			member := value.(Session)
+			if qos, ok := member.Subscriptions()[share]; ok && member != session {
+				members[member] = qos
+			}
 			return true
 		})
+		if len(members) == 0 {
+			continue
+		}
+		pkts := session.TakeShared(share)
+		for _, pkt := range pkts {
+			publishShared(s.shared, share, pkt, members)
+		}
+		if len(pkts) > 0 {
+			sharedRedistributed.Add(float64(len(pkts)))
+			log.FromContext(session.Context()).WithFields(log.F{"share": share, "count": len(pkts)}).Debug("Redistribute shared messages")
+		}
+	}
+}
+
+func (s *simpleStore) cleanup() {
+	interval := s.expiry
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	for {
+		time.Sleep(interval)
+		now := time.Now()
+		var expired []Session
+		s.mu.Lock()
+		for key, persisted := range s.persisted {
+			if persisted.expires.Before(now) {
+				delete(s.persisted, key) // yes, you can delete from within a range
+				expired = append(expired, persisted.Session)
+			}
+		}
+		s.mu.Unlock()
+		for _, session := range expired {
+			session.Discard()
+		}
 	}
 }
@@ -0,0 +1,128 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+package session
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/TheThingsIndustries/mystique/pkg/auth"
+	"github.com/TheThingsIndustries/mystique/pkg/packet"
+	"github.com/smartystreets/assertions"
+	"github.com/smartystreets/assertions/should"
+)
+
+func TestStorePersistent(t *testing.T) {
+	a := assertions.New(t)
+	store := SimpleStore(WithExpiry(time.Minute))
+
+	info := &auth.Info{Username: "user", ClientID: "client"}
+
+	clean := &session{ctx: context.Background(), auth: info, publish: make(chan *packet.PublishPacket, 16)}
+	store.Store(clean)
+	a.So(store.All(), should.HaveLength, 1)
+	store.Delete(clean)
+	a.So(store.All(), should.BeEmpty)
+	a.So(store.Resume("user", "client"), should.BeNil)
+
+	persistent := &session{ctx: context.Background(), auth: info, persistent: true, publish: make(chan *packet.PublishPacket, 16)}
+	persistent.subscriptions.Add("foo", 1)
+	store.Store(persistent)
+	store.Delete(persistent)
+	persistent.Close()
+	a.So(store.All(), should.BeEmpty)
+
+	store.Publish(&packet.PublishPacket{TopicName: "foo", TopicParts: []string{"foo"}, QoS: 0})
+	store.Publish(&packet.PublishPacket{TopicName: "foo", TopicParts: []string{"foo"}, QoS: 1})
+	time.Sleep(10 * time.Millisecond)
+
+	a.So(persistent.PublishChan(), should.BeEmpty)
+	a.So(persistent.pendingOut.Get(), should.HaveLength, 1)
+
+	a.So(store.Resume("other", "client"), should.BeNil)
+	a.So(store.Resume("user", "client"), should.Equal, persistent)
+	a.So(store.Resume("user", "client"), should.BeNil)
+}
+
+func TestStoreExpiry(t *testing.T) {
+	a := assertions.New(t)
+	store := SimpleStore(WithExpiry(10 * time.Millisecond))
+
+	persistent := &session{ctx: context.Background(), auth: &auth.Info{ClientID: "client"}, persistent: true}
+	persistent.subscriptions.Add("foo", 1)
+	store.Delete(persistent)
+
+	time.Sleep(50 * time.Millisecond)
+
+	a.So(store.Resume("", "client"), should.BeNil)
+	a.So(persistent.Subscriptions(), should.BeEmpty)
+}
+
+func TestStoreShared(t *testing.T) {
+	a := assertions.New(t)
+	store := SimpleStore(WithSharedStrategy(RoundRobin()))
+
+	members := make([]*session, 3)
+	for i := range members {
+		members[i] = &session{
+			ctx:     context.Background(),
+			auth:    &auth.Info{ClientID: fmt.Sprintf("client%d", i)},
+			publish: make(chan *packet.PublishPacket, 16),
+		}
+		members[i].subscriptions.Add("$share/group/foo/+", 1)
+		store.Store(members[i])
+	}
+	other := &session{ctx: context.Background(), auth: &auth.Info{ClientID: "other"}, publish: make(chan *packet.PublishPacket, 16)}
+	other.subscriptions.Add("$share/other/foo/#", 0)
+	store.Store(other)
+
+	for i := 0; i < 6; i++ {
+		store.Publish(&packet.PublishPacket{TopicName: "foo/bar", TopicParts: []string{"foo", "bar"}, QoS: 1})
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	for _, member := range members {
+		a.So(member.PublishChan(), should.HaveLength, 2)
+		a.So(member.pendingOut.Len(), should.Equal, 2)
+	}
+	a.So(other.PublishChan(), should.HaveLength, 6)
+
+	// in-flight messages of a member that disconnects are sent to the other members
+	store.Delete(members[0])
+	a.So(members[0].pendingOut.Len(), should.Equal, 0)
+	a.So(len(members[1].PublishChan())+len(members[2].PublishChan()), should.Equal, 6)
+
+	// acknowledged messages are not redistributed
+	for _, pkt := range members[1].pendingOut.Get() {
+		members[1].HandlePuback(&packet.PubackPacket{PacketIdentifier: pkt.(*packet.PublishPacket).PacketIdentifier})
+	}
+	before := len(members[2].PublishChan())
+	store.Delete(members[1])
+	a.So(members[2].PublishChan(), should.HaveLength, before)
+}
+
+func TestSharedStrategy(t *testing.T) {
+	a := assertions.New(t)
+	members := []Session{&session{}, &session{}, &session{}}
+	pkt := &packet.PublishPacket{TopicName: "foo"}
+
+	roundRobin := RoundRobin()
+	a.So(roundRobin.Select("a", pkt, members), should.Equal, members[0])
+	a.So(roundRobin.Select("a", pkt, members), should.Equal, members[1])
+	a.So(roundRobin.Select("b", pkt, members), should.Equal, members[0])
+
+	sticky := Sticky()
+	selected := sticky.Select("a", pkt, members)
+	for i := 0; i < 10; i++ {
+		a.So(sticky.Select("a", pkt, members), should.Equal, selected)
+	}
+
+	a.So(members, should.Contain, Random().Select("a", pkt, members))
+
+	_, err := NewSharedStrategy("sticky")
+	a.So(err, should.BeNil)
+	_, err = NewSharedStrategy("unknown")
+	a.So(err, should.NotBeNil)
+}
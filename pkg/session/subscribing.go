@@ -5,25 +5,40 @@ package session
 import (
 	"github.com/TheThingsIndustries/mystique/pkg/log"
 	"github.com/TheThingsIndustries/mystique/pkg/packet"
+	"github.com/TheThingsIndustries/mystique/pkg/topic"
 )
 
 func (s *session) HandleSubscribe(pkt *packet.SubscribePacket) (*packet.SubackPacket, error) {
 	response := pkt.Response()
 	logger := log.FromContext(s.ctx)
-	for i, topic := range pkt.Topics {
-		acceptedTopic, qos, err := s.auth.Subscribe(topic, pkt.QoSs[i])
+	for i, filter := range pkt.Topics {
+		acceptedTopic, qos, err := s.auth.Subscribe(filter, pkt.QoSs[i])
 		if err != nil {
-			response.ReturnCodes[i] = packet.SubscribeRejected
+			response.ReasonCodes[i] = packet.NotAuthorized
 			continue
 		}
 		logger := logger // shadow
-		if acceptedTopic != topic {
-			logger = logger.WithField("topic_original", topic)
+		if acceptedTopic != filter {
+			logger = logger.WithField("topic_original", filter)
 		}
-		if s.subscriptions.Add(acceptedTopic, qos) {
+		acceptedTopic = s.mountFilter(acceptedTopic)
+		var options packet.SubscriptionOptions
+		if i < len(pkt.Options) {
+			options = pkt.Options[i]
+		}
+		added := s.subscriptions.AddWithOptions(acceptedTopic, qos, options)
+		if added {
 			logger.WithFields(log.F{"topic": acceptedTopic, "qos": qos}).Debug("Subscribe")
 		}
-		response.ReturnCodes[i] = qos
+		response.ReasonCodes[i] = packet.ReasonCode(qos)
+		_, _, shared := topic.SplitShare(acceptedTopic)
+		switch {
+		case shared: // retained messages are not sent for shared subscriptions
+		case options.RetainHandling == packet.DoNotSendRetained:
+		case options.RetainHandling == packet.SendRetainedIfNew && !added:
+		default:
+			s.publishRetained(acceptedTopic, qos)
+		}
 	}
 	return response, nil
 }
@@ -31,17 +46,20 @@ func (s *session) HandleSubscribe(pkt *packet.SubscribePacket) (*packet.SubackPa
 func (s *session) HandleUnsubscribe(pkt *packet.UnsubscribePacket) (*packet.UnsubackPacket, error) {
 	response := pkt.Response()
 	logger := log.FromContext(s.ctx)
-	for _, topic := range pkt.Topics {
+	for i, topic := range pkt.Topics {
 		acceptedTopic, _, err := s.auth.Subscribe(topic, 0)
 		if err != nil {
+			response.ReasonCodes[i] = packet.NotAuthorized
 			continue
 		}
 		logger := logger // shadow
 		if acceptedTopic != topic {
 			logger = logger.WithField("topic_original", topic)
 		}
-		if s.subscriptions.Remove(acceptedTopic) {
+		if s.subscriptions.Remove(s.mountFilter(acceptedTopic)) {
 			logger.WithField("topic", acceptedTopic).Debug("Unsubscribe")
+		} else {
+			response.ReasonCodes[i] = packet.NoSubscriptionExisted
 		}
 	}
 	return response, nil
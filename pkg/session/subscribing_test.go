@@ -0,0 +1,111 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+package session
+
+import (
+	"context"
+	"testing"
+
+	"github.com/TheThingsIndustries/mystique/pkg/auth"
+	"github.com/TheThingsIndustries/mystique/pkg/packet"
+	"github.com/TheThingsIndustries/mystique/pkg/retained"
+	"github.com/smartystreets/assertions"
+	"github.com/smartystreets/assertions/should"
+)
+
+type prefixAuth struct {
+	prefix string
+}
+
+func (a prefixAuth) Connect(ctx context.Context, info *auth.Info) (context.Context, error) {
+	return ctx, nil
+}
+func (a prefixAuth) Subscribe(info *auth.Info, requestedTopic string, requestedQoS byte) (string, byte, error) {
+	return requestedTopic, requestedQoS, nil
+}
+func (a prefixAuth) CanRead(info *auth.Info, topic ...string) bool {
+	return topic[0] == a.prefix
+}
+func (a prefixAuth) CanWrite(info *auth.Info, topic ...string) bool {
+	return topic[0] == a.prefix
+}
+
+func TestSubscribeRetained(t *testing.T) {
+	a := assertions.New(t)
+	store := retained.SimpleStore()
+	ctx := retained.NewContextWithStore(context.Background(), store)
+
+	store.Retain(&packet.PublishPacket{TopicName: "foo/bar", Message: []byte("bar"), QoS: 1})
+	store.Retain(&packet.PublishPacket{TopicName: "foo/baz", Message: []byte("baz"), QoS: 2})
+	store.Retain(&packet.PublishPacket{TopicName: "other/bar", Message: []byte("other")})
+
+	sess := &session{ctx: ctx, auth: &auth.Info{Interface: prefixAuth{"foo"}}, publish: make(chan *packet.PublishPacket, 16)}
+
+	suback, err := sess.HandleSubscribe(&packet.SubscribePacket{
+		PacketIdentifier: 1,
+		Topics:           []string{"+/bar"},
+		QoSs:             []byte{2},
+	})
+	a.So(err, should.BeNil)
+	a.So(suback.ReasonCodes, should.Resemble, []packet.ReasonCode{packet.GrantedQoS2})
+
+	if a.So(sess.PublishChan(), should.HaveLength, 1) {
+		pub := <-sess.PublishChan()
+		a.So(pub.Retain, should.BeTrue)
+		a.So(pub.TopicName, should.Equal, "foo/bar")
+		a.So(pub.QoS, should.Equal, 1)
+		a.So(pub.PacketIdentifier, should.NotEqual, 0)
+	}
+
+	// Messages that match an established subscription are not sent as retained
+	sess.Publish(&packet.PublishPacket{TopicName: "foo/bar", TopicParts: []string{"foo", "bar"}, Message: []byte("new"), Retain: true})
+	if a.So(sess.PublishChan(), should.HaveLength, 1) {
+		pub := <-sess.PublishChan()
+		a.So(pub.Retain, should.BeFalse)
+	}
+}
+
+func TestSubscriptionOptions(t *testing.T) {
+	a := assertions.New(t)
+	ctx := context.Background()
+
+	delivered, deliver := deliver(1)
+	sess := &session{ctx: ctx, auth: &auth.Info{Interface: prefixAuth{"foo"}, ClientID: "client"}, publish: make(chan *packet.PublishPacket, 16), deliver: deliver}
+
+	subscribe := &packet.SubscribePacket{
+		PacketIdentifier: 1,
+		Topics:           []string{"foo/+"},
+		QoSs:             []byte{1},
+		Options:          []packet.SubscriptionOptions{{NoLocal: true, RetainAsPublished: true}},
+	}
+	a.So(subscribe.Validate(), should.BeNil)
+	_, err := sess.HandleSubscribe(subscribe)
+	a.So(err, should.BeNil)
+
+	// the client identifier of the publisher is set on delivered messages
+	_, err = sess.HandlePublish(&packet.PublishPacket{TopicName: "foo/bar", TopicParts: []string{"foo", "bar"}, Message: []byte("own")})
+	a.So(err, should.BeNil)
+	own := <-delivered
+	a.So(own.ClientID, should.Equal, "client")
+
+	// No Local: messages of the client itself are not sent
+	sess.Publish(own)
+	a.So(sess.PublishChan(), should.HaveLength, 0)
+
+	// Retain As Published: the retain flag of the message is kept
+	sess.Publish(&packet.PublishPacket{TopicName: "foo/bar", TopicParts: []string{"foo", "bar"}, Message: []byte("other"), Retain: true, ClientID: "other"})
+	if a.So(sess.PublishChan(), should.HaveLength, 1) {
+		pub := <-sess.PublishChan()
+		a.So(pub.Retain, should.BeTrue)
+	}
+
+	// messages of the client itself are sent if another subscription without No Local matches
+	_, err = sess.HandleSubscribe(&packet.SubscribePacket{PacketIdentifier: 2, Topics: []string{"foo/bar"}, QoSs: []byte{1}})
+	a.So(err, should.BeNil)
+	sess.Publish(own)
+	a.So(sess.PublishChan(), should.HaveLength, 1)
+
+	// No Local is not allowed on shared subscriptions
+	subscribe.Topics = []string{"$share/group/foo/+"}
+	a.So(subscribe.Validate(), should.Equal, packet.ProtocolError)
+}
@@ -0,0 +1,145 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+package session
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/TheThingsIndustries/mystique/pkg/log"
+	"github.com/TheThingsIndustries/mystique/pkg/packet"
+)
+
+// MaxInFlight sets the maximum number of QoS 1 and QoS 2 messages that are sent to a client without being acknowledged
+// MQTT 5.0 clients can request a lower maximum with the Receive Maximum property
+var MaxInFlight = 64
+
+// window of outgoing QoS 1 and QoS 2 messages that are in flight
+// messages that do not fit in the window are held until messages in flight are acknowledged
+type window struct {
+	mu       sync.Mutex
+	size     int // 0 means no limit
+	inFlight map[uint16]struct{}
+	held     []*packet.PublishPacket
+	heldSize int  // total size of the held messages
+	sending  bool // held messages are being sent
+}
+
+func (w *window) full() bool {
+	return w.size > 0 && len(w.inFlight) >= w.size
+}
+
+// hold a message until it fits in the window
+func (w *window) hold(pub *packet.PublishPacket) {
+	w.mu.Lock()
+	w.held = append(w.held, pub)
+	w.heldSize += len(pub.Message)
+	w.mu.Unlock()
+}
+
+// heldLen returns the number and the total size of the held messages
+func (w *window) heldLen() (count, size int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.held), w.heldSize
+}
+
+// oldest returns the oldest held message
+func (w *window) oldest() *packet.PublishPacket {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.held) == 0 {
+		return nil
+	}
+	return w.held[0]
+}
+
+// startSending returns false if held messages are already being sent
+func (w *window) startSending() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.sending {
+		return false
+	}
+	w.sending = true
+	return true
+}
+
+// next returns the next held message that fits in the window and marks it as in flight
+// returns nil and stops sending if there is no such message
+func (w *window) next() *packet.PublishPacket {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.held) == 0 || w.full() {
+		w.sending = false
+		return nil
+	}
+	pub := w.held[0]
+	w.held = w.held[1:]
+	w.heldSize -= len(pub.Message)
+	if w.inFlight == nil {
+		w.inFlight = make(map[uint16]struct{})
+	}
+	w.inFlight[pub.PacketIdentifier] = struct{}{}
+	return pub
+}
+
+// release removes the message with the packet identifier from the window
+func (w *window) release(id uint16) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.inFlight[id]; ok {
+		delete(w.inFlight, id)
+		return
+	}
+	for i, pub := range w.held {
+		if pub.PacketIdentifier == id {
+			w.held = append(w.held[:i], w.held[i+1:]...)
+			w.heldSize -= len(pub.Message)
+			return
+		}
+	}
+}
+
+// reset the window, marking the messages with the packet identifiers as in flight
+func (w *window) reset(ids ...uint16) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.inFlight = make(map[uint16]struct{}, len(ids))
+	for _, id := range ids {
+		w.inFlight[id] = struct{}{}
+	}
+	w.held, w.heldSize = nil, 0
+}
+
+// sendHeld sends the held messages that fit in the window
+// One goroutine at a time sends held messages, so that they are sent in order.
+func (s *session) sendHeld() {
+	if s.window.startSending() {
+		s.sendNext(nil)
+	}
+}
+
+// sendNext sends the waiting message and the held messages that fit in the window
+// If the publish buffer is full, the message waits in a new goroutine until there is room, instead of being dropped.
+func (s *session) sendNext(waiting *packet.PublishPacket) {
+	logger := log.FromContext(s.ctx)
+	if waiting != nil {
+		select {
+		case s.publish <- waiting:
+			atomic.AddUint64(&s.published, 1)
+		case <-s.closed:
+			return // the message is retransmitted when the session is resumed
+		}
+	}
+	for pub := s.window.next(); pub != nil; pub = s.window.next() {
+		select {
+		case s.publish <- pub:
+			atomic.AddUint64(&s.published, 1)
+			logger.WithFields(log.F{"topic": pub.TopicName, "size": len(pub.Message), "qos": pub.QoS}).Debug("Publish message")
+		default:
+			go s.sendNext(pub)
+			return
+		}
+	}
+}
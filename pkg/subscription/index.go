@@ -0,0 +1,154 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+package subscription
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/TheThingsIndustries/mystique/pkg/topic"
+)
+
+// Index of the subscriptions of many subscribers
+// The index is a trie of topic filter parts, so that matching a topic does not depend on the number of subscribers.
+type Index struct {
+	mu   sync.RWMutex
+	root indexNode
+}
+
+type indexNode struct {
+	children    map[string]*indexNode
+	subscribers map[interface{}]byte
+	shared      map[string]map[interface{}]byte // by shared subscription filter
+}
+
+func (n *indexNode) empty() bool {
+	return len(n.children) == 0 && len(n.subscribers) == 0 && len(n.shared) == 0
+}
+
+// Add a subscription of the subscriber to the index
+func (i *Index) Add(filter string, subscriber interface{}, qos byte) {
+	share := ""
+	if _, sharedFilter, ok := topic.SplitShare(filter); ok {
+		share, filter = filter, sharedFilter
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	n := &i.root
+	for _, part := range topic.Split(filter) {
+		if n.children == nil {
+			n.children = make(map[string]*indexNode)
+		}
+		child, ok := n.children[part]
+		if !ok {
+			child = new(indexNode)
+			n.children[part] = child
+		}
+		n = child
+	}
+	if share == "" {
+		if n.subscribers == nil {
+			n.subscribers = make(map[interface{}]byte)
+		}
+		n.subscribers[subscriber] = qos
+		return
+	}
+	if n.shared == nil {
+		n.shared = make(map[string]map[interface{}]byte)
+	}
+	if n.shared[share] == nil {
+		n.shared[share] = make(map[interface{}]byte)
+	}
+	n.shared[share][subscriber] = qos
+}
+
+// Remove a subscription of the subscriber from the index
+func (i *Index) Remove(filter string, subscriber interface{}) {
+	share := ""
+	if _, sharedFilter, ok := topic.SplitShare(filter); ok {
+		share, filter = filter, sharedFilter
+	}
+	i.mu.Lock()
+	i.root.remove(topic.Split(filter), share, subscriber)
+	i.mu.Unlock()
+}
+
+func (n *indexNode) remove(parts []string, share string, subscriber interface{}) {
+	if len(parts) == 0 {
+		if share == "" {
+			delete(n.subscribers, subscriber)
+			return
+		}
+		if members, ok := n.shared[share]; ok {
+			delete(members, subscriber)
+			if len(members) == 0 {
+				delete(n.shared, share)
+			}
+		}
+		return
+	}
+	child, ok := n.children[parts[0]]
+	if !ok {
+		return
+	}
+	child.remove(parts[1:], share, subscriber)
+	if child.empty() {
+		delete(n.children, parts[0])
+	}
+}
+
+// Match the topic to the index
+// returns the maximum QoS by subscriber, and the QoS by subscriber by shared subscription filter
+func (i *Index) Match(t ...string) (subscribers map[interface{}]byte, shared map[string]map[interface{}]byte) {
+	switch len(t) {
+	case 0:
+		return
+	case 1:
+		t = topic.Split(t[0])
+	}
+	collect := func(n *indexNode) {
+		for subscriber, qos := range n.subscribers {
+			if subscribers == nil {
+				subscribers = make(map[interface{}]byte)
+			}
+			if existing, ok := subscribers[subscriber]; !ok || qos > existing {
+				subscribers[subscriber] = qos
+			}
+		}
+		for share, members := range n.shared {
+			if shared == nil {
+				shared = make(map[string]map[interface{}]byte)
+			}
+			if shared[share] == nil {
+				shared[share] = make(map[interface{}]byte, len(members))
+			}
+			for subscriber, qos := range members {
+				shared[share][subscriber] = qos
+			}
+		}
+	}
+	i.mu.RLock()
+	i.root.match(t, strings.HasPrefix(t[0], topic.InternalPrefix), collect)
+	i.mu.RUnlock()
+	return
+}
+
+// match the topic parts, calling collect for each node that matches
+// wildcards do not match the first part of internal topics
+func (n *indexNode) match(parts []string, internal bool, collect func(*indexNode)) {
+	if len(parts) == 0 {
+		collect(n)
+		return
+	}
+	if !internal {
+		if child, ok := n.children[topic.Wildcard]; ok {
+			collect(child)
+		}
+		if child, ok := n.children[topic.PartWildcard]; ok {
+			child.match(parts[1:], false, collect)
+		}
+	}
+	if child, ok := n.children[parts[0]]; ok {
+		child.match(parts[1:], false, collect)
+	}
+}
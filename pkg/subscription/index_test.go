@@ -0,0 +1,148 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+package subscription
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/TheThingsIndustries/mystique/pkg/topic"
+	"github.com/smartystreets/assertions"
+	"github.com/smartystreets/assertions/should"
+)
+
+func TestIndex(t *testing.T) {
+	a := assertions.New(t)
+	index := new(Index)
+
+	subscribers, shared := index.Match("foo")
+	a.So(subscribers, should.BeEmpty)
+	a.So(shared, should.BeEmpty)
+
+	a.So(index.root.empty(), should.BeTrue)
+
+	index.Add("foo/bar", "a", 1)
+	index.Add("foo/+", "a", 2)
+	index.Add("foo/#", "b", 0)
+	index.Add("#", "c", 1)
+	index.Add("+/+/baz", "d", 1)
+	index.Add("$SYS/#", "e", 1)
+	index.Add("$share/group/foo/+", "f", 1)
+	index.Add("$share/group/foo/+", "g", 2)
+
+	subscribers, shared = index.Match("foo/bar")
+	a.So(subscribers, should.Resemble, map[interface{}]byte{"a": 2, "b": 0, "c": 1})
+	a.So(shared, should.Resemble, map[string]map[interface{}]byte{"$share/group/foo/+": {"f": 1, "g": 2}})
+
+	subscribers, shared = index.Match("foo/bar/baz")
+	a.So(subscribers, should.Resemble, map[interface{}]byte{"b": 0, "c": 1, "d": 1})
+	a.So(shared, should.BeEmpty)
+
+	subscribers, _ = index.Match("$SYS/foo")
+	a.So(subscribers, should.Resemble, map[interface{}]byte{"e": 1})
+
+	index.Remove("foo/+", "a")
+	index.Remove("$share/group/foo/+", "f")
+	subscribers, shared = index.Match("foo/bar")
+	a.So(subscribers, should.Resemble, map[interface{}]byte{"a": 1, "b": 0, "c": 1})
+	a.So(shared, should.Resemble, map[string]map[interface{}]byte{"$share/group/foo/+": {"g": 2}})
+
+	for _, filter := range []string{"foo/bar", "foo/#", "#", "+/+/baz", "$SYS/#", "$share/group/foo/+"} {
+		for _, subscriber := range []string{"a", "b", "c", "d", "e", "g"} {
+			index.Remove(filter, subscriber)
+		}
+	}
+	a.So(index.root.empty(), should.BeTrue)
+}
+
+func TestIndexMatchesList(t *testing.T) {
+	a := assertions.New(t)
+	filters := []string{"#", "+", "+/+", "a", "a/#", "a/+", "a/b", "a/+/c", "+/b/#", "$SYS/#", "/", "+/", "/#"}
+	topics := []string{"a", "a/b", "a/b/c", "b/b", "b/b/c", "$SYS/a", "/", "a/", "/a"}
+
+	index := new(Index)
+	lists := make(map[string]*List)
+	for _, filter := range filters {
+		list := new(List)
+		list.SetIndex(index, filter)
+		list.Add(filter, 1)
+		lists[filter] = list
+	}
+
+	for _, t := range topics {
+		subscribers, _ := index.Match(t)
+		for filter, list := range lists {
+			_, expected := list.Match(t)
+			_, actual := subscribers[filter]
+			a.So(actual, should.Equal, expected)
+			a.So(actual, should.Equal, topic.Match(t, filter))
+		}
+	}
+
+	for _, list := range lists {
+		list.Clear()
+	}
+	a.So(index.root.empty(), should.BeTrue)
+}
+
+func TestListSetIndex(t *testing.T) {
+	a := assertions.New(t)
+	index := new(Index)
+	list := new(List)
+	list.Add("foo", 1)
+	list.SetIndex(index, "owner")
+
+	subscribers, _ := index.Match("foo")
+	a.So(subscribers, should.Resemble, map[interface{}]byte{"owner": 1})
+
+	list.Add("bar", 0)
+	list.Remove("foo")
+	subscribers, _ = index.Match("foo")
+	a.So(subscribers, should.BeEmpty)
+	subscribers, _ = index.Match("bar")
+	a.So(subscribers, should.Resemble, map[interface{}]byte{"owner": 0})
+
+	list.SetIndex(nil, nil)
+	a.So(index.root.empty(), should.BeTrue)
+}
+
+// subscribers with a subscription on their own topic and a subscription on a shared topic,
+// like gateways that subscribe to their downlink topic and the status of the network
+func benchmarkSubscribers(n int) []*List {
+	lists := make([]*List, n)
+	for i := range lists {
+		lists[i] = new(List)
+		lists[i].Add(fmt.Sprintf("gateways/%d/down", i), 1)
+		lists[i].Add("network/+/status", 0)
+	}
+	return lists
+}
+
+func BenchmarkListMatch(b *testing.B) {
+	for _, n := range []int{100, 1000, 10000} {
+		lists := benchmarkSubscribers(n)
+		topicParts := topic.Split(fmt.Sprintf("gateways/%d/down", n/2))
+		b.Run(fmt.Sprintf("%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				for _, list := range lists {
+					list.Match(topicParts...)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkIndexMatch(b *testing.B) {
+	for _, n := range []int{100, 1000, 10000} {
+		index := new(Index)
+		for i, list := range benchmarkSubscribers(n) {
+			list.SetIndex(index, i)
+		}
+		topicParts := topic.Split(fmt.Sprintf("gateways/%d/down", n/2))
+		b.Run(fmt.Sprintf("%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				index.Match(topicParts...)
+			}
+		})
+	}
+}
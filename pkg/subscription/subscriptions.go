@@ -6,6 +6,7 @@ package subscription
 import (
 	"sync"
 
+	"github.com/TheThingsIndustries/mystique/pkg/packet"
 	"github.com/TheThingsIndustries/mystique/pkg/topic"
 )
 
@@ -13,6 +14,8 @@ type subscription struct {
 	filter     string
 	filterPath []string
 	qos        byte
+	options    packet.SubscriptionOptions
+	shared     bool
 }
 
 func (s subscription) Match(topicPath []string) bool {
@@ -23,10 +26,37 @@ func (s subscription) Match(topicPath []string) bool {
 type List struct {
 	mu            sync.RWMutex
 	subscriptions []subscription
+
+	// index that the subscriptions are added to as subscriptions of the owner
+	index *Index
+	owner interface{}
+}
+
+// SetIndex sets the index that the subscriptions of the list are added to as subscriptions of the owner
+// the current subscriptions are added to the index
+func (s *List) SetIndex(index *Index, owner interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.index != nil {
+		for _, sub := range s.subscriptions {
+			s.index.Remove(sub.filter, s.owner)
+		}
+	}
+	s.index, s.owner = index, owner
+	if s.index != nil {
+		for _, sub := range s.subscriptions {
+			s.index.Add(sub.filter, s.owner, sub.qos)
+		}
+	}
 }
 
 // Add a subscription to the list
 func (s *List) Add(filter string, qos byte) (added bool) {
+	return s.AddWithOptions(filter, qos, packet.SubscriptionOptions{})
+}
+
+// AddWithOptions adds a subscription with MQTT 5.0 subscription options to the list
+func (s *List) AddWithOptions(filter string, qos byte, options packet.SubscriptionOptions) (added bool) {
 	if len(filter) == 0 {
 		return
 	}
@@ -36,6 +66,14 @@ func (s *List) Add(filter string, qos byte) (added bool) {
 		filter:     filter,
 		filterPath: topic.Split(filter),
 		qos:        qos,
+		options:    options,
+	}
+	if _, sharedFilter, ok := topic.SplitShare(filter); ok {
+		sub.filterPath = topic.Split(sharedFilter)
+		sub.shared = true
+	}
+	if s.index != nil {
+		s.index.Add(filter, s.owner, qos)
 	}
 	for i, existing := range s.subscriptions {
 		if existing.filter == filter {
@@ -54,6 +92,9 @@ func (s *List) Remove(filter string) (removed bool) {
 	defer s.mu.Unlock()
 	for i, sub := range s.subscriptions {
 		if sub.filter == filter {
+			if s.index != nil {
+				s.index.Remove(filter, s.owner)
+			}
 			s.subscriptions = append(s.subscriptions[:i], s.subscriptions[i+1:]...)
 			removed = true
 			subscriptionsGauge.Dec()
@@ -66,12 +107,18 @@ func (s *List) Remove(filter string) (removed bool) {
 // Clear the subscription list
 func (s *List) Clear() {
 	s.mu.Lock()
+	if s.index != nil {
+		for _, sub := range s.subscriptions {
+			s.index.Remove(sub.filter, s.owner)
+		}
+	}
 	subscriptionsGauge.Sub(float64(len(s.subscriptions)))
 	s.subscriptions = nil
 	s.mu.Unlock()
 }
 
 // Match the topic to the subscriptions and return the maximum QoS
+// shared subscriptions are not matched
 func (s *List) Match(t ...string) (qos byte, found bool) {
 	switch len(t) {
 	case 0:
@@ -82,7 +129,7 @@ func (s *List) Match(t ...string) (qos byte, found bool) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	for _, sub := range s.subscriptions {
-		if sub.Match(t) {
+		if !sub.shared && sub.Match(t) {
 			found = true
 			if sub.qos > qos {
 				qos = sub.qos
@@ -92,7 +139,44 @@ func (s *List) Match(t ...string) (qos byte, found bool) {
 	return
 }
 
+// MatchOptions matches the topic to the subscriptions and returns the combined options
+// noLocal is only true if all matching subscriptions have No Local set, retainAsPublished is true if any of them has Retain As Published set.
+// shared subscriptions are not matched
+func (s *List) MatchOptions(t ...string) (noLocal, retainAsPublished bool) {
+	switch len(t) {
+	case 0:
+		return
+	case 1:
+		t = topic.Split(t[0])
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	found := false
+	noLocal = true
+	for _, sub := range s.subscriptions {
+		if !sub.shared && sub.Match(t) {
+			found = true
+			noLocal = noLocal && sub.options.NoLocal
+			retainAsPublished = retainAsPublished || sub.options.RetainAsPublished
+		}
+	}
+	return found && noLocal, retainAsPublished
+}
+
+// Options returns the options of the subscription with the filter
+func (s *List) Options(filter string) (options packet.SubscriptionOptions, found bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, sub := range s.subscriptions {
+		if sub.filter == filter {
+			return sub.options, true
+		}
+	}
+	return
+}
+
 // Matches for the topic
+// shared subscriptions are not matched
 func (s *List) Matches(t ...string) (matches []string) {
 	switch len(t) {
 	case 0:
@@ -103,13 +187,34 @@ func (s *List) Matches(t ...string) (matches []string) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	for _, sub := range s.subscriptions {
-		if sub.Match(t) {
+		if !sub.shared && sub.Match(t) {
 			matches = append(matches, sub.filter)
 		}
 	}
 	return
 }
 
+// MatchShared matches the topic to the shared subscriptions and returns the QoS by shared subscription filter
+func (s *List) MatchShared(t ...string) (matches map[string]byte) {
+	switch len(t) {
+	case 0:
+		return
+	case 1:
+		t = topic.Split(t[0])
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, sub := range s.subscriptions {
+		if sub.shared && sub.Match(t) {
+			if matches == nil {
+				matches = make(map[string]byte)
+			}
+			matches[sub.filter] = sub.qos
+		}
+	}
+	return
+}
+
 // Count the subscriptions
 func (s *List) Count() (count int) {
 	s.mu.RLock()
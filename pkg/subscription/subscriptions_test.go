@@ -46,6 +46,13 @@ func TestSubscriptions(t *testing.T) {
 	_, ok = s.Match("foo")
 	a.So(ok, should.BeFalse)
 
+	a.So(s.Add("$share/group/+", 1), should.BeTrue)
+	_, ok = s.Match("foo")
+	a.So(ok, should.BeFalse)
+	a.So(s.Matches("foo"), should.BeEmpty)
+	a.So(s.MatchShared("foo"), should.Resemble, map[string]byte{"$share/group/+": 1})
+	a.So(s.MatchShared("foo/bar"), should.BeEmpty)
+
 	s.Clear()
 	a.So(s.Count(), should.Equal, 0)
 	a.So(s.Subscriptions(), should.BeEmpty)
@@ -14,6 +14,7 @@ const (
 	Wildcard       = "#"
 	PartWildcard   = "+"
 	InternalPrefix = "$"
+	SharePrefix    = "$share"
 )
 
 // Split a topic into parts
@@ -62,11 +63,38 @@ func ValidateTopic(topic string) error {
 	return nil
 }
 
+// SplitShare splits a shared subscription filter of the form $share/<group>/<filter>
+// returns ok=false if the filter is not a shared subscription filter
+func SplitShare(share string) (group, filter string, ok bool) {
+	if !strings.HasPrefix(share, SharePrefix+Separator) {
+		return "", "", false
+	}
+	parts := strings.SplitN(share, Separator, 3)
+	if len(parts) != 3 {
+		return parts[1], "", true
+	}
+	return parts[1], parts[2], true
+}
+
+// JoinShare joins a group and filter into a shared subscription filter
+func JoinShare(group, filter string) string {
+	return SharePrefix + Separator + group + Separator + filter
+}
+
 // ValidateFilter validates a topic filter
 func ValidateFilter(filter string) error {
 	if len(filter) == 0 {
 		return errors.New("Empty topic filter")
 	}
+	if group, sharedFilter, ok := SplitShare(filter); ok {
+		if len(group) == 0 || strings.ContainsAny(group, Wildcard+PartWildcard) {
+			return errors.New("Invalid shared subscription group")
+		}
+		if len(sharedFilter) == 0 {
+			return errors.New("Empty shared subscription filter")
+		}
+		filter = sharedFilter
+	}
 	if strings.ContainsRune(filter, '\u0000') {
 		return errors.New("Topic filter can not contain NUL character")
 	}
@@ -47,4 +47,22 @@ func TestValidate(t *testing.T) {
 	a.So(ValidateFilter("a+"), should.NotBeNil)
 	a.So(ValidateTopic("a#"), should.NotBeNil)
 	a.So(ValidateFilter("a#"), should.NotBeNil)
+	a.So(ValidateFilter("$share/group/a/+"), should.BeNil)
+	a.So(ValidateFilter("$share/group/a+"), should.NotBeNil)
+	a.So(ValidateFilter("$share/group"), should.NotBeNil)
+	a.So(ValidateFilter("$share//a"), should.NotBeNil)
+	a.So(ValidateFilter("$share/+/a"), should.NotBeNil)
+}
+
+func TestShare(t *testing.T) {
+	a := assertions.New(t)
+	_, _, ok := SplitShare("a/b")
+	a.So(ok, should.BeFalse)
+	_, _, ok = SplitShare("$shared/a/b")
+	a.So(ok, should.BeFalse)
+	group, filter, ok := SplitShare("$share/group/a/#")
+	a.So(ok, should.BeTrue)
+	a.So(group, should.Equal, "group")
+	a.So(filter, should.Equal, "a/#")
+	a.So(JoinShare(group, filter), should.Equal, "$share/group/a/#")
 }
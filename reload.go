@@ -0,0 +1,40 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+package mystique
+
+import (
+	"reflect"
+	"time"
+)
+
+// configReloadDelay is the time between detecting a change of the configuration file and reloading the configuration
+var configReloadDelay = time.Second
+
+// Reload applies the changes of the configuration that are safe while the server runs: the connection limits and the shutdown grace period
+// The other changes are logged, and are applied when the server is restarted.
+func (s *Server) Reload(config Config) error {
+	if err := config.validateListeners(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, option := range []struct {
+		name    string
+		changed bool
+	}{
+		{"listen", !reflect.DeepEqual(s.config.Listen, config.Listen)},
+		{"listeners", !reflect.DeepEqual(s.config.Listeners, config.Listeners)},
+		{"tls", !reflect.DeepEqual(s.config.TLS, config.TLS)},
+		{"websocket", !reflect.DeepEqual(s.config.Websocket, config.Websocket)},
+		{"session", s.config.Session != config.Session},
+		{"limit.packet-size", s.config.Limit.PacketSize != config.Limit.PacketSize},
+	} {
+		if option.changed {
+			s.logger.WithField("option", option.name).Warn("Configuration change requires a restart")
+		}
+	}
+	s.mqtt.SetLimits(config.Limit.IP, config.Limit.User)
+	s.config.Limit.IP, s.config.Limit.User = config.Limit.IP, config.Limit.User
+	s.config.Shutdown = config.Shutdown
+	return nil
+}
@@ -0,0 +1,105 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+package mystique
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/TheThingsIndustries/mystique/pkg/client"
+	"github.com/smartystreets/assertions"
+	"github.com/smartystreets/assertions/should"
+	"github.com/spf13/viper"
+)
+
+func TestConfigFile(t *testing.T) {
+	a := assertions.New(t)
+	defer viper.Reset()
+
+	file := filepath.Join(t.TempDir(), "mystique.yml")
+	err := os.WriteFile(file, []byte(`
+listen:
+  tcp: 127.0.0.1:1883
+limit:
+  ip: 10
+shutdown:
+  grace-period: 5s
+listeners:
+  - name: internal
+    transport: tcp
+    address: 127.0.0.1:1884
+    auth: anonymous
+    read-only: true
+    mount-point: internal
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	viper.SetConfigFile(file)
+	a.So(viper.ReadInConfig(), should.BeNil)
+
+	config, err := flagConfig()
+	a.So(err, should.BeNil)
+	a.So(config.Listen.TCP, should.Equal, "127.0.0.1:1883")
+	a.So(config.Listen.Status, should.Equal, DefaultConfig().Listen.Status)
+	a.So(config.Limit.IP, should.Equal, 10)
+	a.So(config.Shutdown.GracePeriod, should.Equal, 5*time.Second)
+	a.So(config.Listeners, should.Resemble, []ListenerConfig{{
+		Name:       "internal",
+		Transport:  "tcp",
+		Address:    "127.0.0.1:1884",
+		Auth:       "anonymous",
+		ReadOnly:   true,
+		MountPoint: "internal",
+	}})
+	a.So(config.validateListeners(), should.BeNil)
+}
+
+func TestReload(t *testing.T) {
+	a := assertions.New(t)
+	ctx := context.Background()
+
+	config := testConfig()
+	s, err := NewServer(ctx, config)
+	a.So(err, should.BeNil)
+	if !a.So(s.Start(ctx), should.BeNil) {
+		return
+	}
+	defer s.Shutdown(ctx)
+	dial := client.TCP(s.Addrs()["tcp"].String())
+
+	first, err := client.Connect(ctx, dial, client.WithClientID("first"), client.WithoutReconnect())
+	if !a.So(err, should.BeNil) {
+		return
+	}
+	defer first.Disconnect()
+
+	// the limits apply to new connections
+	config.Limit.IP = 1
+	config.Shutdown.GracePeriod = time.Second
+	a.So(s.Reload(config), should.BeNil)
+	a.So(s.config.Shutdown.GracePeriod, should.Equal, time.Second)
+	_, err = client.Connect(ctx, dial, client.WithClientID("second"), client.WithoutReconnect())
+	a.So(err, should.NotBeNil)
+	_, err = first.Ping(ctx)
+	a.So(err, should.BeNil)
+
+	// changes that require a restart are not applied
+	config.Limit.IP = 0
+	config.Listen.TCP = "127.0.0.1:1"
+	a.So(s.Reload(config), should.BeNil)
+	a.So(s.config.Listen.TCP, should.Equal, "127.0.0.1:0")
+	third, err := client.Connect(ctx, dial, client.WithClientID("third"), client.WithoutReconnect())
+	if a.So(err, should.BeNil) {
+		third.Disconnect()
+	}
+
+	// invalid configuration is not applied
+	config.Limit.IP = 1
+	config.Listeners = []ListenerConfig{{Name: "tcp", Transport: "tcp"}}
+	a.So(s.Reload(config), should.NotBeNil)
+	a.So(s.config.Limit.IP, should.Equal, 0)
+}
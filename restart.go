@@ -0,0 +1,122 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+package mystique
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Environment of a restarted process, in addition to LISTEN_FDS and LISTEN_FDNAMES of socket activation
+const (
+	restartPIDEnv   = "MYSTIQUE_RESTART_PID"      // PID of the process that passes its listeners
+	restartReadyEnv = "MYSTIQUE_RESTART_READY_FD" // file descriptor that the restarted process writes to when it started its listeners
+)
+
+// restartTimeout is the time that the restarted process has to start its listeners
+var restartTimeout = 30 * time.Second
+
+// Restart starts a new process of the executable with the same arguments, which takes over the listeners of the server.
+// It returns when the new process started its listeners; the server should then be shut down to drain its sessions.
+func (s *Server) Restart() (*os.Process, error) {
+	s.mu.Lock()
+	if !s.started {
+		s.mu.Unlock()
+		return nil, errors.New("Server was not started")
+	}
+	listeners := make(map[string]net.Listener, len(s.listeners))
+	names := make([]string, 0, len(s.listeners))
+	for name, lis := range s.listeners {
+		listeners[name] = lis
+		names = append(names, name)
+	}
+	s.mu.Unlock()
+	sort.Strings(names)
+
+	files := make([]*os.File, 0, len(names))
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	for _, name := range names {
+		filer, ok := listeners[name].(interface{ File() (*os.File, error) })
+		if !ok {
+			return nil, fmt.Errorf("Can not pass %s listener", name)
+		}
+		file, err := filer.File()
+		if err != nil {
+			return nil, fmt.Errorf("Can not pass %s listener: %s", name, err)
+		}
+		files = append(files, file)
+	}
+
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer ready.Close()
+
+	executable, err := os.Executable()
+	if err != nil {
+		readyWriter.Close()
+		return nil, err
+	}
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, readyWriter)
+	cmd.Env = append(os.Environ(),
+		"LISTEN_FDS="+strconv.Itoa(len(files)),
+		"LISTEN_FDNAMES="+strings.Join(names, ":"),
+		restartPIDEnv+"="+strconv.Itoa(os.Getpid()),
+		restartReadyEnv+"="+strconv.Itoa(listenFDsStart+len(files)),
+	)
+	err = cmd.Start()
+	readyWriter.Close()
+	for _, file := range files {
+		if err := setNonblock(file); err != nil {
+			s.logger.WithError(err).Warn("Could not set listener to non-blocking mode")
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not start restarted process: %s", err)
+	}
+	go cmd.Wait()
+
+	ready.SetReadDeadline(time.Now().Add(restartTimeout))
+	if _, err := ready.Read(make([]byte, 1)); err != nil {
+		cmd.Process.Kill()
+		return nil, fmt.Errorf("Restarted process did not start its listeners: %s", err)
+	}
+
+	// the socket files are now used by the restarted process
+	for _, lis := range listeners {
+		if lis, ok := lis.(*net.UnixListener); ok {
+			lis.SetUnlinkOnClose(false)
+		}
+	}
+	return cmd.Process, nil
+}
+
+// notifyRestarted notifies the process that passed its listeners that the listeners were started
+func notifyRestarted() {
+	env := os.Getenv(restartReadyEnv)
+	if env == "" {
+		return
+	}
+	os.Unsetenv(restartReadyEnv)
+	fd, err := strconv.Atoi(env)
+	if err != nil {
+		return
+	}
+	ready := os.NewFile(uintptr(fd), "ready")
+	ready.Write([]byte{1})
+	ready.Close()
+}
@@ -0,0 +1,15 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+//go:build !unix
+
+package mystique
+
+import "os"
+
+// restartSignals make Run restart the server; restarts are not supported on this platform
+var restartSignals []os.Signal
+
+// reloadSignals make Run reload the configuration; the configuration file is still reloaded when it changes
+var reloadSignals []os.Signal
+
+func setNonblock(file *os.File) error { return nil }
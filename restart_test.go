@@ -0,0 +1,70 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+//go:build unix
+
+package mystique
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/TheThingsIndustries/mystique/pkg/client"
+	"github.com/smartystreets/assertions"
+	"github.com/smartystreets/assertions/should"
+)
+
+// TestRestartProcess is the process that TestRestart starts
+func TestRestartProcess(t *testing.T) {
+	if os.Getenv(restartPIDEnv) == "" {
+		t.Skip("Only runs as process of TestRestart")
+	}
+	ctx := context.Background()
+	s, err := NewServer(ctx, testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Minute)
+}
+
+func TestRestart(t *testing.T) {
+	a := assertions.New(t)
+	ctx := context.Background()
+
+	config := testConfig()
+	config.Listen.Unix = filepath.Join(t.TempDir(), "mqtt.sock")
+	s, err := NewServer(ctx, config)
+	a.So(err, should.BeNil)
+	_, err = s.Restart()
+	a.So(err, should.NotBeNil)
+	if !a.So(s.Start(ctx), should.BeNil) {
+		return
+	}
+	addrs := s.Addrs()
+
+	defer func(args []string) { os.Args = args }(os.Args)
+	os.Args = []string{os.Args[0], "-test.run=^TestRestartProcess$"}
+	process, err := s.Restart()
+	if !a.So(err, should.BeNil) {
+		s.Shutdown(ctx)
+		return
+	}
+	defer process.Kill()
+	s.Shutdown(ctx)
+
+	// the new process accepts the connections
+	for _, dial := range []client.Dialer{
+		client.TCP(addrs["tcp"].String()),
+		client.Unix(config.Listen.Unix),
+	} {
+		c, err := client.Connect(ctx, dial, client.WithoutReconnect())
+		if a.So(err, should.BeNil) {
+			a.So(c.Disconnect(), should.BeNil)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+//go:build unix
+
+package mystique
+
+import (
+	"os"
+	"syscall"
+)
+
+// restartSignals make Run restart the server
+var restartSignals = []os.Signal{syscall.SIGUSR2}
+
+// reloadSignals make Run reload the configuration
+var reloadSignals = []os.Signal{syscall.SIGHUP}
+
+// setNonblock sets the file back to non-blocking mode after it was passed to a process
+// The file shares the mode with the socket of the listener, which must not block.
+func setNonblock(file *os.File) error {
+	conn, err := file.SyscallConn()
+	if err != nil {
+		return err
+	}
+	if ctrlErr := conn.Control(func(fd uintptr) { err = syscall.SetNonblock(int(fd), true) }); ctrlErr != nil {
+		return ctrlErr
+	}
+	return err
+}
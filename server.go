@@ -0,0 +1,390 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+package mystique
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"sync"
+
+	"github.com/TheThingsIndustries/mystique/pkg/inspect"
+	"github.com/TheThingsIndustries/mystique/pkg/log"
+	mqttnet "github.com/TheThingsIndustries/mystique/pkg/net"
+	"github.com/TheThingsIndustries/mystique/pkg/server"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Server runs an MQTT server with its listeners and status server
+type Server struct {
+	logger log.Interface
+	config Config
+	mqtt   server.Server
+
+	status    *http.ServeMux
+	mux       *http.ServeMux
+	certs     *certificates
+	tlsConfig *tls.Config
+	proxies   []*net.IPNet
+	wsOptions []mqttnet.WebsocketOption
+
+	mu      sync.Mutex
+	started bool
+	closing chan struct{}
+	closers []io.Closer
+	addrs   map[string]net.Addr
+	// listeners by name, before wrapping, for Restart
+	listeners map[string]net.Listener
+}
+
+// NewServer returns a new Server with the configuration
+// The options are applied to the MQTT server after the options of the configuration.
+// The logger is taken from the context.
+func NewServer(ctx context.Context, config Config, option ...server.Option) (*Server, error) {
+	store, err := config.Session.Store()
+	if err != nil {
+		return nil, err
+	}
+	policy, err := config.Session.SlowConsumerPolicy()
+	if err != nil {
+		return nil, err
+	}
+	options := append([]server.Option{
+		server.WithSessionStore(store),
+		server.WithSlowConsumerPolicy(policy),
+		server.WithIPLimits(config.Limit.IP),
+		server.WithUserLimits(config.Limit.User),
+	}, option...)
+	return newServer(ctx, config, server.New(ctx, options...))
+}
+
+// newServer returns a new Server for the MQTT server; the session and limit settings of the configuration are not applied
+func newServer(ctx context.Context, config Config, mqtt server.Server) (s *Server, err error) {
+	s = &Server{
+		logger:    log.FromContext(ctx),
+		config:    config,
+		mqtt:      mqtt,
+		status:    http.NewServeMux(),
+		mux:       http.NewServeMux(),
+		closing:   make(chan struct{}),
+		addrs:     make(map[string]net.Addr),
+		listeners: make(map[string]net.Listener),
+	}
+	if err = config.validateListeners(); err != nil {
+		return nil, err
+	}
+	if s.proxies, err = mqttnet.ParseCIDRs(config.Listen.Proxy.Trusted...); err != nil {
+		return nil, fmt.Errorf("Invalid trusted proxies: %s", err)
+	}
+	if err = s.websocketOptions(); err != nil {
+		return nil, err
+	}
+	if config.TLS.Enabled() {
+		tlsConfig := &tls.Config{}
+		if err = config.TLS.protocol(tlsConfig); err != nil {
+			return nil, err
+		}
+		if tlsConfig.ClientAuth, tlsConfig.ClientCAs, err = config.TLS.clientAuth(); err != nil {
+			return nil, err
+		}
+		if config.TLS.CRL != "" && tlsConfig.ClientAuth == tls.NoClientCert {
+			return nil, errors.New("CRL requires client authentication")
+		}
+		if s.certs, err = loadCertificates(s.logger, config.TLS); err != nil {
+			return nil, err
+		}
+		tlsConfig.GetCertificate = s.certs.GetCertificate
+		if config.TLS.CRL != "" {
+			tlsConfig.VerifyConnection = s.certs.VerifyConnection
+		}
+		s.tlsConfig = tlsConfig
+	}
+	return s, nil
+}
+
+// MQTT returns the MQTT server
+func (s *Server) MQTT() server.Server { return s.mqtt }
+
+// StatusMux returns the mux of the status server, so that more handlers can be registered on it
+func (s *Server) StatusMux() *http.ServeMux { return s.status }
+
+// Addrs returns the addresses of the listeners by name (tcp, tls, unix, http, https, status)
+func (s *Server) Addrs() map[string]net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addrs := make(map[string]net.Addr, len(s.addrs))
+	for name, addr := range s.addrs {
+		addrs[name] = addr
+	}
+	return addrs
+}
+
+// Start the listeners of the server
+// The listeners that were started are closed if a listener can not be started.
+func (s *Server) Start(ctx context.Context) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started {
+		return errors.New("Server was already started")
+	}
+	s.started = true
+	defer func() {
+		if err != nil {
+			close(s.closing)
+			for _, closer := range s.closers {
+				closer.Close()
+			}
+			s.closers = nil
+		}
+	}()
+
+	var connOptions []mqttnet.Option
+	if size := s.config.Limit.PacketSize; size > 0 {
+		connOptions = append(connOptions, mqttnet.WithMaxPacketSize(size))
+	}
+
+	wss := s.websocket(s.mqtt.Handle, connOptions)
+
+	activated, err := activatedListeners()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for name, lis := range activated {
+			s.logger.WithField("name", name).Warn("Activated socket is not used")
+			lis.Close()
+		}
+	}()
+
+	// enabled returns true if the listener has an address or an activated socket
+	enabled := func(name, address string) bool {
+		return address != "" || activated[name] != nil
+	}
+
+	var lc net.ListenConfig
+	listen := func(name, network, address string) (lis net.Listener, err error) {
+		if lis = activated[name]; lis != nil {
+			delete(activated, name)
+			s.logger.WithFields(log.F{"name": name, "address": lis.Addr()}).Info("Using activated socket")
+		} else {
+			if network == "unix" {
+				removeStaleSocket(address)
+			}
+			if lis, err = lc.Listen(ctx, network, address); err != nil {
+				return nil, err
+			}
+		}
+		s.listeners[name] = lis
+		if name == "status" || lis.Addr().Network() != "tcp" || len(s.proxies) == 0 {
+			return lis, nil
+		}
+		return mqttnet.ProxyListener(lis, s.proxies), nil
+	}
+
+	tlsConfig := s.tlsConfig
+
+	if address := s.config.Listen.Status; enabled("status", address) {
+		s.status.Handle("/mqtt", wss)
+		s.status.Handle("/metrics", promhttp.Handler())
+		s.status.Handle("/debug/sessions", inspect.Sessions(s.mqtt.Sessions()))
+		if s.config.Listen.Pprof {
+			s.status.HandleFunc("/debug/pprof/", pprof.Index)
+			s.status.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+			s.status.HandleFunc("/debug/pprof/profile", pprof.Profile)
+			s.status.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+			s.status.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		}
+		s.logger.WithField("address", address).Info("Starting status+debug+metrics server")
+		lis, err := listen("status", "tcp", address)
+		if err != nil {
+			return fmt.Errorf("Could not start status+debug+metrics server: %s", err)
+		}
+		s.serve("status", lis, s.status)
+	}
+
+	if address := s.config.Listen.TCP; enabled("tcp", address) {
+		s.logger.WithField("address", address).Info("Starting MQTT server")
+		lis, err := listen("tcp", "tcp", address)
+		if err != nil {
+			return fmt.Errorf("Could not start MQTT server: %s", err)
+		}
+		s.accept("tcp", mqttnet.NewListener(lis, "tcp", connOptions...), s.mqtt.Handle)
+	}
+
+	if address := s.config.Listen.TLS; enabled("tls", address) && tlsConfig != nil {
+		s.logger.WithField("address", address).Info("Starting MQTT+TLS server")
+		lis, err := listen("tls", "tcp", address)
+		if err != nil {
+			return fmt.Errorf("Could not start MQTT+TLS server: %s", err)
+		}
+		s.accept("tls", mqttnet.NewListener(tls.NewListener(lis, tlsConfig), "tls", connOptions...), s.mqtt.Handle)
+	}
+
+	if address := s.config.Listen.Unix; enabled("unix", address) {
+		s.logger.WithField("address", address).Info("Starting MQTT server on Unix socket")
+		lis, err := listen("unix", "unix", address)
+		if err != nil {
+			return fmt.Errorf("Could not start MQTT server on Unix socket: %s", err)
+		}
+		s.accept("unix", mqttnet.NewListener(lis, "unix", connOptions...), s.mqtt.Handle)
+	}
+
+	s.mux.Handle(s.config.Websocket.Pattern, wss)
+
+	if _, err := os.Stat("example/websocket_client.html"); err == nil {
+		s.mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			http.ServeFile(w, r, "example/websocket_client.html")
+		})
+	}
+
+	if address := s.config.Listen.HTTP; enabled("http", address) {
+		s.logger.WithField("address", address).Info("Starting HTTP+ws server")
+		lis, err := listen("http", "tcp", address)
+		if err != nil {
+			return fmt.Errorf("Could not start HTTP+ws server: %s", err)
+		}
+		s.serve("http", lis, s.mux)
+	}
+
+	if address := s.config.Listen.HTTPS; enabled("https", address) && tlsConfig != nil {
+		s.logger.WithField("address", address).Info("Starting HTTPS+wss server")
+		lis, err := listen("https", "tcp", address)
+		if err != nil {
+			return fmt.Errorf("Could not start HTTPS+wss server: %s", err)
+		}
+		s.serve("https", tls.NewListener(lis, tlsConfig), s.mux)
+	}
+
+	for _, listener := range s.config.Listeners {
+		if !enabled(listener.Name, listener.Address) {
+			return fmt.Errorf("No address for listener %s", listener.Name)
+		}
+		listenerOptions, _ := listener.options() // validated by NewServer
+		handle := s.mqtt.Handler(listenerOptions...)
+		listenerConnOptions := connOptions[:len(connOptions):len(connOptions)]
+		if listener.PacketSize > 0 {
+			listenerConnOptions = append(listenerConnOptions, mqttnet.WithMaxPacketSize(listener.PacketSize))
+		}
+		network := "tcp"
+		if listener.Transport == "unix" {
+			network = "unix"
+		}
+		s.logger.WithFields(log.F{"name": listener.Name, "transport": listener.Transport, "address": listener.Address}).Info("Starting listener")
+		lis, err := listen(listener.Name, network, listener.Address)
+		if err != nil {
+			return fmt.Errorf("Could not start listener %s: %s", listener.Name, err)
+		}
+		switch listener.Transport {
+		case "tls", "wss":
+			lis = tls.NewListener(lis, tlsConfig)
+		}
+		switch listener.Transport {
+		case "tcp", "tls", "unix":
+			s.accept(listener.Name, mqttnet.NewListener(lis, listener.Transport, listenerConnOptions...), handle)
+		case "ws", "wss":
+			pattern := listener.Pattern
+			if pattern == "" {
+				pattern = s.config.Websocket.Pattern
+			}
+			mux := http.NewServeMux()
+			mux.Handle(pattern, s.websocket(handle, listenerConnOptions))
+			s.serve(listener.Name, lis, mux)
+		}
+	}
+
+	notifyRestarted()
+
+	return nil
+}
+
+// websocketOptions sets the options of the websocket handlers from the configuration
+func (s *Server) websocketOptions() error {
+	config := s.config.Websocket
+	for _, origin := range config.Origins {
+		if err := mqttnet.ValidateOrigin(origin); err != nil {
+			return err
+		}
+	}
+	trusted, err := mqttnet.ParseCIDRs(config.TrustedProxies...)
+	if err != nil {
+		return fmt.Errorf("Invalid trusted websocket proxies: %s", err)
+	}
+	s.wsOptions = []mqttnet.WebsocketOption{
+		mqttnet.WithAllowedOrigins(config.Origins...),
+		mqttnet.WithPingInterval(config.PingInterval),
+		mqttnet.WithForwardedFor(trusted),
+	}
+	if config.AllowNoOrigin {
+		s.wsOptions = append(s.wsOptions, mqttnet.WithoutOrigin())
+	}
+	return nil
+}
+
+// websocket returns the websocket handler with the options of the configuration
+func (s *Server) websocket(handle func(mqttnet.Conn), connOptions []mqttnet.Option) http.Handler {
+	options := append(s.wsOptions[:len(s.wsOptions):len(s.wsOptions)], mqttnet.WithConnOptions(connOptions...))
+	return mqttnet.Websocket(handle, options...)
+}
+
+// accept connections on the listener until the server shuts down
+func (s *Server) accept(name string, lis mqttnet.Listener, handle func(mqttnet.Conn)) {
+	s.addrs[name] = lis.Addr()
+	s.closers = append(s.closers, lis)
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				select {
+				case <-s.closing:
+				default:
+					s.logger.WithError(err).Errorf("Could not accept %s connection", name)
+				}
+				return
+			}
+			go handle(conn)
+		}
+	}()
+}
+
+// serve HTTP on the listener until the server shuts down
+func (s *Server) serve(name string, lis net.Listener, handler http.Handler) {
+	s.addrs[name] = lis.Addr()
+	srv := &http.Server{Handler: handler, ConnContext: mqttnet.ConnContext}
+	s.closers = append(s.closers, srv)
+	go func() {
+		if err := srv.Serve(lis); err != nil && err != http.ErrServerClosed {
+			s.logger.WithError(err).Errorf("Could not serve %s", name)
+		}
+	}()
+}
+
+// Shutdown the server
+// stops accepting new connections and drains the sessions until the context is done
+// websocket connections are drained by the MQTT server
+func (s *Server) Shutdown(ctx context.Context) (server.ShutdownStats, error) {
+	s.mu.Lock()
+	select {
+	case <-s.closing:
+		s.mu.Unlock()
+		return server.ShutdownStats{}, errors.New("Server was already shut down")
+	default:
+	}
+	close(s.closing)
+	for _, closer := range s.closers {
+		closer.Close()
+	}
+	s.closers = nil
+	s.mu.Unlock()
+
+	if s.certs != nil {
+		s.certs.Close()
+	}
+
+	return s.mqtt.Shutdown(ctx)
+}
@@ -0,0 +1,328 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+package mystique
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/TheThingsIndustries/mystique/pkg/auth"
+	"github.com/TheThingsIndustries/mystique/pkg/client"
+	mqttnet "github.com/TheThingsIndustries/mystique/pkg/net"
+	"github.com/TheThingsIndustries/mystique/pkg/packet"
+	"github.com/TheThingsIndustries/mystique/pkg/server"
+	"github.com/smartystreets/assertions"
+	"github.com/smartystreets/assertions/should"
+	"golang.org/x/net/websocket"
+)
+
+func testConfig() Config {
+	config := DefaultConfig()
+	config.Listen = ListenConfig{
+		TCP:    "127.0.0.1:0",
+		Status: "127.0.0.1:0",
+	}
+	return config
+}
+
+func TestServer(t *testing.T) {
+	a := assertions.New(t)
+	ctx := context.Background()
+
+	// two servers can run in the same process
+	var servers []*Server
+	for i := 0; i < 2; i++ {
+		s, err := NewServer(ctx, testConfig())
+		a.So(err, should.BeNil)
+		a.So(s.Start(ctx), should.BeNil)
+		a.So(s.Start(ctx), should.NotBeNil)
+		servers = append(servers, s)
+	}
+
+	for _, s := range servers {
+		addrs := s.Addrs()
+		a.So(addrs, should.ContainKey, "tcp")
+		a.So(addrs, should.ContainKey, "status")
+		a.So(addrs, should.NotContainKey, "http")
+
+		dial := client.TCP(addrs["tcp"].String())
+		sub, err := client.Connect(ctx, dial, client.WithClientID("sub"), client.WithoutReconnect())
+		if !a.So(err, should.BeNil) {
+			continue
+		}
+		pub, err := client.Connect(ctx, dial, client.WithClientID("pub"), client.WithoutReconnect())
+		if !a.So(err, should.BeNil) {
+			continue
+		}
+		messages := make(chan *packet.PublishPacket, 1)
+		_, err = sub.Subscribe(ctx, "foo", 1, func(pkt *packet.PublishPacket) { messages <- pkt })
+		a.So(err, should.BeNil)
+		a.So(pub.Publish(ctx, &packet.PublishPacket{TopicName: "foo", QoS: 1, Message: []byte("foo")}), should.BeNil)
+		select {
+		case pkt := <-messages:
+			a.So(pkt.Message, should.Resemble, []byte("foo"))
+		case <-time.After(time.Second):
+			t.Error("Did not receive message")
+		}
+
+		res, err := http.Get("http://" + addrs["status"].String() + "/metrics")
+		if a.So(err, should.BeNil) {
+			res.Body.Close()
+			a.So(res.StatusCode, should.Equal, http.StatusOK)
+		}
+
+		// pprof handlers are only served if enabled
+		res, err = http.Get("http://" + addrs["status"].String() + "/debug/pprof/")
+		if a.So(err, should.BeNil) {
+			res.Body.Close()
+			a.So(res.StatusCode, should.Equal, http.StatusNotFound)
+		}
+
+		shutdownCtx, cancel := context.WithTimeout(ctx, time.Second)
+		stats, err := s.Shutdown(shutdownCtx)
+		cancel()
+		a.So(err, should.BeNil)
+		a.So(stats.Sessions, should.Equal, 2)
+
+		_, err = sub.Ping(ctx)
+		a.So(err, should.NotBeNil)
+		sub.Disconnect()
+		pub.Disconnect()
+
+		_, err = net.Dial("tcp", addrs["tcp"].String())
+		a.So(err, should.NotBeNil)
+
+		_, err = s.Shutdown(ctx)
+		a.So(err, should.NotBeNil)
+	}
+}
+
+func TestNewServerInvalidConfig(t *testing.T) {
+	a := assertions.New(t)
+
+	config := testConfig()
+	config.Session.SlowConsumer = "explode"
+	_, err := NewServer(context.Background(), config)
+	a.So(err, should.NotBeNil)
+
+	config = testConfig()
+	config.Websocket.Origins = []string{"https://[example.com"}
+	_, err = NewServer(context.Background(), config)
+	a.So(err, should.NotBeNil)
+
+	config = testConfig()
+	config.Websocket.TrustedProxies = []string{"proxy"}
+	_, err = NewServer(context.Background(), config)
+	a.So(err, should.NotBeNil)
+}
+
+// recordAuth records the auth info of connections
+type recordAuth chan auth.Info
+
+func (r recordAuth) Connect(ctx context.Context, info *auth.Info) (context.Context, error) {
+	r <- *info
+	return ctx, nil
+}
+
+func (r recordAuth) Subscribe(info *auth.Info, topic string, qos byte) (string, byte, error) {
+	return topic, qos, nil
+}
+
+func (r recordAuth) CanRead(info *auth.Info, topic ...string) bool  { return true }
+func (r recordAuth) CanWrite(info *auth.Info, topic ...string) bool { return true }
+
+func TestServerProxy(t *testing.T) {
+	a := assertions.New(t)
+	ctx := context.Background()
+
+	config := testConfig()
+	config.Listen.HTTP = "127.0.0.1:0"
+	config.Listen.Proxy.Trusted = []string{"127.0.0.1"}
+	infos := make(recordAuth, 1)
+	s, err := NewServer(ctx, config, server.WithAuth(infos))
+	a.So(err, should.BeNil)
+	a.So(s.Start(ctx), should.BeNil)
+	defer s.Shutdown(ctx)
+	addrs := s.Addrs()
+
+	// a v2 header with the TLS information of a proxy that verified the client certificate
+	header := []byte("\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x2c")
+	header = append(header, 192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x07, 0x5b)
+	header = append(header, 0x02, 0x00, 0x0b)
+	header = append(header, "example.com"...)
+	header = append(header, 0x20, 0x00, 0x0f, 0x03, 0, 0, 0, 0, 0x22, 0x00, 0x07)
+	header = append(header, "gateway"...)
+
+	proxyDial := func(address string) (net.Conn, error) {
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = conn.Write(header); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+
+	for _, tt := range []struct {
+		transport string
+		dial      client.Dialer
+	}{
+		{
+			transport: "tcp",
+			dial: func(ctx context.Context) (mqttnet.Conn, error) {
+				conn, err := proxyDial(addrs["tcp"].String())
+				if err != nil {
+					return nil, err
+				}
+				return mqttnet.NewConn(conn, "tcp"), nil
+			},
+		},
+		{
+			transport: "ws",
+			dial: func(ctx context.Context) (mqttnet.Conn, error) {
+				conn, err := proxyDial(addrs["http"].String())
+				if err != nil {
+					return nil, err
+				}
+				wsConfig, _ := websocket.NewConfig(fmt.Sprintf("ws://%s/mqtt", addrs["http"]), "http://example.com")
+				wsConfig.Protocol = []string{"mqtt"}
+				ws, err := websocket.NewClient(wsConfig, conn)
+				if err != nil {
+					conn.Close()
+					return nil, err
+				}
+				ws.PayloadType = websocket.BinaryFrame
+				return mqttnet.NewConn(ws, "ws"), nil
+			},
+		},
+	} {
+		c, err := client.Connect(ctx, tt.dial, client.WithoutReconnect())
+		if !a.So(err, should.BeNil) {
+			continue
+		}
+		info := <-infos
+		a.So(info.Transport, should.Equal, tt.transport)
+		a.So(info.RemoteAddr, should.Equal, "192.0.2.1:56324")
+		a.So(info.ServerName, should.Equal, "example.com")
+		a.So(info.TLS, should.Resemble, &auth.TLSInfo{
+			Proxy:          true,
+			PeerCommonName: "gateway",
+			PeerVerified:   true,
+		})
+		c.Disconnect()
+	}
+
+	// connections from trusted proxies need a header
+	_, err = client.Connect(ctx, client.TCP(addrs["tcp"].String()), client.WithoutReconnect())
+	a.So(err, should.NotBeNil)
+}
+
+func TestServerUnix(t *testing.T) {
+	a := assertions.New(t)
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "mqtt.sock")
+
+	// a stale socket of a previous server is removed
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	config := testConfig()
+	config.Listen.Unix = path
+	infos := make(recordAuth, 1)
+	s, err := NewServer(ctx, config, server.WithAuth(infos))
+	a.So(err, should.BeNil)
+	if !a.So(s.Start(ctx), should.BeNil) {
+		return
+	}
+	defer s.Shutdown(ctx)
+	a.So(s.Addrs()["unix"].String(), should.Equal, path)
+
+	c, err := client.Connect(ctx, client.Unix(path), client.WithoutReconnect())
+	if a.So(err, should.BeNil) {
+		info := <-infos
+		a.So(info.Transport, should.Equal, "unix")
+		a.So(c.Disconnect(), should.BeNil)
+	}
+}
+
+func TestServerListeners(t *testing.T) {
+	a := assertions.New(t)
+	ctx := context.Background()
+
+	for _, listeners := range [][]ListenerConfig{
+		{{Name: "tcp", Transport: "tcp", Address: "127.0.0.1:0"}},
+		{{Name: "foo", Transport: "tcp", Address: "127.0.0.1:0"}, {Name: "foo", Transport: "tcp", Address: "127.0.0.1:0"}},
+		{{Name: "foo", Transport: "quic", Address: "127.0.0.1:0"}},
+		{{Name: "foo", Transport: "tls", Address: "127.0.0.1:0"}},
+		{{Name: "foo", Transport: "tcp", Address: "127.0.0.1:0", Auth: "guest"}},
+		{{Name: "foo", Transport: "tcp", Address: "127.0.0.1:0", MountPoint: "foo/#"}},
+		{{Name: "foo", Transport: "tcp", Address: "127.0.0.1:0", MountPoint: "$SYS"}},
+	} {
+		config := testConfig()
+		config.Listeners = listeners
+		_, err := NewServer(ctx, config)
+		a.So(err, should.NotBeNil)
+	}
+
+	config := testConfig()
+	config.Listeners = []ListenerConfig{
+		{Name: "public", Transport: "tcp", Address: "127.0.0.1:0", Auth: "anonymous", ReadOnly: true, MountPoint: "tenant"},
+		{Name: "public-ws", Transport: "ws", Address: "127.0.0.1:0", Pattern: "/public"},
+	}
+	infos := make(recordAuth, 2)
+	s, err := NewServer(ctx, config, server.WithAuth(infos))
+	a.So(err, should.BeNil)
+	if !a.So(s.Start(ctx), should.BeNil) {
+		return
+	}
+	defer s.Shutdown(ctx)
+	addrs := s.Addrs()
+	a.So(addrs, should.ContainKey, "public")
+	a.So(addrs, should.ContainKey, "public-ws")
+
+	pub, err := client.Connect(ctx, client.TCP(addrs["tcp"].String()), client.WithClientID("pub"), client.WithoutReconnect())
+	if !a.So(err, should.BeNil) {
+		return
+	}
+	defer pub.Disconnect()
+	a.So((<-infos).Transport, should.Equal, "tcp")
+
+	sub, err := client.Connect(ctx, client.TCP(addrs["public"].String()), client.WithClientID("sub"), client.WithoutReconnect())
+	if !a.So(err, should.BeNil) {
+		return
+	}
+	defer sub.Disconnect()
+	select {
+	case <-infos:
+		t.Error("Anonymous listener used the auth interface")
+	default:
+	}
+
+	messages := make(chan *packet.PublishPacket, 1)
+	_, err = sub.Subscribe(ctx, "foo", 1, func(pkt *packet.PublishPacket) { messages <- pkt })
+	a.So(err, should.BeNil)
+	a.So(pub.Publish(ctx, &packet.PublishPacket{TopicName: "tenant/foo", QoS: 1, Message: []byte("foo")}), should.BeNil)
+	select {
+	case pkt := <-messages:
+		a.So(pkt.TopicName, should.Equal, "foo")
+	case <-time.After(time.Second):
+		t.Error("Did not receive message")
+	}
+
+	ws, err := client.Connect(ctx, client.Websocket("ws://"+addrs["public-ws"].String()+"/public", nil), client.WithoutReconnect())
+	if a.So(err, should.BeNil) {
+		a.So((<-infos).Transport, should.Equal, "ws")
+		ws.Disconnect()
+	}
+}
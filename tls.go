@@ -0,0 +1,420 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+package mystique
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TheThingsIndustries/mystique/pkg/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var certificateExpiry = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "tls",
+	Name:      "certificate_expiry_seconds",
+	Help:      "Expiry date of the TLS certificate.",
+}, []string{"certificate", "fingerprint"})
+
+func init() {
+	prometheus.MustRegister(certificateExpiry)
+}
+
+// certificateReloadDelay is the time between detecting a change of the files and reloading the certificates
+var certificateReloadDelay = 5 * time.Second
+
+// keyPair contains the locations of a certificate and its key
+type keyPair struct {
+	certFile string
+	keyFile  string
+}
+
+// keyPairs returns the configured key pairs; the first pair is the default
+func (c TLSSettings) keyPairs() ([]keyPair, error) {
+	var pairs []keyPair
+	if c.Cert != "" && c.Key != "" {
+		pairs = append(pairs, keyPair{certFile: c.Cert, keyFile: c.Key})
+	}
+	for _, pair := range c.Certificates {
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("Invalid certificate %q, expected <cert>:<key>", pair)
+		}
+		pairs = append(pairs, keyPair{certFile: parts[0], keyFile: parts[1]})
+	}
+	if c.CertificateDir != "" {
+		dirPairs, err := dirKeyPairs(c.CertificateDir)
+		if err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, dirPairs...)
+	}
+	return pairs, nil
+}
+
+// dirKeyPairs returns the key pairs in the directory: <name>.crt with <name>.key, and <name>.pem with <name>-key.pem
+func dirKeyPairs(dir string) ([]keyPair, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read certificate directory: %s", err)
+	}
+	names := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		names[entry.Name()] = true
+	}
+	var pairs []keyPair
+	for _, entry := range entries {
+		name := entry.Name()
+		var key string
+		switch {
+		case strings.HasSuffix(name, ".crt"):
+			key = strings.TrimSuffix(name, ".crt") + ".key"
+		case strings.HasSuffix(name, ".pem") && !strings.HasSuffix(name, "-key.pem"):
+			key = strings.TrimSuffix(name, ".pem") + "-key.pem"
+		default:
+			continue
+		}
+		if names[key] {
+			pairs = append(pairs, keyPair{certFile: filepath.Join(dir, name), keyFile: filepath.Join(dir, key)})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].certFile < pairs[j].certFile })
+	return pairs, nil
+}
+
+type loadedCertificate struct {
+	keyPair
+	cert        *tls.Certificate
+	fingerprint string
+}
+
+func (p keyPair) load() (*loadedCertificate, error) {
+	cert, err := tls.LoadX509KeyPair(p.certFile, p.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Could not load X509 keypair %s: %s", p.certFile, err)
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse leaf certificate %s: %s", p.certFile, err)
+	}
+	sum := sha1.Sum(cert.Leaf.Raw)
+	return &loadedCertificate{keyPair: p, cert: &cert, fingerprint: hex.EncodeToString(sum[:])}, nil
+}
+
+// readCRL reads the certificate revocation lists in the PEM or DER encoded file
+func readCRL(file string) ([]*x509.RevocationList, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read CRL: %s", err)
+	}
+	if !bytes.Contains(data, []byte("-----BEGIN")) {
+		crl, err := x509.ParseRevocationList(data)
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse CRL: %s", err)
+		}
+		return []*x509.RevocationList{crl}, nil
+	}
+	var crls []*x509.RevocationList
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "X509 CRL" {
+			continue
+		}
+		crl, err := x509.ParseRevocationList(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse CRL: %s", err)
+		}
+		crls = append(crls, crl)
+	}
+	if len(crls) == 0 {
+		return nil, errors.New("No CRL in file")
+	}
+	return crls, nil
+}
+
+// readOCSP reads the DER encoded OCSP response in the file
+func readOCSP(file string) ([]byte, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read OCSP response: %s", err)
+	}
+	if len(data) == 0 {
+		return nil, errors.New("Empty OCSP response")
+	}
+	return data, nil
+}
+
+// certificates that are selected by SNI, and reloaded when the files change
+// The CRL and OCSP response are reloaded together with the certificates.
+type certificates struct {
+	logger log.Interface
+	config TLSSettings
+
+	mu     sync.RWMutex
+	loaded []*loadedCertificate // the first certificate is the default
+	crls   []*x509.RevocationList
+	closed bool
+
+	watcher io.Closer
+}
+
+func loadCertificates(logger log.Interface, config TLSSettings) (*certificates, error) {
+	c := &certificates{logger: logger, config: config}
+	if err := c.read(); err != nil {
+		return nil, err
+	}
+	c.watch()
+	return c, nil
+}
+
+// read the certificates; the loaded certificates are kept if a certificate can not be read
+func (c *certificates) read() error {
+	pairs, err := c.config.keyPairs()
+	if err != nil {
+		return err
+	}
+	if len(pairs) == 0 {
+		return errors.New("No TLS certificates")
+	}
+	loaded := make([]*loadedCertificate, len(pairs))
+	for i, pair := range pairs {
+		if loaded[i], err = pair.load(); err != nil {
+			return err
+		}
+	}
+	if c.config.OCSP != "" {
+		if loaded[0].cert.OCSPStaple, err = readOCSP(c.config.OCSP); err != nil {
+			return err
+		}
+	}
+	var crls []*x509.RevocationList
+	if c.config.CRL != "" {
+		if crls, err = readCRL(c.config.CRL); err != nil {
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	old := c.loaded
+	c.loaded, c.crls = loaded, crls
+	c.mu.Unlock()
+
+	for _, cert := range old {
+		certificateExpiry.DeleteLabelValues(cert.certFile, cert.fingerprint)
+	}
+	for _, cert := range loaded {
+		certificateExpiry.WithLabelValues(cert.certFile, cert.fingerprint).Set(float64(cert.cert.Leaf.NotAfter.Unix()))
+	}
+	return nil
+}
+
+// files returns the files and directories to watch
+func (c *certificates) files() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		return nil
+	}
+	var files []string
+	if c.config.CertificateDir != "" {
+		files = append(files, c.config.CertificateDir)
+	}
+	for _, cert := range c.loaded {
+		if c.config.CertificateDir != "" && filepath.Dir(cert.certFile) == filepath.Clean(c.config.CertificateDir) {
+			continue // watched by the directory
+		}
+		files = append(files, cert.certFile, cert.keyFile)
+	}
+	for _, file := range []string{c.config.CRL, c.config.OCSP} {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// watch the files and read the certificates when they change
+func (c *certificates) watch() {
+	watcher, err := watchFiles(c.logger, c.files, certificateReloadDelay, func() {
+		c.logger.Info("Updating TLS certificates...")
+		if err := c.read(); err != nil {
+			c.logger.WithError(err).Error("Could not update TLS certificates")
+		} else {
+			c.logger.Info("Updated TLS certificates")
+		}
+	})
+	if err != nil {
+		c.logger.WithError(err).Warn("Could not watch TLS certificates")
+		return
+	}
+	c.watcher = watcher
+}
+
+// Close stops watching the files
+func (c *certificates) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	if c.watcher == nil {
+		return nil
+	}
+	return c.watcher.Close()
+}
+
+// GetCertificate returns the certificate for the server name of the client, or the default certificate
+func (c *certificates) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if hello.ServerName != "" {
+		for _, cert := range c.loaded {
+			if hello.SupportsCertificate(cert.cert) == nil {
+				return cert.cert, nil
+			}
+		}
+	}
+	return c.loaded[0].cert, nil
+}
+
+// revoked returns true if the certificate is revoked by a CRL of its issuer
+func (c *certificates) revoked(cert, issuer *x509.Certificate) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, crl := range c.crls {
+		if !bytes.Equal(crl.RawIssuer, cert.RawIssuer) || crl.CheckSignatureFrom(issuer) != nil {
+			continue
+		}
+		for _, revoked := range crl.RevokedCertificates {
+			if revoked.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// VerifyConnection rejects client certificates that are revoked
+// Unlike VerifyPeerCertificate, it is also called for resumed sessions, so that a revoked client can not reuse a session ticket.
+// The certificate is accepted if one of the verified chains does not contain revoked certificates.
+func (c *certificates) VerifyConnection(state tls.ConnectionState) error {
+	if len(state.VerifiedChains) == 0 {
+		return nil
+	}
+chains:
+	for _, chain := range state.VerifiedChains {
+		for i := 0; i < len(chain)-1; i++ {
+			if c.revoked(chain[i], chain[i+1]) {
+				continue chains
+			}
+		}
+		return nil
+	}
+	return errors.New("Client certificate is revoked")
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var curves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+// protocol applies the TLS versions, cipher suites and curves of the configuration
+func (c TLSSettings) protocol(config *tls.Config) error {
+	for _, version := range []struct {
+		name  string
+		value *uint16
+	}{
+		{c.MinVersion, &config.MinVersion},
+		{c.MaxVersion, &config.MaxVersion},
+	} {
+		if version.name == "" {
+			continue
+		}
+		value, ok := tlsVersions[version.name]
+		if !ok {
+			return fmt.Errorf("Invalid TLS version %q", version.name)
+		}
+		*version.value = value
+	}
+	if config.MinVersion != 0 && config.MaxVersion != 0 && config.MinVersion > config.MaxVersion {
+		return errors.New("Minimum TLS version is higher than maximum TLS version")
+	}
+	for _, name := range c.CipherSuites {
+		var id uint16
+		for _, suite := range tls.CipherSuites() {
+			if suite.Name == name {
+				id = suite.ID
+			}
+		}
+		if id == 0 {
+			return fmt.Errorf("Invalid or insecure cipher suite %q", name)
+		}
+		config.CipherSuites = append(config.CipherSuites, id)
+	}
+	for _, name := range c.Curves {
+		curve, ok := curves[name]
+		if !ok {
+			return fmt.Errorf("Invalid curve %q", name)
+		}
+		config.CurvePreferences = append(config.CurvePreferences, curve)
+	}
+	return nil
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"none":    tls.NoClientCert,
+	"request": tls.VerifyClientCertIfGiven,
+	"require": tls.RequireAndVerifyClientCert,
+}
+
+// clientAuth returns the client authentication type and the CAs to verify client certificates
+// Clients that present a certificate must present a valid one in the request mode.
+func (c TLSSettings) clientAuth() (tls.ClientAuthType, *x509.CertPool, error) {
+	mode := c.ClientAuth
+	if mode == "" {
+		mode = "none"
+	}
+	clientAuth, ok := clientAuthTypes[mode]
+	if !ok {
+		return 0, nil, fmt.Errorf("Invalid client auth mode %q", c.ClientAuth)
+	}
+	if clientAuth == tls.NoClientCert {
+		return clientAuth, nil, nil
+	}
+	if c.ClientCA == "" {
+		return 0, nil, errors.New("No CA to verify client certificates")
+	}
+	pem, err := os.ReadFile(c.ClientCA)
+	if err != nil {
+		return 0, nil, fmt.Errorf("Could not read client CA: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return 0, nil, errors.New("Could not read client CA certificates")
+	}
+	return clientAuth, pool, nil
+}
@@ -0,0 +1,449 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+package mystique
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/TheThingsIndustries/mystique/pkg/auth"
+	"github.com/TheThingsIndustries/mystique/pkg/auth/certauth"
+	"github.com/TheThingsIndustries/mystique/pkg/client"
+	"github.com/TheThingsIndustries/mystique/pkg/packet"
+	"github.com/TheThingsIndustries/mystique/pkg/server"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/smartystreets/assertions"
+	"github.com/smartystreets/assertions/should"
+)
+
+// testCA issues certificates for tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue a certificate for the common name and DNS names
+func (ca *testCA) issue(t *testing.T, commonName string, dnsNames ...string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     dnsNames,
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// writeCA writes the certificate of the CA to the directory and returns the file name
+func (ca *testCA) write(t *testing.T, dir string) string {
+	file := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// writeCRL writes a CRL that revokes the certificates to the directory and returns the file name
+func (ca *testCA) writeCRL(t *testing.T, dir string, revoked ...tls.Certificate) string {
+	template := &x509.RevocationList{
+		Number:     big.NewInt(time.Now().UnixNano()),
+		ThisUpdate: time.Now().Add(-time.Hour),
+		NextUpdate: time.Now().Add(time.Hour),
+	}
+	for _, cert := range revoked {
+		template.RevokedCertificates = append(template.RevokedCertificates, pkix.RevokedCertificate{
+			SerialNumber:   cert.Leaf.SerialNumber,
+			RevocationTime: time.Now(),
+		})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, template, ca.cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "ca.crl")
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// writeCertificate writes the certificate and key to the directory and returns the file names
+func writeCertificate(t *testing.T, dir, name string, cert tls.Certificate) (certFile, keyFile string) {
+	key, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestClientAuth(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	serverCA, clientCA := newTestCA(t, "Server CA"), newTestCA(t, "Client CA")
+	certFile, keyFile := writeCertificate(t, dir, "server", serverCA.issue(t, "server", "localhost"))
+	gateway := clientCA.issue(t, "gateway")
+	untrusted := newTestCA(t, "Untrusted CA").issue(t, "gateway")
+
+	certs, _ := certauth.New(certauth.CommonName)
+	certs.SetDefaultAccess(certauth.Access{Write: [][]string{{certauth.Username, "up"}}})
+	infos := make(recordAuth, 1)
+	certs.SetFallback(infos)
+
+	connect := func(s *Server, cert ...tls.Certificate) (*auth.Info, error) {
+		dial := client.TLS(s.Addrs()["tls"].String(), &tls.Config{RootCAs: serverCA.pool, Certificates: cert})
+		c, err := client.Connect(ctx, dial, client.WithoutReconnect())
+		if err != nil {
+			return nil, err
+		}
+		defer c.Disconnect()
+		var info *auth.Info
+		select {
+		case recorded := <-infos:
+			info = &recorded
+		default:
+		}
+		return info, c.Publish(ctx, &packet.PublishPacket{TopicName: "gateway/up", QoS: 1})
+	}
+
+	for _, tt := range []struct {
+		clientAuth string
+		noCert     bool // connect without certificate
+		gateway    bool // connect with certificate of the client CA
+		untrusted  bool // connect with certificate of another CA, which the client does not present
+	}{
+		{clientAuth: "none", noCert: true, gateway: true, untrusted: true},
+		{clientAuth: "request", noCert: true, gateway: true, untrusted: true},
+		{clientAuth: "require", gateway: true},
+	} {
+		t.Run(tt.clientAuth, func(t *testing.T) {
+			a := assertions.New(t)
+
+			config := testConfig()
+			config.Listen.TLS = "127.0.0.1:0"
+			config.TLS = TLSSettings{Cert: certFile, Key: keyFile, ClientAuth: tt.clientAuth, ClientCA: clientCA.write(t, dir)}
+			s, err := NewServer(ctx, config, server.WithAuth(certs))
+			if !a.So(err, should.BeNil) {
+				return
+			}
+			a.So(s.Start(ctx), should.BeNil)
+			defer s.Shutdown(ctx)
+
+			info, err := connect(s)
+			if a.So(err == nil, should.Equal, tt.noCert) && tt.noCert {
+				// the fallback auth interface authenticates clients without certificates
+				a.So(info, should.NotBeNil)
+			}
+
+			info, err = connect(s, gateway)
+			if a.So(err == nil, should.Equal, tt.gateway) && tt.gateway {
+				if tt.clientAuth == "none" {
+					a.So(info, should.NotBeNil)
+				} else {
+					// the certificate authenticates the client without password
+					a.So(info, should.BeNil)
+				}
+			}
+
+			_, err = connect(s, untrusted)
+			a.So(err == nil, should.Equal, tt.untrusted)
+		})
+	}
+
+	a := assertions.New(t)
+	config := testConfig()
+	config.TLS = TLSSettings{Cert: certFile, Key: keyFile, ClientAuth: "require"}
+	_, err := NewServer(ctx, config)
+	a.So(err, should.NotBeNil)
+	config.TLS.ClientAuth = "maybe"
+	_, err = NewServer(ctx, config)
+	a.So(err, should.NotBeNil)
+}
+
+// serverCertificate returns the common name of the valid certificate that the server presents for the server name
+func serverCertificate(address, serverName string, roots *x509.CertPool) string {
+	conn, err := tls.Dial("tcp", address, &tls.Config{ServerName: serverName, RootCAs: roots})
+	if err != nil {
+		return ""
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+// expirySeries returns the number of series of the certificate expiry gauge for certificates in the directories
+func expirySeries(t *testing.T, dirs ...string) (series int) {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != "tls_certificate_expiry_seconds" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() != "certificate" {
+					continue
+				}
+				for _, dir := range dirs {
+					if filepath.Dir(label.GetValue()) == dir {
+						series++
+					}
+				}
+			}
+		}
+	}
+	return series
+}
+
+func TestCertificates(t *testing.T) {
+	a := assertions.New(t)
+	ctx := context.Background()
+	dir, certDir := t.TempDir(), t.TempDir()
+
+	defer func(delay time.Duration) { certificateReloadDelay = delay }(certificateReloadDelay)
+	certificateReloadDelay = 10 * time.Millisecond
+
+	ca := newTestCA(t, "CA")
+	certFile, keyFile := writeCertificate(t, dir, "default", ca.issue(t, "default", "localhost"))
+	aCertFile, aKeyFile := writeCertificate(t, dir, "a", ca.issue(t, "a", "a.example.com"))
+	writeCertificate(t, certDir, "b", ca.issue(t, "b", "b.example.com"))
+	cCertFile, cKeyFile := writeCertificate(t, dir, "c", ca.issue(t, "c", "*.c.example.com"))
+	os.Rename(cCertFile, filepath.Join(certDir, "c.crt"))
+	os.Rename(cKeyFile, filepath.Join(certDir, "c.key"))
+
+	config := testConfig()
+	config.Listen.TLS = "127.0.0.1:0"
+	config.TLS = TLSSettings{
+		Cert:           certFile,
+		Key:            keyFile,
+		Certificates:   []string{aCertFile + ":" + aKeyFile},
+		CertificateDir: certDir,
+	}
+	s, err := NewServer(ctx, config)
+	if !a.So(err, should.BeNil) {
+		return
+	}
+	a.So(s.Start(ctx), should.BeNil)
+	defer s.Shutdown(ctx)
+	address := s.Addrs()["tls"].String()
+
+	a.So(serverCertificate(address, "localhost", ca.pool), should.Equal, "default")
+	a.So(serverCertificate(address, "a.example.com", ca.pool), should.Equal, "a")
+	a.So(serverCertificate(address, "b.example.com", ca.pool), should.Equal, "b")
+	a.So(serverCertificate(address, "foo.c.example.com", ca.pool), should.Equal, "c")
+	a.So(expirySeries(t, dir, certDir), should.Equal, 4)
+
+	// without server name or with an unknown server name, the default certificate is used
+	conn, err := tls.Dial("tcp", address, &tls.Config{InsecureSkipVerify: true, ServerName: "unknown.example.com"})
+	if a.So(err, should.BeNil) {
+		a.So(conn.ConnectionState().PeerCertificates[0].Subject.CommonName, should.Equal, "default")
+		conn.Close()
+	}
+
+	// changed and added certificates are reloaded
+	writeCertificate(t, dir, "a", ca.issue(t, "a2", "a.example.com"))
+	writeCertificate(t, certDir, "d", ca.issue(t, "d", "d.example.com"))
+	deadline := time.Now().Add(5 * time.Second)
+	for serverCertificate(address, "d.example.com", ca.pool) != "d" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for serverCertificate(address, "a.example.com", ca.pool) != "a2" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	a.So(serverCertificate(address, "d.example.com", ca.pool), should.Equal, "d")
+	a.So(serverCertificate(address, "a.example.com", ca.pool), should.Equal, "a2")
+	a.So(expirySeries(t, dir, certDir), should.Equal, 5)
+
+	config.TLS.Certificates = []string{aCertFile}
+	_, err = NewServer(ctx, config)
+	a.So(err, should.NotBeNil)
+
+	// the deprecated TLSConfig returns the certificate
+	cert, err := TLSConfig(certFile, keyFile).GetCertificate(&tls.ClientHelloInfo{ServerName: "localhost"})
+	if a.So(err, should.BeNil) {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		a.So(err, should.BeNil)
+		a.So(leaf.Subject.CommonName, should.Equal, "default")
+	}
+}
+
+func TestTLSHardening(t *testing.T) {
+	a := assertions.New(t)
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	defer func(delay time.Duration) { certificateReloadDelay = delay }(certificateReloadDelay)
+	certificateReloadDelay = 10 * time.Millisecond
+
+	serverCA, clientCA := newTestCA(t, "Server CA"), newTestCA(t, "Client CA")
+	certFile, keyFile := writeCertificate(t, dir, "server", serverCA.issue(t, "server", "localhost"))
+	gateway, revoked := clientCA.issue(t, "gateway"), clientCA.issue(t, "revoked")
+	ocspFile := filepath.Join(dir, "server.ocsp")
+	if err := os.WriteFile(ocspFile, []byte("response"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := testConfig()
+	config.Listen.TLS = "127.0.0.1:0"
+	config.TLS = TLSSettings{
+		Cert:         certFile,
+		Key:          keyFile,
+		ClientAuth:   "require",
+		ClientCA:     clientCA.write(t, dir),
+		CRL:          clientCA.writeCRL(t, dir, revoked),
+		OCSP:         ocspFile,
+		MinVersion:   "1.2",
+		MaxVersion:   "1.2",
+		CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+		Curves:       []string{"P256"},
+	}
+	infos := make(recordAuth, 1)
+	s, err := NewServer(ctx, config, server.WithAuth(infos))
+	if !a.So(err, should.BeNil) {
+		return
+	}
+	a.So(s.Start(ctx), should.BeNil)
+	defer s.Shutdown(ctx)
+	address := s.Addrs()["tls"].String()
+
+	connect := func(cert tls.Certificate) error {
+		dial := client.TLS(address, &tls.Config{RootCAs: serverCA.pool, Certificates: []tls.Certificate{cert}})
+		c, err := client.Connect(ctx, dial, client.WithoutReconnect())
+		if err != nil {
+			return err
+		}
+		<-infos
+		return c.Disconnect()
+	}
+
+	conn, err := tls.Dial("tcp", address, &tls.Config{RootCAs: serverCA.pool, Certificates: []tls.Certificate{gateway}})
+	if a.So(err, should.BeNil) {
+		state := conn.ConnectionState()
+		a.So(state.Version, should.Equal, tls.VersionTLS12)
+		a.So(state.CipherSuite, should.Equal, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256)
+		a.So(string(state.OCSPResponse), should.Equal, "response")
+		conn.Close()
+	}
+	_, err = tls.Dial("tcp", address, &tls.Config{RootCAs: serverCA.pool, MinVersion: tls.VersionTLS13})
+	a.So(err, should.NotBeNil)
+	_, err = tls.Dial("tcp", address, &tls.Config{RootCAs: serverCA.pool, CurvePreferences: []tls.CurveID{tls.CurveP384}})
+	a.So(err, should.NotBeNil)
+
+	// the negotiated version and cipher suite are in the auth info
+	dial := client.TLS(address, &tls.Config{RootCAs: serverCA.pool, Certificates: []tls.Certificate{gateway}})
+	c, err := client.Connect(ctx, dial, client.WithoutReconnect())
+	if a.So(err, should.BeNil) {
+		info := <-infos
+		if a.So(info.TLS, should.NotBeNil) {
+			a.So(info.TLS.Version, should.Equal, "TLSv1.2")
+			a.So(info.TLS.CipherSuite, should.Equal, "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256")
+		}
+		c.Disconnect()
+	}
+
+	a.So(connect(revoked), should.NotBeNil)
+
+	// the gateway gets a session ticket before it is revoked
+	sessions := tls.NewLRUClientSessionCache(1)
+	resume := func() (bool, error) {
+		conn, err := tls.Dial("tcp", address, &tls.Config{RootCAs: serverCA.pool, Certificates: []tls.Certificate{gateway}, ClientSessionCache: sessions})
+		if err != nil {
+			return false, err
+		}
+		defer conn.Close()
+		return conn.ConnectionState().DidResume, nil
+	}
+	didResume, err := resume()
+	a.So(err, should.BeNil)
+	a.So(didResume, should.BeFalse)
+	didResume, err = resume()
+	a.So(err, should.BeNil)
+	a.So(didResume, should.BeTrue)
+
+	// the CRL is reloaded
+	clientCA.writeCRL(t, dir, gateway)
+	deadline := time.Now().Add(5 * time.Second)
+	for connect(revoked) != nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	a.So(connect(revoked), should.BeNil)
+	a.So(connect(gateway), should.NotBeNil)
+
+	// the revoked gateway can not resume its session
+	_, err = resume()
+	a.So(err, should.NotBeNil)
+
+	for _, invalid := range []func(*TLSSettings){
+		func(c *TLSSettings) { c.MinVersion = "1.4" },
+		func(c *TLSSettings) { c.MinVersion, c.MaxVersion = "1.3", "1.2" },
+		func(c *TLSSettings) { c.CipherSuites = []string{"TLS_RSA_WITH_RC4_128_SHA"} },
+		func(c *TLSSettings) { c.Curves = []string{"P224"} },
+		func(c *TLSSettings) { c.ClientAuth = "none" },
+		func(c *TLSSettings) { c.CRL = certFile },
+		func(c *TLSSettings) { c.OCSP = filepath.Join(dir, "missing.ocsp") },
+	} {
+		invalidConfig := config
+		invalidConfig.TLS.CipherSuites = nil
+		invalidConfig.TLS.Curves = nil
+		invalid(&invalidConfig.TLS)
+		_, err = NewServer(ctx, invalidConfig)
+		a.So(err, should.NotBeNil)
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright © 2018 The Things Industries, distributed under the MIT license (see LICENSE file)
+
+package mystique
+
+import (
+	"io"
+	"time"
+
+	"github.com/TheThingsIndustries/mystique/pkg/log"
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchFiles calls update when the files change, after the delay; the changes during the delay are handled by one update
+// The files are added to the watcher again after each update, because files that are replaced must be watched again.
+func watchFiles(logger log.Interface, files func() []string, delay time.Duration, update func()) (io.Closer, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	addFiles := func() {
+		for _, file := range files() {
+			if err := watcher.Add(file); err != nil {
+				logger.WithError(err).WithField("file", file).Warn("Could not watch file")
+			}
+		}
+	}
+	addFiles()
+	updating := make(chan bool, 1)
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Remove|fsnotify.Rename) != 0 {
+					select {
+					case updating <- true:
+						logger.WithField("file", event.Name).Info("Detected file change. Scheduling update...")
+						time.AfterFunc(delay, func() {
+							update()
+							addFiles()
+							<-updating
+						})
+					default:
+						// Debounce
+					}
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logger.WithError(err).Warn("Error watching file")
+			}
+		}
+	}()
+	return watcher, nil
+}